@@ -0,0 +1,31 @@
+-- Prekey bundles for X3DH session setup
+-- Runs after 01-init.sql; apply manually on existing databases
+
+-- Identity key and current signed prekey per device
+CREATE TABLE device_keys (
+    device_id UUID PRIMARY KEY REFERENCES user_devices(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    identity_key TEXT NOT NULL, -- Ed25519, base64
+    signed_prekey_id INTEGER NOT NULL,
+    signed_prekey TEXT NOT NULL, -- X25519, base64
+    signed_prekey_signature TEXT NOT NULL, -- Ed25519 signature by identity_key
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_device_keys_user ON device_keys(user_id);
+
+-- One-time prekeys, each handed out at most once
+CREATE TABLE one_time_prekeys (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    device_id UUID REFERENCES user_devices(id) ON DELETE CASCADE,
+    key_id INTEGER NOT NULL,
+    public_key TEXT NOT NULL, -- X25519, base64
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(device_id, key_id)
+);
+
+CREATE INDEX idx_prekeys_device ON one_time_prekeys(device_id, key_id);
+
+CREATE TRIGGER update_device_keys_updated_at BEFORE UPDATE ON device_keys
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
@@ -0,0 +1,25 @@
+-- Append-only history of device identity keys (key transparency)
+-- Runs after 02-prekeys.sql; apply manually on existing databases
+
+-- No foreign keys: entries outlive the devices they describe
+CREATE TABLE device_key_history (
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID NOT NULL,
+    device_id VARCHAR(255) NOT NULL,
+    identity_key TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_key_history_device ON device_key_history(device_id, id DESC);
+CREATE INDEX idx_key_history_user ON device_key_history(user_id, id);
+
+-- Reject any change to recorded keys
+CREATE OR REPLACE FUNCTION prevent_key_history_changes()
+RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'device_key_history is append-only';
+END;
+$$ language 'plpgsql';
+
+CREATE TRIGGER key_history_append_only BEFORE UPDATE OR DELETE ON device_key_history
+    FOR EACH ROW EXECUTE FUNCTION prevent_key_history_changes();
@@ -0,0 +1,15 @@
+-- Audit log of security-relevant authentication events
+-- Runs after 03-key-history.sql; apply manually on existing databases
+
+-- Keyed by phone number: failed logins usually have no user yet
+CREATE TABLE auth_audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    event VARCHAR(50) NOT NULL,
+    phone_number VARCHAR(20),
+    ip_address INET,
+    details JSONB DEFAULT '{}'::jsonb,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_auth_audit_phone ON auth_audit_log(phone_number, created_at DESC);
+CREATE INDEX idx_auth_audit_event ON auth_audit_log(event, created_at DESC);
@@ -0,0 +1,19 @@
+-- Asymmetric JWT signing keys, shared by every backend instance
+-- Runs after 04-auth-audit.sql; apply manually on existing databases
+
+-- Lifecycle: pending (published in the JWKS, not yet signing) -> active
+-- (signing) -> retired (only verifying until expires_at). Private keys are
+-- stored as PKCS#8 PEM, so protect this table like JWT_SECRET.
+CREATE TABLE jwt_signing_keys (
+    kid VARCHAR(64) PRIMARY KEY,
+    algorithm VARCHAR(10) NOT NULL CHECK (algorithm IN ('RS256', 'EdDSA')),
+    private_key TEXT NOT NULL,
+    public_key TEXT NOT NULL,
+    status VARCHAR(10) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'active', 'retired')),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    activated_at TIMESTAMP WITH TIME ZONE,
+    expires_at TIMESTAMP WITH TIME ZONE
+);
+
+-- At most one key signs at a time
+CREATE UNIQUE INDEX idx_jwt_keys_active ON jwt_signing_keys(status) WHERE status = 'active';
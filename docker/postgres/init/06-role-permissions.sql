@@ -0,0 +1,17 @@
+-- Permissions granted to each user role
+-- Runs after 05-jwt-keys.sql; apply manually on existing databases
+
+-- Routes require permissions (see RoutePolicies in src/internal/auth/authz.go),
+-- never roles directly, so access can be changed here without a deploy.
+-- Cached per user in Redis; flush authz:* keys after editing this table.
+CREATE TABLE role_permissions (
+    role user_role NOT NULL,
+    permission VARCHAR(50) NOT NULL,
+    PRIMARY KEY (role, permission)
+);
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('model', 'gallery:write'),
+    ('admin', 'gallery:write'),
+    ('admin', 'stats:read'),
+    ('admin', 'users:manage');
@@ -0,0 +1,35 @@
+-- Email login and TOTP second factor
+-- Runs after 06-role-permissions.sql; apply manually on existing databases
+
+-- Email is an alternative login for an existing account, once verified
+ALTER TABLE users ADD COLUMN email VARCHAR(255);
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMP WITH TIME ZONE;
+
+CREATE UNIQUE INDEX idx_users_email ON users(email) WHERE email IS NOT NULL AND deleted_at IS NULL;
+
+-- Email logins are audited by address
+ALTER TABLE auth_audit_log ADD COLUMN email VARCHAR(255);
+
+CREATE INDEX idx_auth_audit_email ON auth_audit_log(email, created_at DESC) WHERE email IS NOT NULL;
+
+-- TOTP secret per user, encrypted with TOTP_ENCRYPTION_KEY. The second
+-- factor is enabled once confirmed_at is set.
+CREATE TABLE user_totp (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret TEXT NOT NULL,
+    -- Last time step accepted, so a code can't be replayed
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    confirmed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Single-use recovery codes, stored as SHA-256 hashes
+CREATE TABLE user_recovery_codes (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_recovery_codes_user ON user_recovery_codes(user_id) WHERE used_at IS NULL;
@@ -0,0 +1,26 @@
+-- Push notifications for offline devices
+-- Runs after 07-login-factors.sql; apply manually on existing databases
+
+-- push_token (01-init.sql) is the FCM or APNs device token, or the Web Push
+-- subscription endpoint; push_provider says which service it belongs to
+ALTER TABLE user_devices ADD COLUMN push_provider VARCHAR(16);
+ALTER TABLE user_devices ADD COLUMN push_token_updated_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX idx_devices_push ON user_devices(user_id) WHERE push_token IS NOT NULL;
+
+-- Notifications muted for the whole account
+CREATE TABLE push_settings (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    muted BOOLEAN NOT NULL DEFAULT false,
+    muted_until TIMESTAMP WITH TIME ZONE, -- NULL mutes until turned back on
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Notifications muted for messages from one sender
+CREATE TABLE push_mutes (
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    muted_user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    muted_until TIMESTAMP WITH TIME ZONE, -- NULL mutes until unmuted
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, muted_user_id)
+);
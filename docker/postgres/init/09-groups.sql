@@ -0,0 +1,42 @@
+-- Group chats
+-- Runs after 08-push.sql; apply manually on existing databases
+
+CREATE TYPE group_role AS ENUM ('owner', 'admin', 'member');
+
+-- The server only knows who is in a group; messages are encrypted by the
+-- members with their sender keys and relayed as opaque payloads
+CREATE TABLE chat_groups (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    name VARCHAR(100) NOT NULL,
+    description TEXT,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Every group has exactly one owner while it has members
+CREATE TABLE group_members (
+    group_id UUID REFERENCES chat_groups(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    role group_role NOT NULL DEFAULT 'member',
+    added_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    joined_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (group_id, user_id)
+);
+
+CREATE INDEX idx_group_members_user ON group_members(user_id);
+CREATE UNIQUE INDEX idx_group_members_owner ON group_members(group_id) WHERE role = 'owner';
+
+-- Pending invites; accepting one makes the user a member
+CREATE TABLE group_invites (
+    group_id UUID REFERENCES chat_groups(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    invited_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (group_id, user_id)
+);
+
+CREATE INDEX idx_group_invites_user ON group_invites(user_id);
+
+CREATE TRIGGER update_chat_groups_updated_at BEFORE UPDATE ON chat_groups
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
@@ -0,0 +1,28 @@
+-- Message requests from users who are not yet contacts
+-- Runs after 09-groups.sql; apply manually on existing databases
+
+-- Per-user settings; a missing row means the defaults
+CREATE TABLE user_settings (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    require_approval BOOLEAN NOT NULL DEFAULT false,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER update_user_settings_updated_at BEFORE UPDATE ON user_settings
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+CREATE TYPE message_request_status AS ENUM ('pending', 'accepted', 'declined');
+
+-- The first message a non-contact sends to a user who requires approval
+-- opens a request; nothing else gets through until it is accepted
+CREATE TABLE message_requests (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    sender_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    recipient_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    status message_request_status NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    responded_at TIMESTAMP WITH TIME ZONE,
+    UNIQUE (sender_id, recipient_id)
+);
+
+CREATE INDEX idx_message_requests_recipient ON message_requests(recipient_id, status);
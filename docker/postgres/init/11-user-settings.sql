@@ -0,0 +1,11 @@
+-- App and privacy preferences
+-- Runs after 10-message-requests.sql; apply manually on existing databases
+
+-- notifications_enabled is not stored here: it is the account-wide mute in
+-- push_settings (08-push.sql)
+ALTER TABLE user_settings ADD COLUMN language VARCHAR(16) NOT NULL DEFAULT 'en';
+ALTER TABLE user_settings ADD COLUMN theme VARCHAR(16) NOT NULL DEFAULT 'light'
+    CHECK (theme IN ('light', 'dark', 'system'));
+ALTER TABLE user_settings ADD COLUMN show_online BOOLEAN NOT NULL DEFAULT true;
+ALTER TABLE user_settings ADD COLUMN show_last_seen BOOLEAN NOT NULL DEFAULT true;
+ALTER TABLE user_settings ADD COLUMN allow_discovery BOOLEAN NOT NULL DEFAULT true;
@@ -0,0 +1,25 @@
+-- Resumable media uploads
+-- Runs after 11-user-settings.sql; apply manually on existing databases
+
+-- Each upload is staged as a multipart upload in the temp bucket. Once the
+-- client completes it and the checksum matches, the object moves to the
+-- media bucket and gets a gallery_media row whose upload_id points here.
+CREATE TABLE media_uploads (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    object_name VARCHAR(255) NOT NULL, -- Same key in the temp and media buckets
+    storage_upload_id VARCHAR(255) NOT NULL, -- Multipart upload ID in the temp bucket
+    filename VARCHAR(255) NOT NULL,
+    mime_type VARCHAR(100) NOT NULL,
+    type media_type NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    part_size BIGINT NOT NULL,
+    sha256 VARCHAR(64) NOT NULL, -- Expected digest of the whole file
+    media_id UUID REFERENCES gallery_media(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    completed_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_media_uploads_user ON media_uploads(user_id);
+CREATE INDEX idx_media_uploads_expires ON media_uploads(expires_at) WHERE completed_at IS NULL;
@@ -0,0 +1,6 @@
+-- Direct uploads through presigned URLs
+-- Runs after 12-media-uploads.sql; apply manually on existing databases
+
+-- An upload intent is a media upload the client PUTs straight into the temp
+-- bucket, so it has no multipart upload and a single part of size_bytes
+ALTER TABLE media_uploads ALTER COLUMN storage_upload_id DROP NOT NULL;
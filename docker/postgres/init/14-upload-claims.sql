@@ -0,0 +1,13 @@
+-- Completion claims for media uploads
+-- Runs after 13-upload-intents.sql; apply manually on existing databases
+
+-- Completing an upload checks and copies its object outside any
+-- transaction, so the upload is claimed first: status goes to 'completing'
+-- with claimed_at set, and other completions, new parts and the janitor
+-- leave it alone. A claim older than the claim timeout was abandoned and
+-- may be taken over.
+ALTER TABLE media_uploads
+    ADD COLUMN status VARCHAR(10) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'completing', 'completed')),
+    ADD COLUMN claimed_at TIMESTAMP WITH TIME ZONE;
+
+UPDATE media_uploads SET status = 'completed' WHERE completed_at IS NOT NULL;
@@ -0,0 +1,20 @@
+#!/bin/bash
+
+# Manage the asymmetric JWT signing keys (JWT_ALGORITHM=RS256 or EdDSA)
+# Runs the jwtkeys command inside the backend container
+
+cd "$(dirname "$0")/../docker"
+
+if [ $# -eq 0 ]; then
+    echo "Usage: $0 <list|generate|activate|rotate|retire|prune> [args]"
+    echo "Examples:"
+    echo "  $0 list"
+    echo "  $0 generate -alg EdDSA     # New pending key, published in the JWKS"
+    echo "  $0 activate 20250101-abcd  # Sign with it, retire the current key"
+    echo "  $0 rotate                  # Generate and activate in one step"
+    echo "  $0 retire -now 20250101-abcd"
+    echo "  $0 prune"
+    exit 1
+fi
+
+docker-compose exec backend ./jwtkeys "$@"
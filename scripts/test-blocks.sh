@@ -0,0 +1,183 @@
+#!/bin/bash
+
+# Integration test for contact blocking in the relay and the public profiles
+# Needs two users with one device each; neither may be connected to /ws
+# Usage: TOKEN_A=... USER_A=... TOKEN_B=... USER_B=... ./scripts/test-blocks.sh
+
+# Colors
+GREEN='\033[0;32m'
+RED='\033[0;31m'
+YELLOW='\033[1;33m'
+NC='\033[0m'
+
+# Base URLs
+BASE_URL="${BASE_URL:-http://localhost:8080/api/v1}"
+WS_URL="${WS_URL:-ws://localhost:8080/ws}"
+
+for var in TOKEN_A USER_A TOKEN_B USER_B; do
+    if [ -z "${!var}" ]; then
+        echo -e "${RED}Missing $var${NC}"
+        echo "Usage: TOKEN_A=... USER_A=... TOKEN_B=... USER_B=... $0"
+        exit 1
+    fi
+done
+
+for cmd in websocat jq curl; do
+    if ! command -v "$cmd" > /dev/null; then
+        echo -e "${RED}$cmd is required${NC}"
+        exit 1
+    fi
+done
+
+echo -e "${YELLOW}=== Testing contact blocking ===${NC}\n"
+
+WORK=$(mktemp -d)
+trap 'rm -rf "$WORK"' EXIT
+
+FAILED=0
+
+# Function to make a request and check the status code
+expect_status() {
+    local method=$1
+    local url=$2
+    local token=$3
+    local data=$4
+    local expected=$5
+    local description=$6
+
+    local args=(-s -o "$WORK/body" -w "%{http_code}" -X "$method")
+    if [ -n "$token" ]; then
+        args+=(-H "Authorization: Bearer $token")
+    fi
+    if [ -n "$data" ]; then
+        args+=(-H "Content-Type: application/json" -d "$data")
+    fi
+
+    local status
+    status=$(curl "${args[@]}" "$url")
+    if [ "$status" = "$expected" ]; then
+        echo -e "  ${GREEN}✓ $description ($status)${NC}"
+    else
+        echo -e "  ${RED}✗ $description (expected $expected, got $status)${NC}"
+        cat "$WORK/body"; echo
+        FAILED=1
+    fi
+}
+
+# Function to assert on the last response body
+expect_body() {
+    local filter=$1
+    local description=$2
+
+    if jq -e "$filter" "$WORK/body" > /dev/null 2>&1; then
+        echo -e "  ${GREEN}✓ $description${NC}"
+    else
+        echo -e "  ${RED}✗ $description${NC}"
+        cat "$WORK/body"; echo
+        FAILED=1
+    fi
+}
+
+# Function to assert on the frames a connection received
+expect_frame() {
+    local file=$1
+    local filter=$2
+    local description=$3
+
+    if jq -e -c "select($filter)" "$file" 2>/dev/null | grep -q .; then
+        echo -e "  ${GREEN}✓ $description${NC}"
+    else
+        echo -e "  ${RED}✗ $description${NC}"
+        cat "$file"
+        FAILED=1
+    fi
+}
+
+expect_no_frame() {
+    local file=$1
+    local filter=$2
+    local description=$3
+
+    if jq -e -c "select($filter)" "$file" 2>/dev/null | grep -q .; then
+        echo -e "  ${RED}✗ $description${NC}"
+        cat "$file"
+        FAILED=1
+    else
+        echo -e "  ${GREEN}✓ $description${NC}"
+    fi
+}
+
+# Connects with a token for a few seconds in the background and records
+# the frames it receives
+listen() {
+    local token=$1
+    local out=$2
+
+    websocat -t "$WS_URL?token=$token" < <(sleep 4) > "$out" &
+}
+
+# Sends frames from a token's device and records the answers
+send_frames() {
+    local token=$1
+    local out=$2
+    shift 2
+
+    {
+        for frame in "$@"; do
+            echo "$frame"
+        done
+        sleep 1
+    } | websocat -t "$WS_URL?token=$token" > "$out"
+}
+
+# Blocks are checked before the envelopes, so any device ID does
+message_to() {
+    echo '{"type":"message","to":"'"$1"'","envelopes":[{"device_id":"any","payload":"'"$2"'"}]}'
+}
+
+typing_to() {
+    echo '{"type":"typing","to":"'"$1"'","payload":"true"}'
+}
+
+echo -e "${YELLOW}Blocking${NC}"
+expect_status POST "$BASE_URL/users/contacts" "$TOKEN_A" '{"contact_id":"'"$USER_B"'"}' 201 "A adds B as a contact"
+expect_status POST "$BASE_URL/users/contacts" "$TOKEN_B" '{"contact_id":"'"$USER_A"'"}' 201 "B adds A as a contact"
+expect_status POST "$BASE_URL/users/contacts/$USER_B/block" "$TOKEN_A" "" 200 "A blocks B"
+echo
+
+echo -e "${YELLOW}Relay${NC}"
+listen "$TOKEN_A" "$WORK/blocked_a"
+sleep 1
+send_frames "$TOKEN_B" "$WORK/blocked_b" "$(message_to "$USER_A" YmxvY2tlZA==)" "$(typing_to "$USER_A")"
+wait
+expect_frame "$WORK/blocked_b" '.type == "delivery" or (.type == "error" and (.payload | fromjson | .code == "BLOCKED"))' "B's message is dropped as the policy says"
+expect_no_frame "$WORK/blocked_b" '.type == "error" and (.payload | fromjson | .code == "DEVICE_MISMATCH")' "B can't probe A's devices"
+expect_no_frame "$WORK/blocked_a" '.type == "message" or .type == "typing"' "A gets nothing from B"
+echo
+
+echo -e "${YELLOW}Profiles${NC}"
+expect_status GET "$BASE_URL/users/$USER_A" "$TOKEN_B" "" 404 "B can't see A's profile"
+expect_status GET "$BASE_URL/users/$USER_B" "$TOKEN_A" "" 404 "A can't see B's profile"
+expect_status GET "$BASE_URL/users/contacts" "$TOKEN_B" "" 200 "B lists contacts"
+expect_body '.contacts | map(select(.contact_id == "'"$USER_A"'")) | .[0].is_online == false' "A's presence is hidden from B"
+echo
+
+echo -e "${YELLOW}Unblocking${NC}"
+expect_status POST "$BASE_URL/users/contacts/$USER_B/unblock" "$TOKEN_A" "" 200 "A unblocks B"
+expect_status GET "$BASE_URL/users/$USER_A" "$TOKEN_B" "" 200 "B sees A's profile again"
+listen "$TOKEN_A" "$WORK/unblocked_a"
+sleep 1
+send_frames "$TOKEN_B" /dev/null "$(typing_to "$USER_A")"
+wait
+expect_frame "$WORK/unblocked_a" '.type == "typing" and .from == "'"$USER_B"'"' "A sees B typing again"
+
+expect_status DELETE "$BASE_URL/users/contacts/$USER_B" "$TOKEN_A" "" 200 "A removes the contact"
+expect_status DELETE "$BASE_URL/users/contacts/$USER_A" "$TOKEN_B" "" 200 "B removes the contact"
+echo
+
+if [ $FAILED -ne 0 ]; then
+    echo -e "${RED}Block tests failed${NC}"
+    exit 1
+fi
+
+echo -e "${GREEN}All block tests passed${NC}"
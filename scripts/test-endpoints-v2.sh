@@ -105,6 +105,7 @@ test_endpoint "GET" "/" "" "" "API Info"
 # 3. Authentication Flow
 echo -e "${YELLOW}2. Authentication Flow${NC}"
 test_endpoint "POST" "/auth/request-otp" '{"phone_number":"'$TEST_PHONE'"}' "" "Request OTP"
+test_endpoint "POST" "/auth/request-email-otp" '{"email":"nobody@example.com"}' "" "Request Email OTP (unknown address, same answer)"
 
 # 4. Verify OTP
 echo -e "${YELLOW}Enter OTP from logs (or press Enter to skip auth tests):${NC} "
@@ -146,13 +147,51 @@ if [ -n "$USER_OTP" ]; then
             echo -e "\n${YELLOW}3. Testing Authenticated Endpoints${NC}"
             test_endpoint "GET" "/users/me" "" "$ACCESS_TOKEN" "Get My Profile"
             test_endpoint "GET" "/users/contacts" "" "$ACCESS_TOKEN" "Get Contacts"
-            test_endpoint "GET" "/ws/stats" "" "$ACCESS_TOKEN" "WebSocket Stats"
             test_endpoint "GET" "/gallery" "" "$ACCESS_TOKEN" "Get My Gallery"
             test_endpoint "GET" "/gallery/stats" "" "$ACCESS_TOKEN" "Gallery Stats"
+            test_endpoint "GET" "/auth/sessions" "" "$ACCESS_TOKEN" "List Sessions"
+            test_endpoint "GET" "/auth/devices" "" "$ACCESS_TOKEN" "List Devices"
+            test_endpoint "GET" "/auth/2fa" "" "$ACCESS_TOKEN" "Two-Factor Status"
+
+            # A new user has the "user" role: model and admin routes are off limits
+            echo -e "${YELLOW}Testing: Role Checks${NC}"
+            for route in "PUT /gallery/settings" "GET /ws/stats" "GET /admin/presence/online" "GET /admin/users/$(uuidgen 2>/dev/null || echo 00000000-0000-0000-0000-000000000000)/role"; do
+                RESPONSE=$(make_request "${route%% *}" "${route#* }" '{}' "$ACCESS_TOKEN")
+                if [ "$(echo "$RESPONSE" | tail -n1)" = "403" ]; then
+                    echo -e "  ${GREEN}✓ $route forbidden (403)${NC}"
+                else
+                    echo -e "  ${RED}✗ $route not forbidden ($(echo "$RESPONSE" | tail -n1))${NC}"
+                fi
+            done
             
             # Test refresh token
             echo -e "${YELLOW}4. Testing Token Refresh${NC}"
             test_endpoint "POST" "/auth/refresh" '{"refresh_token":"'$REFRESH_TOKEN'"}' "" "Refresh Token"
+            NEW_REFRESH_TOKEN=$(echo "$BODY" | jq -r '.refresh_token // empty' 2>/dev/null)
+            test_endpoint "POST" "/auth/refresh" '{"refresh_token":"'$NEW_REFRESH_TOKEN'"}' "" "Refresh Rotated Token"
+            LATEST_REFRESH_TOKEN=$(echo "$BODY" | jq -r '.refresh_token // empty' 2>/dev/null)
+
+            # Replaying a rotated refresh token must fail and revoke the session
+            echo -e "${YELLOW}Testing: Refresh Token Reuse${NC}"
+            RESPONSE=$(make_request "POST" "/auth/refresh" '{"refresh_token":"'$REFRESH_TOKEN'"}' "")
+            if [ "$(echo "$RESPONSE" | tail -n1)" = "401" ]; then
+                echo -e "  ${GREEN}✓ Reused token rejected (401)${NC}"
+            else
+                echo -e "  ${RED}✗ Reused token accepted${NC}"
+            fi
+            RESPONSE=$(make_request "POST" "/auth/refresh" '{"refresh_token":"'$LATEST_REFRESH_TOKEN'"}' "")
+            if [ "$(echo "$RESPONSE" | tail -n1)" = "401" ]; then
+                echo -e "  ${GREEN}✓ Session revoked after reuse (401)${NC}"
+            else
+                echo -e "  ${RED}✗ Session still usable after reuse${NC}"
+            fi
+            RESPONSE=$(make_request "GET" "/users/me" "" "$ACCESS_TOKEN")
+            if [ "$(echo "$RESPONSE" | tail -n1)" = "401" ]; then
+                echo -e "  ${GREEN}✓ Access token of revoked session rejected (401)${NC}"
+            else
+                echo -e "  ${RED}✗ Access token still valid after revocation${NC}"
+            fi
+            echo
         else
             echo -e "${RED}Failed to extract access token${NC}"
         fi
@@ -0,0 +1,239 @@
+#!/bin/bash
+
+# Integration test for group chats: membership, roles, fan-out and events
+# Needs three users with one device each; none of them may be connected to /ws
+# Usage: TOKEN_A=... USER_A=... TOKEN_B=... USER_B=... TOKEN_C=... USER_C=... ./scripts/test-groups.sh
+
+# Colors
+GREEN='\033[0;32m'
+RED='\033[0;31m'
+YELLOW='\033[1;33m'
+NC='\033[0m'
+
+# Base URLs
+BASE_URL="${BASE_URL:-http://localhost:8080/api/v1}"
+WS_URL="${WS_URL:-ws://localhost:8080/ws}"
+
+for var in TOKEN_A USER_A TOKEN_B USER_B TOKEN_C USER_C; do
+    if [ -z "${!var}" ]; then
+        echo -e "${RED}Missing $var${NC}"
+        echo "Usage: TOKEN_A=... USER_A=... TOKEN_B=... USER_B=... TOKEN_C=... USER_C=... $0"
+        exit 1
+    fi
+done
+
+for cmd in websocat jq curl; do
+    if ! command -v "$cmd" > /dev/null; then
+        echo -e "${RED}$cmd is required${NC}"
+        exit 1
+    fi
+done
+
+echo -e "${YELLOW}=== Testing group chats ===${NC}\n"
+
+WORK=$(mktemp -d)
+trap 'rm -rf "$WORK"' EXIT
+
+FAILED=0
+
+# Function to make a request and check the status code
+expect_status() {
+    local method=$1
+    local url=$2
+    local token=$3
+    local data=$4
+    local expected=$5
+    local description=$6
+
+    local args=(-s -o "$WORK/body" -w "%{http_code}" -X "$method")
+    if [ -n "$token" ]; then
+        args+=(-H "Authorization: Bearer $token")
+    fi
+    if [ -n "$data" ]; then
+        args+=(-H "Content-Type: application/json" -d "$data")
+    fi
+
+    local status
+    status=$(curl "${args[@]}" "$url")
+    if [ "$status" = "$expected" ]; then
+        echo -e "  ${GREEN}✓ $description ($status)${NC}"
+    else
+        echo -e "  ${RED}✗ $description (expected $expected, got $status)${NC}"
+        cat "$WORK/body"; echo
+        FAILED=1
+    fi
+}
+
+# Function to assert on the last response body
+expect_body() {
+    local filter=$1
+    local description=$2
+
+    if jq -e "$filter" "$WORK/body" > /dev/null 2>&1; then
+        echo -e "  ${GREEN}✓ $description${NC}"
+    else
+        echo -e "  ${RED}✗ $description${NC}"
+        cat "$WORK/body"; echo
+        FAILED=1
+    fi
+}
+
+# Function to assert on the frames a connection received
+expect_frame() {
+    local file=$1
+    local filter=$2
+    local description=$3
+
+    if jq -e -c "select($filter)" "$file" 2>/dev/null | grep -q .; then
+        echo -e "  ${GREEN}✓ $description${NC}"
+    else
+        echo -e "  ${RED}✗ $description${NC}"
+        cat "$file"
+        FAILED=1
+    fi
+}
+
+expect_no_frame() {
+    local file=$1
+    local filter=$2
+    local description=$3
+
+    if jq -e -c "select($filter)" "$file" 2>/dev/null | grep -q .; then
+        echo -e "  ${RED}✗ $description${NC}"
+        cat "$file"
+        FAILED=1
+    else
+        echo -e "  ${GREEN}✓ $description${NC}"
+    fi
+}
+
+# Connects with a token for a few seconds in the background and records
+# the frames it receives
+listen() {
+    local token=$1
+    local out=$2
+
+    websocat -t "$WS_URL?token=$token" < <(sleep 4) > "$out" &
+}
+
+# Sends frames from a token's device and records the answers
+send_frames() {
+    local token=$1
+    local out=$2
+    shift 2
+
+    {
+        for frame in "$@"; do
+            echo "$frame"
+        done
+        sleep 1
+    } | websocat -t "$WS_URL?token=$token" > "$out"
+}
+
+# Acks every queued frame in a file, so later checks only see new ones
+ack_all() {
+    local token=$1
+    local file=$2
+
+    local frames=()
+    for id in $(jq -r 'select(.message_id != null and .type != "delivery") | .message_id' "$file" 2>/dev/null); do
+        frames+=('{"type":"ack","payload":"'"$id"'"}')
+    done
+    send_frames "$token" /dev/null "${frames[@]}"
+}
+
+group_message() {
+    echo '{"type":"group_message","group_id":"'"$GROUP_ID"'","payload":"'"$1"'"}'
+}
+
+echo -e "${YELLOW}Creating and inviting${NC}"
+expect_status POST "$BASE_URL/groups" "$TOKEN_A" '{"name":""}' 400 "empty name rejected"
+expect_status POST "$BASE_URL/groups" "$TOKEN_A" '{"name":"Test group","invite":["'"$USER_B"'"]}' 201 "A creates a group inviting B"
+expect_body '.role == "owner" and .member_count == 1' "A is the only member, as owner"
+expect_body '.invites | map(.user_id) | index("'"$USER_B"'") != null' "B's invite is listed"
+GROUP_ID=$(jq -r '.id' "$WORK/body")
+
+expect_status GET "$BASE_URL/groups/$GROUP_ID" "$TOKEN_C" "" 404 "group hidden from non-members"
+expect_status GET "$BASE_URL/groups/invites" "$TOKEN_B" "" 200 "B lists invites"
+expect_body '.invites | map(.group_id) | index("'"$GROUP_ID"'") != null' "B is invited"
+expect_status POST "$BASE_URL/groups/$GROUP_ID/join" "$TOKEN_C" "" 404 "C can't join without an invite"
+expect_status POST "$BASE_URL/groups/$GROUP_ID/join" "$TOKEN_B" "" 200 "B joins"
+expect_body '.role == "member" and .member_count == 2' "B is a member"
+expect_body 'has("invites") | not' "members don't see invites"
+echo
+
+echo -e "${YELLOW}Roles${NC}"
+expect_status POST "$BASE_URL/groups/$GROUP_ID/invites" "$TOKEN_B" '{"user_id":"'"$USER_C"'"}' 403 "members can't invite"
+expect_status PUT "$BASE_URL/groups/$GROUP_ID/members/$USER_B/role" "$TOKEN_A" '{"role":"boss"}' 400 "unknown role rejected"
+expect_status PUT "$BASE_URL/groups/$GROUP_ID/members/$USER_B/role" "$TOKEN_A" '{"role":"admin"}' 200 "A makes B admin"
+expect_status POST "$BASE_URL/groups/$GROUP_ID/invites" "$TOKEN_B" '{"user_id":"'"$USER_C"'"}' 201 "admin B invites C"
+expect_status POST "$BASE_URL/groups/$GROUP_ID/invites" "$TOKEN_B" '{"user_id":"'"$USER_C"'"}' 409 "inviting twice"
+expect_status DELETE "$BASE_URL/groups/$GROUP_ID/invites/$USER_C" "$TOKEN_C" "" 204 "C declines"
+expect_status POST "$BASE_URL/groups/$GROUP_ID/invites" "$TOKEN_B" '{"user_id":"'"$USER_C"'"}' 201 "B invites C again"
+expect_status POST "$BASE_URL/groups/$GROUP_ID/join" "$TOKEN_C" "" 200 "C joins"
+expect_status DELETE "$BASE_URL/groups/$GROUP_ID/members/$USER_A" "$TOKEN_B" "" 403 "admins can't remove the owner"
+echo
+
+echo -e "${YELLOW}Events${NC}"
+listen "$TOKEN_B" "$WORK/events_b"
+wait
+expect_frame "$WORK/events_b" '.type == "group_event" and .group_id == "'"$GROUP_ID"'" and (.payload | fromjson | .event == "joined" and .user_id == "'"$USER_C"'")' "B got C's join while offline"
+ack_all "$TOKEN_B" "$WORK/events_b"
+listen "$TOKEN_C" "$WORK/events_c"
+wait
+ack_all "$TOKEN_C" "$WORK/events_c"
+echo
+
+echo -e "${YELLOW}Fan-out${NC}"
+listen "$TOKEN_B" "$WORK/fanout_b"
+listen "$TOKEN_C" "$WORK/fanout_c"
+sleep 1
+send_frames "$TOKEN_A" "$WORK/fanout_a" "$(group_message Z3JvdXAtMQ==)" '{"type":"group_message","group_id":"'"$GROUP_ID"'"}'
+wait
+expect_frame "$WORK/fanout_a" '.type == "delivery" and .group_id == "'"$GROUP_ID"'"' "A gets the message ID"
+expect_frame "$WORK/fanout_a" '.type == "error" and (.payload | fromjson | .code == "MISSING_PAYLOAD")' "message without payload rejected"
+expect_frame "$WORK/fanout_b" '.type == "group_message" and .payload == "Z3JvdXAtMQ==" and .from == "'"$USER_A"'"' "B receives it"
+expect_frame "$WORK/fanout_c" '.type == "group_message" and .payload == "Z3JvdXAtMQ==" and .group_id == "'"$GROUP_ID"'"' "C receives it"
+ack_all "$TOKEN_B" "$WORK/fanout_b"
+ack_all "$TOKEN_C" "$WORK/fanout_c"
+
+# C blocks A: A's group messages skip C
+expect_status POST "$BASE_URL/users/contacts" "$TOKEN_C" '{"contact_id":"'"$USER_A"'"}' 201 "C adds A as a contact"
+expect_status POST "$BASE_URL/users/contacts/$USER_A/block" "$TOKEN_C" "" 200 "C blocks A"
+listen "$TOKEN_C" "$WORK/blocked_c"
+sleep 1
+send_frames "$TOKEN_A" /dev/null "$(group_message Z3JvdXAtMg==)"
+wait
+expect_no_frame "$WORK/blocked_c" '.type == "group_message" and .payload == "Z3JvdXAtMg=="' "C doesn't get messages from A"
+expect_status POST "$BASE_URL/users/contacts/$USER_A/unblock" "$TOKEN_C" "" 200 "C unblocks A"
+expect_status DELETE "$BASE_URL/users/contacts/$USER_A" "$TOKEN_C" "" 200 "C removes the contact"
+echo
+
+echo -e "${YELLOW}Leaving${NC}"
+expect_status DELETE "$BASE_URL/groups/$GROUP_ID/members/$USER_C" "$TOKEN_B" "" 204 "B removes C"
+send_frames "$TOKEN_C" "$WORK/removed_c" "$(group_message Z3JvdXAtMw==)"
+expect_frame "$WORK/removed_c" '.type == "group_event" and (.payload | fromjson | .event == "removed")' "C is told it was removed"
+expect_frame "$WORK/removed_c" '.type == "error" and (.payload | fromjson | .code == "NOT_A_MEMBER")' "C can no longer send"
+ack_all "$TOKEN_C" "$WORK/removed_c"
+
+expect_status POST "$BASE_URL/groups/$GROUP_ID/leave" "$TOKEN_A" "" 204 "owner A leaves"
+expect_status GET "$BASE_URL/groups/$GROUP_ID" "$TOKEN_B" "" 200 "B loads the group"
+expect_body '.role == "owner" and .member_count == 1' "B inherited ownership"
+expect_status GET "$BASE_URL/groups/$GROUP_ID" "$TOKEN_A" "" 404 "A no longer sees it"
+expect_status DELETE "$BASE_URL/groups/$GROUP_ID" "$TOKEN_B" "" 204 "B deletes the group"
+expect_status GET "$BASE_URL/groups/$GROUP_ID" "$TOKEN_B" "" 404 "group is gone"
+
+# Drain the events this left queued
+for token in "$TOKEN_A" "$TOKEN_B"; do
+    listen "$token" "$WORK/drain"
+    wait
+    ack_all "$token" "$WORK/drain"
+done
+echo
+
+if [ $FAILED -ne 0 ]; then
+    echo -e "${RED}Group tests failed${NC}"
+    exit 1
+fi
+
+echo -e "${GREEN}All group tests passed${NC}"
@@ -0,0 +1,140 @@
+#!/bin/bash
+
+# Integration test for the prekey bundle API
+# A uploads keys for its device, B claims A's bundles
+# Usage: TOKEN_A=... USER_A=... TOKEN_B=... ./scripts/test-keys.sh
+
+# Colors
+GREEN='\033[0;32m'
+RED='\033[0;31m'
+YELLOW='\033[1;33m'
+NC='\033[0m'
+
+# Base URL
+BASE_URL="${BASE_URL:-http://localhost:8080/api/v1}"
+
+for var in TOKEN_A USER_A TOKEN_B; do
+    if [ -z "${!var}" ]; then
+        echo -e "${RED}Missing $var${NC}"
+        echo "Usage: TOKEN_A=... USER_A=... TOKEN_B=... $0"
+        exit 1
+    fi
+done
+
+for cmd in openssl jq curl; do
+    if ! command -v "$cmd" > /dev/null; then
+        echo -e "${RED}$cmd is required${NC}"
+        exit 1
+    fi
+done
+
+echo -e "${YELLOW}=== Testing prekey bundle API ===${NC}\n"
+
+WORK=$(mktemp -d)
+trap 'rm -rf "$WORK"' EXIT
+
+FAILED=0
+
+# Raw 32-byte public key of a PEM private key, base64 encoded
+raw_public_key() {
+    openssl pkey -in "$1" -pubout -outform DER | tail -c 32 | base64 -w0
+}
+
+# Generate identity (Ed25519), signed prekey and one-time prekeys (X25519)
+openssl genpkey -algorithm ed25519 -out "$WORK/identity.pem" 2>/dev/null
+openssl genpkey -algorithm x25519 -out "$WORK/spk.pem" 2>/dev/null
+for i in 1 2 3; do
+    openssl genpkey -algorithm x25519 -out "$WORK/otpk$i.pem" 2>/dev/null
+done
+
+IDENTITY_KEY=$(raw_public_key "$WORK/identity.pem")
+SPK=$(raw_public_key "$WORK/spk.pem")
+echo -n "$SPK" | base64 -d > "$WORK/spk.raw"
+SIGNATURE=$(openssl pkeyutl -sign -inkey "$WORK/identity.pem" -rawin -in "$WORK/spk.raw" | base64 -w0)
+BAD_SIGNATURE=$(openssl pkeyutl -sign -inkey "$WORK/identity.pem" -rawin -in "$WORK/identity.pem" | base64 -w0)
+OTPK1=$(raw_public_key "$WORK/otpk1.pem")
+OTPK2=$(raw_public_key "$WORK/otpk2.pem")
+OTPK3=$(raw_public_key "$WORK/otpk3.pem")
+
+# Function to make a request and check the status code
+expect_status() {
+    local method=$1
+    local endpoint=$2
+    local token=$3
+    local data=$4
+    local expected=$5
+    local description=$6
+
+    local args=(-s -o "$WORK/body" -w "%{http_code}" -X "$method" -H "Authorization: Bearer $token")
+    if [ -n "$data" ]; then
+        args+=(-H "Content-Type: application/json" -d "$data")
+    fi
+
+    local status
+    status=$(curl "${args[@]}" "$BASE_URL$endpoint")
+    if [ "$status" = "$expected" ]; then
+        echo -e "  ${GREEN}✓ $description ($status)${NC}"
+    else
+        echo -e "  ${RED}✗ $description (expected $expected, got $status)${NC}"
+        cat "$WORK/body"; echo
+        FAILED=1
+    fi
+}
+
+# Function to assert on the last response body
+expect_body() {
+    local filter=$1
+    local description=$2
+
+    if jq -e "$filter" "$WORK/body" > /dev/null 2>&1; then
+        echo -e "  ${GREEN}✓ $description${NC}"
+    else
+        echo -e "  ${RED}✗ $description${NC}"
+        FAILED=1
+    fi
+}
+
+echo -e "${YELLOW}Upload (A)${NC}"
+expect_status PUT /keys "$TOKEN_A" \
+    '{"identity_key":"'"$IDENTITY_KEY"'","signed_prekey":{"key_id":1,"public_key":"'"$SPK"'","signature":"'"$BAD_SIGNATURE"'"}}' \
+    400 "signed prekey with a bad signature rejected"
+expect_status PUT /keys "$TOKEN_A" \
+    '{"identity_key":"'"$IDENTITY_KEY"'","signed_prekey":{"key_id":1,"public_key":"'"$SPK"'","signature":"'"$SIGNATURE"'"},"one_time_prekeys":[{"key_id":1,"public_key":"'"$OTPK1"'"},{"key_id":2,"public_key":"'"$OTPK2"'"}]}' \
+    200 "identity key, signed prekey and prekeys stored"
+expect_body '.one_time_prekeys.one_time_prekeys == 2' "two one-time prekeys stored"
+expect_status POST /keys/prekeys "$TOKEN_A" \
+    '{"one_time_prekeys":[{"key_id":2,"public_key":"'"$OTPK3"'"}]}' \
+    409 "duplicate prekey ID rejected"
+expect_status POST /keys/prekeys "$TOKEN_A" \
+    '{"one_time_prekeys":[{"key_id":3,"public_key":"'"$OTPK3"'"}]}' \
+    200 "prekey batch added"
+expect_status GET /keys/count "$TOKEN_A" "" 200 "prekey count"
+expect_body '.one_time_prekeys == 3' "three one-time prekeys left"
+echo
+
+echo -e "${YELLOW}Claim (B)${NC}"
+expect_status GET "/keys/$USER_A" "$TOKEN_B" "" 200 "first bundle claimed"
+expect_body '.devices[0].identity_key == "'"$IDENTITY_KEY"'"' "bundle carries A's identity key"
+expect_body '.devices[0].signed_prekey.signature == "'"$SIGNATURE"'"' "bundle carries the signed prekey"
+FIRST=$(jq -r '.devices[0].one_time_prekey.key_id' "$WORK/body")
+expect_status GET "/keys/$USER_A" "$TOKEN_B" "" 200 "second bundle claimed"
+expect_body '.devices[0].one_time_prekey.key_id != '"$FIRST" "each claim gets a different one-time prekey"
+expect_status GET "/keys/$USER_A" "$TOKEN_B" "" 200 "third bundle claimed"
+expect_status GET "/keys/$USER_A" "$TOKEN_B" "" 200 "bundle after prekeys ran out"
+expect_body '.devices[0].one_time_prekey == null' "no one-time prekey left to hand out"
+echo
+
+echo -e "${YELLOW}Transparency${NC}"
+expect_status GET "/keys/$USER_A/history" "$TOKEN_B" "" 200 "key history"
+expect_body '.history[-1].identity_key == "'"$IDENTITY_KEY"'"' "history ends with the uploaded identity key"
+expect_status GET "/keys/$USER_A/safety-number" "$TOKEN_B" "" 200 "safety number from B"
+expect_body '.safety_number | gsub(" "; "") | test("^[0-9]{60}$")' "safety number is 60 digits"
+expect_status GET "/keys/$USER_A/safety-number" "$TOKEN_A" "" 200 "safety number with itself"
+echo
+
+if [ $FAILED -ne 0 ]; then
+    echo -e "${RED}Keys tests failed${NC}"
+    exit 1
+fi
+
+echo -e "${GREEN}All keys tests passed${NC}"
@@ -0,0 +1,127 @@
+#!/bin/bash
+
+# Integration test for the OTP login flow against the fake SMS gateway
+# The backend must send through the gateway, e.g. in docker/.env:
+#   SMS_PROVIDER=twilio TWILIO_ACCOUNT_SID=ACtest TWILIO_AUTH_TOKEN=test
+#   TWILIO_API_URL=http://sms-gateway:4010
+#   SMS_STATUS_CALLBACK_URL=http://backend:8080/api/v1/sms/status
+# and the gateway must run: docker compose --profile test up -d sms-gateway
+# Usage: ./scripts/test-otp.sh
+
+# Colors
+GREEN='\033[0;32m'
+RED='\033[0;31m'
+YELLOW='\033[1;33m'
+NC='\033[0m'
+
+# Base URLs
+BASE_URL="${BASE_URL:-http://localhost:8080/api/v1}"
+SMS_URL="${SMS_URL:-http://localhost:4010}"
+
+for cmd in jq curl; do
+    if ! command -v "$cmd" > /dev/null; then
+        echo -e "${RED}$cmd is required${NC}"
+        exit 1
+    fi
+done
+
+if ! curl -s -o /dev/null "$SMS_URL/messages"; then
+    echo -e "${RED}Fake SMS gateway not reachable at $SMS_URL${NC}"
+    echo "Start it with: docker compose -f docker/docker-compose.yml --profile test up -d sms-gateway"
+    exit 1
+fi
+
+echo -e "${YELLOW}=== Testing OTP flow with the fake SMS gateway ===${NC}\n"
+
+WORK=$(mktemp -d)
+trap 'rm -rf "$WORK"' EXIT
+
+FAILED=0
+
+# Random numbers, so reruns don't hit the OTP rate limits
+PHONE="+1555$(printf '%07d' $((RANDOM * RANDOM % 10000000)))"
+RETRY_PHONE="+1555$(printf '%07d' $((RANDOM * RANDOM % 10000000)))"
+
+# Function to make a request and check the status code
+expect_status() {
+    local method=$1
+    local url=$2
+    local data=$3
+    local expected=$4
+    local description=$5
+
+    local args=(-s -o "$WORK/body" -w "%{http_code}" -X "$method")
+    if [ -n "$data" ]; then
+        args+=(-H "Content-Type: application/json" -d "$data")
+    fi
+
+    local status
+    status=$(curl "${args[@]}" "$url")
+    if [ "$status" = "$expected" ]; then
+        echo -e "  ${GREEN}✓ $description ($status)${NC}"
+    else
+        echo -e "  ${RED}✗ $description (expected $expected, got $status)${NC}"
+        cat "$WORK/body"; echo
+        FAILED=1
+    fi
+}
+
+# Function to assert on the last response body
+expect_body() {
+    local filter=$1
+    local description=$2
+
+    if jq -e "$filter" "$WORK/body" > /dev/null 2>&1; then
+        echo -e "  ${GREEN}✓ $description${NC}"
+    else
+        echo -e "  ${RED}✗ $description${NC}"
+        cat "$WORK/body"; echo
+        FAILED=1
+    fi
+}
+
+# The + of a number must be encoded in query strings
+last_message_url() {
+    echo "$SMS_URL/messages/last?to=$(jq -rn --arg p "$1" '$p | @uri')"
+}
+
+expect_status DELETE "$SMS_URL/messages" "" 204 "reset the gateway"
+echo
+
+echo -e "${YELLOW}Login with the code from the gateway${NC}"
+expect_status POST "$BASE_URL/auth/request-otp" '{"phone_number":"'"$PHONE"'"}' 200 "request OTP"
+expect_status GET "$(last_message_url "$PHONE")" "" 200 "gateway received the SMS"
+expect_body '.code | test("^[0-9]{6}$")' "message carries a 6-digit code"
+CODE=$(jq -r '.code' "$WORK/body")
+
+expect_status POST "$BASE_URL/auth/verify-otp" \
+    '{"phone_number":"'"$PHONE"'","otp":"000000","device_id":"otp-test-device","public_key":"dGVzdA=="}' \
+    401 "wrong code rejected"
+expect_status POST "$BASE_URL/auth/verify-otp" \
+    '{"phone_number":"'"$PHONE"'","otp":"'"$CODE"'","device_id":"otp-test-device","public_key":"dGVzdA=="}' \
+    200 "verify OTP with the received code"
+expect_body '.access_token | length > 0' "access token issued"
+echo
+
+echo -e "${YELLOW}Delivery status callbacks${NC}"
+sleep 1
+expect_status GET "$(last_message_url "$PHONE")" "" 200 "message status"
+expect_body '.status == "delivered"' "gateway reported the message delivered"
+echo
+
+echo -e "${YELLOW}Retries${NC}"
+expect_status POST "$SMS_URL/control/fail" '{"count":2,"status":503}' 200 "gateway fails the next 2 sends"
+expect_status POST "$BASE_URL/auth/request-otp" '{"phone_number":"'"$RETRY_PHONE"'"}' 200 "request OTP survives temporary failures"
+expect_status GET "$(last_message_url "$RETRY_PHONE")" "" 200 "gateway received the SMS after retrying"
+
+expect_status POST "$SMS_URL/control/fail" '{"count":10,"status":400}' 200 "gateway rejects the next sends"
+expect_status POST "$BASE_URL/auth/request-otp" '{"phone_number":"'"$RETRY_PHONE"'"}' 500 "request OTP fails on a permanent error"
+expect_status POST "$SMS_URL/control/fail" '{"count":0}' 200 "gateway back to normal"
+echo
+
+if [ $FAILED -ne 0 ]; then
+    echo -e "${RED}OTP tests failed${NC}"
+    exit 1
+fi
+
+echo -e "${GREEN}All OTP tests passed${NC}"
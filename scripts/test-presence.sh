@@ -0,0 +1,202 @@
+#!/bin/bash
+
+# Integration test for presence: heartbeats, statuses, Postgres sync and
+# subscriptions. Needs two users; neither may be connected to /ws
+# Usage: TOKEN_A=... USER_A=... TOKEN_B=... USER_B=... ./scripts/test-presence.sh
+# Set ADMIN_TOKEN to an admin's access token to also test the online listing
+
+# Colors
+GREEN='\033[0;32m'
+RED='\033[0;31m'
+YELLOW='\033[1;33m'
+NC='\033[0m'
+
+# Base URLs
+BASE_URL="${BASE_URL:-http://localhost:8080/api/v1}"
+WS_URL="${WS_URL:-ws://localhost:8080/ws}"
+
+for var in TOKEN_A USER_A TOKEN_B USER_B; do
+    if [ -z "${!var}" ]; then
+        echo -e "${RED}Missing $var${NC}"
+        echo "Usage: TOKEN_A=... USER_A=... TOKEN_B=... USER_B=... $0"
+        exit 1
+    fi
+done
+
+for cmd in websocat jq curl; do
+    if ! command -v "$cmd" > /dev/null; then
+        echo -e "${RED}$cmd is required${NC}"
+        exit 1
+    fi
+done
+
+echo -e "${YELLOW}=== Testing presence ===${NC}\n"
+
+WORK=$(mktemp -d)
+trap 'rm -rf "$WORK"' EXIT
+
+FAILED=0
+
+# Function to make a request and check the status code
+expect_status() {
+    local method=$1
+    local url=$2
+    local token=$3
+    local data=$4
+    local expected=$5
+    local description=$6
+
+    local args=(-s -o "$WORK/body" -w "%{http_code}" -X "$method")
+    if [ -n "$token" ]; then
+        args+=(-H "Authorization: Bearer $token")
+    fi
+    if [ -n "$data" ]; then
+        args+=(-H "Content-Type: application/json" -d "$data")
+    fi
+
+    local status
+    status=$(curl "${args[@]}" "$url")
+    if [ "$status" = "$expected" ]; then
+        echo -e "  ${GREEN}✓ $description ($status)${NC}"
+    else
+        echo -e "  ${RED}✗ $description (expected $expected, got $status)${NC}"
+        cat "$WORK/body"; echo
+        FAILED=1
+    fi
+}
+
+# Function to assert on the last response body
+expect_body() {
+    local filter=$1
+    local description=$2
+
+    if jq -e "$filter" "$WORK/body" > /dev/null 2>&1; then
+        echo -e "  ${GREEN}✓ $description${NC}"
+    else
+        echo -e "  ${RED}✗ $description${NC}"
+        cat "$WORK/body"; echo
+        FAILED=1
+    fi
+}
+
+# Function to assert on the frames a connection received
+expect_frame() {
+    local file=$1
+    local filter=$2
+    local description=$3
+
+    if jq -e -c "select($filter)" "$file" 2>/dev/null | grep -q .; then
+        echo -e "  ${GREEN}✓ $description${NC}"
+    else
+        echo -e "  ${RED}✗ $description${NC}"
+        cat "$file"
+        FAILED=1
+    fi
+}
+
+expect_no_frame() {
+    local file=$1
+    local filter=$2
+    local description=$3
+
+    if jq -e -c "select($filter)" "$file" 2>/dev/null | grep -q .; then
+        echo -e "  ${RED}✗ $description${NC}"
+        cat "$file"
+        FAILED=1
+    else
+        echo -e "  ${GREEN}✓ $description${NC}"
+    fi
+}
+
+# Connects with a token for a while in the background, sending frames
+# first, and records the frames it receives
+connect() {
+    local token=$1
+    local seconds=$2
+    local out=$3
+    shift 3
+
+    {
+        for frame in "$@"; do
+            echo "$frame"
+        done
+        sleep "$seconds"
+    } | websocat -t "$WS_URL?token=$token" > "$out" &
+}
+
+status_of() {
+    echo '.type == "status" and .from == "'"$USER_B"'" and (.payload | fromjson | '"$1"')'
+}
+
+subscribe='{"type":"presence_subscribe","users":["'"$USER_B"'"]}'
+
+echo -e "${YELLOW}Setup${NC}"
+expect_status POST "$BASE_URL/users/contacts" "$TOKEN_A" '{"contact_id":"'"$USER_B"'"}' 201 "A adds B as a contact"
+expect_status POST "$BASE_URL/users/contacts" "$TOKEN_B" '{"contact_id":"'"$USER_A"'"}' 201 "B adds A as a contact"
+echo
+
+echo -e "${YELLOW}Online and away${NC}"
+connect "$TOKEN_A" 6 "$WORK/watch_a" "$subscribe"
+sleep 1
+connect "$TOKEN_B" 3 "$WORK/away_b" '{"type":"presence","payload":"away"}'
+sleep 1
+expect_status GET "$BASE_URL/users/$USER_B" "$TOKEN_A" "" 200 "A reads B's profile"
+expect_body '.is_online == true' "B is online in Postgres"
+wait
+expect_frame "$WORK/watch_a" "$(status_of '.status == "offline"')" "A gets B's current status on subscribing"
+expect_frame "$WORK/watch_a" "$(status_of '.status == "online"')" "A sees B come online"
+expect_frame "$WORK/watch_a" "$(status_of '.status == "away"')" "A sees B go away"
+expect_frame "$WORK/watch_a" "$(status_of '.status == "offline" and .last_seen != null')" "A sees B leave, with B's last seen"
+expect_status GET "$BASE_URL/users/$USER_B" "$TOKEN_A" "" 200 "A reads B's profile"
+expect_body '.is_online == false and .last_seen != null' "B is offline in Postgres"
+echo
+
+echo -e "${YELLOW}Subscriptions are per connection${NC}"
+connect "$TOKEN_A" 4 "$WORK/quiet_a"
+sleep 1
+connect "$TOKEN_B" 1 "$WORK/quiet_b" '{"type":"presence","payload":"invisible"}'
+wait
+expect_no_frame "$WORK/quiet_a" '.type == "status" and .from == "'"$USER_B"'"' "A's unsubscribed connection hears nothing"
+expect_frame "$WORK/quiet_b" '.type == "status" and (.payload | fromjson | .status == "invisible")' "B sees their own status"
+echo
+
+echo -e "${YELLOW}Invisible${NC}"
+connect "$TOKEN_A" 5 "$WORK/invisible_a" "$subscribe"
+sleep 1
+connect "$TOKEN_B" 2 /dev/null
+sleep 1
+expect_status GET "$BASE_URL/users/$USER_B" "$TOKEN_A" "" 200 "A reads B's profile"
+expect_body '.is_online == false' "B stays offline in Postgres"
+wait
+expect_no_frame "$WORK/invisible_a" "$(status_of '.status != "offline"')" "A never sees B online"
+echo
+
+if [ -n "$ADMIN_TOKEN" ]; then
+    echo -e "${YELLOW}Online users${NC}"
+    connect "$TOKEN_B" 2 /dev/null
+    sleep 1
+    expect_status GET "$BASE_URL/ws/stats" "$ADMIN_TOKEN" "" 200 "Admin reads the stats"
+    expect_body '.users.online_count >= 1 and (.users | has("online_users") | not)' "Stats only have the count"
+    expect_status GET "$BASE_URL/admin/presence/online?page_size=200" "$ADMIN_TOKEN" "" 200 "Admin lists online users"
+    expect_body '.users | map(.user_id) | index("'"$USER_B"'") != null' "B is listed"
+    expect_status GET "$BASE_URL/admin/presence/online" "$TOKEN_A" "" 403 "Users can't list online users"
+    wait
+    echo
+fi
+
+# Also leaves B online again for the next run
+echo -e "${YELLOW}Errors${NC}"
+connect "$TOKEN_B" 1 "$WORK/errors_b" '{"type":"presence","payload":"busy"}' '{"type":"presence","payload":"online"}'
+wait
+expect_frame "$WORK/errors_b" '.type == "error" and (.payload | fromjson | .code == "INVALID_STATUS")' "Unknown statuses are rejected"
+
+expect_status DELETE "$BASE_URL/users/contacts/$USER_B" "$TOKEN_A" "" 200 "A removes the contact"
+expect_status DELETE "$BASE_URL/users/contacts/$USER_A" "$TOKEN_B" "" 200 "B removes the contact"
+echo
+
+if [ $FAILED -ne 0 ]; then
+    echo -e "${RED}Presence tests failed${NC}"
+    exit 1
+fi
+
+echo -e "${GREEN}All presence tests passed${NC}"
@@ -0,0 +1,186 @@
+#!/bin/bash
+
+# Integration test for push wake-ups against the fake push gateway
+# The backend must have Web Push configured and accept the gateway's
+# endpoints, e.g. in docker/.env:
+#   VAPID_PRIVATE_KEY=<key> VAPID_SUBJECT=mailto:test@example.com
+#   PUSH_WEBPUSH_HOSTS=push-gateway
+# and the gateway must run: docker compose --profile test up -d push-gateway
+# B must be logged in on a single device and not connected to /ws
+# Usage: TOKEN_A=... USER_A=... TOKEN_B=... USER_B=... ./scripts/test-push.sh
+
+# Colors
+GREEN='\033[0;32m'
+RED='\033[0;31m'
+YELLOW='\033[1;33m'
+NC='\033[0m'
+
+# Base URLs
+BASE_URL="${BASE_URL:-http://localhost:8080/api/v1}"
+WS_URL="${WS_URL:-ws://localhost:8080/ws}"
+PUSH_URL="${PUSH_URL:-http://localhost:4020}"
+# The gateway as the backend reaches it
+PUSH_INTERNAL_URL="${PUSH_INTERNAL_URL:-http://push-gateway:4020}"
+# Longer than PUSH_BATCH_WINDOW
+PUSH_WAIT="${PUSH_WAIT:-5}"
+
+for var in TOKEN_A USER_A TOKEN_B USER_B; do
+    if [ -z "${!var}" ]; then
+        echo -e "${RED}Missing $var${NC}"
+        echo "Usage: TOKEN_A=... USER_A=... TOKEN_B=... USER_B=... $0"
+        exit 1
+    fi
+done
+
+for cmd in websocat jq curl; do
+    if ! command -v "$cmd" > /dev/null; then
+        echo -e "${RED}$cmd is required${NC}"
+        exit 1
+    fi
+done
+
+if ! curl -s -o /dev/null "$PUSH_URL/notifications"; then
+    echo -e "${RED}Fake push gateway not reachable at $PUSH_URL${NC}"
+    echo "Start it with: docker compose -f docker/docker-compose.yml --profile test up -d push-gateway"
+    exit 1
+fi
+
+echo -e "${YELLOW}=== Testing push wake-ups with the fake push gateway ===${NC}\n"
+
+WORK=$(mktemp -d)
+trap 'rm -rf "$WORK"' EXIT
+
+FAILED=0
+
+# Function to make a request and check the status code
+expect_status() {
+    local method=$1
+    local url=$2
+    local token=$3
+    local data=$4
+    local expected=$5
+    local description=$6
+
+    local args=(-s -o "$WORK/body" -w "%{http_code}" -X "$method")
+    if [ -n "$token" ]; then
+        args+=(-H "Authorization: Bearer $token")
+    fi
+    if [ -n "$data" ]; then
+        args+=(-H "Content-Type: application/json" -d "$data")
+    fi
+
+    local status
+    status=$(curl "${args[@]}" "$url")
+    if [ "$status" = "$expected" ]; then
+        echo -e "  ${GREEN}✓ $description ($status)${NC}"
+    else
+        echo -e "  ${RED}✗ $description (expected $expected, got $status)${NC}"
+        cat "$WORK/body"; echo
+        FAILED=1
+    fi
+}
+
+# Function to assert on the last response body
+expect_body() {
+    local filter=$1
+    local description=$2
+
+    if jq -e "$filter" "$WORK/body" > /dev/null 2>&1; then
+        echo -e "  ${GREEN}✓ $description${NC}"
+    else
+        echo -e "  ${RED}✗ $description${NC}"
+        cat "$WORK/body"; echo
+        FAILED=1
+    fi
+}
+
+# Reads a claim from a JWT without verifying it
+jwt_claim() {
+    local payload
+    payload=$(echo "$1" | cut -d. -f2 | tr '_-' '/+')
+    while [ $((${#payload} % 4)) -ne 0 ]; do
+        payload="$payload="
+    done
+    echo "$payload" | base64 -d 2>/dev/null | jq -r ".$2"
+}
+
+# A sends B a chat message, with one envelope for B's only device
+send_message() {
+    {
+        echo '{"type":"message","to":"'"$USER_B"'","envelopes":[{"device_id":"'"$DEVICE_B"'","payload":"dGVzdC1jaXBoZXJ0ZXh0"}]}'
+        sleep 1
+    } | websocat -t "$WS_URL?token=$TOKEN_A" > /dev/null
+}
+
+# Checks how many wake-ups the gateway got for B's endpoint
+expect_wakeups() {
+    local expected=$1
+    local description=$2
+
+    sleep "$PUSH_WAIT"
+    expect_status GET "$PUSH_URL/notifications?token=$(jq -rn --arg e "$ENDPOINT" '$e | @uri')" "" "" 200 "list wake-ups"
+    expect_body ".count == $expected" "$description"
+}
+
+DEVICE_B=$(jwt_claim "$TOKEN_B" device_id)
+ENDPOINT="$PUSH_INTERNAL_URL/webpush/test-$(date +%s)-$RANDOM"
+
+expect_status DELETE "$PUSH_URL/notifications" "" "" 204 "reset the gateway"
+echo
+
+echo -e "${YELLOW}Token registration${NC}"
+expect_status GET "$BASE_URL/push/vapid-key" "$TOKEN_B" "" 200 "VAPID public key"
+expect_body '.public_key | length == 87' "key is an uncompressed P-256 point"
+expect_status PUT "$BASE_URL/push/token" "$TOKEN_B" '{"provider":"sms","token":"x"}' 400 "unknown provider rejected"
+expect_status PUT "$BASE_URL/push/token" "$TOKEN_B" '{"provider":"webpush","token":"https://evil.example.com/push"}' 400 "endpoint on an unknown host rejected"
+expect_status PUT "$BASE_URL/push/token" "$TOKEN_B" '{"provider":"apns","token":"not-hex"}' 400 "malformed APNs token rejected"
+expect_status PUT "$BASE_URL/push/token" "$TOKEN_B" '{"provider":"webpush","subscription":{"endpoint":"'"$ENDPOINT"'","keys":{}}}' 200 "register Web Push subscription"
+expect_body '.device_id == "'"$DEVICE_B"'"' "token bound to the calling device"
+echo
+
+echo -e "${YELLOW}Wake-ups${NC}"
+send_message
+send_message
+expect_wakeups 1 "two messages within the window share one wake-up"
+expect_body '.notifications[0].payload == null' "wake-up carries no content"
+expect_body '.notifications[0].collapse_key | length == 32' "wake-up has a collapse key"
+echo
+
+echo -e "${YELLOW}Mutes${NC}"
+expect_status DELETE "$PUSH_URL/notifications" "" "" 204 "reset the gateway"
+expect_status PUT "$BASE_URL/push/mutes/$USER_B" "$TOKEN_B" "" 400 "can't mute yourself"
+expect_status PUT "$BASE_URL/push/mutes/$USER_A" "$TOKEN_B" "" 200 "B mutes A"
+expect_status GET "$BASE_URL/push/settings" "$TOKEN_B" "" 200 "settings"
+expect_body '.mutes | map(.user_id) | index("'"$USER_A"'") != null' "A is listed as muted"
+send_message
+expect_wakeups 0 "no wake-up for a muted sender"
+
+expect_status DELETE "$BASE_URL/push/mutes/$USER_A" "$TOKEN_B" "" 204 "B unmutes A"
+expect_status DELETE "$BASE_URL/push/mutes/$USER_A" "$TOKEN_B" "" 404 "unmuting twice"
+expect_status PUT "$BASE_URL/push/settings" "$TOKEN_B" '{"muted":true}' 200 "B mutes everything"
+expect_body '.muted == true and .muted_until == null' "muted until turned back on"
+send_message
+expect_wakeups 0 "no wake-up while muted"
+
+expect_status PUT "$BASE_URL/push/settings" "$TOKEN_B" '{"muted":false}' 200 "B turns notifications back on"
+send_message
+expect_wakeups 1 "wake-ups resume"
+echo
+
+echo -e "${YELLOW}Expired subscriptions${NC}"
+expect_status POST "$PUSH_URL/control/unregister" "" '{"token":"'"$ENDPOINT"'"}' 204 "gateway expires the subscription"
+send_message
+sleep "$PUSH_WAIT"
+expect_status DELETE "$PUSH_URL/notifications" "" "" 204 "reset the gateway, subscription works again"
+send_message
+expect_wakeups 0 "backend forgot the expired subscription"
+
+expect_status DELETE "$BASE_URL/push/token" "$TOKEN_B" "" 204 "remove token"
+echo
+
+if [ $FAILED -ne 0 ]; then
+    echo -e "${RED}Push tests failed${NC}"
+    exit 1
+fi
+
+echo -e "${GREEN}All push tests passed${NC}"
@@ -0,0 +1,200 @@
+#!/bin/bash
+
+# Integration test for message requests between users who are not contacts
+# Needs two users with one device each who are not contacts; neither may be
+# connected to /ws
+# Usage: TOKEN_A=... USER_A=... TOKEN_B=... USER_B=... ./scripts/test-requests.sh
+
+# Colors
+GREEN='\033[0;32m'
+RED='\033[0;31m'
+YELLOW='\033[1;33m'
+NC='\033[0m'
+
+# Base URLs
+BASE_URL="${BASE_URL:-http://localhost:8080/api/v1}"
+WS_URL="${WS_URL:-ws://localhost:8080/ws}"
+
+for var in TOKEN_A USER_A TOKEN_B USER_B; do
+    if [ -z "${!var}" ]; then
+        echo -e "${RED}Missing $var${NC}"
+        echo "Usage: TOKEN_A=... USER_A=... TOKEN_B=... USER_B=... $0"
+        exit 1
+    fi
+done
+
+for cmd in websocat jq curl; do
+    if ! command -v "$cmd" > /dev/null; then
+        echo -e "${RED}$cmd is required${NC}"
+        exit 1
+    fi
+done
+
+echo -e "${YELLOW}=== Testing message requests ===${NC}\n"
+
+WORK=$(mktemp -d)
+trap 'rm -rf "$WORK"' EXIT
+
+FAILED=0
+
+# Function to make a request and check the status code
+expect_status() {
+    local method=$1
+    local url=$2
+    local token=$3
+    local data=$4
+    local expected=$5
+    local description=$6
+
+    local args=(-s -o "$WORK/body" -w "%{http_code}" -X "$method")
+    if [ -n "$token" ]; then
+        args+=(-H "Authorization: Bearer $token")
+    fi
+    if [ -n "$data" ]; then
+        args+=(-H "Content-Type: application/json" -d "$data")
+    fi
+
+    local status
+    status=$(curl "${args[@]}" "$url")
+    if [ "$status" = "$expected" ]; then
+        echo -e "  ${GREEN}✓ $description ($status)${NC}"
+    else
+        echo -e "  ${RED}✗ $description (expected $expected, got $status)${NC}"
+        cat "$WORK/body"; echo
+        FAILED=1
+    fi
+}
+
+# Function to assert on the last response body
+expect_body() {
+    local filter=$1
+    local description=$2
+
+    if jq -e "$filter" "$WORK/body" > /dev/null 2>&1; then
+        echo -e "  ${GREEN}✓ $description${NC}"
+    else
+        echo -e "  ${RED}✗ $description${NC}"
+        cat "$WORK/body"; echo
+        FAILED=1
+    fi
+}
+
+# Function to assert on the frames a connection received
+expect_frame() {
+    local file=$1
+    local filter=$2
+    local description=$3
+
+    if jq -e -c "select($filter)" "$file" 2>/dev/null | grep -q .; then
+        echo -e "  ${GREEN}✓ $description${NC}"
+    else
+        echo -e "  ${RED}✗ $description${NC}"
+        cat "$file"
+        FAILED=1
+    fi
+}
+
+expect_no_frame() {
+    local file=$1
+    local filter=$2
+    local description=$3
+
+    if jq -e -c "select($filter)" "$file" 2>/dev/null | grep -q .; then
+        echo -e "  ${RED}✗ $description${NC}"
+        cat "$file"
+        FAILED=1
+    else
+        echo -e "  ${GREEN}✓ $description${NC}"
+    fi
+}
+
+# Connects with a token for a few seconds in the background and records
+# the frames it receives
+listen() {
+    local token=$1
+    local out=$2
+
+    websocat -t "$WS_URL?token=$token" < <(sleep 4) > "$out" &
+}
+
+# Sends frames from a token's device and records the answers
+send_frames() {
+    local token=$1
+    local out=$2
+    shift 2
+
+    {
+        for frame in "$@"; do
+            echo "$frame"
+        done
+        sleep 1
+    } | websocat -t "$WS_URL?token=$token" > "$out"
+}
+
+# Fetches the recipient's first device so the envelopes pass the device check
+message_to() {
+    local device
+    device=$(curl -s -H "Authorization: Bearer $TOKEN_A" "$BASE_URL/users/$1/devices" | jq -r '.devices[0].device_id')
+    echo '{"type":"message","to":"'"$1"'","envelopes":[{"device_id":"'"$device"'","payload":"'"$2"'"}]}'
+}
+
+typing_to() {
+    echo '{"type":"typing","to":"'"$1"'","payload":"true"}'
+}
+
+echo -e "${YELLOW}Settings${NC}"
+expect_status PUT "$BASE_URL/users/requests/settings" "$TOKEN_B" '{}' 400 "require_approval is required"
+expect_status PUT "$BASE_URL/users/requests/settings" "$TOKEN_B" '{"require_approval":true}' 200 "B requires approval"
+expect_status GET "$BASE_URL/users/me" "$TOKEN_B" "" 200 "B reads their profile"
+expect_body '.settings.privacy.require_approval == true' "The setting is stored"
+echo
+
+echo -e "${YELLOW}First message${NC}"
+listen "$TOKEN_B" "$WORK/first_b"
+sleep 1
+send_frames "$TOKEN_A" "$WORK/first_a" "$(message_to "$USER_B" Zmlyc3Q=)" "$(message_to "$USER_B" c2Vjb25k)" "$(typing_to "$USER_B")"
+wait
+expect_frame "$WORK/first_a" '.type == "delivery" and .request_id != null' "A's first message opens a request"
+expect_frame "$WORK/first_a" '.type == "error" and (.payload | fromjson | .code == "MESSAGE_REQUEST_PENDING")' "A's second message is refused"
+expect_frame "$WORK/first_b" '.type == "message" and .request_id != null' "B gets the first message with its request"
+expect_no_frame "$WORK/first_b" '.type == "typing"' "B doesn't see A typing"
+expect_status GET "$BASE_URL/users/$USER_B" "$TOKEN_A" "" 200 "A reads B's profile"
+expect_body '.is_online == false and .last_seen == null' "B's presence is hidden from A"
+echo
+
+echo -e "${YELLOW}Requests${NC}"
+expect_status GET "$BASE_URL/users/requests" "$TOKEN_B" "" 200 "B lists incoming requests"
+REQUEST_ID=$(jq -r '.requests | map(select(.sender_id == "'"$USER_A"'")) | .[0].id' "$WORK/body")
+expect_body '.requests | any(.sender_id == "'"$USER_A"'" and .status == "pending")' "A's request is pending"
+expect_status POST "$BASE_URL/users/requests/$REQUEST_ID/accept" "$TOKEN_A" "" 404 "A can't answer their own request"
+expect_status POST "$BASE_URL/users/requests/$REQUEST_ID/decline" "$TOKEN_B" "" 200 "B declines"
+expect_status GET "$BASE_URL/users/requests/sent" "$TOKEN_A" "" 200 "A lists sent requests"
+expect_body '.requests | any(.id == "'"$REQUEST_ID"'" and .status == "pending")' "A still sees it as pending"
+echo
+
+echo -e "${YELLOW}Accepting${NC}"
+listen "$TOKEN_A" "$WORK/accepted_a"
+sleep 1
+expect_status POST "$BASE_URL/users/requests/$REQUEST_ID/accept" "$TOKEN_B" "" 200 "B accepts after all"
+wait
+expect_frame "$WORK/accepted_a" '.type == "request_accepted" and (.payload | fromjson | .request_id == "'"$REQUEST_ID"'")' "A is told"
+expect_status GET "$BASE_URL/users/contacts" "$TOKEN_A" "" 200 "A lists contacts"
+expect_body '.contacts | any(.contact_id == "'"$USER_B"'")' "B is A's contact"
+expect_status GET "$BASE_URL/users/contacts" "$TOKEN_B" "" 200 "B lists contacts"
+expect_body '.contacts | any(.contact_id == "'"$USER_A"'")' "A is B's contact"
+send_frames "$TOKEN_A" "$WORK/accepted_msg" "$(message_to "$USER_B" YWNjZXB0ZWQ=)"
+expect_frame "$WORK/accepted_msg" '.type == "delivery" and .request_id == null' "A messages B freely"
+echo
+
+echo -e "${YELLOW}Cleanup${NC}"
+expect_status DELETE "$BASE_URL/users/contacts/$USER_B" "$TOKEN_A" "" 200 "A removes the contact"
+expect_status DELETE "$BASE_URL/users/contacts/$USER_A" "$TOKEN_B" "" 200 "B removes the contact"
+expect_status PUT "$BASE_URL/users/requests/settings" "$TOKEN_B" '{"require_approval":false}' 200 "B stops requiring approval"
+echo
+
+if [ $FAILED -ne 0 ]; then
+    echo -e "${RED}Message request tests failed${NC}"
+    exit 1
+fi
+
+echo -e "${GREEN}All message request tests passed${NC}"
@@ -0,0 +1,130 @@
+#!/bin/bash
+
+# Integration test for user settings and the privacy flags
+# Needs two users; discovery is only checked when A is a model
+# Usage: TOKEN_A=... USER_A=... TOKEN_B=... USER_B=... ./scripts/test-settings.sh
+
+# Colors
+GREEN='\033[0;32m'
+RED='\033[0;31m'
+YELLOW='\033[1;33m'
+NC='\033[0m'
+
+# Base URLs
+BASE_URL="${BASE_URL:-http://localhost:8080/api/v1}"
+WS_URL="${WS_URL:-ws://localhost:8080/ws}"
+
+for var in TOKEN_A USER_A TOKEN_B USER_B; do
+    if [ -z "${!var}" ]; then
+        echo -e "${RED}Missing $var${NC}"
+        echo "Usage: TOKEN_A=... USER_A=... TOKEN_B=... USER_B=... $0"
+        exit 1
+    fi
+done
+
+for cmd in jq curl; do
+    if ! command -v "$cmd" > /dev/null; then
+        echo -e "${RED}$cmd is required${NC}"
+        exit 1
+    fi
+done
+
+echo -e "${YELLOW}=== Testing user settings ===${NC}\n"
+
+WORK=$(mktemp -d)
+trap 'rm -rf "$WORK"' EXIT
+
+FAILED=0
+
+# Function to make a request and check the status code
+expect_status() {
+    local method=$1
+    local url=$2
+    local token=$3
+    local data=$4
+    local expected=$5
+    local description=$6
+
+    local args=(-s -o "$WORK/body" -w "%{http_code}" -X "$method")
+    if [ -n "$token" ]; then
+        args+=(-H "Authorization: Bearer $token")
+    fi
+    if [ -n "$data" ]; then
+        args+=(-H "Content-Type: application/json" -d "$data")
+    fi
+
+    local status
+    status=$(curl "${args[@]}" "$url")
+    if [ "$status" = "$expected" ]; then
+        echo -e "  ${GREEN}✓ $description ($status)${NC}"
+    else
+        echo -e "  ${RED}✗ $description (expected $expected, got $status)${NC}"
+        cat "$WORK/body"; echo
+        FAILED=1
+    fi
+}
+
+# Function to assert on the last response body
+expect_body() {
+    local filter=$1
+    local description=$2
+
+    if jq -e "$filter" "$WORK/body" > /dev/null 2>&1; then
+        echo -e "  ${GREEN}✓ $description${NC}"
+    else
+        echo -e "  ${RED}✗ $description${NC}"
+        cat "$WORK/body"; echo
+        FAILED=1
+    fi
+}
+
+echo -e "${YELLOW}Validation${NC}"
+expect_status PUT "$BASE_URL/users/settings" "$TOKEN_A" '{}' 400 "An empty update is refused"
+expect_status PUT "$BASE_URL/users/settings" "$TOKEN_A" '{"language":"english"}' 400 "An invalid language is refused"
+expect_status PUT "$BASE_URL/users/settings" "$TOKEN_A" '{"theme":"blue"}' 400 "An invalid theme is refused"
+expect_status PUT "$BASE_URL/users/settings" "$TOKEN_A" '{"privacy":{"show_online":"no"}}' 400 "A non-boolean flag is refused"
+echo
+
+echo -e "${YELLOW}Settings${NC}"
+expect_status PUT "$BASE_URL/users/settings" "$TOKEN_A" '{"language":"pt-BR","theme":"dark"}' 200 "A changes language and theme"
+expect_body '.language == "pt-BR" and .theme == "dark" and .privacy.show_online == true' "Only those fields change"
+expect_status PUT "$BASE_URL/users/settings" "$TOKEN_A" '{"notifications_enabled":false}' 200 "A turns notifications off"
+expect_status GET "$BASE_URL/push/settings" "$TOKEN_A" "" 200 "A reads the push settings"
+expect_body '.muted == true and .muted_until == null' "Push is muted"
+expect_status GET "$BASE_URL/users/me" "$TOKEN_A" "" 200 "A reads their profile"
+expect_body '.settings.language == "pt-BR" and .settings.notifications_enabled == false' "The profile shows the stored settings"
+echo
+
+echo -e "${YELLOW}Presence${NC}"
+expect_status PUT "$BASE_URL/users/settings" "$TOKEN_A" '{"privacy":{"show_online":false,"show_last_seen":false}}' 200 "A hides their presence"
+expect_status GET "$BASE_URL/users/$USER_A" "$TOKEN_B" "" 200 "B reads A's profile"
+expect_body '.is_online == false and .last_seen == null' "B doesn't see A's presence"
+expect_status GET "$BASE_URL/users/$USER_A" "$TOKEN_A" "" 200 "A reads their own profile"
+expect_body '.last_seen != null' "A still sees their own"
+expect_status PUT "$BASE_URL/users/settings" "$TOKEN_A" '{"privacy":{"show_last_seen":true}}' 200 "A shows their last seen again"
+expect_status GET "$BASE_URL/users/$USER_A" "$TOKEN_B" "" 200 "B reads A's profile"
+expect_body '.is_online == false and .last_seen != null' "B sees A's last seen only"
+echo
+
+if [ "$(jq -r '.role' "$WORK/body")" = "model" ]; then
+    echo -e "${YELLOW}Discovery${NC}"
+    expect_status PUT "$BASE_URL/users/settings" "$TOKEN_A" '{"privacy":{"allow_discovery":false}}' 200 "A turns discovery off"
+    expect_status GET "$BASE_URL/models?page_size=100" "$TOKEN_B" "" 200 "B lists models"
+    expect_body '.models | all(.id != "'"$USER_A"'")' "A is not listed"
+    expect_status GET "$BASE_URL/models/$USER_A" "$TOKEN_B" "" 200 "A's profile is still reachable by ID"
+    expect_status PUT "$BASE_URL/users/settings" "$TOKEN_A" '{"privacy":{"allow_discovery":true}}' 200 "A turns discovery back on"
+    expect_status GET "$BASE_URL/models?page_size=100&sort_by=newest" "$TOKEN_B" "" 200 "B lists models"
+    expect_body '.models | any(.id == "'"$USER_A"'")' "A is listed again"
+    echo
+fi
+
+echo -e "${YELLOW}Cleanup${NC}"
+expect_status PUT "$BASE_URL/users/settings" "$TOKEN_A" '{"notifications_enabled":true,"language":"en","theme":"light","privacy":{"show_online":true,"show_last_seen":true,"allow_discovery":true}}' 200 "A restores the defaults"
+echo
+
+if [ $FAILED -ne 0 ]; then
+    echo -e "${RED}Settings tests failed${NC}"
+    exit 1
+fi
+
+echo -e "${GREEN}All settings tests passed${NC}"
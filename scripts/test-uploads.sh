@@ -0,0 +1,218 @@
+#!/bin/bash
+
+# Integration test for resumable and direct media uploads
+# MinIO must be reachable at the presigned URLs the backend returns
+# Usage: TOKEN=... ./scripts/test-uploads.sh
+
+# Colors
+GREEN='\033[0;32m'
+RED='\033[0;31m'
+YELLOW='\033[1;33m'
+NC='\033[0m'
+
+# Base URL
+BASE_URL="${BASE_URL:-http://localhost:8080/api/v1}"
+
+if [ -z "$TOKEN" ]; then
+    echo -e "${RED}Missing TOKEN${NC}"
+    echo "Usage: TOKEN=... $0"
+    exit 1
+fi
+
+for cmd in jq curl sha256sum; do
+    if ! command -v "$cmd" > /dev/null; then
+        echo -e "${RED}$cmd is required${NC}"
+        exit 1
+    fi
+done
+
+echo -e "${YELLOW}=== Testing media uploads ===${NC}\n"
+
+WORK=$(mktemp -d)
+trap 'rm -rf "$WORK"' EXIT
+
+FAILED=0
+
+# Function to make a request and check the status code
+expect_status() {
+    local method=$1
+    local url=$2
+    local data=$3
+    local expected=$4
+    local description=$5
+
+    local args=(-s -o "$WORK/body" -w "%{http_code}" -X "$method" -H "Authorization: Bearer $TOKEN")
+    if [ -n "$data" ]; then
+        args+=(-H "Content-Type: application/json" -d "$data")
+    fi
+
+    check_status "$(curl "${args[@]}" "$url")" "$expected" "$description"
+}
+
+# Function to send a file as the raw body of a part
+expect_part() {
+    local url=$1
+    local file=$2
+    local expected=$3
+    local description=$4
+
+    check_status "$(curl -s -o "$WORK/body" -w "%{http_code}" -X PUT \
+        -H "Authorization: Bearer $TOKEN" -H "Content-Type: application/octet-stream" \
+        --data-binary "@$file" "$url")" "$expected" "$description"
+}
+
+check_status() {
+    if [ "$1" = "$2" ]; then
+        echo -e "  ${GREEN}✓ $3 ($1)${NC}"
+    else
+        echo -e "  ${RED}✗ $3 (expected $2, got $1)${NC}"
+        cat "$WORK/body"; echo
+        FAILED=1
+    fi
+}
+
+# Function to assert on the last response body
+expect_body() {
+    local filter=$1
+    local description=$2
+
+    if jq -e "$filter" "$WORK/body" > /dev/null 2>&1; then
+        echo -e "  ${GREEN}✓ $description${NC}"
+    else
+        echo -e "  ${RED}✗ $description${NC}"
+        cat "$WORK/body"; echo
+        FAILED=1
+    fi
+}
+
+# Function to send a whole file to POST /media/upload
+expect_upload() {
+    local file=$1
+    local content_type=$2
+    local expected=$3
+    local description=$4
+
+    check_status "$(curl -s -o "$WORK/body" -w "%{http_code}" -X POST \
+        -H "Authorization: Bearer $TOKEN" -F "file=@$file;type=$content_type" \
+        "$BASE_URL/media/upload")" "$expected" "$description"
+}
+
+# Function to PUT a file to a presigned URL
+expect_put() {
+    local url=$1
+    local file=$2
+    local content_type=$3
+    local expected=$4
+    local description=$5
+
+    check_status "$(curl -s -o "$WORK/body" -w "%{http_code}" -X PUT \
+        -H "Content-Type: $content_type" --data-binary "@$file" "$url")" "$expected" "$description"
+}
+
+# A 10MB file: one full 8MB part and a 2MB last one. It starts like an MP4,
+# since the content is checked against the declared type.
+printf '\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom' > "$WORK/video.mp4"
+head -c $((10 * 1024 * 1024 - 24)) /dev/urandom >> "$WORK/video.mp4"
+split -b $((8 * 1024 * 1024)) -d -a 1 "$WORK/video.mp4" "$WORK/part"
+SIZE=$(wc -c < "$WORK/video.mp4" | tr -d ' ')
+SHA256=$(sha256sum "$WORK/video.mp4" | cut -d' ' -f1)
+
+start_upload() {
+    expect_status POST "$BASE_URL/media/uploads" \
+        '{"filename":"video.mp4","content_type":"video/mp4","size":'"$SIZE"',"sha256":"'"$1"'"}' 201 "$2"
+    UPLOAD_ID=$(jq -r '.upload_id' "$WORK/body")
+}
+
+echo -e "${YELLOW}Validation${NC}"
+expect_status POST "$BASE_URL/media/uploads" '{"filename":"video.mp4","content_type":"video/mp4","size":10}' 400 "The checksum is required"
+expect_status POST "$BASE_URL/media/uploads" '{"filename":"notes.exe","content_type":"application/octet-stream","size":10,"sha256":"'"$SHA256"'"}' 400 "Unknown types are rejected"
+expect_status POST "$BASE_URL/media/uploads" '{"filename":"video.mp4","content_type":"video/mp4","size":209715200,"sha256":"'"$SHA256"'"}' 400 "Videos over 100MB are rejected"
+expect_status POST "$BASE_URL/media/uploads" '{"filename":"photo.png","content_type":"image/png","size":31457280,"sha256":"'"$SHA256"'"}' 400 "Photos over 20MB are rejected"
+expect_body '.max_size == 20971520' "Reports the limit for photos"
+expect_status POST "$BASE_URL/media/uploads" '{"filename":"video.mp4","content_type":"audio/mpeg","size":10,"sha256":"'"$SHA256"'"}' 400 "A type that contradicts the extension is rejected"
+echo
+
+echo -e "${YELLOW}Upload and resume${NC}"
+start_upload "$SHA256" "Starts an upload"
+expect_body '.total_parts == 2 and .part_size == 8388608 and .received_parts == []' "Split into two parts"
+expect_part "$BASE_URL/media/uploads/$UPLOAD_ID/parts/2" "$WORK/part0" 400 "A part of the wrong size is rejected"
+expect_part "$BASE_URL/media/uploads/$UPLOAD_ID/parts/1" "$WORK/part0" 200 "Sends the first part"
+expect_status POST "$BASE_URL/media/uploads/$UPLOAD_ID/complete" "" 409 "Can't complete with a part missing"
+expect_status GET "$BASE_URL/media/uploads/$UPLOAD_ID" "" 200 "Reads the upload after a cut"
+expect_body '.received_parts == [1]' "The first part is there"
+expect_part "$BASE_URL/media/uploads/$UPLOAD_ID/parts/2" "$WORK/part1" 200 "Resumes with the second part"
+expect_status POST "$BASE_URL/media/uploads/$UPLOAD_ID/complete" "" 200 "Completes the upload"
+expect_body '.type == "video" and .size == '"$SIZE" "Creates the media"
+MEDIA_ID=$(jq -r '.id' "$WORK/body")
+expect_status POST "$BASE_URL/media/uploads/$UPLOAD_ID/complete" "" 200 "Completing again is safe"
+expect_body '.id == "'"$MEDIA_ID"'"' "Returns the same media"
+curl -s -o "$WORK/download" -H "Authorization: Bearer $TOKEN" "$BASE_URL/media/$MEDIA_ID"
+if [ "$(sha256sum "$WORK/download" | cut -d' ' -f1)" = "$SHA256" ]; then
+    echo -e "  ${GREEN}✓ The stored file matches${NC}"
+else
+    echo -e "  ${RED}✗ The stored file doesn't match${NC}"
+    FAILED=1
+fi
+expect_status DELETE "$BASE_URL/media/$MEDIA_ID" "" 200 "Deletes the media"
+echo
+
+echo -e "${YELLOW}Checksum and abort${NC}"
+start_upload "$(printf '0%.0s' {1..64})" "Starts an upload with the wrong checksum"
+expect_part "$BASE_URL/media/uploads/$UPLOAD_ID/parts/1" "$WORK/part0" 200 "Sends the first part"
+expect_part "$BASE_URL/media/uploads/$UPLOAD_ID/parts/2" "$WORK/part1" 200 "Sends the second part"
+expect_status POST "$BASE_URL/media/uploads/$UPLOAD_ID/complete" "" 422 "The checksum doesn't match"
+expect_status GET "$BASE_URL/media/uploads/$UPLOAD_ID" "" 404 "The upload is dropped"
+start_upload "$SHA256" "Starts another upload"
+expect_status DELETE "$BASE_URL/media/uploads/$UPLOAD_ID" "" 200 "Aborts it"
+expect_part "$BASE_URL/media/uploads/$UPLOAD_ID/parts/1" "$WORK/part0" 404 "No more parts are taken"
+echo
+
+# A real 1x1 PNG for the direct uploads, a file that only claims to be one,
+# the same PNG with a ZIP directory appended and a PNG that says it is
+# 100000x100000
+echo 'iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAIAAACQd1PeAAAADElEQVR4nGP4z8AAAAMBAQDJ/pLvAAAAAElFTkSuQmCC' | base64 -d > "$WORK/photo.png"
+PHOTO_SIZE=$(wc -c < "$WORK/photo.png" | tr -d ' ')
+PHOTO_SHA256=$(sha256sum "$WORK/photo.png" | cut -d' ' -f1)
+head -c "$PHOTO_SIZE" /dev/urandom > "$WORK/fake.png"
+{ cat "$WORK/photo.png"; printf 'PK\x05\x06'; head -c 18 /dev/zero; } > "$WORK/polyglot.png"
+echo 'iVBORw0KGgoAAAANSUhEUgABhqAAAYagCAIAAAAnMJyfAAAAC0lEQVR4nGNgQAUAABAAATm9j2UAAAAASUVORK5CYII=' | base64 -d > "$WORK/bomb.png"
+
+echo -e "${YELLOW}Direct uploads${NC}"
+expect_status POST "$BASE_URL/media/intents" '{"filename":"photo.png","content_type":"image/png","size":'"$PHOTO_SIZE"'}' 400 "The checksum is required"
+expect_status POST "$BASE_URL/media/intents" \
+    '{"filename":"photo.png","content_type":"image/png","size":'"$PHOTO_SIZE"',"sha256":"'"$PHOTO_SHA256"'"}' 201 "Creates an intent"
+expect_body '.method == "PUT" and (.url | length > 0) and .type == "photo" and .size == '"$PHOTO_SIZE" "Returns a presigned URL and the constraints"
+UPLOAD_ID=$(jq -r '.upload_id' "$WORK/body")
+URL=$(jq -r '.url' "$WORK/body")
+expect_status POST "$BASE_URL/media/intents/$UPLOAD_ID/finalize" "" 409 "Can't finalize before the PUT"
+expect_put "$URL" "$WORK/fake.png" image/png 200 "PUTs a file that isn't a PNG"
+expect_status POST "$BASE_URL/media/intents/$UPLOAD_ID/finalize" "" 422 "The content doesn't match"
+expect_put "$URL" "$WORK/photo.png" image/png 200 "PUTs the real file"
+expect_status POST "$BASE_URL/media/intents/$UPLOAD_ID/finalize" "" 200 "Finalizes the intent"
+expect_body '.type == "photo" and .size == '"$PHOTO_SIZE" "Creates the media"
+MEDIA_ID=$(jq -r '.id' "$WORK/body")
+expect_status POST "$BASE_URL/media/intents/$UPLOAD_ID/finalize" "" 200 "Finalizing again is safe"
+expect_body '.id == "'"$MEDIA_ID"'"' "Returns the same media"
+expect_status DELETE "$BASE_URL/media/$MEDIA_ID" "" 200 "Deletes the media"
+expect_status POST "$BASE_URL/media/intents" \
+    '{"filename":"photo.png","content_type":"image/png","size":'"$PHOTO_SIZE"',"sha256":"'"$PHOTO_SHA256"'"}' 201 "Creates another intent"
+UPLOAD_ID=$(jq -r '.upload_id' "$WORK/body")
+expect_status DELETE "$BASE_URL/media/intents/$UPLOAD_ID" "" 200 "Cancels it"
+expect_status POST "$BASE_URL/media/intents/$UPLOAD_ID/finalize" "" 404 "It can't be finalized"
+echo
+
+echo -e "${YELLOW}Content checks${NC}"
+expect_upload "$WORK/fake.png" image/png 422 "A file that isn't a PNG is refused"
+expect_upload "$WORK/polyglot.png" image/png 422 "A PNG that is also a ZIP is refused"
+expect_upload "$WORK/bomb.png" image/png 422 "A PNG with huge dimensions is refused"
+expect_upload "$WORK/photo.png" image/png 200 "A real PNG is stored"
+expect_body '.type == "photo"' "As a photo"
+expect_status DELETE "$BASE_URL/media/$(jq -r '.id' "$WORK/body")" "" 200 "Deletes the media"
+echo
+
+if [ $FAILED -ne 0 ]; then
+    echo -e "${RED}Upload tests failed${NC}"
+    exit 1
+fi
+
+echo -e "${GREEN}All upload tests passed${NC}"
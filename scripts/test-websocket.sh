@@ -0,0 +1,112 @@
+#!/bin/bash
+
+# Integration test for the /ws relay protocol
+# B must be logged in on a single device, so one envelope covers all of its devices
+# Usage: TOKEN_A=... USER_A=... TOKEN_B=... USER_B=... ./scripts/test-websocket.sh
+
+# Colors
+GREEN='\033[0;32m'
+RED='\033[0;31m'
+YELLOW='\033[1;33m'
+NC='\033[0m'
+
+# WebSocket URL
+WS_URL="${WS_URL:-ws://localhost:8080/ws}"
+
+for var in TOKEN_A USER_A TOKEN_B USER_B; do
+    if [ -z "${!var}" ]; then
+        echo -e "${RED}Missing $var${NC}"
+        echo "Usage: TOKEN_A=... USER_A=... TOKEN_B=... USER_B=... $0"
+        exit 1
+    fi
+done
+
+for cmd in websocat jq; do
+    if ! command -v "$cmd" > /dev/null; then
+        echo -e "${RED}$cmd is required${NC}"
+        exit 1
+    fi
+done
+
+echo -e "${YELLOW}=== Testing WebSocket relay protocol ===${NC}\n"
+
+OUT_A=$(mktemp)
+OUT_B=$(mktemp)
+trap 'rm -f "$OUT_A" "$OUT_B"' EXIT
+
+FAILED=0
+
+# Client B: waits for A's message, then acks it and marks it read
+{
+    sleep 2
+    MESSAGE_ID=$(jq -r 'select(.type == "message") | .message_id' "$OUT_B" 2>/dev/null | head -n1)
+    echo '{"type":"ack","payload":"'"$MESSAGE_ID"'"}'
+    echo '{"type":"read","payload":"'"$MESSAGE_ID"'"}'
+    echo '{"type":"ack","payload":"unknown-message-id"}'
+    sleep 3
+} | websocat -t "$WS_URL?token=$TOKEN_B" > "$OUT_B" &
+B_PID=$!
+
+sleep 1
+
+DEVICE_B=$(jq -r 'select(.type == "connected") | .device_id' "$OUT_B" 2>/dev/null | head -n1)
+
+# Client A: exercises every client-to-server frame type
+{
+    echo '{"type":"typing","to":"'"$USER_B"'","payload":"true"}'
+    echo '{"type":"message","to":"'"$USER_B"'","envelopes":[{"device_id":"'"$DEVICE_B"'","payload":"dGVzdC1jaXBoZXJ0ZXh0"}]}'
+    echo '{"type":"message","to":"'"$USER_B"'","envelopes":[{"device_id":"unknown-device","payload":"dGVzdA=="}]}'
+    echo '{"type":"message","to":"'"$USER_B"'","payload":"dGVzdA=="}'
+    echo '{"type":"presence","payload":"away"}'
+    echo '{"type":"ping"}'
+    echo '{"type":"heartbeat"}'
+    echo '{"type":"delivery"}'
+    echo '{"type":"bogus"}'
+    echo 'not json'
+    sleep 3
+} | websocat -t "$WS_URL?token=$TOKEN_A" > "$OUT_A"
+
+wait $B_PID
+
+# Function to assert a frame was received
+expect_frame() {
+    local file=$1
+    local filter=$2
+    local description=$3
+
+    if jq -e -c "select($filter)" "$file" 2>/dev/null | grep -q .; then
+        echo -e "  ${GREEN}✓ $description${NC}"
+    else
+        echo -e "  ${RED}✗ $description${NC}"
+        FAILED=1
+    fi
+}
+
+echo -e "${YELLOW}Client A${NC}"
+expect_frame "$OUT_A" '.type == "connected"' "welcome frame"
+expect_frame "$OUT_A" '.type == "delivery" and .payload != ""' "delivery for sent message"
+expect_frame "$OUT_A" '.type == "status" and (.payload | fromjson | .status) == "away"' "presence status"
+expect_frame "$OUT_A" '.type == "pong"' "pong"
+DELIVERY_ID=$(jq -r 'select(.type == "delivery") | .message_id' "$OUT_A" 2>/dev/null | head -n1)
+expect_frame "$OUT_A" '.type == "delivered" and .message_id == "'"$DELIVERY_ID"'"' "delivered event with the same message ID"
+expect_frame "$OUT_A" '.type == "read" and .from == "'"$USER_B"'" and .message_id == "'"$DELIVERY_ID"'"' "read receipt from B"
+expect_frame "$OUT_A" '.type == "error" and (.payload | fromjson | .code) == "DEVICE_MISMATCH" and (.payload | fromjson | .devices.extra) == ["unknown-device"]' "envelope for unknown device rejected"
+expect_frame "$OUT_A" '.type == "error" and (.payload | fromjson | .code) == "MISSING_ENVELOPES"' "message without envelopes rejected"
+expect_frame "$OUT_A" '.type == "error" and (.payload | fromjson | .code) == "INVALID_TYPE"' "server-only type rejected"
+expect_frame "$OUT_A" '.type == "error" and (.payload | fromjson | .code) == "UNKNOWN_TYPE"' "unknown type rejected"
+expect_frame "$OUT_A" '.type == "error" and (.payload | fromjson | .code) == "PARSE_ERROR"' "invalid JSON rejected"
+echo
+
+echo -e "${YELLOW}Client B${NC}"
+expect_frame "$OUT_B" '.type == "connected"' "welcome frame"
+expect_frame "$OUT_B" '.type == "typing" and (.payload | fromjson | .is_typing) == true' "typing indicator from A"
+expect_frame "$OUT_B" '.type == "message" and .from == "'"$USER_A"'" and .message_id == "'"$DELIVERY_ID"'" and .payload == "dGVzdC1jaXBoZXJ0ZXh0"' "B's envelope from A with the same message ID"
+expect_frame "$OUT_B" '.type == "error" and (.payload | fromjson | .code) == "UNKNOWN_MESSAGE"' "ack for unknown message rejected"
+echo
+
+if [ $FAILED -ne 0 ]; then
+    echo -e "${RED}WebSocket tests failed${NC}"
+    exit 1
+fi
+
+echo -e "${GREEN}All WebSocket tests passed${NC}"
@@ -0,0 +1,40 @@
+// Command fakepush runs an in-memory push service for local development and
+// integration tests.
+//
+// Point the backend at it with FCM_API_URL, APNS_API_URL, or Web Push
+// subscriptions on http://<host>:4020/webpush/<id> (list the host in
+// PUSH_WEBPUSH_HOSTS), then read the wake-ups it received:
+//
+//	curl 'http://localhost:4020/notifications?token=http%3A%2F%2Fpush-gateway%3A4020%2Fwebpush%2Fabc'
+package main
+
+import (
+	"log"
+	"os"
+
+	"chat-e2ee/internal/push"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	if os.Getenv("APP_ENV") != "production" {
+		godotenv.Load()
+	}
+
+	addr := os.Getenv("FAKE_PUSH_ADDR")
+	if addr == "" {
+		addr = ":4020"
+	}
+
+	// Web Push endpoints are recorded by the URL clients registered
+	baseURL := os.Getenv("FAKE_PUSH_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost" + addr
+	}
+
+	gateway := push.NewFakeGateway(baseURL)
+
+	log.Printf("Fake push gateway listening on %s", addr)
+	log.Fatal(gateway.App().Listen(addr))
+}
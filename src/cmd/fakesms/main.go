@@ -0,0 +1,35 @@
+// Command fakesms runs an in-memory SMS gateway for local development and
+// integration tests.
+//
+// Point the backend at it with the Twilio provider (TWILIO_API_URL) or the
+// HTTP provider (SMS_HTTP_URL=http://<host>:4010/messages), then read the
+// codes it received:
+//
+//	curl 'http://localhost:4010/messages/last?to=%2B34600000000'
+package main
+
+import (
+	"log"
+	"os"
+
+	"chat-e2ee/internal/sms"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	if os.Getenv("APP_ENV") != "production" {
+		godotenv.Load()
+	}
+
+	addr := os.Getenv("FAKE_SMS_ADDR")
+	if addr == "" {
+		addr = ":4010"
+	}
+
+	// Callbacks are signed with the same tokens the backend verifies
+	gateway := sms.NewFakeGateway(os.Getenv("TWILIO_AUTH_TOKEN"), os.Getenv("SMS_HTTP_TOKEN"))
+
+	log.Printf("Fake SMS gateway listening on %s", addr)
+	log.Fatal(gateway.App().Listen(addr))
+}
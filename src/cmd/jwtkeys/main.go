@@ -0,0 +1,161 @@
+// Command jwtkeys manages the asymmetric JWT signing keys in PostgreSQL.
+//
+// A rotation without invalid tokens anywhere goes:
+//
+//	jwtkeys generate        # new pending key, published in the JWKS
+//	                        # wait for JWKS caches to expire (5 minutes)
+//	jwtkeys activate <kid>  # sign with it; the old key keeps verifying
+//	jwtkeys prune           # later, drop retired keys that expired
+//
+// rotate does generate and activate in one step, which is enough when no
+// other service caches the JWKS.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"chat-e2ee/internal/auth"
+	"chat-e2ee/internal/config"
+	"chat-e2ee/internal/database"
+
+	"github.com/joho/godotenv"
+)
+
+const usage = `Usage: jwtkeys <command> [arguments]
+
+Commands:
+  list                    List signing keys
+  generate [-alg ALG]     Create a pending key (RS256 or EdDSA)
+  activate <kid>          Sign with a pending key and retire the active one
+  rotate [-alg ALG]       Generate a key and activate it right away
+  retire [-now] <kid>     Stop verifying a key once its tokens expire,
+                          or immediately with -now
+  prune                   Delete expired retired keys
+`
+
+func main() {
+	if os.Getenv("APP_ENV") != "production" {
+		godotenv.Load()
+	}
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	cfg := config.Load()
+
+	db, err := database.NewPostgresConnection(cfg.Database)
+	if err != nil {
+		log.Fatal("Failed to connect to PostgreSQL:", err)
+	}
+	defer db.Close()
+
+	store := auth.NewKeyStore(db)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Retired keys must verify every token they signed, refresh tokens included
+	retireAfter := cfg.JWT.RefreshTokenDuration
+
+	defaultAlg := cfg.JWT.Algorithm
+	if defaultAlg == auth.AlgHS256 {
+		defaultAlg = auth.AlgRS256
+	}
+
+	command, args := os.Args[1], os.Args[2:]
+	switch command {
+	case "list":
+		err = list(ctx, store)
+
+	case "generate", "rotate":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		alg := flags.String("alg", defaultAlg, "signing algorithm: RS256 or EdDSA")
+		flags.Parse(args)
+
+		var key *auth.SigningKey
+		key, err = auth.GenerateSigningKey(*alg)
+		if err != nil {
+			break
+		}
+		if err = store.Create(ctx, key); err != nil {
+			break
+		}
+		fmt.Printf("Generated %s key %s\n", key.Algorithm, key.ID)
+
+		if command == "rotate" {
+			if err = store.Activate(ctx, key.ID, retireAfter); err != nil {
+				break
+			}
+			fmt.Printf("Activated key %s; previous key verifies for %s more\n", key.ID, retireAfter)
+		}
+
+	case "activate":
+		if len(args) != 1 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		if err = store.Activate(ctx, args[0], retireAfter); err == nil {
+			fmt.Printf("Activated key %s; previous key verifies for %s more\n", args[0], retireAfter)
+		}
+
+	case "retire":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		now := flags.Bool("now", false, "invalidate the key's tokens immediately")
+		flags.Parse(args)
+		if flags.NArg() != 1 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+
+		after := retireAfter
+		if *now {
+			after = 0
+		}
+		if err = store.Retire(ctx, flags.Arg(0), after); err == nil {
+			fmt.Printf("Retired key %s; it verifies for %s more\n", flags.Arg(0), after)
+		}
+
+	case "prune":
+		var count int64
+		if count, err = store.Prune(ctx); err == nil {
+			fmt.Printf("Deleted %d expired keys\n", count)
+		}
+
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func list(ctx context.Context, store *auth.KeyStore) error {
+	keys, err := store.List(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KID\tALG\tSTATUS\tCREATED\tEXPIRES")
+	for _, key := range keys {
+		expires := "-"
+		if key.ExpiresAt != nil {
+			expires = key.ExpiresAt.Format(time.RFC3339)
+			if key.Expired(time.Now()) {
+				expires += " (expired)"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			key.ID, key.Algorithm, key.Status, key.CreatedAt.Format(time.RFC3339), expires)
+	}
+	return w.Flush()
+}
@@ -12,9 +12,15 @@ import (
 	"chat-e2ee/internal/config"
 	"chat-e2ee/internal/database"
 	"chat-e2ee/internal/discovery"
+	"chat-e2ee/internal/email"
 	"chat-e2ee/internal/gallery"
+	"chat-e2ee/internal/groups"
+	"chat-e2ee/internal/keys"
 	"chat-e2ee/internal/media"
+	"chat-e2ee/internal/push"
+	"chat-e2ee/internal/ratelimit"
 	"chat-e2ee/internal/relay"
+	"chat-e2ee/internal/sms"
 	"chat-e2ee/internal/users"
 
 	"github.com/gofiber/fiber/v2"
@@ -62,50 +68,135 @@ func main() {
 		cfg.JWT.RefreshTokenDuration,
 	)
 
-	// SMS Provider selection
-	var smsProvider auth.SMSProvider
-	if cfg.SMS.Provider == "twilio" && cfg.SMS.AccountSID != "" {
-		smsProvider = auth.NewTwilioProvider(
-			cfg.SMS.AccountSID,
-			cfg.SMS.AuthToken,
-			cfg.SMS.FromNumber,
-		)
-		log.Println("Using Twilio SMS provider")
-	} else {
-		smsProvider = &auth.MockSMSProvider{}
-		log.Println("Using Mock SMS provider (development mode)")
+	// Asymmetric signing keys, shared by every instance through PostgreSQL
+	var keySet *auth.KeySet
+	if cfg.JWT.Algorithm != auth.AlgHS256 {
+		keyStore := auth.NewKeyStore(db)
+		created, err := keyStore.Bootstrap(context.Background(), cfg.JWT.Algorithm)
+		if err != nil {
+			log.Fatal("Failed to set up JWT signing keys:", err)
+		}
+		if created {
+			log.Printf("Created first %s JWT signing key", cfg.JWT.Algorithm)
+		}
+
+		keySet = auth.NewKeySet(keyStore)
+		if err := keySet.Refresh(context.Background()); err != nil {
+			log.Fatal("Failed to load JWT signing keys:", err)
+		}
+		signing := keySet.Signing()
+		if signing == nil {
+			log.Fatal("No active JWT signing key")
+		}
+		go keySet.Run(context.Background(), cfg.JWT.KeyRefresh)
+
+		jwtService.UseKeySet(keySet)
+		log.Printf("Signing JWTs with key %s (%s)", signing.ID, signing.Algorithm)
+	}
+
+	// SMS providers, routed per country prefix
+	smsStatuses := sms.NewStatusStore(redis)
+	smsRouter, err := sms.New(cfg.SMS, smsStatuses)
+	if err != nil {
+		log.Fatal("Failed to configure SMS providers:", err)
 	}
+	log.Printf("SMS providers: %s", smsRouter.Describe())
 
 	// Initialize stores
 	otpStore := auth.NewRedisOTPStore(redis)
-	sessionStore := auth.NewSessionStore(redis)
+	sessionStore := auth.NewSessionStore(db, redis, cfg.JWT.AccessTokenDuration)
+
+	// Access tokens of revoked sessions are rejected until they expire
+	jwtService.CheckRevocations(sessionStore)
 
 	// Initialize SMS service
-	smsService := auth.NewSMSService(smsProvider, otpStore)
+	auditLog := auth.NewAuditLog(db)
+	smsService := auth.NewSMSService(smsRouter, otpStore, auditLog, cfg.OTP)
 
-	// Initialize handlers
-	authHandler := auth.NewAuthHandler(db, jwtService, smsService, sessionStore)
+	// Email login codes and magic links
+	emailProvider, err := email.New(cfg.Email)
+	if err != nil {
+		log.Fatal("Failed to configure email provider:", err)
+	}
+	emailService := auth.NewEmailService(db, emailProvider, otpStore, auditLog, cfg.Email, cfg.OTP)
 
-	// Initialize media handler
-	mediaHandler := media.NewHandler(db, minioClient, cfg.MinIO.BucketMedia, cfg.MinIO.BucketThumbs, cfg.MinIO.BucketTemp)
+	// TOTP second factor
+	twoFactor, err := auth.NewTwoFactor(db, otpStore, auditLog, cfg.TwoFactor, cfg.OTP)
+	if err != nil {
+		log.Fatal("Failed to configure two-factor authentication:", err)
+	}
+	if !twoFactor.Available() {
+		log.Println("TOTP_ENCRYPTION_KEY not set, two-factor enrollment disabled")
+	}
 
-	// Initialize gallery handler
-	galleryHandler := gallery.NewHandler(db)
+	// Push wake-ups for devices that are offline when messages arrive
+	pushStore := push.NewStore(db)
+	pushNotifier, err := push.New(cfg.Push, pushStore)
+	if err != nil {
+		log.Fatal("Failed to configure push providers:", err)
+	}
+	go pushNotifier.Run()
+	log.Printf("Push providers: %s", pushNotifier.Describe())
 
-	// Initialize user handler
-	userHandler := users.NewHandler(db, minioClient, cfg.MinIO.BucketMedia)
+	// Group membership, which the relay checks on every group message
+	groupService := groups.NewService(db, cfg.Groups.MaxMembers)
 
-	// Initialize discovery handler
-	discoveryHandler := discovery.NewHandler(db)
+	// Contact blocks, cached in Redis and checked by the relay and discovery
+	blocks := users.NewBlocks(db, redis)
+
+	// Message requests, holding messages from non-contacts until accepted
+	messageRequests := users.NewRequests(db, redis, blocks)
+
+	// Contacts and privacy settings, deciding whose presence users may follow
+	presenceAudience := users.NewService(db)
+	presenceAudience.UseBlocks(blocks)
+	presenceAudience.UseRequests(messageRequests)
 
 	// Initialize WebSocket relay service - CRITICAL!
+	// Created before the handlers so they can notify devices through the hub
 	log.Println("Initializing WebSocket relay service...")
-	relayHandler, hub := relay.CreateRelayService(redis, jwtService)
+	relayHandler, hub := relay.CreateRelayService(db, redis, jwtService, cfg.Relay, pushNotifier, groupService, blocks, messageRequests, presenceAudience)
 	if relayHandler == nil || hub == nil {
 		log.Fatal("Failed to initialize WebSocket relay service")
 	}
 	log.Printf("WebSocket relay service initialized: handler=%v, hub=%v", relayHandler != nil, hub != nil)
 
+	// Revoked sessions lose their live connections on every node
+	sessionStore.OnRevoke(hub.Disconnect)
+
+	// Initialize keys handler, warning devices through the relay when prekeys run low
+	keysHandler := keys.NewHandler(db, hub, cfg.Keys.PrekeyLowThreshold)
+
+	// Key history, so contacts hear about identity key changes on login too
+	keyLog := keys.NewTransparency(db, hub)
+
+	// Roles and permissions, resolved per request and cached in Redis
+	authz := auth.NewAuthorizer(db, redis)
+
+	// Initialize handlers
+	pushHandler := push.NewHandler(pushStore, pushNotifier)
+	groupHandler := groups.NewHandler(groupService, hub)
+	smsHandler := sms.NewHandler(smsStatuses, cfg.SMS.AuthToken, cfg.SMS.HTTPToken, cfg.SMS.StatusCallbackURL)
+	authHandler := auth.NewAuthHandler(db, jwtService, smsService, emailService, twoFactor, sessionStore, keyLog, auditLog, authz)
+
+	// Initialize media handler, expiring abandoned uploads and temp objects
+	mediaService := media.NewService(db, minioClient, cfg.MinIO.BucketMedia, cfg.MinIO.BucketThumbs, cfg.MinIO.BucketTemp)
+	go mediaService.RunUploadJanitor(time.Hour)
+	mediaHandler := media.NewHandler(db, mediaService)
+
+	// Initialize gallery handler
+	galleryHandler := gallery.NewHandler(db, blocks)
+
+	// Initialize user handler, with preferences and privacy settings
+	userSettings := users.NewSettings(db, redis)
+	userHandler := users.NewHandler(db, minioClient, cfg.MinIO.BucketMedia, blocks, messageRequests, userSettings, hub)
+
+	// Initialize discovery handler
+	discoveryHandler := discovery.NewHandler(db, blocks, messageRequests)
+
+	// Rate limiter, shared by all instances through Redis
+	limiter := ratelimit.NewLimiter(redis, cfg.RateLimit)
+
 	// Create Fiber app
 	app := fiber.New(fiber.Config{
 		AppName:      "Chat E2EE",
@@ -115,6 +206,7 @@ func main() {
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
 		BodyLimit:    100 * 1024 * 1024, // 100MB for file uploads
+		ProxyHeader:  cfg.App.ProxyHeader,
 	})
 
 	// Middleware
@@ -126,6 +218,7 @@ func main() {
 		AllowOrigins:     cfg.App.CORSOrigins,
 		AllowMethods:     "GET,POST,PUT,DELETE,OPTIONS",
 		AllowHeaders:     "Origin,Content-Type,Accept,Authorization",
+		ExposeHeaders:    "RateLimit-Limit,RateLimit-Remaining,RateLimit-Reset,RateLimit-Policy,Retry-After",
 		AllowCredentials: true,
 		MaxAge:           3600,
 	}))
@@ -165,8 +258,9 @@ func main() {
 		})
 	})
 
-	// API routes
+	// API routes, limited per IP with the default policy
 	api := app.Group("/api/v1")
+	api.Use(auth.RateLimitMiddleware(limiter, "api", auth.ByIP))
 
 	// Public routes
 	api.Get("/", func(c *fiber.Ctx) error {
@@ -182,6 +276,8 @@ func main() {
 				"media":     "/api/v1/media/*",
 				"gallery":   "/api/v1/gallery/*",
 				"users":     "/api/v1/users/*",
+				"keys":      "/api/v1/keys/*",
+				"groups":    "/api/v1/groups/*",
 				"models":    "/api/v1/models/*",
 				"discovery": "/api/v1/models/*",
 			},
@@ -190,18 +286,45 @@ func main() {
 
 	// Auth routes (public)
 	authGroup := api.Group("/auth")
-	authGroup.Post("/request-otp", auth.RateLimitMiddleware(3), authHandler.RequestOTP)
-	authGroup.Post("/verify-otp", auth.RateLimitMiddleware(5), authHandler.VerifyOTP)
-	authGroup.Post("/refresh", authHandler.RefreshToken)
+	authGroup.Post("/request-otp", auth.RateLimitMiddleware(limiter, "request-otp", auth.ByIP, auth.ByPhone), authHandler.RequestOTP)
+	authGroup.Post("/verify-otp", auth.RateLimitMiddleware(limiter, "verify-otp", auth.ByIP, auth.ByPhone), authHandler.VerifyOTP)
+	authGroup.Post("/request-email-otp", auth.RateLimitMiddleware(limiter, "request-email-otp", auth.ByIP, auth.ByEmail), authHandler.RequestEmailOTP)
+	authGroup.Post("/verify-email-otp", auth.RateLimitMiddleware(limiter, "verify-email-otp", auth.ByIP, auth.ByEmail), authHandler.VerifyEmailOTP)
+	authGroup.Post("/verify-2fa", auth.RateLimitMiddleware(limiter, "verify-2fa", auth.ByIP), authHandler.VerifyTwoFactor)
+	authGroup.Post("/refresh", auth.RateLimitMiddleware(limiter, "refresh", auth.ByIP), authHandler.RefreshToken)
+
+	// SMS delivery-status callbacks (public, signed by the providers)
+	api.Post("/sms/status/twilio", smsHandler.TwilioStatus)
+	api.Post("/sms/status/http", smsHandler.HTTPStatus)
 
 	// ===== PROTECTED ROUTES =====
 	// Auth logout (protected)
 	api.Post("/auth/logout", auth.AuthMiddleware(jwtService), authHandler.Logout)
 
+	api.Post("/auth/logout-all", auth.AuthMiddleware(jwtService), authHandler.LogoutAll)
+
+	// Session and device management (protected)
+	api.Get("/auth/sessions", auth.AuthMiddleware(jwtService), authHandler.ListSessions)
+	api.Delete("/auth/sessions/:id", auth.AuthMiddleware(jwtService), authHandler.RevokeSession)
+	api.Get("/auth/devices", auth.AuthMiddleware(jwtService), authHandler.ListDevices)
+	api.Delete("/auth/devices/:deviceId", auth.AuthMiddleware(jwtService), authHandler.RevokeDevice)
+
+	// Login factors (protected)
+	api.Post("/auth/email", auth.AuthMiddleware(jwtService), authHandler.LinkEmail)
+	api.Post("/auth/email/verify", auth.AuthMiddleware(jwtService), authHandler.ConfirmEmail)
+	api.Delete("/auth/email", auth.AuthMiddleware(jwtService), authHandler.UnlinkEmail)
+	api.Get("/auth/2fa", auth.AuthMiddleware(jwtService), authHandler.TwoFactorStatus)
+	api.Post("/auth/2fa/totp", auth.AuthMiddleware(jwtService), authHandler.EnrollTOTP)
+	api.Post("/auth/2fa/totp/confirm", auth.AuthMiddleware(jwtService), authHandler.ConfirmTOTP)
+	api.Delete("/auth/2fa/totp", auth.AuthMiddleware(jwtService), authHandler.DisableTOTP)
+	api.Post("/auth/2fa/recovery-codes", auth.AuthMiddleware(jwtService), authHandler.RegenerateRecoveryCodes)
+
 	// User routes (protected) - MOVED BEFORE PUBLIC ROUTES
 	userGroup := api.Group("/users", auth.AuthMiddleware(jwtService))
 	userGroup.Get("/me", userHandler.GetMe)
 	userGroup.Put("/me", userHandler.UpdateMe)
+	userGroup.Get("/settings", userHandler.GetSettings)
+	userGroup.Put("/settings", userHandler.UpdateSettings)
 	userGroup.Post("/avatar", userHandler.UpdateAvatar)
 	userGroup.Get("/contacts", userHandler.GetContacts)
 	userGroup.Post("/contacts", userHandler.AddContact)
@@ -209,10 +332,53 @@ func main() {
 	userGroup.Delete("/contacts/:id", userHandler.RemoveContact)
 	userGroup.Post("/contacts/:id/block", userHandler.BlockContact)
 	userGroup.Post("/contacts/:id/unblock", userHandler.UnblockContact)
+	userGroup.Get("/requests", userHandler.ListRequests)
+	userGroup.Get("/requests/sent", userHandler.ListSentRequests)
+	userGroup.Put("/requests/settings", userHandler.UpdateRequestSettings)
+	userGroup.Post("/requests/:id/accept", userHandler.AcceptRequest)
+	userGroup.Post("/requests/:id/decline", userHandler.DeclineRequest)
+	userGroup.Post("/requests/:id/block", userHandler.BlockRequest)
+	userGroup.Get("/:id/devices", userHandler.GetUserDevices)
+
+	// E2EE key routes (protected)
+	keysGroup := api.Group("/keys", auth.AuthMiddleware(jwtService))
+	keysGroup.Put("/", keysHandler.UploadKeys)
+	keysGroup.Post("/prekeys", keysHandler.UploadPrekeys)
+	keysGroup.Put("/signed-prekey", keysHandler.RotateSignedPrekey)
+	keysGroup.Get("/count", keysHandler.GetPrekeyCount)
+	// Each claim uses up one-time prekeys of every device of the target
+	keysGroup.Get("/:userId", auth.RateLimitMiddleware(limiter, "claim-keys", auth.ByUserAndParam("userId")), keysHandler.ClaimBundles)
+	keysGroup.Get("/:userId/history", keysHandler.GetKeyHistory)
+	keysGroup.Get("/:userId/safety-number", keysHandler.GetSafetyNumber)
+
+	// Push notification routes (protected); tokens belong to the calling device
+	pushGroup := api.Group("/push", auth.AuthMiddleware(jwtService))
+	pushGroup.Put("/token", pushHandler.RegisterToken)
+	pushGroup.Delete("/token", pushHandler.RemoveToken)
+	pushGroup.Get("/vapid-key", pushHandler.GetVAPIDKey)
+	pushGroup.Get("/settings", pushHandler.GetSettings)
+	pushGroup.Put("/settings", pushHandler.UpdateSettings)
+	pushGroup.Put("/mutes/:userId", pushHandler.MuteUser)
+	pushGroup.Delete("/mutes/:userId", pushHandler.UnmuteUser)
+
+	// Group chat routes (protected); membership events go out through the hub
+	groupGroup := api.Group("/groups", auth.AuthMiddleware(jwtService))
+	groupGroup.Post("/", groupHandler.CreateGroup)
+	groupGroup.Get("/", groupHandler.ListGroups)
+	groupGroup.Get("/invites", groupHandler.ListInvites)
+	groupGroup.Get("/:id", groupHandler.GetGroup)
+	groupGroup.Put("/:id", groupHandler.UpdateGroup)
+	groupGroup.Delete("/:id", groupHandler.DeleteGroup)
+	groupGroup.Post("/:id/invites", groupHandler.InviteMember)
+	groupGroup.Delete("/:id/invites/:userId", groupHandler.RevokeInvite)
+	groupGroup.Post("/:id/join", groupHandler.JoinGroup)
+	groupGroup.Post("/:id/leave", groupHandler.LeaveGroup)
+	groupGroup.Delete("/:id/members/:userId", groupHandler.RemoveMember)
+	groupGroup.Put("/:id/members/:userId/role", groupHandler.SetMemberRole)
 
 	// Public user routes - NOW AFTER PROTECTED ROUTES
 	publicUsers := api.Group("/users")
-	publicUsers.Get("/:id", userHandler.GetUser)
+	publicUsers.Get("/:id", auth.OptionalAuthMiddleware(jwtService), userHandler.GetUser)
 
 	// Public gallery routes - Registrar directamente sin grupo
 	api.Get("/gallery/discover", auth.OptionalAuthMiddleware(jwtService), galleryHandler.DiscoverGalleries)
@@ -221,9 +387,9 @@ func main() {
 	galleryGroup := api.Group("/gallery", auth.AuthMiddleware(jwtService))
 	galleryGroup.Get("/", galleryHandler.GetMyGallery)
 	galleryGroup.Get("/stats", galleryHandler.GetGalleryStats) // MOVED BEFORE publicGallery routes
-	galleryGroup.Post("/media", mediaHandler.AddToGallery)
-	galleryGroup.Delete("/media/:id", mediaHandler.RemoveFromGallery)
-	galleryGroup.Put("/settings", galleryHandler.UpdateGallerySettings)
+	galleryGroup.Post("/media", auth.Authorize(authz), mediaHandler.AddToGallery)
+	galleryGroup.Delete("/media/:id", auth.Authorize(authz), mediaHandler.RemoveFromGallery)
+	galleryGroup.Put("/settings", auth.Authorize(authz), galleryHandler.UpdateGallerySettings)
 
 	api.Get("/gallery/:userId", auth.OptionalAuthMiddleware(jwtService), galleryHandler.GetUserGallery)
 	// Models discovery routes (public with optional auth)
@@ -237,7 +403,15 @@ func main() {
 
 	// Media routes (protected)
 	mediaGroup := api.Group("/media", auth.AuthMiddleware(jwtService))
-	mediaGroup.Post("/upload", mediaHandler.Upload)
+	mediaGroup.Post("/upload", auth.RateLimitMiddleware(limiter, "upload", auth.ByUser), mediaHandler.Upload)
+	mediaGroup.Post("/uploads", auth.RateLimitMiddleware(limiter, "upload", auth.ByUser), mediaHandler.CreateUpload)
+	mediaGroup.Get("/uploads/:id", mediaHandler.GetUpload)
+	mediaGroup.Put("/uploads/:id/parts/:part", mediaHandler.UploadPart)
+	mediaGroup.Post("/uploads/:id/complete", mediaHandler.CompleteUpload)
+	mediaGroup.Delete("/uploads/:id", mediaHandler.AbortUpload)
+	mediaGroup.Post("/intents", auth.RateLimitMiddleware(limiter, "upload", auth.ByUser), mediaHandler.CreateIntent)
+	mediaGroup.Post("/intents/:id/finalize", mediaHandler.CompleteUpload)
+	mediaGroup.Delete("/intents/:id", mediaHandler.AbortUpload)
 	mediaGroup.Get("/:id", mediaHandler.GetFile)
 	mediaGroup.Delete("/:id", mediaHandler.DeleteFile)
 	mediaGroup.Get("/thumbnail/:name", func(c *fiber.Ctx) error {
@@ -262,7 +436,13 @@ func main() {
 	log.Println("Registering WebSocket routes...")
 
 	// WebSocket stats endpoint (protected)
-	api.Get("/ws/stats", auth.AuthMiddleware(jwtService), relayHandler.GetStats())
+	api.Get("/ws/stats", auth.AuthMiddleware(jwtService), auth.Authorize(authz), relayHandler.GetStats())
+
+	// Admin routes: admins only, each route also needs its permission
+	adminGroup := api.Group("/admin", auth.AuthMiddleware(jwtService), auth.RequireRole(authz, auth.RoleAdmin))
+	adminGroup.Get("/users/:id/role", auth.Authorize(authz), authHandler.GetUserRole)
+	adminGroup.Put("/users/:id/role", auth.Authorize(authz), authHandler.SetUserRole)
+	adminGroup.Get("/presence/online", auth.Authorize(authz), relayHandler.ListOnlineUsers())
 
 	// Test WebSocket endpoint (sin autenticación)
 	app.Get("/test-ws", websocket.New(func(c *websocket.Conn) {
@@ -281,6 +461,9 @@ func main() {
 	log.Println("✅ Registered /test-ws endpoint")
 	log.Println("✅ Registered /api/v1/ws/stats")
 
+	// Public keys for services that verify our tokens
+	app.Get("/.well-known/jwks.json", auth.JWKSHandler(keySet))
+
 	// WebSocket route - MUST BE BEFORE app.Listen()!
 	app.Use("/ws", relayHandler.UpgradeHandler())
 	app.Get("/ws", relayHandler.WebSocketHandler())
@@ -292,22 +475,88 @@ func main() {
 			"message": "Phase 5 API Routes completed!",
 			"endpoints": fiber.Map{
 				"auth": fiber.Map{
-					"request-otp": "POST /api/v1/auth/request-otp",
-					"verify-otp":  "POST /api/v1/auth/verify-otp",
-					"refresh":     "POST /api/v1/auth/refresh",
-					"logout":      "POST /api/v1/auth/logout",
+					"request-otp":    "POST /api/v1/auth/request-otp",
+					"verify-otp":     "POST /api/v1/auth/verify-otp",
+					"refresh":        "POST /api/v1/auth/refresh",
+					"logout":         "POST /api/v1/auth/logout",
+					"logout-all":     "POST /api/v1/auth/logout-all",
+					"sessions":       "GET /api/v1/auth/sessions",
+					"revoke":         "DELETE /api/v1/auth/sessions/:id",
+					"devices":        "GET /api/v1/auth/devices",
+					"remove":         "DELETE /api/v1/auth/devices/:deviceId",
+					"email-otp":      "POST /api/v1/auth/request-email-otp",
+					"verify-email":   "POST /api/v1/auth/verify-email-otp",
+					"verify-2fa":     "POST /api/v1/auth/verify-2fa",
+					"link-email":     "POST /api/v1/auth/email",
+					"confirm-email":  "POST /api/v1/auth/email/verify",
+					"unlink-email":   "DELETE /api/v1/auth/email",
+					"2fa-status":     "GET /api/v1/auth/2fa",
+					"enroll-totp":    "POST /api/v1/auth/2fa/totp",
+					"confirm-totp":   "POST /api/v1/auth/2fa/totp/confirm",
+					"disable-totp":   "DELETE /api/v1/auth/2fa/totp",
+					"recovery-codes": "POST /api/v1/auth/2fa/recovery-codes",
+				},
+				"sms": fiber.Map{
+					"twilio-status": "POST /api/v1/sms/status/twilio",
+					"http-status":   "POST /api/v1/sms/status/http",
+				},
+				"admin": fiber.Map{
+					"role":         "GET /api/v1/admin/users/:id/role",
+					"set-role":     "PUT /api/v1/admin/users/:id/role",
+					"online-users": "GET /api/v1/admin/presence/online",
 				},
 				"users": fiber.Map{
-					"profile":        "GET /api/v1/users/me",
-					"update":         "PUT /api/v1/users/me",
-					"avatar":         "POST /api/v1/users/avatar",
-					"contacts":       "GET /api/v1/users/contacts",
-					"add-contact":    "POST /api/v1/users/contacts",
-					"update-contact": "PUT /api/v1/users/contacts/:id",
-					"remove-contact": "DELETE /api/v1/users/contacts/:id",
-					"block":          "POST /api/v1/users/contacts/:id/block",
-					"unblock":        "POST /api/v1/users/contacts/:id/unblock",
-					"public-profile": "GET /api/v1/users/:id",
+					"profile":         "GET /api/v1/users/me",
+					"update":          "PUT /api/v1/users/me",
+					"settings":        "GET /api/v1/users/settings",
+					"update-settings": "PUT /api/v1/users/settings",
+					"avatar":          "POST /api/v1/users/avatar",
+					"contacts":        "GET /api/v1/users/contacts",
+					"add-contact":     "POST /api/v1/users/contacts",
+					"update-contact":  "PUT /api/v1/users/contacts/:id",
+					"remove-contact":  "DELETE /api/v1/users/contacts/:id",
+					"block":           "POST /api/v1/users/contacts/:id/block",
+					"unblock":         "POST /api/v1/users/contacts/:id/unblock",
+					"requests":        "GET /api/v1/users/requests",
+					"sent-requests":   "GET /api/v1/users/requests/sent",
+					"request-setting": "PUT /api/v1/users/requests/settings",
+					"accept-request":  "POST /api/v1/users/requests/:id/accept",
+					"decline-request": "POST /api/v1/users/requests/:id/decline",
+					"block-request":   "POST /api/v1/users/requests/:id/block",
+					"public-profile":  "GET /api/v1/users/:id",
+					"devices":         "GET /api/v1/users/:id/devices",
+				},
+				"keys": fiber.Map{
+					"upload":        "PUT /api/v1/keys",
+					"prekeys":       "POST /api/v1/keys/prekeys",
+					"signed-prekey": "PUT /api/v1/keys/signed-prekey",
+					"count":         "GET /api/v1/keys/count",
+					"bundles":       "GET /api/v1/keys/:userId",
+					"history":       "GET /api/v1/keys/:userId/history",
+					"safety-number": "GET /api/v1/keys/:userId/safety-number",
+				},
+				"push": fiber.Map{
+					"register-token":  "PUT /api/v1/push/token",
+					"remove-token":    "DELETE /api/v1/push/token",
+					"vapid-key":       "GET /api/v1/push/vapid-key",
+					"settings":        "GET /api/v1/push/settings",
+					"update-settings": "PUT /api/v1/push/settings",
+					"mute":            "PUT /api/v1/push/mutes/:userId",
+					"unmute":          "DELETE /api/v1/push/mutes/:userId",
+				},
+				"groups": fiber.Map{
+					"create":        "POST /api/v1/groups",
+					"list":          "GET /api/v1/groups",
+					"invites":       "GET /api/v1/groups/invites",
+					"get":           "GET /api/v1/groups/:id",
+					"update":        "PUT /api/v1/groups/:id",
+					"delete":        "DELETE /api/v1/groups/:id",
+					"invite":        "POST /api/v1/groups/:id/invites",
+					"revoke-invite": "DELETE /api/v1/groups/:id/invites/:userId",
+					"join":          "POST /api/v1/groups/:id/join",
+					"leave":         "POST /api/v1/groups/:id/leave",
+					"remove-member": "DELETE /api/v1/groups/:id/members/:userId",
+					"set-role":      "PUT /api/v1/groups/:id/members/:userId/role",
 				},
 				"models": fiber.Map{
 					"list":    "GET /api/v1/models",
@@ -319,6 +568,8 @@ func main() {
 				},
 				"media": fiber.Map{
 					"upload":    "POST /api/v1/media/upload",
+					"resumable": "POST /api/v1/media/uploads",
+					"direct":    "POST /api/v1/media/intents",
 					"get":       "GET /api/v1/media/:id",
 					"delete":    "DELETE /api/v1/media/:id",
 					"thumbnail": "GET /api/v1/media/thumbnail/:name",
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// User roles, as in the user_role enum
+const (
+	RoleUser  = "user"
+	RoleModel = "model"
+	RoleAdmin = "admin"
+)
+
+// Permission is an action a role may be granted in role_permissions
+type Permission string
+
+const (
+	PermGalleryWrite Permission = "gallery:write" // Manage one's own gallery
+	PermStatsRead    Permission = "stats:read"    // Read server statistics
+	PermUsersManage  Permission = "users:manage"  // Change other users' roles
+)
+
+// RoutePolicies is the policy table used by Authorize: the permission each
+// route requires, keyed by method and registered path
+var RoutePolicies = map[string]Permission{
+	"POST /api/v1/gallery/media":        PermGalleryWrite,
+	"DELETE /api/v1/gallery/media/:id":  PermGalleryWrite,
+	"PUT /api/v1/gallery/settings":      PermGalleryWrite,
+	"GET /api/v1/ws/stats":              PermStatsRead,
+	"GET /api/v1/admin/presence/online": PermStatsRead,
+	"GET /api/v1/admin/users/:id/role":  PermUsersManage,
+	"PUT /api/v1/admin/users/:id/role":  PermUsersManage,
+}
+
+// How long a user's resolved role and permissions stay cached. Changes made
+// through SetRole apply at once; direct database edits within this time.
+const authzCacheTTL = 10 * time.Minute
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrInvalidRole  = errors.New("invalid role")
+)
+
+// Grants is a user's role and the permissions it carries
+type Grants struct {
+	Role        string
+	Permissions map[Permission]bool
+}
+
+// Has reports whether the grants include a permission
+func (g *Grants) Has(permission Permission) bool {
+	return g.Permissions[permission]
+}
+
+// Authorizer resolves roles and permissions from the database, caching
+// them per user in Redis
+type Authorizer struct {
+	db    *sql.DB
+	redis *redis.Client
+}
+
+func NewAuthorizer(db *sql.DB, redisClient *redis.Client) *Authorizer {
+	return &Authorizer{
+		db:    db,
+		redis: redisClient,
+	}
+}
+
+func authzKey(userID string) string {
+	return fmt.Sprintf("authz:%s", userID)
+}
+
+// Grants returns the current role and permissions of a user
+func (a *Authorizer) Grants(ctx context.Context, userID string) (*Grants, error) {
+	cached, err := a.redis.HGetAll(ctx, authzKey(userID)).Result()
+	if err == nil && cached["role"] != "" {
+		return newGrants(cached["role"], strings.Split(cached["permissions"], ",")), nil
+	}
+
+	var role string
+	var permissions []string
+	err = a.db.QueryRowContext(ctx,
+		`SELECT u.role, COALESCE(array_agg(rp.permission) FILTER (WHERE rp.permission IS NOT NULL), '{}')
+		FROM users u
+		LEFT JOIN role_permissions rp ON rp.role = u.role
+		WHERE u.id = $1 AND u.deleted_at IS NULL
+		GROUP BY u.role`,
+		userID,
+	).Scan(&role, pq.Array(&permissions))
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := a.redis.TxPipeline()
+	pipe.HSet(ctx, authzKey(userID), "role", role, "permissions", strings.Join(permissions, ","))
+	pipe.Expire(ctx, authzKey(userID), authzCacheTTL)
+	pipe.Exec(ctx)
+
+	return newGrants(role, permissions), nil
+}
+
+// Role returns the current role of a user
+func (a *Authorizer) Role(ctx context.Context, userID string) (string, error) {
+	grants, err := a.Grants(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	return grants.Role, nil
+}
+
+// SetRole changes a user's role, effective on their next request
+func (a *Authorizer) SetRole(ctx context.Context, userID, role string) error {
+	switch role {
+	case RoleUser, RoleModel, RoleAdmin:
+	default:
+		return ErrInvalidRole
+	}
+
+	result, err := a.db.ExecContext(ctx,
+		"UPDATE users SET role = $2, updated_at = NOW() WHERE id = $1 AND deleted_at IS NULL",
+		userID, role,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+
+	return a.Invalidate(ctx, userID)
+}
+
+// Invalidate drops a user's cached grants
+func (a *Authorizer) Invalidate(ctx context.Context, userID string) error {
+	return a.redis.Del(ctx, authzKey(userID)).Err()
+}
+
+func newGrants(role string, permissions []string) *Grants {
+	grants := &Grants{
+		Role:        role,
+		Permissions: make(map[Permission]bool, len(permissions)),
+	}
+	for _, permission := range permissions {
+		if permission != "" {
+			grants.Permissions[Permission(permission)] = true
+		}
+	}
+	return grants
+}
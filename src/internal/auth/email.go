@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"net/url"
+	"strings"
+
+	"chat-e2ee/internal/config"
+
+	"github.com/lib/pq"
+)
+
+// EmailProvider interface allows for different email providers (see the
+// email package)
+type EmailProvider interface {
+	SendEmail(ctx context.Context, to, subject, body string) error
+}
+
+var (
+	ErrInvalidEmail     = errors.New("invalid email address")
+	ErrEmailTaken       = errors.New("email already linked to another account")
+	ErrEmailNotLinked   = errors.New("no email linked to this account")
+	ErrMagicLinkInvalid = errors.New("magic link invalid or expired")
+)
+
+// EmailService logs users in with codes and magic links sent to the email
+// linked to their account. Accounts are still created by phone number; an
+// email has to be linked and verified before it can be used to log in.
+type EmailService struct {
+	db           *sql.DB
+	provider     EmailProvider
+	store        OTPStore
+	audit        *AuditLog
+	codes        *otpCodes
+	magicLinkURL string
+}
+
+// NewEmailService creates the email login service. Codes share the phone
+// OTP limits in otpCfg, and stay valid for cfg.CodeExpiry.
+func NewEmailService(db *sql.DB, provider EmailProvider, store OTPStore, audit *AuditLog, cfg config.EmailConfig, otpCfg config.OTPConfig) *EmailService {
+	return &EmailService{
+		db:           db,
+		provider:     provider,
+		store:        store,
+		audit:        audit,
+		codes:        newOTPCodes(store, audit, otpCfg, cfg.CodeExpiry),
+		magicLinkURL: cfg.MagicLinkURL,
+	}
+}
+
+// NormalizeEmail validates a bare address and returns it in lower case
+func NormalizeEmail(address string) (string, error) {
+	address = strings.TrimSpace(address)
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Address != address || len(address) > 255 {
+		return "", ErrInvalidEmail
+	}
+	return strings.ToLower(address), nil
+}
+
+// SendLoginCode emails a login code, and a magic link if configured, to the
+// account with this verified email. Unknown addresses get nothing and no
+// error, so the endpoint doesn't reveal which addresses have accounts.
+func (s *EmailService) SendLoginCode(ctx context.Context, email, ip string) error {
+	if _, err := s.userByEmail(ctx, email); err != nil {
+		if err == ErrUserNotFound {
+			return nil
+		}
+		return err
+	}
+
+	subject := emailSubject(email)
+	code, err := s.codes.issue(ctx, subject, ip)
+	if err != nil {
+		return err
+	}
+
+	minutes := int(s.codes.expiry.Minutes())
+	body := fmt.Sprintf("Your Chat E2EE login code is: %s\nValid for %d minutes.\n", code, minutes)
+
+	if s.magicLinkURL != "" {
+		token, err := s.issueMagicLink(ctx, email)
+		if err != nil {
+			s.codes.discard(ctx, subject)
+			return err
+		}
+		body += fmt.Sprintf("\nOr open this link on the device you are logging in on:\n%s\n", s.magicLink(token))
+	}
+	body += "\nIf you didn't try to log in, you can ignore this email.\n"
+
+	if err := s.provider.SendEmail(ctx, email, "Your Chat E2EE login code", body); err != nil {
+		s.codes.discard(ctx, subject)
+		s.discardMagicLink(ctx, email)
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	return nil
+}
+
+// VerifyLoginCode checks an email login code and returns the account it
+// logs in to. Errors are those of SMSService.VerifyOTP.
+func (s *EmailService) VerifyLoginCode(ctx context.Context, email, code, ip string) (string, error) {
+	if err := s.codes.verify(ctx, emailSubject(email), code, ip); err != nil {
+		return "", err
+	}
+	// The magic link sent along with the code is spent too
+	s.discardMagicLink(ctx, email)
+
+	return s.userByEmail(ctx, email)
+}
+
+// VerifyMagicLink spends a magic link token and returns the email it was
+// sent to and the account it logs in to
+func (s *EmailService) VerifyMagicLink(ctx context.Context, token, ip string) (string, string, error) {
+	email, err := s.store.TakeOTP(ctx, magicLinkKey(token))
+	if err != nil {
+		return "", "", ErrMagicLinkInvalid
+	}
+
+	// A locked out address can't log in through its links either
+	subject := emailSubject(email)
+	if err := s.codes.checkLockout(ctx, subject, ip); err != nil {
+		return "", "", err
+	}
+	// The code sent along with the link is spent too
+	s.codes.succeeded(ctx, subject)
+	_ = s.store.DeleteOTP(ctx, "magic-for:"+email)
+
+	userID, err := s.userByEmail(ctx, email)
+	if err != nil {
+		return "", "", err
+	}
+
+	s.audit.Record(ctx, subject.event(AuditMagicLinkUsed, ip, map[string]interface{}{
+		"user_id": userID,
+	}))
+
+	return email, userID, nil
+}
+
+// StartLink sends a verification code to an email a user wants to link to
+// their account
+func (s *EmailService) StartLink(ctx context.Context, userID, email, ip string) error {
+	var taken bool
+	err := s.db.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM users WHERE email = $1 AND id <> $2 AND deleted_at IS NULL)",
+		email, userID,
+	).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrEmailTaken
+	}
+
+	subject := linkSubject(userID, email)
+	code, err := s.codes.issue(ctx, subject, ip)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Your Chat E2EE email verification code is: %s\nValid for %d minutes.\n\n"+
+		"If you didn't add this email to a Chat E2EE account, you can ignore this email.\n",
+		code, int(s.codes.expiry.Minutes()))
+	if err := s.provider.SendEmail(ctx, email, "Verify your email for Chat E2EE", body); err != nil {
+		s.codes.discard(ctx, subject)
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	return nil
+}
+
+// ConfirmLink checks the verification code and links the email to the
+// user's account, replacing any email linked before
+func (s *EmailService) ConfirmLink(ctx context.Context, userID, email, code, ip string) error {
+	if err := s.codes.verify(ctx, linkSubject(userID, email), code, ip); err != nil {
+		return err
+	}
+
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE users SET email = $2, email_verified_at = NOW(), updated_at = NOW() WHERE id = $1 AND deleted_at IS NULL",
+		userID, email,
+	)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrEmailTaken
+	}
+	if err != nil {
+		return err
+	}
+
+	s.audit.Record(ctx, emailSubject(email).event(AuditEmailLinked, ip, map[string]interface{}{
+		"user_id": userID,
+	}))
+	return nil
+}
+
+// Unlink removes the email from a user's account
+func (s *EmailService) Unlink(ctx context.Context, userID string) error {
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE users SET email = NULL, email_verified_at = NULL, updated_at = NOW() WHERE id = $1 AND email IS NOT NULL",
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrEmailNotLinked
+	}
+	return nil
+}
+
+// userByEmail returns the account with a verified email
+func (s *EmailService) userByEmail(ctx context.Context, email string) (string, error) {
+	var userID string
+	err := s.db.QueryRowContext(ctx,
+		"SELECT id FROM users WHERE email = $1 AND email_verified_at IS NOT NULL AND deleted_at IS NULL",
+		email,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	return userID, err
+}
+
+// issueMagicLink stores a new single-use token for the email, replacing the
+// previous one. Only its hash is kept.
+func (s *EmailService) issueMagicLink(ctx context.Context, email string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	s.discardMagicLink(ctx, email)
+	if err := s.store.SetOTP(ctx, magicLinkKey(token), email, s.codes.expiry); err != nil {
+		return "", fmt.Errorf("failed to store magic link: %w", err)
+	}
+	if err := s.store.SetOTP(ctx, "magic-for:"+email, magicLinkKey(token), s.codes.expiry); err != nil {
+		log.Printf("Failed to index magic link for %s: %v", email, err)
+	}
+
+	return token, nil
+}
+
+// discardMagicLink invalidates the email's outstanding magic link
+func (s *EmailService) discardMagicLink(ctx context.Context, email string) {
+	key, err := s.store.TakeOTP(ctx, "magic-for:"+email)
+	if err == nil {
+		_ = s.store.DeleteOTP(ctx, key)
+	}
+}
+
+func (s *EmailService) magicLink(token string) string {
+	separator := "?"
+	if strings.Contains(s.magicLinkURL, "?") {
+		separator = "&"
+	}
+	return s.magicLinkURL + separator + "token=" + url.QueryEscape(token)
+}
+
+func magicLinkKey(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return "magic:" + hex.EncodeToString(hash[:])
+}
+
+// linkSubject keeps the codes for linking an email apart from login codes
+func linkSubject(userID, email string) otpSubject {
+	return otpSubject{key: "email-link:" + userID + ":" + email, email: email}
+}
@@ -3,28 +3,47 @@ package auth
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"log"
+	"math"
 	"regexp"
+	"sort"
+	"strconv"
 	"time"
 
+	"chat-e2ee/internal/keys"
+
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 )
 
+// ErrDeviceTaken is returned when a device ID is already registered to another user
+var ErrDeviceTaken = errors.New("device registered to another user")
+
 // AuthHandler handles authentication endpoints
 type AuthHandler struct {
 	db           *sql.DB
 	jwtService   *JWTService
 	smsService   *SMSService
+	emailService *EmailService
+	twoFactor    *TwoFactor
 	sessionStore *SessionStore
+	keyLog       *keys.Transparency
+	audit        *AuditLog
+	authz        *Authorizer
 }
 
-func NewAuthHandler(db *sql.DB, jwtService *JWTService, smsService *SMSService, sessionStore *SessionStore) *AuthHandler {
+func NewAuthHandler(db *sql.DB, jwtService *JWTService, smsService *SMSService, emailService *EmailService, twoFactor *TwoFactor, sessionStore *SessionStore, keyLog *keys.Transparency, audit *AuditLog, authz *Authorizer) *AuthHandler {
 	return &AuthHandler{
 		db:           db,
 		jwtService:   jwtService,
 		smsService:   smsService,
+		emailService: emailService,
+		twoFactor:    twoFactor,
 		sessionStore: sessionStore,
+		keyLog:       keyLog,
+		audit:        audit,
+		authz:        authz,
 	}
 }
 
@@ -48,11 +67,20 @@ func (h *AuthHandler) RequestOTP(c *fiber.Ctx) error {
 		})
 	}
 
-	// Send OTP
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// Send OTP, with room for the provider to retry
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	if err := h.smsService.SendOTP(ctx, req.PhoneNumber); err != nil {
+	if err := h.smsService.SendOTP(ctx, req.PhoneNumber, c.IP()); err != nil {
+		var locked *LockedError
+		if errors.As(err, &locked) {
+			return lockedResponse(c, locked)
+		}
+		if err == ErrTooManyOTPRequests {
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
 		log.Printf("Failed to send OTP to %s: %v", req.PhoneNumber, err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to send OTP",
@@ -73,6 +101,7 @@ func (h *AuthHandler) VerifyOTP(c *fiber.Ctx) error {
 		DeviceID    string `json:"device_id" validate:"required"`
 		DeviceName  string `json:"device_name"`
 		PublicKey   string `json:"public_key" validate:"required"` // For E2EE
+		TOTPCode    string `json:"totp_code"`                      // Second factor, if enabled
 	}
 
 	if err := c.BodyParser(&req); err != nil {
@@ -85,10 +114,8 @@ func (h *AuthHandler) VerifyOTP(c *fiber.Ctx) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if err := h.smsService.VerifyOTP(ctx, req.PhoneNumber, req.OTP); err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+	if err := h.smsService.VerifyOTP(ctx, req.PhoneNumber, req.OTP, c.IP()); err != nil {
+		return verifyOTPError(c, err, req.PhoneNumber)
 	}
 
 	// Get or create user
@@ -100,16 +127,95 @@ func (h *AuthHandler) VerifyOTP(c *fiber.Ctx) error {
 		})
 	}
 
+	return h.completeLogin(ctx, c, &LoginChallenge{
+		UserID:     userID,
+		IsNewUser:  isNewUser,
+		DeviceID:   req.DeviceID,
+		DeviceName: req.DeviceName,
+		PublicKey:  req.PublicKey,
+	}, req.TOTPCode)
+}
+
+// completeLogin finishes a login whose first factor passed. Users with a
+// second factor must send a TOTP or recovery code; without one they get a
+// challenge token to send it to /auth/verify-2fa.
+func (h *AuthHandler) completeLogin(ctx context.Context, c *fiber.Ctx, login *LoginChallenge, totpCode string) error {
+	enabled, err := h.twoFactor.Enabled(ctx, login.UserID)
+	if err != nil {
+		log.Printf("Failed to check second factor of %s: %v", login.UserID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to process user",
+		})
+	}
+
+	if enabled {
+		if totpCode == "" {
+			token, err := h.twoFactor.NewChallenge(ctx, login)
+			if err != nil {
+				log.Printf("Failed to create second factor challenge: %v", err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "Failed to process user",
+				})
+			}
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error":     "Two-factor code required",
+				"code":      "TOTP_REQUIRED",
+				"mfa_token": token,
+			})
+		}
+
+		if err := h.twoFactor.Verify(ctx, login.UserID, totpCode, c.IP()); err != nil {
+			return twoFactorError(c, err)
+		}
+	}
+
+	return h.issueTokens(ctx, c, login)
+}
+
+// issueTokens registers the login's device and starts its session
+func (h *AuthHandler) issueTokens(ctx context.Context, c *fiber.Ctx, login *LoginChallenge) error {
+	userID := login.UserID
+
 	// Register device
-	if err := h.registerDevice(ctx, userID, req.DeviceID, req.DeviceName, req.PublicKey); err != nil {
+	if err := h.registerDevice(ctx, userID, login.DeviceID, login.DeviceName, login.PublicKey); err != nil {
+		if err == ErrDeviceTaken {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Device is registered to another account",
+			})
+		}
 		log.Printf("Failed to register device: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to register device",
 		})
 	}
 
+	// A new public key changes the device's identity, so contacts are told
+	if h.keyLog != nil {
+		if err := h.keyLog.RecordIdentityKey(ctx, userID, login.DeviceID); err != nil {
+			log.Printf("Failed to record identity key for device %s: %v", login.DeviceID, err)
+		}
+	}
+
+	// Each login starts a new session, the family of its refresh tokens
+	session := &Session{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		DeviceID:  login.DeviceID,
+		ExpiresAt: time.Now().Add(h.jwtService.RefreshTokenDuration()),
+		IPAddress: c.IP(),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+	}
+
+	role, err := h.authz.Role(ctx, userID)
+	if err != nil {
+		log.Printf("Failed to resolve role of %s: %v", userID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to process user",
+		})
+	}
+
 	// Generate JWT tokens
-	accessToken, refreshToken, err := h.jwtService.GenerateTokenPair(userID, req.DeviceID)
+	accessToken, refreshToken, err := h.jwtService.GenerateTokenPair(userID, login.DeviceID, session.ID, role)
 	if err != nil {
 		log.Printf("Failed to generate tokens: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -117,23 +223,24 @@ func (h *AuthHandler) VerifyOTP(c *fiber.Ctx) error {
 		})
 	}
 
-	// Store session
-	sessionData := map[string]string{
-		"user_id":   userID,
-		"device_id": req.DeviceID,
-		"phone":     req.PhoneNumber,
+	if err := h.sessionStore.CreateSession(ctx, session, accessToken, refreshToken); err != nil {
+		log.Printf("Failed to store session: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create session",
+		})
 	}
-	h.sessionStore.StoreSession(ctx, refreshToken, sessionData, 7*24*time.Hour)
 
 	return c.JSON(fiber.Map{
 		"access_token":  accessToken,
 		"refresh_token": refreshToken,
 		"user_id":       userID,
-		"is_new_user":   isNewUser,
+		"is_new_user":   login.IsNewUser,
 	})
 }
 
-// RefreshToken handles token refresh
+// RefreshToken rotates the refresh token: the response carries a new access
+// token and a new refresh token, and the old refresh token stops working.
+// Presenting an already rotated refresh token revokes the whole session.
 func (h *AuthHandler) RefreshToken(c *fiber.Ctx) error {
 	var req struct {
 		RefreshToken string `json:"refresh_token" validate:"required"`
@@ -159,36 +266,221 @@ func (h *AuthHandler) RefreshToken(c *fiber.Ctx) error {
 		})
 	}
 
-	// Check if session exists
-	ctx := context.Background()
-	session, err := h.sessionStore.GetSession(ctx, req.RefreshToken)
-	if err != nil || len(session) == 0 {
+	// Tokens issued before sessions were tracked have no session to rotate
+	if claims.SessionID == "" {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "Session not found",
 		})
 	}
 
-	// Generate new access token
-	accessToken, err := h.jwtService.RefreshAccessToken(req.RefreshToken)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// New tokens carry the user's current role, not the one they logged in with
+	role, err := h.authz.Role(ctx, claims.UserID)
+	if err == ErrUserNotFound {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if err != nil {
+		log.Printf("Failed to resolve role of %s: %v", claims.UserID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to refresh token",
+		})
+	}
+
+	accessToken, refreshToken, err := h.jwtService.GenerateTokenPair(claims.UserID, claims.DeviceID, claims.SessionID, role)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to refresh token",
 		})
 	}
 
-	// Extend session
-	h.sessionStore.ExtendSession(ctx, req.RefreshToken, 7*24*time.Hour)
+	expiresAt := time.Now().Add(h.jwtService.RefreshTokenDuration())
+	err = h.sessionStore.RotateSession(ctx, claims.SessionID, req.RefreshToken, accessToken, refreshToken, expiresAt)
+	switch err {
+	case nil:
+	case ErrRefreshTokenReused:
+		h.audit.Record(ctx, &AuditEvent{
+			Event:     AuditRefreshReused,
+			IPAddress: c.IP(),
+			Details: map[string]interface{}{
+				"user_id":    claims.UserID,
+				"device_id":  claims.DeviceID,
+				"session_id": claims.SessionID,
+			},
+		})
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Refresh token already used, session revoked",
+			"code":  "REFRESH_TOKEN_REUSED",
+		})
+	case ErrSessionNotFound:
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Session not found",
+		})
+	default:
+		log.Printf("Failed to rotate session %s: %v", claims.SessionID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to refresh token",
+		})
+	}
 
 	return c.JSON(fiber.Map{
-		"access_token": accessToken,
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
 	})
 }
 
-// Logout handles user logout
+// Logout ends the session of the access token, so its refresh token can no
+// longer be used
 func (h *AuthHandler) Logout(c *fiber.Ctx) error {
-	// Get refresh token from request
+	userID := c.Locals("userID").(string)
+	sessionID, _ := c.Locals("sessionID").(string)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if sessionID != "" {
+		err := h.sessionStore.RevokeSession(ctx, sessionID, userID)
+		if err != nil && err != ErrSessionNotFound {
+			log.Printf("Failed to revoke session %s: %v", sessionID, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to log out",
+			})
+		}
+	}
+
+	// Update user last seen
+	if userID != "" {
+		h.updateLastSeen(ctx, userID)
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Logged out successfully",
+	})
+}
+
+// Helper functions
+
+// ListSessions returns the caller's active sessions
+func (h *AuthHandler) ListSessions(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	sessionID, _ := c.Locals("sessionID").(string)
+
+	sessions, err := h.sessionStore.ListSessions(c.Context(), userID, sessionID)
+	if err != nil {
+		log.Printf("Failed to list sessions for %s: %v", userID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list sessions",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"sessions": sessions,
+	})
+}
+
+// RevokeSession ends one of the caller's sessions and disconnects it
+func (h *AuthHandler) RevokeSession(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	sessionID := c.Params("id")
+
+	if _, err := uuid.Parse(sessionID); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid session ID",
+		})
+	}
+
+	if err := h.sessionStore.RevokeSession(c.Context(), sessionID, userID); err != nil {
+		if err == ErrSessionNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Session not found",
+			})
+		}
+		log.Printf("Failed to revoke session %s: %v", sessionID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke session",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Session revoked",
+	})
+}
+
+// ListDevices returns the caller's registered devices
+func (h *AuthHandler) ListDevices(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	deviceID, _ := c.Locals("deviceID").(string)
+
+	devices, err := h.sessionStore.ListDevices(c.Context(), userID, deviceID)
+	if err != nil {
+		log.Printf("Failed to list devices for %s: %v", userID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list devices",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"devices": devices,
+	})
+}
+
+// RevokeDevice logs a device out of every session and removes it from the
+// caller's account
+func (h *AuthHandler) RevokeDevice(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	deviceID := c.Params("deviceId")
+
+	count, err := h.sessionStore.RevokeDevice(c.Context(), userID, deviceID)
+	if err != nil {
+		if err == ErrSessionDeviceAbsent {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Device not found",
+			})
+		}
+		log.Printf("Failed to revoke device %s: %v", deviceID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke device",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":          "Device revoked",
+		"sessions_revoked": count,
+	})
+}
+
+// LogoutAll ends every session of the caller, including the current one
+func (h *AuthHandler) LogoutAll(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	count, err := h.sessionStore.RevokeAllSessions(ctx, userID)
+	if err != nil {
+		log.Printf("Failed to revoke sessions of %s: %v", userID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to log out",
+		})
+	}
+
+	h.updateLastSeen(ctx, userID)
+
+	return c.JSON(fiber.Map{
+		"message":          "Logged out of all sessions",
+		"sessions_revoked": count,
+	})
+}
+
+// RequestEmailOTP emails a login code, and a magic link if configured, to
+// the account with this verified email. The response is the same whether or
+// not the address has an account.
+func (h *AuthHandler) RequestEmailOTP(c *fiber.Ctx) error {
 	var req struct {
-		RefreshToken string `json:"refresh_token"`
+		Email string `json:"email" validate:"required,email"`
 	}
 
 	if err := c.BodyParser(&req); err != nil {
@@ -197,24 +489,469 @@ func (h *AuthHandler) Logout(c *fiber.Ctx) error {
 		})
 	}
 
-	// Delete session
-	if req.RefreshToken != "" {
-		ctx := context.Background()
-		h.sessionStore.DeleteSession(ctx, req.RefreshToken)
+	email, err := NormalizeEmail(req.Email)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid email format",
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := h.emailService.SendLoginCode(ctx, email, c.IP()); err != nil {
+		var locked *LockedError
+		if errors.As(err, &locked) {
+			return lockedResponse(c, locked)
+		}
+		if err == ErrTooManyOTPRequests {
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		log.Printf("Failed to send login email to %s: %v", email, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to send email",
+		})
 	}
 
-	// Update user last seen
+	return c.JSON(fiber.Map{
+		"message": "If this email belongs to an account, a login code was sent",
+		"email":   email,
+	})
+}
+
+// VerifyEmailOTP logs in with an email code, or with the token of a magic
+// link, and returns JWT tokens like VerifyOTP
+func (h *AuthHandler) VerifyEmailOTP(c *fiber.Ctx) error {
+	var req struct {
+		Email      string `json:"email"`
+		OTP        string `json:"otp"`   // Code from the email...
+		Token      string `json:"token"` // ...or the token of its magic link
+		DeviceID   string `json:"device_id" validate:"required"`
+		DeviceName string `json:"device_name"`
+		PublicKey  string `json:"public_key" validate:"required"`
+		TOTPCode   string `json:"totp_code"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var userID string
+	var err error
+	switch {
+	case req.Token != "":
+		userID, err = h.verifyMagicLink(ctx, req.Token, req.Email, c.IP())
+		if err == ErrMagicLinkInvalid {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+	case req.OTP != "":
+		email, normErr := NormalizeEmail(req.Email)
+		if normErr != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid email format",
+			})
+		}
+		userID, err = h.emailService.VerifyLoginCode(ctx, email, req.OTP, c.IP())
+
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "otp or token required",
+		})
+	}
+
+	if err == ErrUserNotFound {
+		// The email was unlinked after the code was sent
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": ErrOTPNotFound.Error(),
+		})
+	}
+	if err != nil {
+		return verifyOTPError(c, err, req.Email)
+	}
+
+	return h.completeLogin(ctx, c, &LoginChallenge{
+		UserID:     userID,
+		DeviceID:   req.DeviceID,
+		DeviceName: req.DeviceName,
+		PublicKey:  req.PublicKey,
+	}, req.TOTPCode)
+}
+
+// verifyMagicLink spends a magic link token. If the client also sent the
+// email, the link must have been sent to it.
+func (h *AuthHandler) verifyMagicLink(ctx context.Context, token, email, ip string) (string, error) {
+	linkEmail, userID, err := h.emailService.VerifyMagicLink(ctx, token, ip)
+	if err != nil {
+		return "", err
+	}
+	if email != "" {
+		if normalized, _ := NormalizeEmail(email); normalized != linkEmail {
+			return "", ErrMagicLinkInvalid
+		}
+	}
+	return userID, nil
+}
+
+// VerifyTwoFactor completes a login that answered TOTP_REQUIRED, with the
+// challenge's mfa_token and a TOTP or recovery code
+func (h *AuthHandler) VerifyTwoFactor(c *fiber.Ctx) error {
+	var req struct {
+		MFAToken string `json:"mfa_token" validate:"required"`
+		TOTPCode string `json:"totp_code" validate:"required"`
+	}
+
+	if err := c.BodyParser(&req); err != nil || req.MFAToken == "" || req.TOTPCode == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "mfa_token and totp_code required",
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	login, err := h.twoFactor.Challenge(ctx, req.MFAToken)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if err := h.twoFactor.Verify(ctx, login.UserID, req.TOTPCode, c.IP()); err != nil {
+		// Wrong codes may be retried; a locked out login has to start over
+		if err == ErrTwoFactorLocked {
+			h.twoFactor.EndChallenge(ctx, req.MFAToken)
+		}
+		return twoFactorError(c, err)
+	}
+	h.twoFactor.EndChallenge(ctx, req.MFAToken)
+
+	return h.issueTokens(ctx, c, login)
+}
+
+// LinkEmail sends a verification code to an email the caller wants to log
+// in with
+func (h *AuthHandler) LinkEmail(c *fiber.Ctx) error {
 	userID := c.Locals("userID").(string)
-	if userID != "" {
-		h.updateLastSeen(context.Background(), userID)
+
+	var req struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	email, err := NormalizeEmail(req.Email)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid email format",
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := h.emailService.StartLink(ctx, userID, email, c.IP()); err != nil {
+		var locked *LockedError
+		switch {
+		case err == ErrEmailTaken:
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		case err == ErrTooManyOTPRequests:
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		case errors.As(err, &locked):
+			return lockedResponse(c, locked)
+		}
+		log.Printf("Failed to send verification email to %s: %v", email, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to send email",
+		})
 	}
 
 	return c.JSON(fiber.Map{
-		"message": "Logged out successfully",
+		"message": "Verification code sent",
+		"email":   email,
 	})
 }
 
-// Helper functions
+// ConfirmEmail links the email once the caller sends its verification code
+func (h *AuthHandler) ConfirmEmail(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var req struct {
+		Email string `json:"email" validate:"required,email"`
+		OTP   string `json:"otp" validate:"required,len=6"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	email, err := NormalizeEmail(req.Email)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid email format",
+		})
+	}
+
+	if err := h.emailService.ConfirmLink(c.Context(), userID, email, req.OTP, c.IP()); err != nil {
+		if err == ErrEmailTaken {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return verifyOTPError(c, err, email)
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Email linked",
+		"email":   email,
+	})
+}
+
+// UnlinkEmail removes the caller's email, which can then no longer be used
+// to log in
+func (h *AuthHandler) UnlinkEmail(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	if err := h.emailService.Unlink(c.Context(), userID); err != nil {
+		if err == ErrEmailNotLinked {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		log.Printf("Failed to unlink email of %s: %v", userID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to unlink email",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Email unlinked",
+	})
+}
+
+// TwoFactorStatus tells the caller whether their second factor is enabled
+func (h *AuthHandler) TwoFactorStatus(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	enabled, left, err := h.twoFactor.Status(c.Context(), userID)
+	if err != nil {
+		log.Printf("Failed to get second factor status of %s: %v", userID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get two-factor status",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"enabled":             enabled,
+		"available":           h.twoFactor.Available(),
+		"recovery_codes_left": left,
+	})
+}
+
+// EnrollTOTP starts TOTP enrollment, returning the secret to add to an
+// authenticator app. It takes effect once confirmed with ConfirmTOTP.
+func (h *AuthHandler) EnrollTOTP(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var phoneNumber string
+	err := h.db.QueryRowContext(c.Context(),
+		"SELECT phone_number FROM users WHERE id = $1 AND deleted_at IS NULL",
+		userID,
+	).Scan(&phoneNumber)
+	if err != nil {
+		log.Printf("Failed to load user %s: %v", userID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to process user",
+		})
+	}
+
+	secret, uri, err := h.twoFactor.Enroll(c.Context(), userID, phoneNumber)
+	if err != nil {
+		return twoFactorError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"secret":      secret,
+		"otpauth_url": uri,
+	})
+}
+
+// ConfirmTOTP enables the second factor with a code from the authenticator
+// app. The response carries the recovery codes, shown only this once.
+func (h *AuthHandler) ConfirmTOTP(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var req struct {
+		Code string `json:"code" validate:"required,len=6"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	codes, err := h.twoFactor.Confirm(c.Context(), userID, req.Code, c.IP())
+	if err != nil {
+		return twoFactorError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableTOTP removes the second factor, given a TOTP or recovery code
+func (h *AuthHandler) DisableTOTP(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var req struct {
+		Code string `json:"code" validate:"required"`
+	}
+	if err := c.BodyParser(&req); err != nil || req.Code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "code required",
+		})
+	}
+
+	if err := h.twoFactor.Disable(c.Context(), userID, req.Code, c.IP()); err != nil {
+		return twoFactorError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Two-factor authentication disabled",
+	})
+}
+
+// RegenerateRecoveryCodes replaces the caller's recovery codes, given a
+// TOTP code
+func (h *AuthHandler) RegenerateRecoveryCodes(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var req struct {
+		Code string `json:"code" validate:"required,len=6"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	codes, err := h.twoFactor.RegenerateRecoveryCodes(c.Context(), userID, req.Code, c.IP())
+	if err != nil {
+		return twoFactorError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"recovery_codes": codes,
+	})
+}
+
+// GetUserRole returns a user's role and permissions (admin)
+func (h *AuthHandler) GetUserRole(c *fiber.Ctx) error {
+	targetID := c.Params("id")
+	if _, err := uuid.Parse(targetID); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	grants, err := h.authz.Grants(c.Context(), targetID)
+	if err != nil {
+		if err == ErrUserNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
+		log.Printf("Failed to resolve role of %s: %v", targetID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get role",
+		})
+	}
+
+	permissions := make([]Permission, 0, len(grants.Permissions))
+	for permission := range grants.Permissions {
+		permissions = append(permissions, permission)
+	}
+	sort.Slice(permissions, func(i, j int) bool { return permissions[i] < permissions[j] })
+
+	return c.JSON(fiber.Map{
+		"user_id":     targetID,
+		"role":        grants.Role,
+		"permissions": permissions,
+	})
+}
+
+// SetUserRole changes a user's role (admin). It applies to the user's next
+// request; their tokens pick up the new role claim on the next refresh.
+func (h *AuthHandler) SetUserRole(c *fiber.Ctx) error {
+	adminID := c.Locals("userID").(string)
+	targetID := c.Params("id")
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if _, err := uuid.Parse(targetID); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	// An admin demoting themselves could leave no one able to undo it
+	if targetID == adminID && req.Role != RoleAdmin {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Admins cannot change their own role",
+		})
+	}
+
+	if err := h.authz.SetRole(c.Context(), targetID, req.Role); err != nil {
+		switch err {
+		case ErrInvalidRole:
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid role. Must be user, model or admin",
+			})
+		case ErrUserNotFound:
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
+		log.Printf("Failed to set role of %s: %v", targetID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to set role",
+		})
+	}
+
+	log.Printf("[Auth] Role changed: UserID=%s Role=%s By=%s", targetID, req.Role, adminID)
+
+	return c.JSON(fiber.Map{
+		"message": "Role updated",
+		"user_id": targetID,
+		"role":    req.Role,
+	})
+}
 
 func (h *AuthHandler) getOrCreateUser(ctx context.Context, phoneNumber string) (string, bool, error) {
 	var userID string
@@ -253,14 +990,23 @@ func (h *AuthHandler) getOrCreateUser(ctx context.Context, phoneNumber string) (
 func (h *AuthHandler) registerDevice(ctx context.Context, userID, deviceID, deviceName, publicKey string) error {
 	platform := "web" // Default, could be detected from user agent
 
-	_, err := h.db.ExecContext(ctx,
+	// Only the device's own user may update it
+	result, err := h.db.ExecContext(ctx,
 		`INSERT INTO user_devices (id, user_id, device_id, name, platform, public_key, created_at) 
 		VALUES ($1, $2, $3, $4, $5, $6, NOW())
 		ON CONFLICT (device_id) 
-		DO UPDATE SET public_key = $6, last_active = NOW()`,
+		DO UPDATE SET public_key = $6, last_active = NOW()
+		WHERE user_devices.user_id = $2`,
 		uuid.New().String(), userID, deviceID, deviceName, platform, publicKey,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrDeviceTaken
+	}
+	return nil
 }
 
 func (h *AuthHandler) updateLastSeen(ctx context.Context, userID string) {
@@ -272,3 +1018,72 @@ func (h *AuthHandler) updateLastSeen(ctx context.Context, userID string) {
 		log.Printf("Failed to update last seen for user %s: %v", userID, err)
 	}
 }
+
+// verifyOTPError responds to a failed phone or email code
+func verifyOTPError(c *fiber.Ctx, err error, subject string) error {
+	var invalid *InvalidOTPError
+	var locked *LockedError
+	switch {
+	case errors.As(err, &invalid):
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error":         err.Error(),
+			"attempts_left": invalid.AttemptsLeft,
+		})
+	case errors.As(err, &locked):
+		return lockedResponse(c, locked)
+	case err == ErrOTPNotFound, err == ErrOTPAttemptsExceeded:
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	default:
+		log.Printf("Failed to verify OTP for %s: %v", subject, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify OTP",
+		})
+	}
+}
+
+// twoFactorError responds to a failed second factor
+func twoFactorError(c *fiber.Ctx, err error) error {
+	switch err {
+	case ErrInvalidTwoFactorCode:
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+			"code":  "TOTP_INVALID",
+		})
+	case ErrTwoFactorLocked:
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(twoFactorWindow.Seconds())))
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error": err.Error(),
+			"code":  "TOTP_LOCKED",
+		})
+	case ErrTOTPNotEnrolled:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case ErrTOTPAlreadyEnabled:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case ErrTwoFactorUnavailable:
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	default:
+		log.Printf("Two-factor check failed: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check two-factor code",
+		})
+	}
+}
+
+// lockedResponse tells the client how long a locked out phone number has to wait
+func lockedResponse(c *fiber.Ctx, locked *LockedError) error {
+	retryAfter := int(math.Ceil(locked.RetryAfter.Seconds()))
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+	return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+		"error":       locked.Error(),
+		"code":        "OTP_LOCKED",
+		"retry_after": retryAfter,
+	})
+}
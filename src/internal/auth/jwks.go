@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"log"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// A token with an unknown kid reloads the keys at most this often, so a key
+// activated on another instance is picked up without waiting for Run
+const keyReloadInterval = 10 * time.Second
+
+// JWK is a public signing key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Curve     string `json:"crv,omitempty"` // OKP
+	X         string `json:"x,omitempty"`   // OKP
+	N         string `json:"n,omitempty"`   // RSA
+	E         string `json:"e,omitempty"`   // RSA
+}
+
+// KeySet caches the signing keys of a KeyStore in memory
+type KeySet struct {
+	store *KeyStore
+
+	mu       sync.RWMutex
+	keys     map[string]*SigningKey
+	signing  *SigningKey
+	loadedAt time.Time
+
+	reloadMu sync.Mutex
+}
+
+func NewKeySet(store *KeyStore) *KeySet {
+	return &KeySet{
+		store: store,
+		keys:  make(map[string]*SigningKey),
+	}
+}
+
+// Refresh reloads the keys from the store
+func (ks *KeySet) Refresh(ctx context.Context) error {
+	keys, err := ks.store.List(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[string]*SigningKey, len(keys))
+	var signing *SigningKey
+	for _, key := range keys {
+		byID[key.ID] = key
+		if key.Status == KeyActive {
+			signing = key
+		}
+	}
+
+	ks.mu.Lock()
+	ks.keys = byID
+	ks.signing = signing
+	ks.loadedAt = time.Now()
+	ks.mu.Unlock()
+
+	return nil
+}
+
+// Run reloads the keys every interval until ctx is cancelled
+func (ks *KeySet) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ks.Refresh(ctx); err != nil {
+				log.Printf("[Auth] Failed to reload signing keys: %v", err)
+			}
+		}
+	}
+}
+
+// Signing returns the key new tokens are signed with, or nil if none is active
+func (ks *KeySet) Signing() *SigningKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.signing
+}
+
+// Verifier returns the key that signed a token with the given kid
+func (ks *KeySet) Verifier(ctx context.Context, kid string) (*SigningKey, bool) {
+	if key, ok := ks.lookup(kid); ok {
+		return key, true
+	}
+
+	ks.reloadMu.Lock()
+	defer ks.reloadMu.Unlock()
+
+	ks.mu.RLock()
+	stale := time.Since(ks.loadedAt) >= keyReloadInterval
+	ks.mu.RUnlock()
+
+	if stale {
+		if err := ks.Refresh(ctx); err != nil {
+			log.Printf("[Auth] Failed to reload signing keys: %v", err)
+		}
+	}
+	return ks.lookup(kid)
+}
+
+func (ks *KeySet) lookup(kid string) (*SigningKey, bool) {
+	ks.mu.RLock()
+	key, ok := ks.keys[kid]
+	ks.mu.RUnlock()
+
+	if !ok || key.Expired(time.Now()) {
+		return nil, false
+	}
+	return key, true
+}
+
+// JWKS returns the public keys that may verify tokens: the pending ones so
+// verifiers learn them before they sign, the active one and the retired ones
+// whose tokens are still valid
+func (ks *KeySet) JWKS() []JWK {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	now := time.Now()
+	jwks := make([]JWK, 0, len(ks.keys))
+	for _, key := range ks.keys {
+		if key.Expired(now) {
+			continue
+		}
+		jwks = append(jwks, toJWK(key))
+	}
+
+	sort.Slice(jwks, func(i, j int) bool {
+		return jwks[i].KeyID > jwks[j].KeyID
+	})
+	return jwks
+}
+
+func toJWK(key *SigningKey) JWK {
+	jwk := JWK{
+		Use:       "sig",
+		Algorithm: key.Algorithm,
+		KeyID:     key.ID,
+	}
+
+	switch public := key.PublicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	}
+
+	return jwk
+}
+
+// JWKSHandler serves the public keys at /.well-known/jwks.json. With HS256
+// signing there are no public keys and the set is empty.
+func JWKSHandler(keys *KeySet) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		jwks := []JWK{}
+		if keys != nil {
+			jwks = keys.JWKS()
+		}
+
+		c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+		return c.JSON(fiber.Map{
+			"keys": jwks,
+		})
+	}
+}
@@ -1,27 +1,46 @@
 package auth
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
 var (
-	ErrInvalidToken = errors.New("invalid token")
-	ErrExpiredToken = errors.New("expired token")
+	ErrInvalidToken   = errors.New("invalid token")
+	ErrExpiredToken   = errors.New("expired token")
+	ErrWrongTokenType = errors.New("wrong token type")
+	ErrTokenRevoked   = errors.New("token revoked")
+	ErrRevocationDown = errors.New("revocation check failed")
 )
 
+// RevocationChecker reports whether a session's tokens were revoked early
+type RevocationChecker interface {
+	IsRevoked(ctx context.Context, sessionID string) (bool, error)
+}
+
+// JWTService issues and validates tokens. By default they are signed with
+// the shared HS256 secret; with a key set they are signed with its active
+// key and carry its kid, while tokens without a kid still verify against
+// the secret if one is configured.
 type JWTService struct {
 	secret               string
 	accessTokenDuration  time.Duration
 	refreshTokenDuration time.Duration
+	revocations          RevocationChecker
+	keys                 *KeySet
 }
 
 type Claims struct {
-	UserID   string `json:"user_id"`
-	DeviceID string `json:"device_id"`
-	Type     string `json:"type"` // "access" or "refresh"
+	UserID    string `json:"user_id"`
+	DeviceID  string `json:"device_id"`
+	SessionID string `json:"sid,omitempty"`  // The login this token belongs to
+	Role      string `json:"role,omitempty"` // Role when issued; authorization re-checks it
+	Type      string `json:"type"`           // "access" or "refresh"
 	jwt.RegisteredClaims
 }
 
@@ -33,16 +52,16 @@ func NewJWTService(secret string, accessDuration, refreshDuration time.Duration)
 	}
 }
 
-// GenerateTokenPair generates both access and refresh tokens
-func (j *JWTService) GenerateTokenPair(userID, deviceID string) (accessToken, refreshToken string, err error) {
+// GenerateTokenPair generates both access and refresh tokens for a session
+func (j *JWTService) GenerateTokenPair(userID, deviceID, sessionID, role string) (accessToken, refreshToken string, err error) {
 	// Generate access token
-	accessToken, err = j.generateToken(userID, deviceID, "access", j.accessTokenDuration)
+	accessToken, err = j.generateToken(userID, deviceID, sessionID, role, "access", j.accessTokenDuration)
 	if err != nil {
 		return "", "", err
 	}
 
 	// Generate refresh token
-	refreshToken, err = j.generateToken(userID, deviceID, "refresh", j.refreshTokenDuration)
+	refreshToken, err = j.generateToken(userID, deviceID, sessionID, role, "refresh", j.refreshTokenDuration)
 	if err != nil {
 		return "", "", err
 	}
@@ -50,32 +69,68 @@ func (j *JWTService) GenerateTokenPair(userID, deviceID string) (accessToken, re
 	return accessToken, refreshToken, nil
 }
 
-// generateToken creates a single token
-func (j *JWTService) generateToken(userID, deviceID, tokenType string, duration time.Duration) (string, error) {
+// UseKeySet signs new tokens with the key set's active key
+func (j *JWTService) UseKeySet(keys *KeySet) {
+	j.keys = keys
+}
+
+// CheckRevocations makes ValidateAccessToken reject tokens of revoked sessions
+func (j *JWTService) CheckRevocations(checker RevocationChecker) {
+	j.revocations = checker
+}
+
+// AccessTokenDuration is how long an access token lasts
+func (j *JWTService) AccessTokenDuration() time.Duration {
+	return j.accessTokenDuration
+}
+
+// RefreshTokenDuration is how long a refresh token, and so an idle session, lasts
+func (j *JWTService) RefreshTokenDuration() time.Duration {
+	return j.refreshTokenDuration
+}
+
+// generateToken creates a single token. The random ID keeps two tokens
+// issued in the same second from being identical.
+func (j *JWTService) generateToken(userID, deviceID, sessionID, role, tokenType string, duration time.Duration) (string, error) {
 	now := time.Now()
 	claims := Claims{
-		UserID:   userID,
-		DeviceID: deviceID,
-		Type:     tokenType,
+		UserID:    userID,
+		DeviceID:  deviceID,
+		SessionID: sessionID,
+		Role:      role,
+		Type:      tokenType,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
 			ExpiresAt: jwt.NewNumericDate(now.Add(duration)),
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(j.secret))
+	if j.keys == nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return token.SignedString([]byte(j.secret))
+	}
+
+	key := j.keys.Signing()
+	if key == nil {
+		return "", ErrNoSigningKey
+	}
+
+	token := jwt.NewWithClaims(key.Method(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.PrivateKey)
 }
 
 // ValidateToken validates and parses a token
 func (j *JWTService) ValidateToken(tokenString string) (*Claims, error) {
+	return j.validateToken(context.Background(), tokenString)
+}
+
+func (j *JWTService) validateToken(ctx context.Context, tokenString string) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("unexpected signing method")
-		}
-		return []byte(j.secret), nil
-	})
+		return j.verificationKey(ctx, token)
+	}, jwt.WithValidMethods([]string{AlgHS256, AlgRS256, AlgEdDSA}))
 
 	if err != nil {
 		return nil, err
@@ -94,23 +149,59 @@ func (j *JWTService) ValidateToken(tokenString string) (*Claims, error) {
 	return claims, nil
 }
 
-// RefreshAccessToken generates a new access token from a valid refresh token
-func (j *JWTService) RefreshAccessToken(refreshToken string) (string, error) {
-	claims, err := j.ValidateToken(refreshToken)
-	if err != nil {
-		return "", err
+// verificationKey picks the key for a token by its kid, making sure the
+// token's algorithm matches the key so one can't be passed off as another
+func (j *JWTService) verificationKey(ctx context.Context, token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok || j.secret == "" {
+			return nil, errors.New("unexpected signing method")
+		}
+		return []byte(j.secret), nil
 	}
 
-	// Verify this is a refresh token
-	if claims.Type != "refresh" {
-		return "", errors.New("not a refresh token")
+	if j.keys == nil {
+		return nil, ErrSigningKeyNotFound
+	}
+	key, ok := j.keys.Verifier(ctx, kid)
+	if !ok {
+		return nil, ErrSigningKeyNotFound
 	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, errors.New("unexpected signing method")
+	}
+	return key.PublicKey, nil
+}
 
-	// Generate new access token
-	accessToken, err := j.generateToken(claims.UserID, claims.DeviceID, "access", j.accessTokenDuration)
+// ValidateAccessToken validates a token presented to access the API or relay.
+// Besides ValidateToken's checks it requires an access token of a session
+// that has not been revoked. If the denylist can't be read the error wraps
+// ErrRevocationDown, so callers can tell an outage from a bad token.
+func (j *JWTService) ValidateAccessToken(ctx context.Context, tokenString string) (*Claims, error) {
+	claims, err := j.validateToken(ctx, tokenString)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	if claims.Type != "access" {
+		return nil, ErrWrongTokenType
 	}
 
-	return accessToken, nil
+	// Every login starts a session, so a token without one predates them and
+	// could never be revoked
+	if claims.SessionID == "" {
+		return nil, ErrInvalidToken
+	}
+
+	if j.revocations != nil {
+		revoked, err := j.revocations.IsRevoked(ctx, claims.SessionID)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrRevocationDown, err)
+		}
+		if revoked {
+			return nil, ErrTokenRevoked
+		}
+	}
+
+	return claims, nil
 }
@@ -1,8 +1,16 @@
 package auth
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
 	"strings"
 
+	"chat-e2ee/internal/ratelimit"
+
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -27,34 +35,52 @@ func AuthMiddleware(jwtService *JWTService) fiber.Handler {
 
 		// Validate token
 		token := parts[1]
-		claims, err := jwtService.ValidateToken(token)
+		claims, err := jwtService.ValidateAccessToken(c.Context(), token)
 		if err != nil {
-			if err == ErrExpiredToken {
-				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-					"error": "Token expired",
-					"code":  "TOKEN_EXPIRED",
-				})
-			}
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Invalid token",
-			})
-		}
-
-		// Check token type
-		if claims.Type != "access" {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Invalid token type",
-			})
+			return tokenError(c, err)
 		}
 
 		// Store user info in context
 		c.Locals("userID", claims.UserID)
 		c.Locals("deviceID", claims.DeviceID)
+		c.Locals("sessionID", claims.SessionID)
+		c.Locals("role", claims.Role)
 
 		return c.Next()
 	}
 }
 
+// tokenError maps a ValidateAccessToken error to a response
+func tokenError(c *fiber.Ctx, err error) error {
+	switch err {
+	case ErrExpiredToken:
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Token expired",
+			"code":  "TOKEN_EXPIRED",
+		})
+	case ErrWrongTokenType:
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid token type",
+		})
+	case ErrTokenRevoked:
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Session revoked",
+			"code":  "TOKEN_REVOKED",
+		})
+	}
+
+	if errors.Is(err, ErrRevocationDown) {
+		log.Printf("[Auth] %v", err)
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Failed to validate token",
+		})
+	}
+
+	return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+		"error": "Invalid token",
+	})
+}
+
 // OptionalAuthMiddleware allows requests with or without authentication
 // FIXED: This was rejecting unauthenticated requests
 func OptionalAuthMiddleware(jwtService *JWTService) fiber.Handler {
@@ -79,17 +105,10 @@ func OptionalAuthMiddleware(jwtService *JWTService) fiber.Handler {
 
 		// Validate token
 		token := parts[1]
-		claims, err := jwtService.ValidateToken(token)
+		claims, err := jwtService.ValidateAccessToken(c.Context(), token)
 		if err != nil {
-			// Token is invalid, but that's OK for optional auth
-			// Just continue without authentication
-			c.Locals("authenticated", false)
-			return c.Next()
-		}
-
-		// Check token type
-		if claims.Type != "access" {
-			// Wrong token type, continue without auth
+			// Token is invalid, revoked or of the wrong type, but that's OK
+			// for optional auth. Just continue without authentication
 			c.Locals("authenticated", false)
 			return c.Next()
 		}
@@ -97,35 +116,211 @@ func OptionalAuthMiddleware(jwtService *JWTService) fiber.Handler {
 		// Valid token found! Store user info
 		c.Locals("userID", claims.UserID)
 		c.Locals("deviceID", claims.DeviceID)
+		c.Locals("sessionID", claims.SessionID)
+		c.Locals("role", claims.Role)
 		c.Locals("authenticated", true)
 
 		return c.Next()
 	}
 }
 
-// RequireRole middleware checks if user has required role
-func RequireRole(requiredRole string) fiber.Handler {
+// RequireRole allows only users whose current role is one of roles. The
+// role is resolved on every request, so role changes apply immediately.
+// Must run after AuthMiddleware.
+func RequireRole(authz *Authorizer, roles ...string) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		// This would typically check the user's role from database
-		// For now, we'll implement basic structure
-		userID := c.Locals("userID")
-		if userID == nil {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Authentication required",
-			})
+		grants, err := loadGrants(c, authz)
+		if grants == nil {
+			return err
+		}
+
+		for _, role := range roles {
+			if grants.Role == role {
+				return c.Next()
+			}
 		}
+		return forbidden(c)
+	}
+}
 
-		// TODO: Fetch user role from database and check
-		// For now, just pass through
+// RequirePermission allows only users whose role grants permission.
+// Must run after AuthMiddleware.
+func RequirePermission(authz *Authorizer, permission Permission) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		grants, err := loadGrants(c, authz)
+		if grants == nil {
+			return err
+		}
+
+		if !grants.Has(permission) {
+			return forbidden(c)
+		}
 		return c.Next()
 	}
 }
 
-// RateLimitMiddleware for auth endpoints
-func RateLimitMiddleware(maxAttempts int) fiber.Handler {
+// Authorize checks the permission RoutePolicies lists for the matched
+// route. A route without a policy is denied, so a typo can't open it up.
+// Must be registered on the route itself, after AuthMiddleware.
+func Authorize(authz *Authorizer) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		// TODO: Implement rate limiting using Redis
-		// Track by IP address or phone number
+		route := c.Method() + " " + c.Route().Path
+		permission, ok := RoutePolicies[route]
+		if !ok {
+			log.Printf("[Auth] No policy for route %s, denying", route)
+			return forbidden(c)
+		}
+
+		grants, err := loadGrants(c, authz)
+		if grants == nil {
+			return err
+		}
+
+		if !grants.Has(permission) {
+			return forbidden(c)
+		}
+		return c.Next()
+	}
+}
+
+// loadGrants resolves the caller's grants and stores the role in Locals. If
+// it returns nil grants the error response has already been written.
+func loadGrants(c *fiber.Ctx, authz *Authorizer) (*Grants, error) {
+	userID, _ := c.Locals("userID").(string)
+	if userID == "" {
+		return nil, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Authentication required",
+		})
+	}
+
+	grants, err := authz.Grants(c.Context(), userID)
+	if err == ErrUserNotFound {
+		return nil, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if err != nil {
+		log.Printf("[Auth] Failed to resolve role of %s: %v", userID, err)
+		return nil, c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Failed to check permissions",
+		})
+	}
+
+	c.Locals("role", grants.Role)
+	return grants, nil
+}
+
+func forbidden(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+		"error": "Insufficient permissions",
+		"code":  "FORBIDDEN",
+	})
+}
+
+// RateLimitKey picks the identifier a request is counted against, such as
+// its IP address. An empty identifier is not counted.
+type RateLimitKey func(c *fiber.Ctx) string
+
+// ByIP counts requests per client IP
+func ByIP(c *fiber.Ctx) string {
+	return "ip:" + c.IP()
+}
+
+// ByUser counts requests per authenticated user. It must run after
+// AuthMiddleware.
+func ByUser(c *fiber.Ctx) string {
+	userID, ok := GetUserID(c)
+	if !ok || userID == "" {
+		return ""
+	}
+	return "user:" + userID
+}
+
+// ByUserAndParam counts requests per authenticated user and value of a
+// route parameter, such as the user a request targets. It must run after
+// AuthMiddleware.
+func ByUserAndParam(param string) RateLimitKey {
+	return func(c *fiber.Ctx) string {
+		userID, ok := GetUserID(c)
+		target := c.Params(param)
+		if !ok || userID == "" || target == "" {
+			return ""
+		}
+		return "user:" + userID + ":" + param + ":" + target
+	}
+}
+
+// ByPhone counts requests per phone_number in the JSON body
+func ByPhone(c *fiber.Ctx) string {
+	var body struct {
+		PhoneNumber string `json:"phone_number"`
+	}
+	if err := json.Unmarshal(c.Body(), &body); err != nil {
+		return ""
+	}
+
+	phone := strings.TrimPrefix(strings.TrimSpace(body.PhoneNumber), "+")
+	if phone == "" {
+		return ""
+	}
+	return "phone:" + phone
+}
+
+// ByEmail counts requests per email in the JSON body
+func ByEmail(c *fiber.Ctx) string {
+	var body struct {
+		Email string `json:"email"`
+	}
+	if err := json.Unmarshal(c.Body(), &body); err != nil {
+		return ""
+	}
+
+	email := strings.ToLower(strings.TrimSpace(body.Email))
+	if email == "" {
+		return ""
+	}
+	return "email:" + email
+}
+
+// RateLimitMiddleware limits requests to a route with the route's policy
+// from the rate limit config. Each key is counted separately and the request
+// is rejected if any of them is over the limit. Responses carry the
+// RateLimit-* headers, plus Retry-After when rejected.
+//
+// If Redis is unavailable requests are let through.
+func RateLimitMiddleware(limiter *ratelimit.Limiter, route string, keys ...RateLimitKey) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		identifiers := make([]string, 0, len(keys))
+		for _, key := range keys {
+			identifiers = append(identifiers, key(c))
+		}
+
+		result, err := limiter.Allow(c.Context(), route, identifiers...)
+		if err != nil {
+			log.Printf("[RateLimit] Check failed for %s, allowing request: %v", route, err)
+			return c.Next()
+		}
+
+		policy := result.Policy
+		if policy.Requests == 0 {
+			return c.Next()
+		}
+
+		reset := int(math.Ceil(result.ResetAfter.Seconds()))
+		c.Set("RateLimit-Limit", strconv.Itoa(policy.Requests))
+		c.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Set("RateLimit-Reset", strconv.Itoa(reset))
+		c.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", policy.Requests, int(policy.Window.Seconds())))
+
+		if !result.Allowed {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(reset))
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error":       "Too many requests",
+				"code":        "RATE_LIMITED",
+				"retry_after": reset,
+			})
+		}
+
 		return c.Next()
 	}
 }
@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"chat-e2ee/internal/config"
+)
+
+// otpSubject is who a code was sent to: the key its code, counters and
+// lockout are stored under, and the phone number or email audit events
+// are recorded with
+type otpSubject struct {
+	key   string
+	phone string
+	email string
+}
+
+func phoneSubject(phoneNumber string) otpSubject {
+	return otpSubject{key: phoneNumber, phone: phoneNumber}
+}
+
+func emailSubject(email string) otpSubject {
+	return otpSubject{key: "email:" + email, email: email}
+}
+
+func (s otpSubject) event(event, ip string, details map[string]interface{}) *AuditEvent {
+	return &AuditEvent{
+		Event:       event,
+		PhoneNumber: s.phone,
+		Email:       s.email,
+		IPAddress:   ip,
+		Details:     details,
+	}
+}
+
+// otpCodes issues and verifies one-time codes with brute-force protection,
+// for every channel codes are sent through
+type otpCodes struct {
+	store  OTPStore
+	audit  *AuditLog
+	length int
+	expiry time.Duration
+
+	// Brute-force protection
+	maxAttempts int
+	lockout     time.Duration
+	maxLockout  time.Duration
+}
+
+func newOTPCodes(store OTPStore, audit *AuditLog, cfg config.OTPConfig, expiry time.Duration) *otpCodes {
+	return &otpCodes{
+		store:       store,
+		audit:       audit,
+		length:      6,
+		expiry:      expiry,
+		maxAttempts: cfg.MaxAttempts,
+		lockout:     cfg.Lockout,
+		maxLockout:  cfg.MaxLockout,
+	}
+}
+
+// generate creates a random numeric code
+func (o *otpCodes) generate() (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(o.length)), nil)
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+
+	// Pad with zeros if necessary
+	format := fmt.Sprintf("%%0%dd", o.length)
+	return fmt.Sprintf(format, n), nil
+}
+
+// issue generates and stores a new code for the subject, to be sent by the
+// caller
+func (o *otpCodes) issue(ctx context.Context, subject otpSubject, ip string) (string, error) {
+	// A locked out subject can't get a fresh code to keep guessing with
+	if err := o.checkLockout(ctx, subject, ip); err != nil {
+		return "", err
+	}
+
+	// Check rate limiting (max 3 OTPs per hour)
+	attempts, err := o.store.IncrementAttempts(ctx, "send:"+subject.key, time.Hour)
+	if err == nil && attempts > 3 {
+		return "", ErrTooManyOTPRequests
+	}
+
+	otp, err := o.generate()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate OTP: %w", err)
+	}
+
+	// Store OTP with expiry. A new code gets a fresh set of attempts.
+	if err := o.store.SetOTP(ctx, subject.key, otp, o.expiry); err != nil {
+		return "", fmt.Errorf("failed to store OTP: %w", err)
+	}
+	if err := o.store.ResetAttempts(ctx, "verify:"+subject.key); err != nil {
+		log.Printf("Failed to reset verify attempts for %s: %v", subject.key, err)
+	}
+
+	return otp, nil
+}
+
+// discard deletes a code that couldn't be delivered
+func (o *otpCodes) discard(ctx context.Context, subject otpSubject) {
+	_ = o.store.DeleteOTP(ctx, subject.key)
+}
+
+// verify checks a code. Every attempt is counted before the comparison, so
+// concurrent guesses can't exceed the limit. Wrong codes return an
+// *InvalidOTPError; the last allowed failure discards the code and locks the
+// subject out, returning a *LockedError.
+func (o *otpCodes) verify(ctx context.Context, subject otpSubject, otp, ip string) error {
+	if err := o.checkLockout(ctx, subject, ip); err != nil {
+		return err
+	}
+
+	// Get stored OTP
+	storedOTP, err := o.store.GetOTP(ctx, subject.key)
+	if err != nil {
+		return ErrOTPNotFound
+	}
+
+	attempts, err := o.store.IncrementAttempts(ctx, "verify:"+subject.key, o.expiry)
+	if err != nil {
+		return fmt.Errorf("failed to count attempt: %w", err)
+	}
+
+	// Compare OTPs without leaking how many digits matched
+	if attempts <= o.maxAttempts && subtle.ConstantTimeCompare([]byte(storedOTP), []byte(otp)) == 1 {
+		o.succeeded(ctx, subject)
+		return nil
+	}
+
+	attemptsLeft := o.maxAttempts - attempts
+	if attemptsLeft < 0 {
+		attemptsLeft = 0
+	}
+
+	o.audit.Record(ctx, subject.event(AuditOTPFailed, ip, map[string]interface{}{
+		"attempt":       attempts,
+		"attempts_left": attemptsLeft,
+	}))
+
+	switch {
+	case attemptsLeft > 0:
+		return &InvalidOTPError{AttemptsLeft: attemptsLeft}
+	case attempts == o.maxAttempts:
+		return o.lockOut(ctx, subject, ip)
+	default:
+		// Raced with the attempt that triggered the lockout
+		return ErrOTPAttemptsExceeded
+	}
+}
+
+// succeeded deletes a verified code and clears the subject's counters
+func (o *otpCodes) succeeded(ctx context.Context, subject otpSubject) {
+	if err := o.store.DeleteOTP(ctx, subject.key); err != nil {
+		log.Printf("Failed to delete OTP for %s: %v", subject.key, err)
+	}
+
+	_ = o.store.ResetAttempts(ctx, "verify:"+subject.key)
+	_ = o.store.ResetAttempts(ctx, "send:"+subject.key)
+	_ = o.store.ResetAttempts(ctx, "lockouts:"+subject.key)
+}
+
+// checkLockout returns a *LockedError if the subject is locked out
+func (o *otpCodes) checkLockout(ctx context.Context, subject otpSubject, ip string) error {
+	remaining, err := o.store.GetLockout(ctx, subject.key)
+	if err != nil {
+		return fmt.Errorf("failed to check lockout: %w", err)
+	}
+	if remaining <= 0 {
+		return nil
+	}
+
+	o.audit.Record(ctx, subject.event(AuditOTPLocked, ip, map[string]interface{}{
+		"retry_after": int(remaining.Seconds()),
+	}))
+
+	return &LockedError{RetryAfter: remaining}
+}
+
+// lockOut discards the current code and locks the subject out, doubling the
+// lockout each time it happens again within a day
+func (o *otpCodes) lockOut(ctx context.Context, subject otpSubject, ip string) error {
+	if err := o.store.DeleteOTP(ctx, subject.key); err != nil {
+		log.Printf("Failed to delete OTP for %s: %v", subject.key, err)
+	}
+	_ = o.store.ResetAttempts(ctx, "verify:"+subject.key)
+
+	o.audit.Record(ctx, subject.event(AuditOTPInvalidated, ip, map[string]interface{}{
+		"max_attempts": o.maxAttempts,
+	}))
+
+	if o.lockout <= 0 {
+		return ErrOTPAttemptsExceeded
+	}
+
+	level, err := o.store.IncrementAttempts(ctx, "lockouts:"+subject.key, lockoutMemory)
+	if err != nil {
+		log.Printf("Failed to count lockouts for %s: %v", subject.key, err)
+		level = 1
+	}
+
+	duration := o.lockout
+	for i := 1; i < level && duration < o.maxLockout; i++ {
+		duration *= 2
+	}
+	if o.maxLockout > 0 && duration > o.maxLockout {
+		duration = o.maxLockout
+	}
+
+	if err := o.store.SetLockout(ctx, subject.key, duration); err != nil {
+		log.Printf("Failed to lock out %s: %v", subject.key, err)
+		return ErrOTPAttemptsExceeded
+	}
+
+	o.audit.Record(ctx, subject.event(AuditOTPLockout, ip, map[string]interface{}{
+		"level":    level,
+		"duration": int(duration.Seconds()),
+	}))
+
+	return &LockedError{RetryAfter: duration}
+}
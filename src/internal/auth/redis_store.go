@@ -33,15 +33,35 @@ func (r *RedisOTPStore) GetOTP(ctx context.Context, phone string) (string, error
 	return val, err
 }
 
+// TakeOTP retrieves and deletes an OTP in one step, so it can be used once
+func (r *RedisOTPStore) TakeOTP(ctx context.Context, phone string) (string, error) {
+	key := fmt.Sprintf("otp:%s", phone)
+
+	pipe := r.client.TxPipeline()
+	get := pipe.Get(ctx, key)
+	pipe.Del(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return "", err
+	}
+
+	val, err := get.Result()
+	if err == redis.Nil {
+		return "", fmt.Errorf("OTP not found")
+	}
+	return val, err
+}
+
 // DeleteOTP removes an OTP
 func (r *RedisOTPStore) DeleteOTP(ctx context.Context, phone string) error {
 	key := fmt.Sprintf("otp:%s", phone)
 	return r.client.Del(ctx, key).Err()
 }
 
-// IncrementAttempts increments and returns the attempt count
-func (r *RedisOTPStore) IncrementAttempts(ctx context.Context, phone string) (int, error) {
-	key := fmt.Sprintf("otp_attempts:%s", phone)
+// IncrementAttempts increments a named counter, such as "verify:" plus a
+// phone number, and returns the new count. The counter expires window after
+// the first attempt.
+func (r *RedisOTPStore) IncrementAttempts(ctx context.Context, name string, window time.Duration) (int, error) {
+	key := fmt.Sprintf("otp_attempts:%s", name)
 
 	// Increment the counter
 	val, err := r.client.Incr(ctx, key).Result()
@@ -49,56 +69,35 @@ func (r *RedisOTPStore) IncrementAttempts(ctx context.Context, phone string) (in
 		return 0, err
 	}
 
-	// Set expiration on first attempt (1 hour window)
+	// Set expiration on first attempt
 	if val == 1 {
-		r.client.Expire(ctx, key, time.Hour)
+		r.client.Expire(ctx, key, window)
 	}
 
 	return int(val), nil
 }
 
-// SessionStore manages user sessions in Redis
-type SessionStore struct {
-	client *redis.Client
+// ResetAttempts clears a named counter
+func (r *RedisOTPStore) ResetAttempts(ctx context.Context, name string) error {
+	key := fmt.Sprintf("otp_attempts:%s", name)
+	return r.client.Del(ctx, key).Err()
 }
 
-func NewSessionStore(client *redis.Client) *SessionStore {
-	return &SessionStore{client: client}
+// SetLockout blocks OTPs for a phone number for the given duration
+func (r *RedisOTPStore) SetLockout(ctx context.Context, phone string, duration time.Duration) error {
+	key := fmt.Sprintf("otp_lockout:%s", phone)
+	return r.client.Set(ctx, key, time.Now().Add(duration).Unix(), duration).Err()
 }
 
-// StoreSession saves session data
-func (s *SessionStore) StoreSession(ctx context.Context, sessionID string, data map[string]string, expiry time.Duration) error {
-	key := fmt.Sprintf("session:%s", sessionID)
-
-	// Convert map to Redis hash
-	args := make([]interface{}, 0, len(data)*2)
-	for k, v := range data {
-		args = append(args, k, v)
+// GetLockout returns how long a phone number stays locked, or 0
+func (r *RedisOTPStore) GetLockout(ctx context.Context, phone string) (time.Duration, error) {
+	key := fmt.Sprintf("otp_lockout:%s", phone)
+	ttl, err := r.client.PTTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
 	}
-
-	// Store hash
-	if err := s.client.HSet(ctx, key, args...).Err(); err != nil {
-		return err
+	if ttl < 0 {
+		return 0, nil
 	}
-
-	// Set expiration
-	return s.client.Expire(ctx, key, expiry).Err()
-}
-
-// GetSession retrieves session data
-func (s *SessionStore) GetSession(ctx context.Context, sessionID string) (map[string]string, error) {
-	key := fmt.Sprintf("session:%s", sessionID)
-	return s.client.HGetAll(ctx, key).Result()
-}
-
-// DeleteSession removes a session
-func (s *SessionStore) DeleteSession(ctx context.Context, sessionID string) error {
-	key := fmt.Sprintf("session:%s", sessionID)
-	return s.client.Del(ctx, key).Err()
-}
-
-// ExtendSession updates the expiration time
-func (s *SessionStore) ExtendSession(ctx context.Context, sessionID string, expiry time.Duration) error {
-	key := fmt.Sprintf("session:%s", sessionID)
-	return s.client.Expire(ctx, key, expiry).Err()
+	return ttl, nil
 }
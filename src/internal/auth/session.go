@@ -0,0 +1,356 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Session errors
+var (
+	ErrSessionNotFound     = errors.New("session not found or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token reused, session revoked")
+	ErrSessionDeviceAbsent = errors.New("session device not registered")
+)
+
+// Session is one login of a device. Each refresh replaces its refresh token,
+// so a session is the family of all refresh tokens issued since the login.
+type Session struct {
+	ID        string
+	UserID    string
+	DeviceID  string
+	ExpiresAt time.Time
+	IPAddress string
+	UserAgent string
+}
+
+// SessionInfo describes an active session for the session management API
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	DeviceID   string    `json:"device_id"`
+	DeviceName string    `json:"device_name,omitempty"`
+	Platform   string    `json:"platform"`
+	IPAddress  string    `json:"ip_address,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsed   time.Time `json:"last_used"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+// DeviceInfo describes a registered device for the session management API
+type DeviceInfo struct {
+	DeviceID       string    `json:"device_id"`
+	Name           string    `json:"name,omitempty"`
+	Platform       string    `json:"platform"`
+	LastActive     time.Time `json:"last_active"`
+	CreatedAt      time.Time `json:"created_at"`
+	ActiveSessions int       `json:"active_sessions"`
+	Current        bool      `json:"current"`
+}
+
+// SessionStore tracks refresh token families in the user_sessions table.
+// Only SHA-256 hashes of tokens are stored; refresh_token_hash always holds
+// the one refresh token of the family that may still be used.
+//
+// Access tokens carry their session ID, so revoking a session also puts the
+// ID on a Redis denylist for as long as an access token can live.
+type SessionStore struct {
+	db        *sql.DB
+	redis     *redis.Client
+	accessTTL time.Duration
+	onRevoke  func(userID, deviceID, sessionID string)
+}
+
+func NewSessionStore(db *sql.DB, redisClient *redis.Client, accessTokenDuration time.Duration) *SessionStore {
+	return &SessionStore{
+		db:        db,
+		redis:     redisClient,
+		accessTTL: accessTokenDuration,
+	}
+}
+
+// OnRevoke registers a function called for every revoked session, e.g. to
+// close its live connections. It must be called before the store is used.
+func (s *SessionStore) OnRevoke(fn func(userID, deviceID, sessionID string)) {
+	s.onRevoke = fn
+}
+
+func revokedSessionKey(sessionID string) string {
+	return fmt.Sprintf("revoked_session:%s", sessionID)
+}
+
+// HashToken returns the hex SHA-256 of a token, as stored in user_sessions
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession starts a token family for a device login
+func (s *SessionStore) CreateSession(ctx context.Context, session *Session, accessToken, refreshToken string) error {
+	result, err := s.db.ExecContext(ctx,
+		`INSERT INTO user_sessions (id, user_id, device_id, token_hash, refresh_token_hash, expires_at, ip_address, user_agent)
+		SELECT $1::uuid, $2::uuid, ud.id, $4::varchar, $5::varchar, $6::timestamptz, NULLIF($7, '')::inet, NULLIF($8::text, '')
+		FROM user_devices ud
+		WHERE ud.device_id = $3 AND ud.user_id = $2`,
+		session.ID, session.UserID, session.DeviceID,
+		HashToken(accessToken), HashToken(refreshToken), session.ExpiresAt,
+		session.IPAddress, session.UserAgent,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrSessionDeviceAbsent
+	}
+	return nil
+}
+
+// RotateSession swaps the family's current refresh token for a new one.
+//
+// If oldRefresh is not the current token but the family still exists, the
+// token was already rotated and is being replayed: either the client or an
+// attacker holds a stolen copy, so the whole family is revoked and
+// ErrRefreshTokenReused is returned.
+func (s *SessionStore) RotateSession(ctx context.Context, sessionID, oldRefresh, newAccess, newRefresh string, expiresAt time.Time) error {
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE user_sessions
+		SET refresh_token_hash = $3, token_hash = $4, expires_at = $5, last_used = NOW()
+		WHERE id = $1 AND refresh_token_hash = $2 AND expires_at > NOW()`,
+		sessionID, HashToken(oldRefresh), HashToken(newRefresh), HashToken(newAccess), expiresAt,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 1 {
+		return nil
+	}
+
+	var userID, deviceID string
+	err = s.db.QueryRowContext(ctx,
+		`DELETE FROM user_sessions s
+		USING user_devices ud
+		WHERE s.id = $1 AND s.refresh_token_hash <> $2 AND ud.id = s.device_id
+		RETURNING s.user_id, ud.device_id`,
+		sessionID, HashToken(oldRefresh),
+	).Scan(&userID, &deviceID)
+	if err == sql.ErrNoRows {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	s.revoked(ctx, userID, deviceID, sessionID)
+	return ErrRefreshTokenReused
+}
+
+// RevokeSession ends one of a user's sessions, invalidating its refresh
+// token and its access tokens
+func (s *SessionStore) RevokeSession(ctx context.Context, sessionID, userID string) error {
+	var deviceID string
+	err := s.db.QueryRowContext(ctx,
+		`DELETE FROM user_sessions s
+		USING user_devices ud
+		WHERE s.id = $1 AND s.user_id = $2 AND ud.id = s.device_id
+		RETURNING ud.device_id`,
+		sessionID, userID,
+	).Scan(&deviceID)
+	if err == sql.ErrNoRows {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	s.revoked(ctx, userID, deviceID, sessionID)
+	return nil
+}
+
+// RevokeAllSessions ends every session of a user and returns how many
+func (s *SessionStore) RevokeAllSessions(ctx context.Context, userID string) (int, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`DELETE FROM user_sessions s
+		USING user_devices ud
+		WHERE s.user_id = $1 AND ud.id = s.device_id
+		RETURNING s.id, ud.device_id`,
+		userID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return s.revokeRows(ctx, userID, rows)
+}
+
+// RevokeDevice ends every session of a device and removes it from the
+// user's account, so it no longer receives messages and must log in again
+func (s *SessionStore) RevokeDevice(ctx context.Context, userID, deviceID string) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx,
+		`DELETE FROM user_sessions s
+		USING user_devices ud
+		WHERE ud.device_id = $1 AND ud.user_id = $2 AND s.device_id = ud.id
+		RETURNING s.id`,
+		deviceID, userID,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	var sessionIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		sessionIDs = append(sessionIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx,
+		"DELETE FROM user_devices WHERE device_id = $1 AND user_id = $2",
+		deviceID, userID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return 0, ErrSessionDeviceAbsent
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range sessionIDs {
+		s.revoked(ctx, userID, deviceID, id)
+	}
+	// Also drops connections made with tokens from before sessions were tracked
+	if s.onRevoke != nil {
+		s.onRevoke(userID, deviceID, "")
+	}
+
+	return len(sessionIDs), nil
+}
+
+// IsRevoked reports whether a session was revoked while its access tokens
+// may still be valid
+func (s *SessionStore) IsRevoked(ctx context.Context, sessionID string) (bool, error) {
+	n, err := s.redis.Exists(ctx, revokedSessionKey(sessionID)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// ListSessions returns a user's active sessions, most recently used first
+func (s *SessionStore) ListSessions(ctx context.Context, userID, currentSessionID string) ([]*SessionInfo, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT s.id, ud.device_id, COALESCE(ud.name, ''), ud.platform,
+		        COALESCE(host(s.ip_address), ''), COALESCE(s.user_agent, ''),
+		        s.created_at, s.last_used, s.expires_at
+		FROM user_sessions s
+		JOIN user_devices ud ON ud.id = s.device_id
+		WHERE s.user_id = $1 AND s.expires_at > NOW()
+		ORDER BY s.last_used DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]*SessionInfo, 0)
+	for rows.Next() {
+		var info SessionInfo
+		err := rows.Scan(&info.ID, &info.DeviceID, &info.DeviceName, &info.Platform,
+			&info.IPAddress, &info.UserAgent, &info.CreatedAt, &info.LastUsed, &info.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		info.Current = info.ID == currentSessionID
+		sessions = append(sessions, &info)
+	}
+
+	return sessions, rows.Err()
+}
+
+// ListDevices returns a user's registered devices with their active sessions
+func (s *SessionStore) ListDevices(ctx context.Context, userID, currentDeviceID string) ([]*DeviceInfo, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT ud.device_id, COALESCE(ud.name, ''), ud.platform, ud.last_active, ud.created_at,
+		        COUNT(s.id) FILTER (WHERE s.expires_at > NOW())
+		FROM user_devices ud
+		LEFT JOIN user_sessions s ON s.device_id = ud.id
+		WHERE ud.user_id = $1
+		GROUP BY ud.id
+		ORDER BY ud.last_active DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := make([]*DeviceInfo, 0)
+	for rows.Next() {
+		var info DeviceInfo
+		err := rows.Scan(&info.DeviceID, &info.Name, &info.Platform,
+			&info.LastActive, &info.CreatedAt, &info.ActiveSessions)
+		if err != nil {
+			return nil, err
+		}
+		info.Current = info.DeviceID == currentDeviceID
+		devices = append(devices, &info)
+	}
+
+	return devices, rows.Err()
+}
+
+// revokeRows revokes the sessions returned as (id, device_id) rows
+func (s *SessionStore) revokeRows(ctx context.Context, userID string, rows *sql.Rows) (int, error) {
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var sessionID, deviceID string
+		if err := rows.Scan(&sessionID, &deviceID); err != nil {
+			return count, err
+		}
+		s.revoked(ctx, userID, deviceID, sessionID)
+		count++
+	}
+	return count, rows.Err()
+}
+
+// revoked denylists a deleted session's access tokens and closes its
+// connections
+func (s *SessionStore) revoked(ctx context.Context, userID, deviceID, sessionID string) {
+	if s.redis != nil && s.accessTTL > 0 {
+		if err := s.redis.Set(ctx, revokedSessionKey(sessionID), userID, s.accessTTL).Err(); err != nil {
+			log.Printf("[Auth] Failed to denylist session %s: %v", sessionID, err)
+		}
+	}
+
+	if s.onRevoke != nil {
+		s.onRevoke(userID, deviceID, sessionID)
+	}
+
+	log.Printf("[Auth] Session revoked: UserID=%s DeviceID=%s SessionID=%s", userID, deviceID, sessionID)
+}
@@ -0,0 +1,330 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Signing algorithms. HS256 uses the shared JWT_SECRET; the others use the
+// key pairs in jwt_signing_keys.
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// Signing key statuses
+const (
+	KeyPending = "pending" // Published in the JWKS, not signing yet
+	KeyActive  = "active"  // Signs new tokens
+	KeyRetired = "retired" // Only verifies tokens until it expires
+)
+
+const rsaKeyBits = 2048
+
+var (
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+	ErrSigningKeyNotFound   = errors.New("signing key not found")
+	ErrNoSigningKey         = errors.New("no active signing key")
+	ErrRetireActiveKey      = errors.New("activate another key before retiring the active one")
+)
+
+// SigningKey is an asymmetric key pair for signing tokens, identified in
+// token headers by its kid
+type SigningKey struct {
+	ID          string
+	Algorithm   string
+	Status      string
+	PrivateKey  crypto.Signer
+	PublicKey   crypto.PublicKey
+	CreatedAt   time.Time
+	ActivatedAt *time.Time
+	ExpiresAt   *time.Time
+}
+
+// Method returns the JWT signing method of the key
+func (k *SigningKey) Method() jwt.SigningMethod {
+	if k.Algorithm == AlgEdDSA {
+		return jwt.SigningMethodEdDSA
+	}
+	return jwt.SigningMethodRS256
+}
+
+// Expired reports whether a retired key may no longer verify tokens
+func (k *SigningKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !k.ExpiresAt.After(now)
+}
+
+// GenerateSigningKey creates a new pending key pair
+func GenerateSigningKey(algorithm string) (*SigningKey, error) {
+	var private crypto.Signer
+	switch algorithm {
+	case AlgRS256:
+		key, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+		if err != nil {
+			return nil, err
+		}
+		private = key
+	case AlgEdDSA:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		private = key
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &SigningKey{
+		ID:         fmt.Sprintf("%s-%s", now.UTC().Format("20060102"), hex.EncodeToString(suffix)),
+		Algorithm:  algorithm,
+		Status:     KeyPending,
+		PrivateKey: private,
+		PublicKey:  private.Public(),
+		CreatedAt:  now,
+	}, nil
+}
+
+// KeyStore keeps the signing keys in the jwt_signing_keys table, so every
+// instance signs and verifies with the same set
+type KeyStore struct {
+	db *sql.DB
+}
+
+func NewKeyStore(db *sql.DB) *KeyStore {
+	return &KeyStore{db: db}
+}
+
+// Create stores a new key with its current status
+func (s *KeyStore) Create(ctx context.Context, key *SigningKey) error {
+	privatePEM, publicPEM, err := encodeKeyPair(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO jwt_signing_keys (kid, algorithm, private_key, public_key, status, created_at, activated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		key.ID, key.Algorithm, privatePEM, publicPEM, key.Status, key.CreatedAt, key.ActivatedAt,
+	)
+	return err
+}
+
+// Bootstrap makes sure there is an active key, creating one with the given
+// algorithm if needed. It is safe to run from several instances at once.
+func (s *KeyStore) Bootstrap(ctx context.Context, algorithm string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM jwt_signing_keys WHERE status = 'active')",
+	).Scan(&exists)
+	if err != nil || exists {
+		return false, err
+	}
+
+	key, err := GenerateSigningKey(algorithm)
+	if err != nil {
+		return false, err
+	}
+	privatePEM, publicPEM, err := encodeKeyPair(key)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := s.db.ExecContext(ctx,
+		`INSERT INTO jwt_signing_keys (kid, algorithm, private_key, public_key, status, activated_at)
+		VALUES ($1, $2, $3, $4, 'active', NOW())
+		ON CONFLICT (status) WHERE status = 'active' DO NOTHING`,
+		key.ID, key.Algorithm, privatePEM, publicPEM,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n == 1, nil
+}
+
+// List returns the keys that can still verify tokens, newest first. With
+// includeExpired it also returns retired keys past their expiry.
+func (s *KeyStore) List(ctx context.Context, includeExpired bool) ([]*SigningKey, error) {
+	query := `SELECT kid, algorithm, private_key, status, created_at, activated_at, expires_at
+		FROM jwt_signing_keys`
+	if !includeExpired {
+		query += " WHERE expires_at IS NULL OR expires_at > NOW()"
+	}
+	query += " ORDER BY created_at DESC"
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*SigningKey
+	for rows.Next() {
+		var key SigningKey
+		var privatePEM string
+		var activatedAt, expiresAt sql.NullTime
+
+		err := rows.Scan(&key.ID, &key.Algorithm, &privatePEM, &key.Status,
+			&key.CreatedAt, &activatedAt, &expiresAt)
+		if err != nil {
+			return nil, err
+		}
+
+		key.PrivateKey, err = decodePrivateKey(privatePEM)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", key.ID, err)
+		}
+		key.PublicKey = key.PrivateKey.Public()
+		if activatedAt.Valid {
+			key.ActivatedAt = &activatedAt.Time
+		}
+		if expiresAt.Valid {
+			key.ExpiresAt = &expiresAt.Time
+		}
+
+		keys = append(keys, &key)
+	}
+
+	return keys, rows.Err()
+}
+
+// Activate makes a pending key the signing key. The previous active key is
+// retired but keeps verifying for retireAfter, which should cover the
+// lifetime of the tokens it signed.
+func (s *KeyStore) Activate(ctx context.Context, kid string, retireAfter time.Duration) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRowContext(ctx,
+		"SELECT status FROM jwt_signing_keys WHERE kid = $1 FOR UPDATE", kid,
+	).Scan(&status)
+	if err == sql.ErrNoRows {
+		return ErrSigningKeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if status == KeyActive {
+		return nil
+	}
+	if status != KeyPending {
+		return fmt.Errorf("key %s is %s, only pending keys can be activated", kid, status)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE jwt_signing_keys
+		SET status = 'retired', expires_at = NOW() + make_interval(secs => $1)
+		WHERE status = 'active'`,
+		retireAfter.Seconds(),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE jwt_signing_keys SET status = 'active', activated_at = NOW() WHERE kid = $1",
+		kid,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Retire stops a key from verifying tokens after the given delay. A delay
+// of 0 invalidates its tokens immediately, e.g. if the key leaked.
+func (s *KeyStore) Retire(ctx context.Context, kid string, after time.Duration) error {
+	var status string
+	err := s.db.QueryRowContext(ctx,
+		"SELECT status FROM jwt_signing_keys WHERE kid = $1", kid,
+	).Scan(&status)
+	if err == sql.ErrNoRows {
+		return ErrSigningKeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if status == KeyActive {
+		return ErrRetireActiveKey
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		`UPDATE jwt_signing_keys
+		SET status = 'retired', expires_at = NOW() + make_interval(secs => $2)
+		WHERE kid = $1`,
+		kid, after.Seconds(),
+	)
+	return err
+}
+
+// Prune deletes retired keys that no longer verify anything
+func (s *KeyStore) Prune(ctx context.Context) (int64, error) {
+	result, err := s.db.ExecContext(ctx,
+		"DELETE FROM jwt_signing_keys WHERE status = 'retired' AND expires_at <= NOW()",
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// encodeKeyPair returns the PKCS#8 private key and PKIX public key as PEM
+func encodeKeyPair(key *SigningKey) (string, string, error) {
+	private, err := x509.MarshalPKCS8PrivateKey(key.PrivateKey)
+	if err != nil {
+		return "", "", err
+	}
+	public, err := x509.MarshalPKIXPublicKey(key.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	privatePEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: private})
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})
+	return string(privatePEM), string(publicPEM), nil
+}
+
+func decodePrivateKey(data string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("invalid PEM private key")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+}
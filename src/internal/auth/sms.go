@@ -2,138 +2,104 @@ package auth
 
 import (
 	"context"
-	"crypto/rand"
+	"errors"
 	"fmt"
-	"log"
-	"math/big"
 	"time"
+
+	"chat-e2ee/internal/config"
 )
 
-// SMSProvider interface allows for different SMS providers
+// SMSProvider interface allows for different SMS providers (see the sms
+// package)
 type SMSProvider interface {
 	SendSMS(ctx context.Context, to, message string) error
 }
 
-// MockSMSProvider for development/testing
-type MockSMSProvider struct{}
+// Common OTP errors
+var (
+	ErrOTPNotFound         = errors.New("OTP not found or expired")
+	ErrTooManyOTPRequests  = errors.New("too many OTP requests, please try again later")
+	ErrOTPAttemptsExceeded = errors.New("too many failed attempts, OTP invalidated")
+)
 
-func (m *MockSMSProvider) SendSMS(ctx context.Context, to, message string) error {
-	log.Printf("[MOCK SMS] To: %s, Message: %s", to, message)
-	return nil
+// Lockout levels are forgotten after this long without a new lockout
+const lockoutMemory = 24 * time.Hour
+
+// InvalidOTPError is returned for a wrong code that still leaves attempts
+type InvalidOTPError struct {
+	AttemptsLeft int
 }
 
-// TwilioProvider for production use
-type TwilioProvider struct {
-	accountSID string
-	authToken  string
-	fromNumber string
-	// In production, you'd use the Twilio Go SDK here
+func (e *InvalidOTPError) Error() string {
+	return "invalid OTP"
 }
 
-func NewTwilioProvider(accountSID, authToken, fromNumber string) *TwilioProvider {
-	return &TwilioProvider{
-		accountSID: accountSID,
-		authToken:  authToken,
-		fromNumber: fromNumber,
-	}
+// LockedError is returned while a phone number or email is locked out
+type LockedError struct {
+	RetryAfter time.Duration
 }
 
-func (t *TwilioProvider) SendSMS(ctx context.Context, to, message string) error {
-	// TODO: Implement actual Twilio integration
-	// For now, just log
-	log.Printf("[TWILIO] Would send SMS to %s: %s", to, message)
-	return nil
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("too many failed attempts, try again in %s", e.RetryAfter.Round(time.Second))
 }
 
-// SMSService handles OTP generation and verification
+// SMSService handles OTP generation and verification for phone numbers
 type SMSService struct {
-	provider     SMSProvider
-	otpStore     OTPStore
-	otpLength    int
-	otpExpiryMin int
+	provider SMSProvider
+	codes    *otpCodes
 }
 
 // OTPStore interface for storing OTPs (Redis implementation)
 type OTPStore interface {
 	SetOTP(ctx context.Context, phone, otp string, expiry time.Duration) error
 	GetOTP(ctx context.Context, phone string) (string, error)
+	TakeOTP(ctx context.Context, phone string) (string, error)
 	DeleteOTP(ctx context.Context, phone string) error
-	IncrementAttempts(ctx context.Context, phone string) (int, error)
+	IncrementAttempts(ctx context.Context, name string, window time.Duration) (int, error)
+	ResetAttempts(ctx context.Context, name string) error
+	SetLockout(ctx context.Context, phone string, duration time.Duration) error
+	GetLockout(ctx context.Context, phone string) (time.Duration, error)
 }
 
-func NewSMSService(provider SMSProvider, store OTPStore) *SMSService {
+// NewSMSService creates the OTP service. A phone number gets cfg.MaxAttempts
+// tries per code; after that the code is discarded and the number is locked
+// out, for cfg.Lockout the first time and twice as long each time after, up
+// to cfg.MaxLockout.
+func NewSMSService(provider SMSProvider, store OTPStore, audit *AuditLog, cfg config.OTPConfig) *SMSService {
 	return &SMSService{
-		provider:     provider,
-		otpStore:     store,
-		otpLength:    6,
-		otpExpiryMin: 5, // OTP expires in 5 minutes
+		provider: provider,
+		codes:    newOTPCodes(store, audit, cfg, 5*time.Minute), // OTP expires in 5 minutes
 	}
 }
 
 // GenerateOTP creates a random numeric OTP
 func (s *SMSService) GenerateOTP() (string, error) {
-	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(s.otpLength)), nil)
-	n, err := rand.Int(rand.Reader, max)
-	if err != nil {
-		return "", err
-	}
-
-	// Pad with zeros if necessary
-	format := fmt.Sprintf("%%0%dd", s.otpLength)
-	return fmt.Sprintf(format, n), nil
+	return s.codes.generate()
 }
 
 // SendOTP generates and sends an OTP to the phone number
-func (s *SMSService) SendOTP(ctx context.Context, phoneNumber string) error {
-	// Check rate limiting (max 3 OTPs per hour)
-	attempts, err := s.otpStore.IncrementAttempts(ctx, "attempts:"+phoneNumber)
-	if err == nil && attempts > 3 {
-		return fmt.Errorf("too many OTP requests, please try again later")
-	}
+func (s *SMSService) SendOTP(ctx context.Context, phoneNumber, ip string) error {
+	subject := phoneSubject(phoneNumber)
 
-	// Generate OTP
-	otp, err := s.GenerateOTP()
+	otp, err := s.codes.issue(ctx, subject, ip)
 	if err != nil {
-		return fmt.Errorf("failed to generate OTP: %w", err)
-	}
-
-	// Store OTP with expiry
-	expiry := time.Duration(s.otpExpiryMin) * time.Minute
-	if err := s.otpStore.SetOTP(ctx, phoneNumber, otp, expiry); err != nil {
-		return fmt.Errorf("failed to store OTP: %w", err)
+		return err
 	}
 
 	// Send SMS
-	message := fmt.Sprintf("Your Chat E2EE verification code is: %s\nValid for %d minutes.", otp, s.otpExpiryMin)
+	message := fmt.Sprintf("Your Chat E2EE verification code is: %s\nValid for %d minutes.", otp, int(s.codes.expiry.Minutes()))
 	if err := s.provider.SendSMS(ctx, phoneNumber, message); err != nil {
 		// Delete OTP if SMS fails
-		_ = s.otpStore.DeleteOTP(ctx, phoneNumber)
+		s.codes.discard(ctx, subject)
 		return fmt.Errorf("failed to send SMS: %w", err)
 	}
 
 	return nil
 }
 
-// VerifyOTP checks if the provided OTP is valid
-func (s *SMSService) VerifyOTP(ctx context.Context, phoneNumber, otp string) error {
-	// Get stored OTP
-	storedOTP, err := s.otpStore.GetOTP(ctx, phoneNumber)
-	if err != nil {
-		return fmt.Errorf("OTP not found or expired")
-	}
-
-	// Compare OTPs
-	if storedOTP != otp {
-		return fmt.Errorf("invalid OTP")
-	}
-
-	// Delete OTP after successful verification
-	if err := s.otpStore.DeleteOTP(ctx, phoneNumber); err != nil {
-		log.Printf("Failed to delete OTP for %s: %v", phoneNumber, err)
-	}
-
-	// Clear rate limit attempts on successful verification
-	_ = s.otpStore.DeleteOTP(ctx, "attempts:"+phoneNumber)
-
-	return nil
+// VerifyOTP checks if the provided OTP is valid. Wrong codes return an
+// *InvalidOTPError; the last allowed failure discards the code and locks
+// the number out, returning a *LockedError.
+func (s *SMSService) VerifyOTP(ctx context.Context, phoneNumber, otp, ip string) error {
+	return s.codes.verify(ctx, phoneSubject(phoneNumber), otp, ip)
 }
@@ -0,0 +1,554 @@
+package auth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"chat-e2ee/internal/config"
+)
+
+// TOTP parameters (RFC 6238), the defaults every authenticator app supports
+const (
+	totpPeriod = 30 // Seconds per code
+	totpDigits = 6
+	totpSkew   = 1 // Codes accepted either side of the current one, for clock drift
+)
+
+const (
+	recoveryCodeCount = 10
+	// Wrong second factor codes are counted per user over this window
+	twoFactorWindow = 15 * time.Minute
+	// How long a login waiting for its second factor stays open
+	challengeTTL = 5 * time.Minute
+)
+
+var (
+	ErrTwoFactorUnavailable = errors.New("two-factor authentication is not configured")
+	ErrTOTPAlreadyEnabled   = errors.New("two-factor authentication already enabled")
+	ErrTOTPNotEnrolled      = errors.New("two-factor authentication not enrolled")
+	ErrInvalidTwoFactorCode = errors.New("invalid two-factor code")
+	ErrTwoFactorLocked      = errors.New("too many failed two-factor attempts, try again later")
+	ErrChallengeNotFound    = errors.New("two-factor challenge not found or expired")
+)
+
+var (
+	totpCodePattern = regexp.MustCompile(`^\d{6}$`)
+	base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// LoginChallenge is a login whose first factor passed and that waits for
+// the second one
+type LoginChallenge struct {
+	UserID     string `json:"user_id"`
+	IsNewUser  bool   `json:"is_new_user"`
+	DeviceID   string `json:"device_id"`
+	DeviceName string `json:"device_name"`
+	PublicKey  string `json:"public_key"`
+}
+
+// TwoFactor manages TOTP second factors and their recovery codes
+type TwoFactor struct {
+	db          *sql.DB
+	store       OTPStore
+	audit       *AuditLog
+	issuer      string
+	aead        cipher.AEAD // Nil if no encryption key is configured
+	maxAttempts int
+}
+
+// NewTwoFactor creates the second factor service. Without an encryption key
+// users can't enroll.
+func NewTwoFactor(db *sql.DB, store OTPStore, audit *AuditLog, cfg config.TwoFactorConfig, otpCfg config.OTPConfig) (*TwoFactor, error) {
+	t := &TwoFactor{
+		db:          db,
+		store:       store,
+		audit:       audit,
+		issuer:      cfg.Issuer,
+		maxAttempts: otpCfg.MaxAttempts,
+	}
+
+	if cfg.EncryptionKey != "" {
+		key := sha256.Sum256([]byte(cfg.EncryptionKey))
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, err
+		}
+		if t.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// Available reports whether users can enroll
+func (t *TwoFactor) Available() bool {
+	return t.aead != nil
+}
+
+// Enabled reports whether a user has a confirmed second factor
+func (t *TwoFactor) Enabled(ctx context.Context, userID string) (bool, error) {
+	var enabled bool
+	err := t.db.QueryRowContext(ctx,
+		"SELECT confirmed_at IS NOT NULL FROM user_totp WHERE user_id = $1",
+		userID,
+	).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// Status returns whether the second factor is enabled and how many unused
+// recovery codes are left
+func (t *TwoFactor) Status(ctx context.Context, userID string) (bool, int, error) {
+	enabled, err := t.Enabled(ctx, userID)
+	if err != nil || !enabled {
+		return false, 0, err
+	}
+
+	var left int
+	err = t.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM user_recovery_codes WHERE user_id = $1 AND used_at IS NULL",
+		userID,
+	).Scan(&left)
+	return true, left, err
+}
+
+// Enroll creates a new TOTP secret for the user, replacing any unconfirmed
+// one, and returns it with its otpauth:// URI for authenticator apps. The
+// second factor is enabled by Confirm.
+func (t *TwoFactor) Enroll(ctx context.Context, userID, account string) (string, string, error) {
+	if t.aead == nil {
+		return "", "", ErrTwoFactorUnavailable
+	}
+
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	encrypted, err := t.encrypt(raw)
+	if err != nil {
+		return "", "", err
+	}
+
+	result, err := t.db.ExecContext(ctx,
+		`INSERT INTO user_totp (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, last_used_step = 0, created_at = NOW()
+		WHERE user_totp.confirmed_at IS NULL`,
+		userID, encrypted,
+	)
+	if err != nil {
+		return "", "", err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return "", "", ErrTOTPAlreadyEnabled
+	}
+
+	secret := base32NoPadding.EncodeToString(raw)
+	label := url.PathEscape(t.issuer + ":" + account)
+	params := url.Values{
+		"secret":    {secret},
+		"issuer":    {t.issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return secret, "otpauth://totp/" + label + "?" + params.Encode(), nil
+}
+
+// Confirm enables the second factor with a first code from the
+// authenticator app, and returns a fresh set of recovery codes
+func (t *TwoFactor) Confirm(ctx context.Context, userID, code, ip string) ([]string, error) {
+	secret, confirmed, lastStep, err := t.secret(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if confirmed {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	if err := t.countAttempt(ctx, userID, ip); err != nil {
+		return nil, err
+	}
+
+	step, ok := totpMatch(secret, code, time.Now())
+	if !ok || step <= lastStep {
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx,
+		"UPDATE user_totp SET confirmed_at = NOW(), last_used_step = $2 WHERE user_id = $1 AND confirmed_at IS NULL",
+		userID, step,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	_ = t.store.ResetAttempts(ctx, "2fa:"+userID)
+	t.audit.Record(ctx, &AuditEvent{
+		Event:     AuditTOTPEnabled,
+		IPAddress: ip,
+		Details:   map[string]interface{}{"user_id": userID},
+	})
+
+	return codes, nil
+}
+
+// Disable removes the second factor and its recovery codes. It takes a
+// current TOTP or recovery code.
+func (t *TwoFactor) Disable(ctx context.Context, userID, code, ip string) error {
+	if err := t.Verify(ctx, userID, code, ip); err != nil {
+		return err
+	}
+
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_totp WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	t.audit.Record(ctx, &AuditEvent{
+		Event:     AuditTOTPDisabled,
+		IPAddress: ip,
+		Details:   map[string]interface{}{"user_id": userID},
+	})
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes. It takes a
+// current TOTP code; a recovery code is not enough.
+func (t *TwoFactor) RegenerateRecoveryCodes(ctx context.Context, userID, code, ip string) ([]string, error) {
+	if !totpCodePattern.MatchString(code) {
+		return nil, ErrInvalidTwoFactorCode
+	}
+	if err := t.Verify(ctx, userID, code, ip); err != nil {
+		return nil, err
+	}
+
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	t.audit.Record(ctx, &AuditEvent{
+		Event:     AuditRecoveryRotate,
+		IPAddress: ip,
+		Details:   map[string]interface{}{"user_id": userID},
+	})
+	return codes, nil
+}
+
+// Verify checks a second factor: a 6-digit TOTP code, accepted once, or an
+// unused recovery code, which is then spent. Wrong codes count towards
+// ErrTwoFactorLocked.
+func (t *TwoFactor) Verify(ctx context.Context, userID, code, ip string) error {
+	if err := t.countAttempt(ctx, userID, ip); err != nil {
+		return err
+	}
+
+	var ok bool
+	var err error
+	if totpCodePattern.MatchString(code) {
+		ok, err = t.useTOTP(ctx, userID, code)
+	} else {
+		ok, err = t.useRecoveryCode(ctx, userID, code, ip)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		t.audit.Record(ctx, &AuditEvent{
+			Event:     AuditTOTPFailed,
+			IPAddress: ip,
+			Details:   map[string]interface{}{"user_id": userID},
+		})
+		return ErrInvalidTwoFactorCode
+	}
+
+	_ = t.store.ResetAttempts(ctx, "2fa:"+userID)
+	return nil
+}
+
+// NewChallenge stores a login waiting for its second factor and returns the
+// token that completes it
+func (t *TwoFactor) NewChallenge(ctx context.Context, login *LoginChallenge) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	data, err := json.Marshal(login)
+	if err != nil {
+		return "", err
+	}
+	if err := t.store.SetOTP(ctx, challengeKey(token), string(data), challengeTTL); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Challenge returns the login waiting on a token. It stays open for more
+// attempts until EndChallenge.
+func (t *TwoFactor) Challenge(ctx context.Context, token string) (*LoginChallenge, error) {
+	data, err := t.store.GetOTP(ctx, challengeKey(token))
+	if err != nil {
+		return nil, ErrChallengeNotFound
+	}
+
+	var login LoginChallenge
+	if err := json.Unmarshal([]byte(data), &login); err != nil {
+		return nil, ErrChallengeNotFound
+	}
+	return &login, nil
+}
+
+// EndChallenge closes a login challenge
+func (t *TwoFactor) EndChallenge(ctx context.Context, token string) {
+	_ = t.store.DeleteOTP(ctx, challengeKey(token))
+}
+
+// countAttempt counts a second factor attempt, failing once the user is
+// over the limit
+func (t *TwoFactor) countAttempt(ctx context.Context, userID, ip string) error {
+	attempts, err := t.store.IncrementAttempts(ctx, "2fa:"+userID, twoFactorWindow)
+	if err != nil {
+		return fmt.Errorf("failed to count attempt: %w", err)
+	}
+	if attempts > t.maxAttempts {
+		t.audit.Record(ctx, &AuditEvent{
+			Event:     AuditTOTPLocked,
+			IPAddress: ip,
+			Details:   map[string]interface{}{"user_id": userID, "attempt": attempts},
+		})
+		return ErrTwoFactorLocked
+	}
+	return nil
+}
+
+// useTOTP accepts a code newer than the last one used, so it can't be
+// replayed within its validity window
+func (t *TwoFactor) useTOTP(ctx context.Context, userID, code string) (bool, error) {
+	secret, confirmed, lastStep, err := t.secret(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	if !confirmed {
+		return false, ErrTOTPNotEnrolled
+	}
+
+	step, ok := totpMatch(secret, code, time.Now())
+	if !ok || step <= lastStep {
+		return false, nil
+	}
+
+	result, err := t.db.ExecContext(ctx,
+		"UPDATE user_totp SET last_used_step = $2 WHERE user_id = $1 AND last_used_step < $2",
+		userID, step,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n == 1, nil
+}
+
+func (t *TwoFactor) useRecoveryCode(ctx context.Context, userID, code, ip string) (bool, error) {
+	result, err := t.db.ExecContext(ctx,
+		`UPDATE user_recovery_codes SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+		userID, hashRecoveryCode(code),
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	var left int
+	t.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM user_recovery_codes WHERE user_id = $1 AND used_at IS NULL",
+		userID,
+	).Scan(&left)
+
+	t.audit.Record(ctx, &AuditEvent{
+		Event:     AuditRecoveryUsed,
+		IPAddress: ip,
+		Details:   map[string]interface{}{"user_id": userID, "codes_left": left},
+	})
+	return true, nil
+}
+
+// secret loads and decrypts a user's TOTP secret
+func (t *TwoFactor) secret(ctx context.Context, userID string) ([]byte, bool, int64, error) {
+	var encrypted string
+	var confirmed bool
+	var lastStep int64
+	err := t.db.QueryRowContext(ctx,
+		"SELECT secret, confirmed_at IS NOT NULL, last_used_step FROM user_totp WHERE user_id = $1",
+		userID,
+	).Scan(&encrypted, &confirmed, &lastStep)
+	if err == sql.ErrNoRows {
+		return nil, false, 0, ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return nil, false, 0, err
+	}
+
+	secret, err := t.decrypt(encrypted)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	return secret, confirmed, lastStep, nil
+}
+
+// encrypt seals a secret with AES-GCM as base64(nonce || ciphertext)
+func (t *TwoFactor) encrypt(plaintext []byte) (string, error) {
+	nonce := make([]byte, t.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := t.aead.Seal(nonce, nonce, plaintext, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (t *TwoFactor) decrypt(encoded string) ([]byte, error) {
+	if t.aead == nil {
+		return nil, ErrTwoFactorUnavailable
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < t.aead.NonceSize() {
+		return nil, errors.New("malformed TOTP secret")
+	}
+
+	nonce, ciphertext := sealed[:t.aead.NonceSize()], sealed[t.aead.NonceSize():]
+	plaintext, err := t.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt TOTP secret, was TOTP_ENCRYPTION_KEY changed? %w", err)
+	}
+	return plaintext, nil
+}
+
+// replaceRecoveryCodes deletes a user's recovery codes and returns a new
+// set. Only their hashes are stored.
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID string) ([]string, error) {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 7)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		// 10 base32 characters (50 bits), shown as xxxxx-xxxxx
+		encoded := strings.ToLower(base32NoPadding.EncodeToString(raw))[:10]
+		codes[i] = encoded[:5] + "-" + encoded[5:]
+
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO user_recovery_codes (user_id, code_hash) VALUES ($1, $2)",
+			userID, hashRecoveryCode(codes[i]),
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, nil
+}
+
+// hashRecoveryCode ignores case, spaces and dashes, as users retype them
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(hash[:])
+}
+
+func challengeKey(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return "2fa-challenge:" + hex.EncodeToString(hash[:])
+}
+
+// totpCode computes the HOTP value (RFC 4226) of a time step
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// totpMatch returns the time step a code belongs to, if it is within the
+// allowed skew of now
+func totpMatch(secret []byte, code string, now time.Time) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for step := current + totpSkew; step >= current-totpSkew; step-- {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
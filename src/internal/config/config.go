@@ -14,7 +14,14 @@ type Config struct {
 	MinIO     MinIOConfig
 	JWT       JWTConfig
 	SMS       SMSConfig
+	Email     EmailConfig
+	OTP       OTPConfig
+	TwoFactor TwoFactorConfig
 	RateLimit RateLimitConfig
+	Relay     RelayConfig
+	Push      PushConfig
+	Keys      KeysConfig
+	Groups    GroupsConfig
 }
 
 type AppConfig struct {
@@ -23,6 +30,7 @@ type AppConfig struct {
 	Version     string
 	Debug       bool
 	CORSOrigins string
+	ProxyHeader string // Header with the client IP when behind a proxy, e.g. X-Forwarded-For
 }
 
 type DatabaseConfig struct {
@@ -55,20 +63,118 @@ type JWTConfig struct {
 	Secret               string
 	AccessTokenDuration  time.Duration
 	RefreshTokenDuration time.Duration
+	// HS256 signs with Secret; RS256 or EdDSA sign with the keys in
+	// jwt_signing_keys, and pick the algorithm of the first key created
+	Algorithm string
+	// How often instances reload the signing keys
+	KeyRefresh time.Duration
 }
 
 type SMSConfig struct {
-	Provider   string // "twilio" or "mock"
+	Provider   string // "twilio", "http" or "mock"
 	AccountSID string
 	AuthToken  string
 	FromNumber string
+	TwilioURL  string // Twilio API base URL, e.g. the fake gateway in tests
+
+	// Generic HTTP/webhook provider
+	HTTPURL   string
+	HTTPToken string // Bearer token, also the HMAC key of its status callbacks
+	HTTPFrom  string
+
+	// Provider per phone number prefix, e.g. "+1=twilio,+44=http"; numbers
+	// that match no prefix use Provider
+	Routes map[string]string
+
+	MaxAttempts  int           // Send attempts per message, with backoff
+	RetryBackoff time.Duration // Delay before the first retry, doubled on each
+
+	// Public base URL providers post delivery statuses to, without the
+	// provider name, e.g. https://api.example.com/api/v1/sms/status
+	StatusCallbackURL string
+}
+
+type EmailConfig struct {
+	Provider     string // "smtp" or "mock"
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	SMTPTLS      string // "starttls", "tls" (implicit, usually port 465) or "none"
+	From         string // e.g. "Chat E2EE <no-reply@example.com>"
+	// Client URL magic links point to, with ?token= appended; no links are
+	// sent if empty
+	MagicLinkURL string
+	CodeExpiry   time.Duration // How long email codes and magic links are valid
+}
+
+type OTPConfig struct {
+	MaxAttempts int           // Wrong codes allowed before the code is discarded
+	Lockout     time.Duration // First lockout after running out of attempts, doubles on each repeat
+	MaxLockout  time.Duration // Longest lockout
+}
+
+type TwoFactorConfig struct {
+	Issuer        string // Shown by authenticator apps
+	EncryptionKey string // Encrypts TOTP secrets at rest; enrollment is disabled without it
 }
 
 type RateLimitConfig struct {
+	Enabled  bool
+	Requests int                        // Default policy, for routes without their own
+	Window   time.Duration              // Window of the default policy
+	Policies map[string]RateLimitPolicy // Per-route policies by route name
+}
+
+type RateLimitPolicy struct {
 	Requests int
 	Window   time.Duration
 }
 
+type RelayConfig struct {
+	MaxPendingMessages int           // Per-user cap on unacknowledged messages
+	PendingMessageTTL  time.Duration // How long undelivered messages are kept
+	ClusterMode        bool          // Share connected devices with other instances through Redis
+	NodeID             string        // This instance's ID in the cluster, random if empty
+	FrameRate          float64       // Frames per second a connection may send, 0 disables throttling
+	FrameBurst         int           // Frames a connection may send at once before being throttled
+	BlockPolicy        string        // "silent" drops frames between blocked users as if sent, "error" rejects them
+	PresenceTTL        time.Duration // How long a device stays online after its last heartbeat
+}
+
+type PushConfig struct {
+	// Messages for a user within this window share one wake-up per device
+	BatchWindow  time.Duration
+	TTL          time.Duration // How long push services keep a wake-up for an unreachable device
+	MaxAttempts  int           // Send attempts per wake-up, with backoff
+	RetryBackoff time.Duration // Delay before the first retry, doubled on each
+
+	// Providers without credentials log wake-ups instead of sending them
+	FCMCredentialsFile string // Service account key file
+	FCMProjectID       string // Overrides the project in the key file
+	FCMURL             string
+
+	APNsKeyFile string // Token signing key (.p8)
+	APNsKeyID   string
+	APNsTeamID  string
+	APNsTopic   string // The iOS app's bundle ID
+	APNsURL     string // https://api.sandbox.push.apple.com for development builds
+
+	VAPIDPrivateKey string // Raw P-256 key, base64url
+	VAPIDSubject    string // mailto: or https: contact for push services
+	// Extra hosts Web Push subscriptions may point to, besides the browser
+	// vendors' push services
+	WebPushHosts []string
+}
+
+type KeysConfig struct {
+	PrekeyLowThreshold int // Devices are warned below this many one-time prekeys
+}
+
+type GroupsConfig struct {
+	MaxMembers int // Members plus pending invites a group may have
+}
+
 func Load() *Config {
 	return &Config{
 		App: AppConfig{
@@ -77,6 +183,7 @@ func Load() *Config {
 			Version:     getEnv("APP_VERSION", "1.0.0"),
 			Debug:       getBoolEnv("APP_DEBUG", false),
 			CORSOrigins: getEnv("CORS_ORIGINS", "http://localhost:3000"),
+			ProxyHeader: getEnv("APP_PROXY_HEADER", ""),
 		},
 		Database: DatabaseConfig{
 			Host:     getEnv("POSTGRES_HOST", "postgres"),
@@ -105,16 +212,88 @@ func Load() *Config {
 			Secret:               getEnv("JWT_SECRET", ""),
 			AccessTokenDuration:  getDurationEnv("JWT_ACCESS_TOKEN_EXPIRE", "15m"),
 			RefreshTokenDuration: getDurationEnv("JWT_REFRESH_TOKEN_EXPIRE", "7d"),
+			Algorithm:            getEnv("JWT_ALGORITHM", "HS256"),
+			KeyRefresh:           getDurationEnv("JWT_KEY_REFRESH", "1m"),
 		},
 		SMS: SMSConfig{
 			Provider:   getEnv("SMS_PROVIDER", "mock"),
 			AccountSID: getEnv("TWILIO_ACCOUNT_SID", ""),
 			AuthToken:  getEnv("TWILIO_AUTH_TOKEN", ""),
 			FromNumber: getEnv("TWILIO_PHONE_NUMBER", ""),
+			TwilioURL:  getEnv("TWILIO_API_URL", "https://api.twilio.com"),
+
+			HTTPURL:   getEnv("SMS_HTTP_URL", ""),
+			HTTPToken: getEnv("SMS_HTTP_TOKEN", ""),
+			HTTPFrom:  getEnv("SMS_HTTP_FROM", ""),
+
+			Routes: getMapEnv("SMS_ROUTES"),
+
+			MaxAttempts:  getIntEnv("SMS_MAX_ATTEMPTS", 3),
+			RetryBackoff: getDurationEnv("SMS_RETRY_BACKOFF", "500ms"),
+
+			StatusCallbackURL: getEnv("SMS_STATUS_CALLBACK_URL", ""),
+		},
+		Email: EmailConfig{
+			Provider:     getEnv("EMAIL_PROVIDER", "mock"),
+			SMTPHost:     getEnv("SMTP_HOST", ""),
+			SMTPPort:     getIntEnv("SMTP_PORT", 587),
+			SMTPUsername: getEnv("SMTP_USERNAME", ""),
+			SMTPPassword: getEnv("SMTP_PASSWORD", ""),
+			SMTPTLS:      getEnv("SMTP_TLS", "starttls"),
+			From:         getEnv("EMAIL_FROM", ""),
+			MagicLinkURL: getEnv("EMAIL_MAGIC_LINK_URL", ""),
+			CodeExpiry:   getDurationEnv("EMAIL_CODE_EXPIRE", "15m"),
+		},
+		OTP: OTPConfig{
+			MaxAttempts: getIntEnv("OTP_MAX_ATTEMPTS", 5),
+			Lockout:     getDurationEnv("OTP_LOCKOUT", "5m"),
+			MaxLockout:  getDurationEnv("OTP_MAX_LOCKOUT", "24h"),
+		},
+		TwoFactor: TwoFactorConfig{
+			Issuer:        getEnv("TOTP_ISSUER", "Chat E2EE"),
+			EncryptionKey: getEnv("TOTP_ENCRYPTION_KEY", ""),
 		},
 		RateLimit: RateLimitConfig{
+			Enabled:  getBoolEnv("RATE_LIMIT_ENABLED", true),
 			Requests: getIntEnv("RATE_LIMIT_REQUESTS", 100),
 			Window:   getDurationEnv("RATE_LIMIT_WINDOW", "1m"),
+			Policies: getPoliciesEnv("RATE_LIMIT_POLICIES", "request-otp=3/15m,verify-otp=5/15m,request-email-otp=3/15m,verify-email-otp=5/15m,verify-2fa=5/15m,refresh=10/1m,upload=30/1m,claim-keys=10/1m"),
+		},
+		Relay: RelayConfig{
+			MaxPendingMessages: getIntEnv("RELAY_MAX_PENDING_MESSAGES", 1000),
+			PendingMessageTTL:  getDurationEnv("RELAY_PENDING_MESSAGE_TTL", "7d"),
+			ClusterMode:        getBoolEnv("RELAY_CLUSTER_MODE", false),
+			NodeID:             getEnv("RELAY_NODE_ID", ""),
+			FrameRate:          getFloatEnv("RELAY_FRAME_RATE", 30),
+			FrameBurst:         getIntEnv("RELAY_FRAME_BURST", 120),
+			BlockPolicy:        getEnv("RELAY_BLOCK_POLICY", "silent"),
+			PresenceTTL:        getDurationEnv("RELAY_PRESENCE_TTL", "2m"),
+		},
+		Push: PushConfig{
+			BatchWindow:  getDurationEnv("PUSH_BATCH_WINDOW", "3s"),
+			TTL:          getDurationEnv("PUSH_TTL", "1d"),
+			MaxAttempts:  getIntEnv("PUSH_MAX_ATTEMPTS", 3),
+			RetryBackoff: getDurationEnv("PUSH_RETRY_BACKOFF", "1s"),
+
+			FCMCredentialsFile: getEnv("FCM_CREDENTIALS_FILE", ""),
+			FCMProjectID:       getEnv("FCM_PROJECT_ID", ""),
+			FCMURL:             getEnv("FCM_API_URL", "https://fcm.googleapis.com"),
+
+			APNsKeyFile: getEnv("APNS_KEY_FILE", ""),
+			APNsKeyID:   getEnv("APNS_KEY_ID", ""),
+			APNsTeamID:  getEnv("APNS_TEAM_ID", ""),
+			APNsTopic:   getEnv("APNS_TOPIC", ""),
+			APNsURL:     getEnv("APNS_API_URL", "https://api.push.apple.com"),
+
+			VAPIDPrivateKey: getEnv("VAPID_PRIVATE_KEY", ""),
+			VAPIDSubject:    getEnv("VAPID_SUBJECT", ""),
+			WebPushHosts:    getListEnv("PUSH_WEBPUSH_HOSTS"),
+		},
+		Keys: KeysConfig{
+			PrekeyLowThreshold: getIntEnv("KEYS_PREKEY_LOW_THRESHOLD", 10),
+		},
+		Groups: GroupsConfig{
+			MaxMembers: getIntEnv("GROUP_MAX_MEMBERS", 256),
 		},
 	}
 }
@@ -146,9 +325,76 @@ func getIntEnv(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getFloatEnv(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		f, err := strconv.ParseFloat(value, 64)
+		if err == nil {
+			return f
+		}
+	}
+	return defaultValue
+}
+
+// getPoliciesEnv parses rate limit policies written as
+// "route=requests/window,route=requests/window", e.g. "upload=30/1m".
+// Routes set in the environment override the same routes in defaultValue.
+func getPoliciesEnv(key string, defaultValue string) map[string]RateLimitPolicy {
+	policies := make(map[string]RateLimitPolicy)
+	parsePolicies(defaultValue, policies)
+	parsePolicies(os.Getenv(key), policies)
+	return policies
+}
+
+func parsePolicies(value string, policies map[string]RateLimitPolicy) {
+	for _, entry := range strings.Split(value, ",") {
+		route, limit, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		requests, window, ok := strings.Cut(limit, "/")
+		if !ok {
+			continue
+		}
+
+		n, err := strconv.Atoi(requests)
+		if err != nil {
+			continue
+		}
+
+		policies[route] = RateLimitPolicy{
+			Requests: n,
+			Window:   parseDuration(window),
+		}
+	}
+}
+
+// getMapEnv parses "key=value,key=value" lists
+func getMapEnv(key string) map[string]string {
+	values := make(map[string]string)
+	for _, entry := range strings.Split(os.Getenv(key), ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if ok && k != "" && v != "" {
+			values[k] = v
+		}
+	}
+	return values
+}
+
+func getListEnv(key string) []string {
+	values := make([]string, 0)
+	for _, entry := range strings.Split(os.Getenv(key), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			values = append(values, entry)
+		}
+	}
+	return values
+}
+
 func getDurationEnv(key string, defaultValue string) time.Duration {
-	value := getEnv(key, defaultValue)
+	return parseDuration(getEnv(key, defaultValue))
+}
 
+func parseDuration(value string) time.Duration {
 	// Handle simple formats like "7d" for 7 days
 	if strings.HasSuffix(value, "d") {
 		days := strings.TrimSuffix(value, "d")
@@ -16,10 +16,17 @@ type Handler struct {
 	db          *sql.DB
 }
 
-// NewHandler creates a new discovery handler
-func NewHandler(db *sql.DB) *Handler {
+// NewHandler creates a new discovery handler. Signed-in viewers don't see
+// models on either side of a block with them, nor the presence of models
+// who haven't approved them. Nobody sees models who turned off discovery in
+// the listings, nor presence models chose to hide.
+func NewHandler(db *sql.DB, blocks *users.Blocks, requests *users.Requests) *Handler {
+	userService := users.NewService(db)
+	userService.UseBlocks(blocks)
+	userService.UseRequests(requests)
+
 	return &Handler{
-		userService: users.NewService(db),
+		userService: userService,
 		db:          db,
 	}
 }
@@ -33,6 +40,7 @@ func (h *Handler) GetModels(c *fiber.Ctx) error {
 		SortBy:     c.Query("sort_by", "active"), // default sort by activity
 		Page:       c.QueryInt("page", 1),
 		PageSize:   c.QueryInt("page_size", 20),
+		ViewerID:   viewerID(c),
 	}
 
 	// Validate pagination
@@ -87,6 +95,7 @@ func (h *Handler) SearchModels(c *fiber.Ctx) error {
 		SortBy:     "active",
 		Page:       1,
 		PageSize:   20,
+		ViewerID:   viewerID(c),
 	}
 
 	// Get models
@@ -108,6 +117,18 @@ func (h *Handler) SearchModels(c *fiber.Ctx) error {
 func (h *Handler) GetModelProfile(c *fiber.Ctx) error {
 	modelID := c.Params("id")
 
+	blocked, err := h.userService.Blocked(c.Context(), viewerID(c), modelID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch model",
+		})
+	}
+	if blocked {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Model not found",
+		})
+	}
+
 	// Get user info
 	user, err := h.userService.GetUser(c.Context(), modelID)
 	if err != nil {
@@ -139,13 +160,26 @@ func (h *Handler) GetModelProfile(c *fiber.Ctx) error {
 		DisplayName: user.DisplayName,
 		AvatarURL:   user.AvatarURL,
 		Status:      user.Status,
-		IsOnline:    user.IsOnline,
-		LastSeen:    user.LastSeen,
 		CreatedAt:   user.CreatedAt,
 		Gallery:     galleryInfo,
 		Metadata:    h.getPublicMetadata(user.Metadata),
 	}
 
+	// Models choose what presence they show, and models who require approval
+	// only show it to their contacts
+	showOnline, showLastSeen, err := h.userService.PresenceVisible(c.Context(), viewerID(c), modelID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch model",
+		})
+	}
+	if showOnline {
+		profile.IsOnline = user.IsOnline
+	}
+	if showLastSeen {
+		profile.LastSeen = &user.LastSeen
+	}
+
 	return c.JSON(profile)
 }
 
@@ -156,6 +190,7 @@ func (h *Handler) GetPopularModels(c *fiber.Ctx) error {
 		SortBy:   "popular",
 		Page:     1,
 		PageSize: c.QueryInt("limit", 12),
+		ViewerID: viewerID(c),
 	}
 
 	if filters.PageSize > 50 {
@@ -183,6 +218,7 @@ func (h *Handler) GetNewModels(c *fiber.Ctx) error {
 		SortBy:   "newest",
 		Page:     1,
 		PageSize: c.QueryInt("limit", 12),
+		ViewerID: viewerID(c),
 	}
 
 	if filters.PageSize > 50 {
@@ -211,6 +247,7 @@ func (h *Handler) GetOnlineModels(c *fiber.Ctx) error {
 		SortBy:     "active",
 		Page:       c.QueryInt("page", 1),
 		PageSize:   c.QueryInt("page_size", 20),
+		ViewerID:   viewerID(c),
 	}
 
 	if filters.PageSize > 100 {
@@ -235,6 +272,12 @@ func (h *Handler) GetOnlineModels(c *fiber.Ctx) error {
 
 // Helper functions
 
+// viewerID is the signed-in user browsing, or empty for anonymous visitors
+func viewerID(c *fiber.Ctx) string {
+	userID, _ := c.Locals("userID").(string)
+	return userID
+}
+
 func (h *Handler) getModelGalleryInfo(ctx context.Context, modelID string) (*ModelGalleryInfo, error) {
 	var info ModelGalleryInfo
 
@@ -12,7 +12,7 @@ type ModelProfileResponse struct {
 	AvatarURL   *string                `json:"avatar_url,omitempty"`
 	Status      string                 `json:"status"`
 	IsOnline    bool                   `json:"is_online"`
-	LastSeen    time.Time              `json:"last_seen"`
+	LastSeen    *time.Time             `json:"last_seen,omitempty"`
 	CreatedAt   time.Time              `json:"created_at"`
 	Gallery     *ModelGalleryInfo      `json:"gallery,omitempty"`
 	Metadata    map[string]interface{} `json:"metadata,omitempty"`
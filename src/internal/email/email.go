@@ -0,0 +1,53 @@
+// Package email sends transactional email, such as login codes, for the
+// auth package's EmailProvider
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"chat-e2ee/internal/config"
+)
+
+// ErrInvalidHeader is returned for recipients or subjects that would inject
+// extra headers
+var ErrInvalidHeader = errors.New("invalid email header value")
+
+// Sender is implemented by every provider; it matches auth.EmailProvider
+type Sender interface {
+	SendEmail(ctx context.Context, to, subject, body string) error
+}
+
+// New returns the provider selected in cfg
+func New(cfg config.EmailConfig) (Sender, error) {
+	switch cfg.Provider {
+	case "smtp":
+		if cfg.SMTPHost == "" || cfg.From == "" {
+			return nil, errors.New("SMTP_HOST and EMAIL_FROM are required for the smtp provider")
+		}
+		return NewSMTP(cfg)
+	case "mock", "":
+		return &Mock{}, nil
+	default:
+		return nil, fmt.Errorf("unknown email provider %q", cfg.Provider)
+	}
+}
+
+// Mock logs emails instead of sending them, for development
+type Mock struct{}
+
+func (m *Mock) SendEmail(ctx context.Context, to, subject, body string) error {
+	log.Printf("[MOCK EMAIL] To: %s, Subject: %s\n%s", to, subject, body)
+	return nil
+}
+
+// checkHeader rejects values with line breaks
+func checkHeader(value string) error {
+	if strings.ContainsAny(value, "\r\n") {
+		return ErrInvalidHeader
+	}
+	return nil
+}
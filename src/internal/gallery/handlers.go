@@ -5,6 +5,8 @@ import (
 	"errors"
 	"log"
 
+	"chat-e2ee/internal/users"
+
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -16,12 +18,15 @@ var (
 // Handler handles gallery-related HTTP requests
 type Handler struct {
 	service *Service
+	blocks  *users.Blocks
 }
 
-// NewHandler creates a new gallery handler
-func NewHandler(db *sql.DB) *Handler {
+// NewHandler creates a new gallery handler. Galleries of users on either
+// side of a block with the viewer are hidden from them.
+func NewHandler(db *sql.DB, blocks *users.Blocks) *Handler {
 	return &Handler{
 		service: NewService(db),
+		blocks:  blocks,
 	}
 }
 
@@ -93,6 +98,22 @@ func (h *Handler) GetUserGallery(c *fiber.Ctx) error {
 		})
 	}
 
+	// Blocked pairs don't see each other's galleries
+	if viewerID, _ := c.Locals("userID").(string); viewerID != "" && h.blocks != nil {
+		blocked, err := h.blocks.Blocked(c.Context(), viewerID, userID)
+		if err != nil {
+			log.Printf("[GetUserGallery] Failed to check blocks of %s: %v", viewerID, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to fetch gallery",
+			})
+		}
+		if blocked {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Gallery not found",
+			})
+		}
+	}
+
 	// Get gallery
 	log.Printf("[GetUserGallery] Fetching gallery for userID: %s", userID)
 	gallery, err := h.service.GetGallery(c.Context(), userID)
@@ -200,8 +221,20 @@ func (h *Handler) DiscoverGalleries(c *fiber.Ctx) error {
 
 	offset := (page - 1) * pageSize
 
+	// Signed-in viewers don't see galleries on either side of their blocks
+	var hidden []string
+	if viewerID, _ := c.Locals("userID").(string); viewerID != "" && h.blocks != nil {
+		var err error
+		hidden, err = h.blocks.Hidden(c.Context(), viewerID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to fetch galleries",
+			})
+		}
+	}
+
 	// Get galleries
-	galleries, err := h.service.GetModelGalleries(c.Context(), pageSize, offset)
+	galleries, err := h.service.GetModelGalleries(c.Context(), pageSize, offset, hidden)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to fetch galleries",
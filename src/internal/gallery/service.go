@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 // Service handles gallery operations
@@ -165,8 +166,14 @@ func (s *Service) UpdateGallerySettings(ctx context.Context, galleryID string, s
 	return err
 }
 
-// GetModelGalleries retrieves all galleries for models (for discovery)
-func (s *Service) GetModelGalleries(ctx context.Context, limit, offset int) ([]*GalleryPreview, error) {
+// GetModelGalleries retrieves all galleries for models (for discovery),
+// leaving out the models in exclude and those who turned off discovery
+func (s *Service) GetModelGalleries(ctx context.Context, limit, offset int, exclude []string) ([]*GalleryPreview, error) {
+	// A nil array is NULL, which would match nothing
+	if exclude == nil {
+		exclude = []string{}
+	}
+
 	query := `
 		SELECT g.id, g.model_id, g.media_count, g.updated_at,
 		       u.username, u.display_name, u.avatar_url,
@@ -175,12 +182,15 @@ func (s *Service) GetModelGalleries(ctx context.Context, limit, offset int) ([]*
 		        ORDER BY created_at DESC LIMIT 1) as preview_url
 		FROM model_galleries g
 		JOIN users u ON u.id = g.model_id
+		LEFT JOIN user_settings st ON st.user_id = g.model_id
 		WHERE u.role = 'model' AND u.status = 'active'
 		  AND g.media_count > 0
+		  AND COALESCE(st.allow_discovery, true)
+		  AND g.model_id <> ALL($3::uuid[])
 		ORDER BY g.updated_at DESC
 		LIMIT $1 OFFSET $2`
 
-	rows, err := s.DB.QueryContext(ctx, query, limit, offset)
+	rows, err := s.DB.QueryContext(ctx, query, limit, offset, pq.Array(exclude))
 	if err != nil {
 		return nil, err
 	}
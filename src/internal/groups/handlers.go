@@ -0,0 +1,352 @@
+package groups
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// Notifier fans events out to the devices of a group's members, queueing
+// them for devices that are offline
+type Notifier interface {
+	NotifyGroup(groupID string, userIDs []string, event string, payload interface{})
+}
+
+// GroupEvent is the frame type membership events are delivered as
+const GroupEvent = "group_event"
+
+// Handler handles the group chat endpoints
+type Handler struct {
+	service  *Service
+	notifier Notifier
+}
+
+// NewHandler creates a new groups handler. Membership changes are announced
+// to the members through notifier.
+func NewHandler(service *Service, notifier Notifier) *Handler {
+	return &Handler{
+		service:  service,
+		notifier: notifier,
+	}
+}
+
+// CreateGroup creates a group owned by the caller
+func (h *Handler) CreateGroup(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var req CreateGroupRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if len(req.Invite) >= h.service.maxMembers {
+		return h.groupError(c, ErrGroupFull, "")
+	}
+
+	groupID, err := h.service.Create(c.Context(), userID, &req)
+	if err != nil {
+		return h.groupError(c, err, "Failed to create group")
+	}
+
+	group, err := h.service.Get(c.Context(), groupID, userID)
+	if err != nil {
+		return h.groupError(c, err, "Failed to fetch group")
+	}
+
+	for _, invite := range group.Invites {
+		h.notify(groupID, []string{invite.UserID}, EventInvited, invite.UserID, userID, "")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(group)
+}
+
+// ListGroups returns the caller's groups
+func (h *Handler) ListGroups(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	groups, err := h.service.List(c.Context(), userID)
+	if err != nil {
+		return h.groupError(c, err, "Failed to fetch groups")
+	}
+
+	return c.JSON(fiber.Map{
+		"groups": groups,
+		"count":  len(groups),
+	})
+}
+
+// ListInvites returns the caller's pending invites
+func (h *Handler) ListInvites(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	invites, err := h.service.Invites(c.Context(), userID)
+	if err != nil {
+		return h.groupError(c, err, "Failed to fetch invites")
+	}
+
+	return c.JSON(fiber.Map{
+		"invites": invites,
+		"count":   len(invites),
+	})
+}
+
+// GetGroup returns a group the caller is a member of
+func (h *Handler) GetGroup(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	group, err := h.service.Get(c.Context(), c.Params("id"), userID)
+	if err != nil {
+		return h.groupError(c, err, "Failed to fetch group")
+	}
+
+	return c.JSON(group)
+}
+
+// UpdateGroup renames a group or changes its description
+func (h *Handler) UpdateGroup(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	groupID := c.Params("id")
+
+	var req UpdateGroupRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := h.service.Update(c.Context(), groupID, userID, &req); err != nil {
+		return h.groupError(c, err, "Failed to update group")
+	}
+	h.notifyMembers(c.Context(), groupID, nil, EventUpdated, "", userID, "")
+
+	return h.GetGroup(c)
+}
+
+// DeleteGroup deletes a group; only its owner may
+func (h *Handler) DeleteGroup(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	groupID := c.Params("id")
+
+	members, err := h.service.Delete(c.Context(), groupID, userID)
+	if err != nil {
+		return h.groupError(c, err, "Failed to delete group")
+	}
+	h.notify(groupID, members, EventDeleted, "", userID, "")
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// InviteMember invites a user to the group
+func (h *Handler) InviteMember(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	groupID := c.Params("id")
+
+	var req struct {
+		UserID string `json:"user_id"`
+	}
+	if err := c.BodyParser(&req); err != nil || req.UserID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "user_id is required",
+		})
+	}
+
+	if err := h.service.Invite(c.Context(), groupID, userID, req.UserID); err != nil {
+		return h.groupError(c, err, "Failed to invite user")
+	}
+	h.notify(groupID, []string{req.UserID}, EventInvited, req.UserID, userID, "")
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message":  "User invited",
+		"group_id": groupID,
+		"user_id":  req.UserID,
+	})
+}
+
+// RevokeInvite withdraws an invite, or declines it when the caller is the
+// invitee
+func (h *Handler) RevokeInvite(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	groupID := c.Params("id")
+	inviteeID := c.Params("userId")
+
+	if err := h.service.RevokeInvite(c.Context(), groupID, userID, inviteeID); err != nil {
+		return h.groupError(c, err, "Failed to revoke invite")
+	}
+	if inviteeID != userID {
+		h.notify(groupID, []string{inviteeID}, EventInviteRevoked, inviteeID, userID, "")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// JoinGroup accepts the caller's invite to a group
+func (h *Handler) JoinGroup(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	groupID := c.Params("id")
+
+	if err := h.service.Join(c.Context(), groupID, userID); err != nil {
+		return h.groupError(c, err, "Failed to join group")
+	}
+	h.notifyMembers(c.Context(), groupID, nil, EventJoined, userID, userID, RoleMember)
+
+	return h.GetGroup(c)
+}
+
+// LeaveGroup removes the caller from a group
+func (h *Handler) LeaveGroup(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	groupID := c.Params("id")
+
+	newOwner, err := h.service.Leave(c.Context(), groupID, userID)
+	if err != nil {
+		return h.groupError(c, err, "Failed to leave group")
+	}
+
+	// The leaver's other devices hear about it too
+	h.notifyMembers(c.Context(), groupID, []string{userID}, EventLeft, userID, userID, "")
+	if newOwner != "" {
+		h.notifyMembers(c.Context(), groupID, nil, EventRoleChanged, newOwner, userID, RoleOwner)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// RemoveMember kicks a member out of the group
+func (h *Handler) RemoveMember(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	groupID := c.Params("id")
+	memberID := c.Params("userId")
+
+	if err := h.service.Kick(c.Context(), groupID, userID, memberID); err != nil {
+		return h.groupError(c, err, "Failed to remove member")
+	}
+	h.notifyMembers(c.Context(), groupID, []string{memberID}, EventRemoved, memberID, userID, "")
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// SetMemberRole promotes or demotes a member, or hands over ownership
+func (h *Handler) SetMemberRole(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	groupID := c.Params("id")
+	memberID := c.Params("userId")
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := h.service.SetRole(c.Context(), groupID, userID, memberID, req.Role); err != nil {
+		return h.groupError(c, err, "Failed to change role")
+	}
+	h.notifyMembers(c.Context(), groupID, nil, EventRoleChanged, memberID, userID, req.Role)
+	if req.Role == RoleOwner {
+		h.notifyMembers(c.Context(), groupID, nil, EventRoleChanged, userID, userID, RoleAdmin)
+	}
+
+	return c.JSON(fiber.Map{
+		"group_id": groupID,
+		"user_id":  memberID,
+		"role":     req.Role,
+	})
+}
+
+// notifyMembers announces an event to the group's current members and to
+// any extra users, such as someone who was just removed
+func (h *Handler) notifyMembers(ctx context.Context, groupID string, extra []string, event, subjectID, actorID, role string) {
+	members, err := h.service.MemberIDs(ctx, groupID)
+	if err != nil {
+		log.Printf("[Groups] Failed to load members of %s for %s event: %v", groupID, event, err)
+		return
+	}
+	h.notify(groupID, append(members, extra...), event, subjectID, actorID, role)
+}
+
+func (h *Handler) notify(groupID string, userIDs []string, event, subjectID, actorID, role string) {
+	if h.notifier == nil || len(userIDs) == 0 {
+		return
+	}
+
+	// Events are delivered after the request returns, and route params
+	// alias its buffers
+	groupID = utils.CopyString(groupID)
+	recipients := make([]string, len(userIDs))
+	for i, userID := range userIDs {
+		recipients[i] = utils.CopyString(userID)
+	}
+
+	h.notifier.NotifyGroup(groupID, recipients, GroupEvent, &Event{
+		GroupID: groupID,
+		Event:   event,
+		UserID:  subjectID,
+		ActorID: actorID,
+		Role:    role,
+		At:      time.Now().UTC(),
+	})
+}
+
+func (h *Handler) groupError(c *fiber.Ctx, err error, message string) error {
+	switch err {
+	case ErrGroupNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Group not found",
+		})
+	case ErrForbidden:
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Your role in the group does not allow this",
+		})
+	case ErrUserNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	case ErrMemberNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User is not a member of the group",
+		})
+	case ErrInviteNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Invite not found",
+		})
+	case ErrAlreadyMember:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "User is already a member",
+		})
+	case ErrAlreadyInvited:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "User is already invited",
+		})
+	case ErrGroupFull:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Group has reached its member limit",
+		})
+	case ErrBlocked:
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "User cannot be invited",
+		})
+	case ErrInvalidName:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Name must be 1-100 characters and description at most 500",
+		})
+	case ErrInvalidRole:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Role must be owner, admin or member",
+		})
+	case ErrSelf:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Use leave to change your own membership",
+		})
+	default:
+		log.Printf("[Groups] %s: %v", message, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": message,
+		})
+	}
+}
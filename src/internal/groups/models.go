@@ -0,0 +1,82 @@
+package groups
+
+import "time"
+
+// Member roles, as in the group_role enum
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// Membership events, sent to the members' devices as group_event frames
+const (
+	EventInvited       = "invited"        // Only to the invitee
+	EventInviteRevoked = "invite_revoked" // Only to the invitee
+	EventJoined        = "joined"
+	EventLeft          = "left"
+	EventRemoved       = "removed"
+	EventRoleChanged   = "role_changed"
+	EventUpdated       = "updated"
+	EventDeleted       = "deleted"
+)
+
+// Group is a group chat and, when loaded for one of its members, its
+// member list and the caller's role
+type Group struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	MemberCount int       `json:"member_count"`
+	Role        string    `json:"role,omitempty"` // The caller's role
+
+	Members []*Member `json:"members,omitempty"`
+	Invites []*Invite `json:"invites,omitempty"` // Only shown to admins
+}
+
+// Member is a user in a group
+type Member struct {
+	UserID      string    `json:"user_id"`
+	Username    string    `json:"username"`
+	DisplayName string    `json:"display_name,omitempty"`
+	Role        string    `json:"role"`
+	AddedBy     string    `json:"added_by,omitempty"`
+	JoinedAt    time.Time `json:"joined_at"`
+}
+
+// Invite is a pending invitation to a group
+type Invite struct {
+	GroupID   string    `json:"group_id"`
+	GroupName string    `json:"group_name,omitempty"`
+	UserID    string    `json:"user_id"`
+	InvitedBy string    `json:"invited_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateGroupRequest creates a group owned by the caller, inviting the
+// given users
+type CreateGroupRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Invite      []string `json:"invite,omitempty"`
+}
+
+// UpdateGroupRequest changes a group's name or description
+type UpdateGroupRequest struct {
+	Name        *string `json:"name,omitempty"`
+	Description *string `json:"description,omitempty"`
+}
+
+// Event tells the members' devices how the group changed, so they can
+// rotate their sender keys when someone leaves
+type Event struct {
+	GroupID string    `json:"group_id"`
+	Event   string    `json:"event"`
+	UserID  string    `json:"user_id,omitempty"`  // The member the event is about
+	ActorID string    `json:"actor_id,omitempty"` // Who made the change
+	Role    string    `json:"role,omitempty"`     // New role, for joined and role_changed
+	At      time.Time `json:"at"`
+}
@@ -0,0 +1,728 @@
+package groups
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+const (
+	maxNameLength        = 100
+	maxDescriptionLength = 500
+)
+
+// Common errors
+var (
+	ErrGroupNotFound  = errors.New("group not found") // Also returned to non-members
+	ErrForbidden      = errors.New("role does not allow this")
+	ErrUserNotFound   = errors.New("user not found")
+	ErrMemberNotFound = errors.New("member not found")
+	ErrAlreadyMember  = errors.New("user is already a member")
+	ErrAlreadyInvited = errors.New("user is already invited")
+	ErrInviteNotFound = errors.New("invite not found")
+	ErrGroupFull      = errors.New("group is full")
+	ErrBlocked        = errors.New("user blocked the inviter")
+	ErrInvalidName    = errors.New("invalid group name")
+	ErrInvalidRole    = errors.New("role must be owner, admin or member")
+	ErrSelf           = errors.New("cannot change your own membership this way")
+)
+
+// Service keeps groups, their members and pending invites in PostgreSQL
+type Service struct {
+	db         *sql.DB
+	maxMembers int
+}
+
+// NewService creates a group service. Groups can hold up to maxMembers
+// members and pending invites together.
+func NewService(db *sql.DB, maxMembers int) *Service {
+	return &Service{
+		db:         db,
+		maxMembers: maxMembers,
+	}
+}
+
+// roleRank orders roles so that a member can only manage lower ranks
+func roleRank(role string) int {
+	switch role {
+	case RoleOwner:
+		return 3
+	case RoleAdmin:
+		return 2
+	case RoleMember:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// isInvalidID reports whether a query failed on an ID that is not a UUID
+// or does not reference an existing row
+func isInvalidID(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && (pqErr.Code == "22P02" || pqErr.Code == "23503")
+}
+
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// memberRole returns a user's role in a group, or ErrMemberNotFound
+func memberRole(ctx context.Context, q queryer, groupID, userID string) (string, error) {
+	var role string
+	err := q.QueryRowContext(ctx,
+		"SELECT role FROM group_members WHERE group_id = $1 AND user_id = $2",
+		groupID, userID,
+	).Scan(&role)
+	if err == sql.ErrNoRows || isInvalidID(err) {
+		return "", ErrMemberNotFound
+	}
+	return role, err
+}
+
+// lockGroup serializes membership changes of a group within tx
+func lockGroup(ctx context.Context, tx *sql.Tx, groupID string) error {
+	var id string
+	err := tx.QueryRowContext(ctx,
+		"SELECT id FROM chat_groups WHERE id = $1 FOR UPDATE",
+		groupID,
+	).Scan(&id)
+	if err == sql.ErrNoRows || isInvalidID(err) {
+		return ErrGroupNotFound
+	}
+	return err
+}
+
+// requireRole checks that actorID is a member of the group with at least
+// the given role. Non-members get ErrGroupNotFound, so they can't probe
+// which groups exist.
+func requireRole(ctx context.Context, q queryer, groupID, actorID, role string) (string, error) {
+	actorRole, err := memberRole(ctx, q, groupID, actorID)
+	if err == ErrMemberNotFound {
+		return "", ErrGroupNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if roleRank(actorRole) < roleRank(role) {
+		return "", ErrForbidden
+	}
+	return actorRole, nil
+}
+
+func validName(name string) bool {
+	return name != "" && utf8.RuneCountInString(name) <= maxNameLength
+}
+
+// Create creates a group owned by ownerID and invites the requested users
+func (s *Service) Create(ctx context.Context, ownerID string, req *CreateGroupRequest) (string, error) {
+	name := strings.TrimSpace(req.Name)
+	if !validName(name) || utf8.RuneCountInString(req.Description) > maxDescriptionLength {
+		return "", ErrInvalidName
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var groupID string
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO chat_groups (name, description, created_by) VALUES ($1, NULLIF($2, ''), $3) RETURNING id",
+		name, req.Description, ownerID,
+	).Scan(&groupID)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO group_members (group_id, user_id, role, added_by) VALUES ($1, $2, 'owner', $2)",
+		groupID, ownerID,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	for _, userID := range req.Invite {
+		err := s.invite(ctx, tx, groupID, ownerID, userID)
+		if err == ErrAlreadyInvited || err == ErrAlreadyMember {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return groupID, tx.Commit()
+}
+
+// Get returns a group with its members. Pending invites are only listed
+// for admins.
+func (s *Service) Get(ctx context.Context, groupID, userID string) (*Group, error) {
+	role, err := requireRole(ctx, s.db, groupID, userID, RoleMember)
+	if err != nil {
+		return nil, err
+	}
+
+	group := &Group{Role: role}
+	var description, createdBy sql.NullString
+	err = s.db.QueryRowContext(ctx,
+		`SELECT id, name, description, created_by, created_at, updated_at
+		FROM chat_groups WHERE id = $1`,
+		groupID,
+	).Scan(&group.ID, &group.Name, &description, &createdBy, &group.CreatedAt, &group.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrGroupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	group.Description = description.String
+	group.CreatedBy = createdBy.String
+
+	group.Members, err = s.members(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	group.MemberCount = len(group.Members)
+
+	if roleRank(role) >= roleRank(RoleAdmin) {
+		group.Invites, err = s.groupInvites(ctx, groupID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return group, nil
+}
+
+func (s *Service) members(ctx context.Context, groupID string) ([]*Member, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT m.user_id, COALESCE(u.username, ''), COALESCE(u.display_name, ''), m.role, m.added_by, m.joined_at
+		FROM group_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.group_id = $1
+		ORDER BY m.joined_at`,
+		groupID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make([]*Member, 0)
+	for rows.Next() {
+		m := &Member{}
+		var addedBy sql.NullString
+		if err := rows.Scan(&m.UserID, &m.Username, &m.DisplayName, &m.Role, &addedBy, &m.JoinedAt); err != nil {
+			return nil, err
+		}
+		m.AddedBy = addedBy.String
+		members = append(members, m)
+	}
+
+	return members, rows.Err()
+}
+
+func (s *Service) groupInvites(ctx context.Context, groupID string) ([]*Invite, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT group_id, user_id, invited_by, created_at
+		FROM group_invites WHERE group_id = $1
+		ORDER BY created_at`,
+		groupID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := make([]*Invite, 0)
+	for rows.Next() {
+		inv := &Invite{}
+		var invitedBy sql.NullString
+		if err := rows.Scan(&inv.GroupID, &inv.UserID, &invitedBy, &inv.CreatedAt); err != nil {
+			return nil, err
+		}
+		inv.InvitedBy = invitedBy.String
+		invites = append(invites, inv)
+	}
+
+	return invites, rows.Err()
+}
+
+// List returns the groups a user is a member of, most recently active first
+func (s *Service) List(ctx context.Context, userID string) ([]*Group, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT g.id, g.name, g.description, g.created_by, g.created_at, g.updated_at, m.role,
+			(SELECT COUNT(*) FROM group_members c WHERE c.group_id = g.id)
+		FROM group_members m
+		JOIN chat_groups g ON g.id = m.group_id
+		WHERE m.user_id = $1
+		ORDER BY g.updated_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := make([]*Group, 0)
+	for rows.Next() {
+		g := &Group{}
+		var description, createdBy sql.NullString
+		if err := rows.Scan(&g.ID, &g.Name, &description, &createdBy, &g.CreatedAt, &g.UpdatedAt, &g.Role, &g.MemberCount); err != nil {
+			return nil, err
+		}
+		g.Description = description.String
+		g.CreatedBy = createdBy.String
+		groups = append(groups, g)
+	}
+
+	return groups, rows.Err()
+}
+
+// Invites returns the pending invites of a user
+func (s *Service) Invites(ctx context.Context, userID string) ([]*Invite, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT i.group_id, g.name, i.user_id, i.invited_by, i.created_at
+		FROM group_invites i
+		JOIN chat_groups g ON g.id = i.group_id
+		WHERE i.user_id = $1
+		ORDER BY i.created_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := make([]*Invite, 0)
+	for rows.Next() {
+		inv := &Invite{}
+		var invitedBy sql.NullString
+		if err := rows.Scan(&inv.GroupID, &inv.GroupName, &inv.UserID, &invitedBy, &inv.CreatedAt); err != nil {
+			return nil, err
+		}
+		inv.InvitedBy = invitedBy.String
+		invites = append(invites, inv)
+	}
+
+	return invites, rows.Err()
+}
+
+// Update changes a group's name or description. Admins and the owner may
+// do so.
+func (s *Service) Update(ctx context.Context, groupID, actorID string, req *UpdateGroupRequest) error {
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if !validName(name) {
+			return ErrInvalidName
+		}
+		req.Name = &name
+	}
+	if req.Description != nil && utf8.RuneCountInString(*req.Description) > maxDescriptionLength {
+		return ErrInvalidName
+	}
+
+	if _, err := requireRole(ctx, s.db, groupID, actorID, RoleAdmin); err != nil {
+		return err
+	}
+
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE chat_groups SET
+			name = COALESCE($2, name),
+			description = CASE WHEN $3::text IS NULL THEN description ELSE NULLIF($3, '') END
+		WHERE id = $1`,
+		groupID, req.Name, req.Description,
+	)
+	return err
+}
+
+// Delete removes a group and all its members. Only the owner may, and it
+// returns who the members were.
+func (s *Service) Delete(ctx context.Context, groupID, actorID string) ([]string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := lockGroup(ctx, tx, groupID); err != nil {
+		return nil, err
+	}
+	if _, err := requireRole(ctx, tx, groupID, actorID, RoleOwner); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT user_id FROM group_members WHERE group_id = $1", groupID)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]string, 0)
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		members = append(members, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chat_groups WHERE id = $1", groupID); err != nil {
+		return nil, err
+	}
+
+	return members, tx.Commit()
+}
+
+// Invite invites a user to a group. Admins and the owner may invite.
+func (s *Service) Invite(ctx context.Context, groupID, actorID, userID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockGroup(ctx, tx, groupID); err != nil {
+		return err
+	}
+	if _, err := requireRole(ctx, tx, groupID, actorID, RoleAdmin); err != nil {
+		return err
+	}
+	if err := s.invite(ctx, tx, groupID, actorID, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// invite records an invite. The group must be locked within tx.
+func (s *Service) invite(ctx context.Context, tx *sql.Tx, groupID, actorID, userID string) error {
+	var exists, blocked bool
+	err := tx.QueryRowContext(ctx,
+		`SELECT EXISTS(SELECT 1 FROM users WHERE id = $1 AND deleted_at IS NULL),
+			EXISTS(SELECT 1 FROM user_contacts WHERE user_id = $1 AND contact_id = $2 AND blocked = true)`,
+		userID, actorID,
+	).Scan(&exists, &blocked)
+	if isInvalidID(err) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+	if blocked {
+		return ErrBlocked
+	}
+
+	if _, err := memberRole(ctx, tx, groupID, userID); err == nil {
+		return ErrAlreadyMember
+	} else if err != ErrMemberNotFound {
+		return err
+	}
+
+	var size int
+	err = tx.QueryRowContext(ctx,
+		`SELECT (SELECT COUNT(*) FROM group_members WHERE group_id = $1) +
+			(SELECT COUNT(*) FROM group_invites WHERE group_id = $1)`,
+		groupID,
+	).Scan(&size)
+	if err != nil {
+		return err
+	}
+	if size >= s.maxMembers {
+		return ErrGroupFull
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO group_invites (group_id, user_id, invited_by) VALUES ($1, $2, $3)",
+		groupID, userID, actorID,
+	)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrAlreadyInvited
+	}
+	return err
+}
+
+// RevokeInvite withdraws an invite. The invitee may decline their own
+// invite; anyone else must be an admin of the group.
+func (s *Service) RevokeInvite(ctx context.Context, groupID, actorID, userID string) error {
+	if actorID != userID {
+		if _, err := requireRole(ctx, s.db, groupID, actorID, RoleAdmin); err != nil {
+			return err
+		}
+	}
+
+	result, err := s.db.ExecContext(ctx,
+		"DELETE FROM group_invites WHERE group_id = $1 AND user_id = $2",
+		groupID, userID,
+	)
+	if isInvalidID(err) {
+		return ErrInviteNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// Join accepts a user's invite, making them a member
+func (s *Service) Join(ctx context.Context, groupID, userID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockGroup(ctx, tx, groupID); err != nil {
+		if err == ErrGroupNotFound {
+			return ErrInviteNotFound
+		}
+		return err
+	}
+
+	var invitedBy sql.NullString
+	err = tx.QueryRowContext(ctx,
+		"DELETE FROM group_invites WHERE group_id = $1 AND user_id = $2 RETURNING invited_by",
+		groupID, userID,
+	).Scan(&invitedBy)
+	if err == sql.ErrNoRows {
+		return ErrInviteNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO group_members (group_id, user_id, role, added_by) VALUES ($1, $2, 'member', $3)",
+		groupID, userID, invitedBy,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Leave removes a user from a group. When the owner leaves, ownership
+// passes to the longest-standing admin, or member if there are no admins;
+// a group left empty is deleted. It returns the new owner, if any.
+func (s *Service) Leave(ctx context.Context, groupID, userID string) (string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if err := lockGroup(ctx, tx, groupID); err != nil {
+		return "", err
+	}
+	role, err := requireRole(ctx, tx, groupID, userID, RoleMember)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"DELETE FROM group_members WHERE group_id = $1 AND user_id = $2",
+		groupID, userID,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	newOwner := ""
+	if role == RoleOwner {
+		err = tx.QueryRowContext(ctx,
+			`SELECT user_id FROM group_members WHERE group_id = $1
+			ORDER BY role = 'admin' DESC, joined_at
+			LIMIT 1`,
+			groupID,
+		).Scan(&newOwner)
+		switch {
+		case err == sql.ErrNoRows:
+			if _, err := tx.ExecContext(ctx, "DELETE FROM chat_groups WHERE id = $1", groupID); err != nil {
+				return "", err
+			}
+		case err != nil:
+			return "", err
+		default:
+			_, err = tx.ExecContext(ctx,
+				"UPDATE group_members SET role = 'owner' WHERE group_id = $1 AND user_id = $2",
+				groupID, newOwner,
+			)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return newOwner, tx.Commit()
+}
+
+// Kick removes another member from a group. Admins may remove members and
+// the owner may remove anyone.
+func (s *Service) Kick(ctx context.Context, groupID, actorID, userID string) error {
+	if actorID == userID {
+		return ErrSelf
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockGroup(ctx, tx, groupID); err != nil {
+		return err
+	}
+	actorRole, err := requireRole(ctx, tx, groupID, actorID, RoleAdmin)
+	if err != nil {
+		return err
+	}
+	role, err := memberRole(ctx, tx, groupID, userID)
+	if err != nil {
+		return err
+	}
+	if roleRank(actorRole) <= roleRank(role) {
+		return ErrForbidden
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"DELETE FROM group_members WHERE group_id = $1 AND user_id = $2",
+		groupID, userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetRole changes a member's role. Only the owner may; making someone else
+// the owner demotes the current owner to admin.
+func (s *Service) SetRole(ctx context.Context, groupID, actorID, userID, role string) error {
+	if roleRank(role) == 0 {
+		return ErrInvalidRole
+	}
+	if actorID == userID {
+		return ErrSelf
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockGroup(ctx, tx, groupID); err != nil {
+		return err
+	}
+	if _, err := requireRole(ctx, tx, groupID, actorID, RoleOwner); err != nil {
+		return err
+	}
+	if _, err := memberRole(ctx, tx, groupID, userID); err != nil {
+		return err
+	}
+
+	// Only one owner at a time, see idx_group_members_owner
+	if role == RoleOwner {
+		_, err = tx.ExecContext(ctx,
+			"UPDATE group_members SET role = 'admin' WHERE group_id = $1 AND user_id = $2",
+			groupID, actorID,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE group_members SET role = $3 WHERE group_id = $1 AND user_id = $2",
+		groupID, userID, role,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MemberIDs returns the user IDs of a group's members
+func (s *Service) MemberIDs(ctx context.Context, groupID string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT user_id FROM group_members WHERE group_id = $1",
+		groupID,
+	)
+	if isInvalidID(err) {
+		return nil, ErrGroupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make([]string, 0)
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		members = append(members, userID)
+	}
+
+	return members, rows.Err()
+}
+
+// Recipients returns the devices a group message from senderID goes to,
+// keyed by member, and whether the sender is a member at all. Members who
+// blocked the sender are left out, as are members without devices. The
+// sender's own devices are included.
+func (s *Service) Recipients(ctx context.Context, groupID, senderID string) (map[string][]string, bool, error) {
+	if _, err := memberRole(ctx, s.db, groupID, senderID); err != nil {
+		if err == ErrMemberNotFound {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT m.user_id, d.device_id
+		FROM group_members m
+		JOIN user_devices d ON d.user_id = m.user_id
+		WHERE m.group_id = $1
+		AND NOT EXISTS (
+			SELECT 1 FROM user_contacts c
+			WHERE c.user_id = m.user_id AND c.contact_id = $2 AND c.blocked = true
+		)`,
+		groupID, senderID,
+	)
+	if err != nil {
+		return nil, true, err
+	}
+	defer rows.Close()
+
+	recipients := make(map[string][]string)
+	for rows.Next() {
+		var userID, deviceID string
+		if err := rows.Scan(&userID, &deviceID); err != nil {
+			return nil, true, err
+		}
+		recipients[userID] = append(recipients[userID], deviceID)
+	}
+
+	return recipients, true, rows.Err()
+}
@@ -0,0 +1,125 @@
+package keys
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// Bump when the fingerprint input changes, so clients can tell versions apart
+	fingerprintVersion = 0
+	// Iterated hashing makes precomputing colliding keys expensive
+	fingerprintIterations = 5200
+)
+
+// DeviceIdentity is the identity key a device contributes to its user's fingerprint
+type DeviceIdentity struct {
+	DeviceID    string `json:"device_id"`
+	IdentityKey string `json:"identity_key"`
+}
+
+// UserFingerprint is the 30-digit fingerprint of one user's device keys
+type UserFingerprint struct {
+	UserID      string           `json:"user_id"`
+	Fingerprint string           `json:"fingerprint"`
+	Devices     []DeviceIdentity `json:"devices"`
+}
+
+// SafetyNumber lets two users check out of band that they see the same keys.
+// Both users get the same number: the two fingerprints ordered by user ID.
+type SafetyNumber struct {
+	Version      int               `json:"version"`
+	SafetyNumber string            `json:"safety_number"`
+	Fingerprints []UserFingerprint `json:"fingerprints"`
+}
+
+// SafetyNumber computes the safety number between two users from the current
+// identity keys of all their devices
+func (t *Transparency) SafetyNumber(ctx context.Context, userID, contactID string) (*SafetyNumber, error) {
+	fingerprints := make([]UserFingerprint, 0, 2)
+	for _, id := range []string{userID, contactID} {
+		devices, err := t.currentIdentityKeys(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if len(devices) == 0 {
+			return nil, ErrKeysNotFound
+		}
+
+		fingerprints = append(fingerprints, UserFingerprint{
+			UserID:      id,
+			Fingerprint: computeFingerprint(id, devices),
+			Devices:     devices,
+		})
+	}
+
+	sort.Slice(fingerprints, func(i, j int) bool {
+		return fingerprints[i].UserID < fingerprints[j].UserID
+	})
+
+	return &SafetyNumber{
+		Version:      fingerprintVersion,
+		SafetyNumber: groupDigits(fingerprints[0].Fingerprint + fingerprints[1].Fingerprint),
+		Fingerprints: fingerprints,
+	}, nil
+}
+
+// computeFingerprint hashes a user's device keys into 30 digits.
+//
+// The key material is, for each device in byte order of device ID:
+// device_id, 0x00, identity_key (as stored), 0x00. Then
+//
+//	hash = SHA-512(version as 2 bytes big endian || keys || user_id)
+//	repeat 5200 times: hash = SHA-512(hash || keys)
+//
+// and each 5-byte chunk of the first 30 bytes, read as a big-endian integer
+// modulo 100000, gives 5 digits.
+func computeFingerprint(userID string, devices []DeviceIdentity) string {
+	sorted := make([]DeviceIdentity, len(devices))
+	copy(sorted, devices)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].DeviceID < sorted[j].DeviceID
+	})
+
+	var keys []byte
+	for _, d := range sorted {
+		keys = append(keys, d.DeviceID...)
+		keys = append(keys, 0)
+		keys = append(keys, d.IdentityKey...)
+		keys = append(keys, 0)
+	}
+
+	input := make([]byte, 2, 2+len(keys)+len(userID))
+	binary.BigEndian.PutUint16(input, fingerprintVersion)
+	input = append(input, keys...)
+	input = append(input, userID...)
+
+	hash := sha512.Sum512(input)
+	for i := 0; i < fingerprintIterations; i++ {
+		hash = sha512.Sum512(append(hash[:], keys...))
+	}
+
+	var digits strings.Builder
+	for i := 0; i < 30; i += 5 {
+		chunk := uint64(0)
+		for _, b := range hash[i : i+5] {
+			chunk = chunk<<8 | uint64(b)
+		}
+		fmt.Fprintf(&digits, "%05d", chunk%100000)
+	}
+
+	return digits.String()
+}
+
+// groupDigits splits a number into blocks of 5 digits for display
+func groupDigits(number string) string {
+	groups := make([]string, 0, len(number)/5)
+	for i := 0; i < len(number); i += 5 {
+		groups = append(groups, number[i:i+5])
+	}
+	return strings.Join(groups, " ")
+}
@@ -0,0 +1,250 @@
+package keys
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Notifier delivers server events to connected devices
+type Notifier interface {
+	// NotifyUsers queues an event for every device of the users, online or not
+	NotifyUsers(userIDs []string, event string, payload interface{})
+	NotifyDevice(userID, deviceID, event string, payload interface{})
+}
+
+// PrekeysLowEvent is sent to a device when its one-time prekeys run low
+const PrekeysLowEvent = "prekeys_low"
+
+// Handler handles the prekey bundle endpoints
+type Handler struct {
+	service      *Service
+	transparency *Transparency
+	notifier     Notifier
+	lowThreshold int
+}
+
+// NewHandler creates a new keys handler. Devices are notified through
+// notifier when they have fewer than lowThreshold one-time prekeys left.
+func NewHandler(db *sql.DB, notifier Notifier, lowThreshold int) *Handler {
+	return &Handler{
+		service:      NewService(db),
+		transparency: NewTransparency(db, notifier),
+		notifier:     notifier,
+		lowThreshold: lowThreshold,
+	}
+}
+
+// UploadKeys stores the caller device's identity key, signed prekey and
+// optional one-time prekeys
+func (h *Handler) UploadKeys(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	deviceID := c.Locals("deviceID").(string)
+
+	var req UploadKeysRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	count, err := h.service.UploadKeys(c.Context(), userID, deviceID, &req)
+	if err != nil {
+		return h.keyError(c, err, "Failed to store keys")
+	}
+
+	if err := h.transparency.RecordIdentityKey(c.Context(), userID, deviceID); err != nil {
+		log.Printf("[Keys] Failed to record identity key for device %s: %v", deviceID, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"message":          "Keys stored successfully",
+		"one_time_prekeys": h.prekeyCount(count),
+	})
+}
+
+// UploadPrekeys adds a batch of one-time prekeys to the caller's device
+func (h *Handler) UploadPrekeys(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	deviceID := c.Locals("deviceID").(string)
+
+	var req UploadPrekeysRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	count, err := h.service.AddPrekeys(c.Context(), userID, deviceID, req.OneTimePrekeys)
+	if err != nil {
+		return h.keyError(c, err, "Failed to store prekeys")
+	}
+
+	return c.JSON(fiber.Map{
+		"message":          "Prekeys stored successfully",
+		"one_time_prekeys": h.prekeyCount(count),
+	})
+}
+
+// RotateSignedPrekey replaces the caller device's signed prekey
+func (h *Handler) RotateSignedPrekey(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	deviceID := c.Locals("deviceID").(string)
+
+	var req RotateSignedPrekeyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := h.service.RotateSignedPrekey(c.Context(), userID, deviceID, &req.SignedPrekey); err != nil {
+		return h.keyError(c, err, "Failed to rotate signed prekey")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Signed prekey rotated successfully",
+	})
+}
+
+// GetPrekeyCount returns how many one-time prekeys the caller's device has left
+func (h *Handler) GetPrekeyCount(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	deviceID := c.Locals("deviceID").(string)
+
+	count, err := h.service.CountPrekeys(c.Context(), userID, deviceID)
+	if err != nil {
+		return h.keyError(c, err, "Failed to count prekeys")
+	}
+
+	return c.JSON(h.prekeyCount(count))
+}
+
+// ClaimBundles hands out one prekey bundle per device of a user, or only
+// for the device given in ?device_id=
+func (h *Handler) ClaimBundles(c *fiber.Ctx) error {
+	targetUserID := c.Params("userId")
+	onlyDevice := c.Query("device_id")
+
+	bundles, claims, err := h.service.ClaimBundles(c.Context(), targetUserID, onlyDevice)
+	if err != nil {
+		log.Printf("[Keys] Failed to claim bundles for %s: %v", targetUserID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch prekey bundles",
+		})
+	}
+
+	if len(bundles) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "No keys found for user",
+		})
+	}
+
+	for _, claim := range claims {
+		h.warnIfLow(claim)
+	}
+
+	return c.JSON(BundlesResponse{
+		UserID:  targetUserID,
+		Devices: bundles,
+	})
+}
+
+// GetKeyHistory returns every identity key a user's devices have had
+func (h *Handler) GetKeyHistory(c *fiber.Ctx) error {
+	targetUserID := c.Params("userId")
+
+	history, err := h.transparency.GetHistory(c.Context(), targetUserID)
+	if err != nil {
+		log.Printf("[Keys] Failed to load key history for %s: %v", targetUserID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch key history",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"user_id": targetUserID,
+		"history": history,
+	})
+}
+
+// GetSafetyNumber returns the safety number between the caller and a user
+func (h *Handler) GetSafetyNumber(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	targetUserID := c.Params("userId")
+
+	safetyNumber, err := h.transparency.SafetyNumber(c.Context(), userID, targetUserID)
+	if err != nil {
+		if err == ErrKeysNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "No keys found for user",
+			})
+		}
+		log.Printf("[Keys] Failed to compute safety number for %s and %s: %v", userID, targetUserID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to compute safety number",
+		})
+	}
+
+	return c.JSON(safetyNumber)
+}
+
+// warnIfLow tells a device to upload more one-time prekeys. It fires when
+// a claim takes the count below the threshold and again when it runs out,
+// rather than on every claim. Concurrent claims can skip counts, so it
+// checks for crossings rather than exact values.
+func (h *Handler) warnIfLow(claim ClaimedPrekey) {
+	if h.notifier == nil {
+		return
+	}
+
+	crossedLow := claim.Previous >= h.lowThreshold && claim.Remaining < h.lowThreshold
+	ranOut := claim.Previous > 0 && claim.Remaining == 0
+	if !crossedLow && !ranOut {
+		return
+	}
+
+	h.notifier.NotifyDevice(claim.UserID, claim.DeviceID, PrekeysLowEvent, h.prekeyCount(claim.Remaining))
+}
+
+func (h *Handler) prekeyCount(count int) PrekeyCount {
+	return PrekeyCount{
+		OneTimePrekeys: count,
+		Low:            count < h.lowThreshold,
+	}
+}
+
+func (h *Handler) keyError(c *fiber.Ctx, err error, message string) error {
+	switch err {
+	case ErrDeviceNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Device not registered",
+		})
+	case ErrKeysNotFound:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Upload an identity key and signed prekey first",
+		})
+	case ErrInvalidKey:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid key. Keys must be base64 encoded: 32-byte public keys, 64-byte signatures",
+		})
+	case ErrInvalidSignature:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Signed prekey signature is not valid for the identity key",
+		})
+	case ErrDuplicatePrekey:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "One-time prekey ID already in use",
+		})
+	case ErrTooManyPrekeys:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Too many one-time prekeys",
+		})
+	default:
+		log.Printf("[Keys] %s: %v", message, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": message,
+		})
+	}
+}
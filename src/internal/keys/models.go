@@ -0,0 +1,53 @@
+package keys
+
+// SignedPrekey is a medium-term X25519 key signed by the device identity key
+type SignedPrekey struct {
+	KeyID     int    `json:"key_id"`
+	PublicKey string `json:"public_key"` // base64, 32 bytes
+	Signature string `json:"signature"`  // base64 Ed25519 signature over the raw public key
+}
+
+// OneTimePrekey is an X25519 key that is handed out to a single sender
+type OneTimePrekey struct {
+	KeyID     int    `json:"key_id"`
+	PublicKey string `json:"public_key"` // base64, 32 bytes
+}
+
+// UploadKeysRequest replaces the caller device's identity key and signed
+// prekey, optionally with a fresh batch of one-time prekeys
+type UploadKeysRequest struct {
+	IdentityKey    string          `json:"identity_key"` // base64 Ed25519 public key
+	SignedPrekey   SignedPrekey    `json:"signed_prekey"`
+	OneTimePrekeys []OneTimePrekey `json:"one_time_prekeys,omitempty"`
+}
+
+// UploadPrekeysRequest adds one-time prekeys to the caller's device
+type UploadPrekeysRequest struct {
+	OneTimePrekeys []OneTimePrekey `json:"one_time_prekeys"`
+}
+
+// RotateSignedPrekeyRequest replaces the caller's signed prekey
+type RotateSignedPrekeyRequest struct {
+	SignedPrekey SignedPrekey `json:"signed_prekey"`
+}
+
+// PrekeyBundle is what a sender needs to start an X3DH session with one
+// recipient device. OneTimePrekey is nil when the device ran out.
+type PrekeyBundle struct {
+	DeviceID      string         `json:"device_id"`
+	IdentityKey   string         `json:"identity_key"`
+	SignedPrekey  SignedPrekey   `json:"signed_prekey"`
+	OneTimePrekey *OneTimePrekey `json:"one_time_prekey,omitempty"`
+}
+
+// BundlesResponse holds one claimed bundle per device of a user
+type BundlesResponse struct {
+	UserID  string          `json:"user_id"`
+	Devices []*PrekeyBundle `json:"devices"`
+}
+
+// PrekeyCount reports how many one-time prekeys a device has left
+type PrekeyCount struct {
+	OneTimePrekeys int  `json:"one_time_prekeys"`
+	Low            bool `json:"low"`
+}
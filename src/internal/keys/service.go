@@ -0,0 +1,390 @@
+package keys
+
+import (
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+)
+
+const (
+	// Most one-time prekeys accepted in a single upload
+	maxPrekeyBatch = 100
+	// Most one-time prekeys stored per device
+	maxStoredPrekeys = 1000
+
+	curve25519KeySize = 32
+)
+
+// Common errors
+var (
+	ErrDeviceNotFound   = errors.New("device not found")
+	ErrKeysNotFound     = errors.New("device has no identity key")
+	ErrInvalidKey       = errors.New("invalid key encoding or size")
+	ErrInvalidSignature = errors.New("signed prekey signature verification failed")
+	ErrDuplicatePrekey  = errors.New("duplicate one-time prekey id")
+	ErrTooManyPrekeys   = errors.New("too many one-time prekeys")
+)
+
+// Service stores device key material and hands out prekey bundles
+type Service struct {
+	db *sql.DB
+}
+
+// NewService creates a new key service
+func NewService(db *sql.DB) *Service {
+	return &Service{db: db}
+}
+
+// ClaimedPrekey records that a bundle was claimed for a device, and how many
+// one-time prekeys it had before and has left afterwards. Both are counted
+// outside the claim, so with concurrent claims Previous may be higher and
+// Remaining lower than one key apart.
+type ClaimedPrekey struct {
+	UserID    string
+	DeviceID  string
+	Previous  int
+	Remaining int
+}
+
+// UploadKeys stores a device's identity key and signed prekey, plus any
+// one-time prekeys. A new identity key invalidates the old one-time prekeys.
+// It returns how many one-time prekeys the device has.
+func (s *Service) UploadKeys(ctx context.Context, userID, deviceID string, req *UploadKeysRequest) (int, error) {
+	identityKey, err := decodeKey(req.IdentityKey, ed25519.PublicKeySize)
+	if err != nil {
+		return 0, err
+	}
+	if err := verifySignedPrekey(identityKey, &req.SignedPrekey); err != nil {
+		return 0, err
+	}
+	if err := validatePrekeys(req.OneTimePrekeys); err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	deviceRef, err := lookupDevice(ctx, tx, userID, deviceID)
+	if err != nil {
+		return 0, err
+	}
+
+	var currentIdentity sql.NullString
+	err = tx.QueryRowContext(ctx,
+		"SELECT identity_key FROM device_keys WHERE device_id = $1 FOR UPDATE",
+		deviceRef,
+	).Scan(&currentIdentity)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	if currentIdentity.Valid && currentIdentity.String != req.IdentityKey {
+		// Prekeys are only meaningful together with the identity they were made for
+		if _, err := tx.ExecContext(ctx, "DELETE FROM one_time_prekeys WHERE device_id = $1", deviceRef); err != nil {
+			return 0, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO device_keys (device_id, user_id, identity_key, signed_prekey_id, signed_prekey, signed_prekey_signature)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (device_id)
+		DO UPDATE SET identity_key = $3, signed_prekey_id = $4, signed_prekey = $5, signed_prekey_signature = $6`,
+		deviceRef, userID, req.IdentityKey,
+		req.SignedPrekey.KeyID, req.SignedPrekey.PublicKey, req.SignedPrekey.Signature,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := insertPrekeys(ctx, tx, deviceRef, req.OneTimePrekeys)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// AddPrekeys tops up a device's one-time prekeys and returns the new total
+func (s *Service) AddPrekeys(ctx context.Context, userID, deviceID string, prekeys []OneTimePrekey) (int, error) {
+	if len(prekeys) == 0 {
+		return 0, ErrInvalidKey
+	}
+	if err := validatePrekeys(prekeys); err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	deviceRef, err := lookupDevice(ctx, tx, userID, deviceID)
+	if err != nil {
+		return 0, err
+	}
+
+	var exists bool
+	err = tx.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM device_keys WHERE device_id = $1)",
+		deviceRef,
+	).Scan(&exists)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, ErrKeysNotFound
+	}
+
+	count, err := insertPrekeys(ctx, tx, deviceRef, prekeys)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// RotateSignedPrekey replaces a device's signed prekey after checking it was
+// signed by the stored identity key
+func (s *Service) RotateSignedPrekey(ctx context.Context, userID, deviceID string, signedPrekey *SignedPrekey) error {
+	deviceRef, err := lookupDevice(ctx, s.db, userID, deviceID)
+	if err != nil {
+		return err
+	}
+
+	var encodedIdentity string
+	err = s.db.QueryRowContext(ctx,
+		"SELECT identity_key FROM device_keys WHERE device_id = $1",
+		deviceRef,
+	).Scan(&encodedIdentity)
+	if err == sql.ErrNoRows {
+		return ErrKeysNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	identityKey, err := decodeKey(encodedIdentity, ed25519.PublicKeySize)
+	if err != nil {
+		return err
+	}
+	if err := verifySignedPrekey(identityKey, signedPrekey); err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		`UPDATE device_keys SET signed_prekey_id = $2, signed_prekey = $3, signed_prekey_signature = $4
+		WHERE device_id = $1`,
+		deviceRef, signedPrekey.KeyID, signedPrekey.PublicKey, signedPrekey.Signature,
+	)
+	return err
+}
+
+// CountPrekeys returns how many one-time prekeys a device has left
+func (s *Service) CountPrekeys(ctx context.Context, userID, deviceID string) (int, error) {
+	deviceRef, err := lookupDevice(ctx, s.db, userID, deviceID)
+	if err != nil {
+		return 0, err
+	}
+	return countPrekeys(ctx, s.db, deviceRef)
+}
+
+// ClaimBundles returns a prekey bundle for every device of a user that has
+// uploaded keys, or only for onlyDevice if set. Each bundle takes one
+// one-time prekey, which is removed so no other sender can get it.
+func (s *Service) ClaimBundles(ctx context.Context, userID, onlyDevice string) ([]*PrekeyBundle, []ClaimedPrekey, error) {
+	query := `
+		SELECT ud.id, ud.device_id, dk.identity_key,
+		       dk.signed_prekey_id, dk.signed_prekey, dk.signed_prekey_signature
+		FROM user_devices ud
+		JOIN device_keys dk ON dk.device_id = ud.id
+		WHERE ud.user_id = $1 AND ($2 = '' OR ud.device_id = $2)
+		ORDER BY ud.created_at`
+
+	rows, err := s.db.QueryContext(ctx, query, userID, onlyDevice)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	type deviceBundle struct {
+		ref    string
+		bundle *PrekeyBundle
+	}
+
+	devices := make([]deviceBundle, 0)
+	for rows.Next() {
+		var d deviceBundle
+		d.bundle = &PrekeyBundle{}
+		err := rows.Scan(&d.ref, &d.bundle.DeviceID, &d.bundle.IdentityKey,
+			&d.bundle.SignedPrekey.KeyID, &d.bundle.SignedPrekey.PublicKey, &d.bundle.SignedPrekey.Signature)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		devices = append(devices, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	bundles := make([]*PrekeyBundle, 0, len(devices))
+	claims := make([]ClaimedPrekey, 0, len(devices))
+	for _, d := range devices {
+		previous, err := countPrekeys(ctx, s.db, d.ref)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// SKIP LOCKED lets concurrent claims take different keys instead of waiting
+		var prekey OneTimePrekey
+		err = s.db.QueryRowContext(ctx,
+			`DELETE FROM one_time_prekeys
+			WHERE id = (
+				SELECT id FROM one_time_prekeys
+				WHERE device_id = $1
+				ORDER BY key_id
+				LIMIT 1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING key_id, public_key`,
+			d.ref,
+		).Scan(&prekey.KeyID, &prekey.PublicKey)
+
+		switch {
+		case err == sql.ErrNoRows:
+			// The signed prekey alone still allows a session
+		case err != nil:
+			return nil, nil, err
+		default:
+			d.bundle.OneTimePrekey = &prekey
+		}
+
+		remaining, err := countPrekeys(ctx, s.db, d.ref)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		bundles = append(bundles, d.bundle)
+		claims = append(claims, ClaimedPrekey{
+			UserID:    userID,
+			DeviceID:  d.bundle.DeviceID,
+			Previous:  previous,
+			Remaining: remaining,
+		})
+	}
+
+	return bundles, claims, nil
+}
+
+// Helper functions
+
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// lookupDevice resolves a device ID from a token to its user_devices row
+func lookupDevice(ctx context.Context, q queryer, userID, deviceID string) (string, error) {
+	var ref string
+	err := q.QueryRowContext(ctx,
+		"SELECT id FROM user_devices WHERE device_id = $1 AND user_id = $2",
+		deviceID, userID,
+	).Scan(&ref)
+	if err == sql.ErrNoRows {
+		return "", ErrDeviceNotFound
+	}
+	return ref, err
+}
+
+func countPrekeys(ctx context.Context, q queryer, deviceRef string) (int, error) {
+	var count int
+	err := q.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM one_time_prekeys WHERE device_id = $1",
+		deviceRef,
+	).Scan(&count)
+	return count, err
+}
+
+func insertPrekeys(ctx context.Context, tx *sql.Tx, deviceRef string, prekeys []OneTimePrekey) (int, error) {
+	for _, prekey := range prekeys {
+		result, err := tx.ExecContext(ctx,
+			`INSERT INTO one_time_prekeys (device_id, key_id, public_key)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (device_id, key_id) DO NOTHING`,
+			deviceRef, prekey.KeyID, prekey.PublicKey,
+		)
+		if err != nil {
+			return 0, err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return 0, ErrDuplicatePrekey
+		}
+	}
+
+	count, err := countPrekeys(ctx, tx, deviceRef)
+	if err != nil {
+		return 0, err
+	}
+	if count > maxStoredPrekeys {
+		return 0, ErrTooManyPrekeys
+	}
+	return count, nil
+}
+
+func validatePrekeys(prekeys []OneTimePrekey) error {
+	if len(prekeys) > maxPrekeyBatch {
+		return ErrTooManyPrekeys
+	}
+
+	seen := make(map[int]bool, len(prekeys))
+	for _, prekey := range prekeys {
+		if seen[prekey.KeyID] {
+			return ErrDuplicatePrekey
+		}
+		seen[prekey.KeyID] = true
+
+		if _, err := decodeKey(prekey.PublicKey, curve25519KeySize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifySignedPrekey checks that the signed prekey was signed by the
+// device's Ed25519 identity key
+func verifySignedPrekey(identityKey []byte, signedPrekey *SignedPrekey) error {
+	publicKey, err := decodeKey(signedPrekey.PublicKey, curve25519KeySize)
+	if err != nil {
+		return err
+	}
+
+	signature, err := decodeKey(signedPrekey.Signature, ed25519.SignatureSize)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(identityKey), publicKey, signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func decodeKey(encoded string, size int) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != size {
+		return nil, ErrInvalidKey
+	}
+	return key, nil
+}
@@ -0,0 +1,218 @@
+package keys
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// KeyChangedEvent is sent to a user's contacts when one of their device
+// identity keys changes, since it changes their safety number
+const KeyChangedEvent = "key_changed"
+
+// Key change reasons
+const (
+	KeyAdded   = "added"   // First key of a new device
+	KeyChanged = "changed" // A device replaced its key
+)
+
+// KeyChange is the payload of a key_changed event
+type KeyChange struct {
+	UserID      string    `json:"user_id"`
+	DeviceID    string    `json:"device_id"`
+	IdentityKey string    `json:"identity_key"`
+	Reason      string    `json:"reason"`
+	ChangedAt   time.Time `json:"changed_at"`
+}
+
+// KeyHistoryEntry is one recorded identity key of a device
+type KeyHistoryEntry struct {
+	DeviceID    string    `json:"device_id"`
+	IdentityKey string    `json:"identity_key"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Transparency keeps the append-only history of device identity keys and
+// tells contacts when a key changes.
+//
+// A device's identity key is the one uploaded through the keys API, or the
+// public_key given at login until it uploads one.
+type Transparency struct {
+	db       *sql.DB
+	notifier Notifier
+}
+
+// NewTransparency creates a key history recorder that notifies through notifier
+func NewTransparency(db *sql.DB, notifier Notifier) *Transparency {
+	return &Transparency{
+		db:       db,
+		notifier: notifier,
+	}
+}
+
+// RecordIdentityKey appends the device's current identity key to its history
+// if it differs from the last recorded one, and sends key_changed to the
+// user's contacts. Call it after anything that may have replaced the key.
+func (t *Transparency) RecordIdentityKey(ctx context.Context, userID, deviceID string) error {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Serialize concurrent logins and uploads of the same device
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", deviceID); err != nil {
+		return err
+	}
+
+	var identityKey string
+	err = tx.QueryRowContext(ctx,
+		`SELECT COALESCE(dk.identity_key, ud.public_key)
+		FROM user_devices ud
+		LEFT JOIN device_keys dk ON dk.device_id = ud.id
+		WHERE ud.device_id = $1 AND ud.user_id = $2`,
+		deviceID, userID,
+	).Scan(&identityKey)
+	if err == sql.ErrNoRows {
+		return ErrDeviceNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var previous sql.NullString
+	err = tx.QueryRowContext(ctx,
+		`SELECT identity_key FROM device_key_history
+		WHERE device_id = $1 AND user_id = $2
+		ORDER BY id DESC LIMIT 1`,
+		deviceID, userID,
+	).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if previous.Valid && previous.String == identityKey {
+		return nil
+	}
+
+	var changedAt time.Time
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO device_key_history (user_id, device_id, identity_key)
+		VALUES ($1, $2, $3)
+		RETURNING created_at`,
+		userID, deviceID, identityKey,
+	).Scan(&changedAt)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	change := &KeyChange{
+		UserID:      userID,
+		DeviceID:    deviceID,
+		IdentityKey: identityKey,
+		Reason:      KeyAdded,
+		ChangedAt:   changedAt,
+	}
+	if previous.Valid {
+		change.Reason = KeyChanged
+	}
+
+	t.notifyContacts(ctx, change)
+	return nil
+}
+
+// notifyContacts sends key_changed to everyone with the user in their
+// contacts, everyone in the user's contacts, and the user's own devices
+func (t *Transparency) notifyContacts(ctx context.Context, change *KeyChange) {
+	if t.notifier == nil {
+		return
+	}
+
+	rows, err := t.db.QueryContext(ctx,
+		`SELECT user_id FROM user_contacts WHERE contact_id = $1
+		UNION
+		SELECT contact_id FROM user_contacts WHERE user_id = $1`,
+		change.UserID,
+	)
+	if err != nil {
+		log.Printf("[Keys] Failed to load contacts of %s for key change: %v", change.UserID, err)
+		return
+	}
+	defer rows.Close()
+
+	recipients := []string{change.UserID}
+	for rows.Next() {
+		var contactID string
+		if err := rows.Scan(&contactID); err != nil {
+			continue
+		}
+		recipients = append(recipients, contactID)
+	}
+
+	// Queued, so contacts who are offline still learn about it before
+	// trusting the old key again
+	t.notifier.NotifyUsers(recipients, KeyChangedEvent, change)
+
+	log.Printf("[Keys] Identity key %s for UserID=%s DeviceID=%s, notified %d users",
+		change.Reason, change.UserID, change.DeviceID, len(recipients))
+}
+
+// GetHistory returns every identity key recorded for a user's devices,
+// oldest first
+func (t *Transparency) GetHistory(ctx context.Context, userID string) ([]*KeyHistoryEntry, error) {
+	rows, err := t.db.QueryContext(ctx,
+		`SELECT device_id, identity_key, created_at
+		FROM device_key_history
+		WHERE user_id = $1
+		ORDER BY id`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]*KeyHistoryEntry, 0)
+	for rows.Next() {
+		var e KeyHistoryEntry
+		if err := rows.Scan(&e.DeviceID, &e.IdentityKey, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &e)
+	}
+
+	return entries, rows.Err()
+}
+
+// currentIdentityKeys returns the identity key of each of a user's devices,
+// sorted by device ID
+func (t *Transparency) currentIdentityKeys(ctx context.Context, userID string) ([]DeviceIdentity, error) {
+	rows, err := t.db.QueryContext(ctx,
+		`SELECT ud.device_id, COALESCE(dk.identity_key, ud.public_key)
+		FROM user_devices ud
+		LEFT JOIN device_keys dk ON dk.device_id = ud.id
+		WHERE ud.user_id = $1
+		ORDER BY ud.device_id`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := make([]DeviceIdentity, 0)
+	for rows.Next() {
+		var d DeviceIdentity
+		if err := rows.Scan(&d.DeviceID, &d.IdentityKey); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+
+	return devices, rows.Err()
+}
@@ -1,16 +1,18 @@
 package media
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"strconv"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
-	"github.com/minio/minio-go/v7"
 )
 
 // Handler handles media-related HTTP requests
@@ -20,8 +22,7 @@ type Handler struct {
 }
 
 // NewHandler creates a new media handler
-func NewHandler(db *sql.DB, minioClient *minio.Client, bucketMedia, bucketThumb, bucketTemp string) *Handler {
-	service := NewService(db, minioClient, bucketMedia, bucketThumb, bucketTemp)
+func NewHandler(db *sql.DB, service *Service) *Handler {
 	return &Handler{
 		service: service,
 		db:      db,
@@ -50,42 +51,108 @@ func (h *Handler) Upload(c *fiber.Ctx) error {
 
 	file := files[0]
 
-	// Validate file size
-	if file.Size > MaxFileSize {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error":    "File too large",
-			"max_size": MaxFileSize,
+	// Open file
+	src, err := file.Open()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to open file",
 		})
 	}
+	defer src.Close()
+
+	// Upload file once its type, size and content check out
+	media, err := h.service.UploadFile(c.Context(), src, file, userID, "")
+	if err != nil {
+		return uploadError(c, err, "Failed to upload file")
+	}
+
+	// Return response
+	return c.JSON(UploadResponse{
+		ID:   media.ID,
+		URL:  media.URL,
+		Type: media.Type,
+		Size: media.Size,
+	})
+}
 
-	// Validate file type
-	if err := ValidateFileType(file.Filename, file.Header.Get("Content-Type")); err != nil {
+// CreateUpload starts a resumable upload
+func (h *Handler) CreateUpload(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var req CreateUploadRequest
+	if err := c.BodyParser(&req); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid file type",
+			"error": "Invalid request body",
 		})
 	}
 
-	// Open file
-	src, err := file.Open()
+	upload, err := h.service.CreateUpload(c.Context(), userID, &req)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to open file",
+		return uploadError(c, err, "Failed to start upload")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(upload)
+}
+
+// CreateIntent returns a presigned URL to PUT a file straight into storage
+func (h *Handler) CreateIntent(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var req CreateUploadRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
 		})
 	}
-	defer src.Close()
 
-	// Determine media type
-	mediaType := GetMediaType(file.Header.Get("Content-Type"))
+	intent, err := h.service.CreateIntent(c.Context(), userID, &req)
+	if err != nil {
+		return uploadError(c, err, "Failed to create upload intent")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(intent)
+}
+
+// GetUpload returns an upload and the parts received so far
+func (h *Handler) GetUpload(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
 
-	// Upload file
-	media, err := h.service.UploadFile(c.Context(), src, file, userID, mediaType)
+	upload, err := h.service.GetUpload(c.Context(), userID, c.Params("id"))
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to upload file",
-		})
+		return uploadError(c, err, "Failed to get upload")
+	}
+
+	return c.JSON(upload)
+}
+
+// UploadPart stores one part of an upload, sent as the raw request body
+func (h *Handler) UploadPart(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	part, err := strconv.Atoi(c.Params("part"))
+	if err != nil {
+		return uploadError(c, ErrInvalidPart, "")
+	}
+
+	body := c.Body()
+	stored, err := h.service.PutUploadPart(c.Context(), userID, c.Params("id"), part, bytes.NewReader(body), int64(len(body)), c.Get("Content-MD5"))
+	if err != nil {
+		return uploadError(c, err, "Failed to store part")
+	}
+
+	return c.JSON(stored)
+}
+
+// CompleteUpload checks and stores a finished upload or a finalized intent
+// as media
+func (h *Handler) CompleteUpload(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	media, err := h.service.CompleteUpload(c.Context(), userID, c.Params("id"))
+	if err != nil {
+		return uploadError(c, err, "Failed to complete upload")
 	}
 
-	// Return response
 	return c.JSON(UploadResponse{
 		ID:   media.ID,
 		URL:  media.URL,
@@ -94,6 +161,87 @@ func (h *Handler) Upload(c *fiber.Ctx) error {
 	})
 }
 
+// AbortUpload drops an unfinished upload
+func (h *Handler) AbortUpload(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	if err := h.service.AbortUpload(c.Context(), userID, c.Params("id")); err != nil {
+		return uploadError(c, err, "Failed to abort upload")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Upload aborted",
+	})
+}
+
+func uploadError(c *fiber.Ctx, err error, message string) error {
+	var tooLarge *FileTooLargeError
+	if errors.As(err, &tooLarge) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":    "File too large",
+			"max_size": tooLarge.MaxSize,
+		})
+	}
+
+	switch err {
+	case ErrUploadNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Upload not found",
+		})
+	case ErrMediaNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Media not found",
+		})
+	case ErrInvalidUpload:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "filename, size and a hex sha256 are required",
+		})
+	case ErrInvalidFileType:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid file type",
+		})
+	case ErrInvalidPart:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid part number or size",
+		})
+	case ErrUploadIncomplete:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The file hasn't been fully uploaded",
+		})
+	case ErrUploadInProgress:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The upload is being completed, retry later",
+		})
+	case ErrChecksumMismatch:
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Checksum mismatch",
+		})
+	case ErrSizeMismatch:
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "File size doesn't match the declared size",
+		})
+	case ErrTypeMismatch:
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "File content doesn't match the declared type",
+		})
+	case ErrImageTooLarge:
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error":         "Image dimensions too large",
+			"max_dimension": MaxImageDimension,
+			"max_pixels":    MaxImagePixels,
+		})
+	case ErrPolyglotFile:
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "File is also valid as another format",
+		})
+	}
+
+	log.Printf("[Media] %s: %v", message, err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": message,
+	})
+}
+
 // GetFile handles file retrieval
 func (h *Handler) GetFile(c *fiber.Ctx) error {
 	mediaID := c.Params("id")
@@ -12,6 +12,17 @@ var (
 	ErrFileTooLarge    = errors.New("file too large")
 	ErrGalleryNotFound = errors.New("gallery not found")
 	ErrUnauthorized    = errors.New("unauthorized access")
+
+	ErrUploadNotFound   = errors.New("upload not found")
+	ErrInvalidUpload    = errors.New("invalid upload")
+	ErrInvalidPart      = errors.New("invalid part")
+	ErrUploadIncomplete = errors.New("upload incomplete")
+	ErrUploadInProgress = errors.New("upload is being completed")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	ErrSizeMismatch     = errors.New("size mismatch")
+	ErrTypeMismatch     = errors.New("content type mismatch")
+	ErrImageTooLarge    = errors.New("image dimensions too large")
+	ErrPolyglotFile     = errors.New("file is also valid as another format")
 )
 
 // MediaFile represents a media file
@@ -63,6 +74,62 @@ type UploadResponse struct {
 	Size         int64  `json:"size"`
 }
 
+// CreateUploadRequest starts a resumable upload or an upload intent
+type CreateUploadRequest struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"` // Hex digest of the whole file, checked on completion
+}
+
+// Upload is a resumable upload. Parts are numbered from 1 and all have
+// PartSize bytes except the last one.
+type Upload struct {
+	ID            string     `json:"upload_id"`
+	Filename      string     `json:"filename"`
+	MimeType      string     `json:"mime_type"`
+	Type          string     `json:"type"`
+	Size          int64      `json:"size"`
+	PartSize      int64      `json:"part_size"`
+	TotalParts    int        `json:"total_parts"`
+	ReceivedParts []int      `json:"received_parts"`
+	Status        string     `json:"status"`             // pending, completing or completed
+	MediaID       *string    `json:"media_id,omitempty"` // Set once completed
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	CompletedAt   *time.Time `json:"completed_at,omitempty"`
+
+	userID     string
+	objectName string
+	storageID  string // Empty for upload intents, which have a single part
+	sha256     string
+	claimedAt  time.Time // When the current completion claimed it
+}
+
+// UploadIntent lets a client PUT a file straight into storage. Once the PUT
+// succeeds the client finalizes the intent, which checks the stored object
+// against Size, Type and SHA256.
+type UploadIntent struct {
+	ID           string    `json:"upload_id"`
+	URL          string    `json:"url"`
+	Method       string    `json:"method"`
+	Filename     string    `json:"filename"`
+	MimeType     string    `json:"mime_type"` // Content-Type to send with the PUT
+	Type         string    `json:"type"`
+	Size         int64     `json:"size"` // The object must have exactly this size
+	MaxSize      int64     `json:"max_size"`
+	SHA256       string    `json:"sha256"`
+	URLExpiresAt time.Time `json:"url_expires_at"`
+	ExpiresAt    time.Time `json:"expires_at"` // Finalize before this
+}
+
+// UploadPart is a part stored for a resumable upload
+type UploadPart struct {
+	Part int    `json:"part"`
+	Size int64  `json:"size"`
+	ETag string `json:"etag"`
+}
+
 // GalleryListResponse represents a paginated list of gallery items
 type GalleryListResponse struct {
 	Items      []*MediaFile `json:"items"`
@@ -94,4 +161,16 @@ const (
 	ThumbnailWidth   = 400
 	ThumbnailHeight  = 400
 	ThumbnailQuality = 80
+
+	// Resumable uploads: parts must be at least 5MB for multipart storage,
+	// except the last one
+	UploadPartSize = 8 * 1024 * 1024 // 8MB
+	UploadExpiry   = 24 * time.Hour
+
+	// How long completing an upload may take before another request can
+	// take it over, e.g. because the server died halfway
+	UploadClaimTimeout = 15 * time.Minute
+
+	// How long the presigned URL of an upload intent is valid
+	IntentURLExpiry = time.Hour
 )
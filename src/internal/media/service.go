@@ -34,18 +34,33 @@ func NewService(db *sql.DB, minioClient *minio.Client, bucketMedia, bucketThumb,
 	}
 }
 
-// UploadFile handles file upload to MinIO
+// UploadFile checks a file's type, size and content and uploads it to
+// MinIO. If mediaType is set, other kinds of media are refused.
 func (s *Service) UploadFile(ctx context.Context, file multipart.File, header *multipart.FileHeader, userID string, mediaType string) (*MediaFile, error) {
-	// Generate unique filename
-	ext := filepath.Ext(header.Filename)
-	objectName := fmt.Sprintf("%s/%s%s", userID, uuid.New().String(), ext)
+	format, err := ValidateFileType(header.Filename, header.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	if mediaType != "" && format.MediaType != mediaType {
+		return nil, ErrInvalidFileType
+	}
+	if header.Size > format.MaxSize {
+		return nil, &FileTooLargeError{MaxSize: format.MaxSize}
+	}
 
-	// Determine content type
-	contentType := header.Header.Get("Content-Type")
-	if contentType == "" {
-		contentType = "application/octet-stream"
+	// Nothing is stored unless the content is what the file claims to be
+	if err := CheckContent(format, file); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
 	}
 
+	// Generate unique filename
+	ext := strings.ToLower(filepath.Ext(header.Filename))
+	objectName := fmt.Sprintf("%s/%s%s", userID, uuid.New().String(), ext)
+	contentType := format.MimeType
+
 	// Upload to MinIO
 	info, err := s.minioClient.PutObject(ctx, s.bucketMedia, objectName, file, header.Size, minio.PutObjectOptions{
 		ContentType: contentType,
@@ -65,7 +80,7 @@ func (s *Service) UploadFile(ctx context.Context, file multipart.File, header *m
 		OriginalFilename: header.Filename,
 		MimeType:         contentType,
 		Size:             header.Size,
-		Type:             mediaType,
+		Type:             format.MediaType,
 		URL:              url,
 		CreatedAt:        time.Now(),
 	}
@@ -168,33 +183,3 @@ func (s *Service) CreateUploadURL(ctx context.Context, objectName string, expiry
 	}
 	return url.String(), nil
 }
-
-// ValidateFileType checks if the file type is allowed
-func ValidateFileType(filename string, contentType string) error {
-	ext := strings.ToLower(filepath.Ext(filename))
-
-	// Allowed extensions
-	allowedImages := map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true}
-	allowedVideos := map[string]bool{".mp4": true, ".webm": true, ".mov": true}
-	allowedAudio := map[string]bool{".mp3": true, ".wav": true, ".ogg": true, ".m4a": true}
-
-	if allowedImages[ext] || allowedVideos[ext] || allowedAudio[ext] {
-		return nil
-	}
-
-	return ErrInvalidFileType
-}
-
-// GetMediaType returns the media type based on mime type
-func GetMediaType(mimeType string) string {
-	if strings.HasPrefix(mimeType, "image/") {
-		return "photo"
-	}
-	if strings.HasPrefix(mimeType, "video/") {
-		return "video"
-	}
-	if strings.HasPrefix(mimeType, "audio/") {
-		return "audio"
-	}
-	return "file"
-}
@@ -0,0 +1,710 @@
+package media
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/minio/minio-go/v7"
+)
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Upload statuses. An upload is claimed for completion before its object is
+// checked and copied, which happens outside any transaction.
+const (
+	uploadPending    = "pending"
+	uploadCompleting = "completing"
+	uploadCompleted  = "completed"
+)
+
+// unclaimed matches the uploads no request is completing: pending ones and
+// ones whose completion was abandoned
+var unclaimed = fmt.Sprintf(
+	`(status = '%s' OR (status = '%s' AND claimed_at <= NOW() - INTERVAL '%d seconds'))`,
+	uploadPending, uploadCompleting, int64(UploadClaimTimeout.Seconds()),
+)
+
+// uploadColumns are the media_uploads columns scanUpload reads
+const uploadColumns = `id, user_id, object_name, storage_upload_id, filename, mime_type, type,
+	size_bytes, part_size, sha256, media_id, created_at, expires_at, completed_at, status, claimed_at`
+
+// CreateUpload validates a resumable upload and opens its multipart upload
+// in the temp bucket
+func (s *Service) CreateUpload(ctx context.Context, userID string, req *CreateUploadRequest) (*Upload, error) {
+	upload, err := newUpload(userID, req)
+	if err != nil {
+		return nil, err
+	}
+
+	upload.storageID, err = s.core().NewMultipartUpload(ctx, s.bucketTemp, upload.objectName, minio.PutObjectOptions{
+		ContentType: upload.MimeType,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start multipart upload: %w", err)
+	}
+
+	if err := s.saveUpload(ctx, upload); err != nil {
+		s.core().AbortMultipartUpload(ctx, s.bucketTemp, upload.objectName, upload.storageID)
+		return nil, err
+	}
+	return upload, nil
+}
+
+// CreateIntent validates an upload the client will PUT straight into the
+// temp bucket and returns a presigned URL for it. Finalizing the intent is
+// completing it as an upload.
+func (s *Service) CreateIntent(ctx context.Context, userID string, req *CreateUploadRequest) (*UploadIntent, error) {
+	upload, err := newUpload(userID, req)
+	if err != nil {
+		return nil, err
+	}
+	upload.PartSize = upload.Size
+	upload.TotalParts = 1
+
+	urlExpiresAt := time.Now().Add(IntentURLExpiry)
+	url, err := s.CreateUploadURL(ctx, upload.objectName, IntentURLExpiry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to presign upload: %w", err)
+	}
+	if err := s.saveUpload(ctx, upload); err != nil {
+		return nil, err
+	}
+
+	return &UploadIntent{
+		ID:           upload.ID,
+		URL:          url,
+		Method:       "PUT",
+		Filename:     upload.Filename,
+		MimeType:     upload.MimeType,
+		Type:         upload.Type,
+		Size:         upload.Size,
+		MaxSize:      lookupFormat(upload.MimeType).MaxSize,
+		SHA256:       upload.sha256,
+		URLExpiresAt: urlExpiresAt,
+		ExpiresAt:    upload.ExpiresAt,
+	}, nil
+}
+
+// newUpload validates a request for a user's upload and names its object
+func newUpload(userID string, req *CreateUploadRequest) (*Upload, error) {
+	req.SHA256 = strings.ToLower(req.SHA256)
+	if req.Filename == "" || req.Size <= 0 || !sha256Pattern.MatchString(req.SHA256) {
+		return nil, ErrInvalidUpload
+	}
+	format, err := ValidateFileType(req.Filename, req.ContentType)
+	if err != nil {
+		return nil, err
+	}
+	if req.Size > format.MaxSize {
+		return nil, &FileTooLargeError{MaxSize: format.MaxSize}
+	}
+
+	upload := &Upload{
+		Filename:      req.Filename,
+		MimeType:      format.MimeType,
+		Type:          format.MediaType,
+		Size:          req.Size,
+		PartSize:      UploadPartSize,
+		ReceivedParts: []int{},
+		Status:        uploadPending,
+		userID:        userID,
+		objectName:    fmt.Sprintf("%s/%s%s", userID, uuid.New().String(), strings.ToLower(filepath.Ext(req.Filename))),
+		sha256:        req.SHA256,
+	}
+	upload.TotalParts = upload.partCount()
+	return upload, nil
+}
+
+// saveUpload inserts a new upload, setting its ID and times
+func (s *Service) saveUpload(ctx context.Context, upload *Upload) error {
+	err := s.db.QueryRowContext(ctx,
+		`INSERT INTO media_uploads (
+			user_id, object_name, storage_upload_id, filename, mime_type,
+			type, size_bytes, part_size, sha256, expires_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NOW() + $10 * INTERVAL '1 second')
+		RETURNING id, created_at, expires_at`,
+		upload.userID, upload.objectName, sql.NullString{String: upload.storageID, Valid: upload.storageID != ""},
+		upload.Filename, upload.MimeType, upload.Type, upload.Size, upload.PartSize, upload.sha256,
+		int64(UploadExpiry.Seconds()),
+	).Scan(&upload.ID, &upload.CreatedAt, &upload.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to save upload: %w", err)
+	}
+	return nil
+}
+
+// GetUpload returns one of a user's uploads with the parts received so
+// far, which is where a client resumes from
+func (s *Service) GetUpload(ctx context.Context, userID, uploadID string) (*Upload, error) {
+	upload, err := s.loadUpload(ctx, userID, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	// Parts are gone once a completion assembled them
+	if upload.Status != uploadPending || upload.storageID == "" {
+		return upload, nil
+	}
+
+	parts, err := s.listParts(ctx, upload)
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range parts {
+		upload.ReceivedParts = append(upload.ReceivedParts, part.PartNumber)
+	}
+	return upload, nil
+}
+
+// PutUploadPart stores one part of an upload. Sending a part again
+// replaces it. md5Base64, if set, is checked by the storage.
+func (s *Service) PutUploadPart(ctx context.Context, userID, uploadID string, part int, data io.Reader, size int64, md5Base64 string) (*UploadPart, error) {
+	upload, err := s.loadUpload(ctx, userID, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if upload.CompletedAt != nil {
+		return nil, ErrUploadNotFound
+	}
+	if upload.Status == uploadCompleting {
+		return nil, ErrUploadInProgress
+	}
+	if upload.storageID == "" || part < 1 || part > upload.TotalParts || size != upload.partLength(part) {
+		return nil, ErrInvalidPart
+	}
+
+	stored, err := s.core().PutObjectPart(ctx, s.bucketTemp, upload.objectName, upload.storageID, part, data, size, minio.PutObjectPartOptions{
+		Md5Base64: md5Base64,
+	})
+	if err != nil {
+		switch minio.ToErrorResponse(err).Code {
+		case "BadDigest", "InvalidDigest":
+			return nil, ErrChecksumMismatch
+		case "NoSuchUpload":
+			return nil, ErrUploadNotFound
+		}
+		return nil, fmt.Errorf("failed to store part: %w", err)
+	}
+
+	return &UploadPart{Part: part, Size: size, ETag: stored.ETag}, nil
+}
+
+// CompleteUpload assembles an upload whose parts are all in, or takes the
+// object PUT for an intent, checks its size, content and SHA-256, moves it
+// into the media bucket and creates its gallery_media row. Completing an
+// upload again returns the same media; while another request is completing
+// it, ErrUploadInProgress is returned.
+//
+// The upload is claimed first and the storage work runs outside any
+// transaction, so slow checks and copies don't hold row locks.
+func (s *Service) CompleteUpload(ctx context.Context, userID, uploadID string) (*MediaFile, error) {
+	upload, err := s.claimUpload(ctx, userID, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if upload.CompletedAt != nil {
+		// Completed before; its media may have been deleted since
+		if upload.MediaID == nil {
+			return nil, ErrMediaNotFound
+		}
+		return s.mediaFile(ctx, userID, *upload.MediaID)
+	}
+
+	sum, err := s.stage(ctx, upload)
+	switch err {
+	case nil:
+	case ErrSizeMismatch, ErrTypeMismatch, ErrImageTooLarge, ErrPolyglotFile, ErrChecksumMismatch:
+		s.removeTemp(ctx, upload.objectName)
+		// An intent's object can be PUT again, but a multipart upload's
+		// parts are gone once assembled, so it can't be retried
+		if upload.storageID == "" {
+			s.releaseUpload(ctx, upload)
+			return nil, err
+		}
+		if _, dbErr := s.db.ExecContext(ctx,
+			"DELETE FROM media_uploads WHERE id = $1 AND claimed_at = $2",
+			upload.ID, upload.claimedAt,
+		); dbErr != nil {
+			return nil, dbErr
+		}
+		return nil, err
+	default:
+		s.releaseUpload(ctx, upload)
+		return nil, err
+	}
+
+	_, err = s.minioClient.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: s.bucketMedia, Object: upload.objectName},
+		minio.CopySrcOptions{Bucket: s.bucketTemp, Object: upload.objectName},
+	)
+	if err != nil {
+		s.releaseUpload(ctx, upload)
+		return nil, fmt.Errorf("failed to move upload: %w", err)
+	}
+
+	media := &MediaFile{
+		ID:               uuid.New().String(),
+		UserID:           userID,
+		Type:             upload.Type,
+		Filename:         upload.objectName,
+		OriginalFilename: upload.Filename,
+		MimeType:         upload.MimeType,
+		Size:             upload.Size,
+		URL:              fmt.Sprintf("/api/v1/media/%s", upload.objectName),
+		Hash:             &sum,
+		CreatedAt:        time.Now(),
+	}
+
+	if err := s.saveCompleted(ctx, upload, media); err != nil {
+		// A request that took the claim over owns the copied object now
+		if err == ErrUploadInProgress {
+			return nil, err
+		}
+		s.minioClient.RemoveObject(ctx, s.bucketMedia, upload.objectName, minio.RemoveObjectOptions{})
+		s.releaseUpload(ctx, upload)
+		return nil, fmt.Errorf("failed to save media record: %w", err)
+	}
+
+	s.removeTemp(ctx, upload.objectName)
+	return media, nil
+}
+
+// claimUpload marks one of a user's uploads as being completed, so other
+// completions, new parts and the janitor leave it alone. A claim older than
+// UploadClaimTimeout was abandoned and is taken over. Completed uploads are
+// returned as they are, and ErrUploadInProgress if someone else holds the
+// claim.
+func (s *Service) claimUpload(ctx context.Context, userID, uploadID string) (*Upload, error) {
+	upload, err := scanUpload(s.db.QueryRowContext(ctx,
+		`UPDATE media_uploads SET status = $3, claimed_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND expires_at > NOW() AND `+unclaimed+`
+		RETURNING `+uploadColumns,
+		uploadID, userID, uploadCompleting,
+	))
+	if err != ErrUploadNotFound {
+		return upload, err
+	}
+
+	// Not claimable: find out why
+	upload, err = s.loadUpload(ctx, userID, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if upload.CompletedAt == nil {
+		return nil, ErrUploadInProgress
+	}
+	return upload, nil
+}
+
+// releaseUpload gives up a claim after a failed completion, so the upload
+// can be completed again
+func (s *Service) releaseUpload(ctx context.Context, upload *Upload) {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE media_uploads SET status = $2, claimed_at = NULL
+		WHERE id = $1 AND status = $3 AND claimed_at = $4`,
+		upload.ID, uploadPending, uploadCompleting, upload.claimedAt,
+	)
+	if err != nil {
+		log.Printf("[Media] Failed to release upload %s: %v", upload.ID, err)
+	}
+}
+
+// saveCompleted creates the media row of a claimed upload and marks it
+// completed. It returns ErrUploadInProgress if the claim was taken over.
+func (s *Service) saveCompleted(ctx context.Context, upload *Upload, media *MediaFile) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO gallery_media (
+			id, gallery_id, type, filename, original_filename,
+			mime_type, size_bytes, url, hash, upload_id, created_at
+		) VALUES ($1, NULL, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		media.ID, media.Type, media.Filename, media.OriginalFilename,
+		media.MimeType, media.Size, media.URL, *media.Hash, upload.ID, media.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx,
+		`UPDATE media_uploads SET status = $2, media_id = $3, completed_at = NOW()
+		WHERE id = $1 AND status = $4 AND claimed_at = $5`,
+		upload.ID, uploadCompleted, media.ID, uploadCompleting, upload.claimedAt,
+	)
+	if err != nil {
+		return err
+	}
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if claimed == 0 {
+		return ErrUploadInProgress
+	}
+
+	return tx.Commit()
+}
+
+// stage gets an upload's whole object into the temp bucket and checks it,
+// returning its hex SHA-256
+func (s *Service) stage(ctx context.Context, upload *Upload) (string, error) {
+	if upload.storageID != "" {
+		if err := s.assemble(ctx, upload); err != nil {
+			return "", err
+		}
+	}
+	return s.checkStaged(ctx, upload)
+}
+
+// AbortUpload drops an upload that hasn't been completed, with its parts.
+// An upload that is being completed can't be aborted.
+func (s *Service) AbortUpload(ctx context.Context, userID, uploadID string) error {
+	upload, err := s.loadUpload(ctx, userID, uploadID)
+	if err != nil {
+		return err
+	}
+	if upload.CompletedAt != nil {
+		return ErrUploadNotFound
+	}
+
+	return s.dropUpload(ctx, upload)
+}
+
+// ExpireUploads drops the uploads that weren't completed in time and
+// returns how many
+func (s *Service) ExpireUploads(ctx context.Context) (int, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, object_name, storage_upload_id FROM media_uploads
+		WHERE completed_at IS NULL AND expires_at <= NOW() AND `+unclaimed,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	expired := make([]*Upload, 0)
+	for rows.Next() {
+		upload := &Upload{}
+		var storageID sql.NullString
+		if err := rows.Scan(&upload.ID, &upload.objectName, &storageID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		upload.storageID = storageID.String
+		expired = append(expired, upload)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, upload := range expired {
+		switch err := s.dropUpload(ctx, upload); err {
+		case nil:
+			count++
+		case ErrUploadInProgress:
+			// Claimed since it was listed
+		default:
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// SweepTemp removes what abandoned uploads left in the temp bucket that
+// ExpireUploads can't reach: objects and multipart uploads older than
+// UploadExpiry, whose uploads have expired or are gone. It returns how many
+// it removed.
+func (s *Service) SweepTemp(ctx context.Context) (int, error) {
+	cutoff := time.Now().Add(-UploadExpiry)
+	count := 0
+
+	for object := range s.minioClient.ListObjects(ctx, s.bucketTemp, minio.ListObjectsOptions{Recursive: true}) {
+		if object.Err != nil {
+			return count, fmt.Errorf("failed to list temp objects: %w", object.Err)
+		}
+		if object.LastModified.After(cutoff) {
+			continue
+		}
+		if err := s.minioClient.RemoveObject(ctx, s.bucketTemp, object.Key, minio.RemoveObjectOptions{}); err != nil {
+			return count, fmt.Errorf("failed to remove %s: %w", object.Key, err)
+		}
+		count++
+	}
+
+	for multipart := range s.minioClient.ListIncompleteUploads(ctx, s.bucketTemp, "", true) {
+		if multipart.Err != nil {
+			return count, fmt.Errorf("failed to list multipart uploads: %w", multipart.Err)
+		}
+		if multipart.Initiated.After(cutoff) {
+			continue
+		}
+		err := s.core().AbortMultipartUpload(ctx, s.bucketTemp, multipart.Key, multipart.UploadID)
+		if err != nil && minio.ToErrorResponse(err).Code != "NoSuchUpload" {
+			return count, fmt.Errorf("failed to abort %s: %w", multipart.Key, err)
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// RunUploadJanitor expires abandoned uploads and sweeps the temp bucket
+// every interval
+func (s *Service) RunUploadJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx := context.Background()
+
+		count, err := s.ExpireUploads(ctx)
+		if err != nil {
+			log.Printf("[Media] Failed to expire uploads: %v", err)
+		}
+		if count > 0 {
+			log.Printf("[Media] Expired %d abandoned uploads", count)
+		}
+
+		count, err = s.SweepTemp(ctx)
+		if err != nil {
+			log.Printf("[Media] Failed to sweep the temp bucket: %v", err)
+		}
+		if count > 0 {
+			log.Printf("[Media] Removed %d stale objects from the temp bucket", count)
+		}
+	}
+}
+
+func (s *Service) core() minio.Core {
+	return minio.Core{Client: s.minioClient}
+}
+
+// loadUpload reads one of a user's uploads. Expired uploads that weren't
+// completed are not found.
+func (s *Service) loadUpload(ctx context.Context, userID, uploadID string) (*Upload, error) {
+	return scanUpload(s.db.QueryRowContext(ctx,
+		`SELECT `+uploadColumns+`
+		FROM media_uploads
+		WHERE id = $1 AND user_id = $2 AND (completed_at IS NOT NULL OR expires_at > NOW())`,
+		uploadID, userID,
+	))
+}
+
+// scanUpload reads an upload selected with uploadColumns
+func scanUpload(row *sql.Row) (*Upload, error) {
+	upload := &Upload{ReceivedParts: []int{}}
+	var storageID, mediaID sql.NullString
+	var completedAt, claimedAt pq.NullTime
+	err := row.Scan(
+		&upload.ID, &upload.userID, &upload.objectName, &storageID,
+		&upload.Filename, &upload.MimeType, &upload.Type,
+		&upload.Size, &upload.PartSize, &upload.sha256, &mediaID,
+		&upload.CreatedAt, &upload.ExpiresAt, &completedAt, &upload.Status, &claimedAt,
+	)
+	if err == sql.ErrNoRows || isInvalidID(err) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	upload.storageID = storageID.String
+	upload.claimedAt = claimedAt.Time
+	upload.TotalParts = upload.partCount()
+	if mediaID.Valid {
+		upload.MediaID = &mediaID.String
+	}
+	if completedAt.Valid {
+		upload.CompletedAt = &completedAt.Time
+	}
+	return upload, nil
+}
+
+// assemble completes the multipart upload into a single object in the temp
+// bucket, unless an earlier attempt already did
+func (s *Service) assemble(ctx context.Context, upload *Upload) error {
+	if _, err := s.minioClient.StatObject(ctx, s.bucketTemp, upload.objectName, minio.StatObjectOptions{}); err == nil {
+		return nil
+	}
+
+	parts, err := s.listParts(ctx, upload)
+	if err != nil {
+		return err
+	}
+
+	complete := make([]minio.CompletePart, 0, len(parts))
+	for _, part := range parts {
+		if part.PartNumber != len(complete)+1 || part.Size != upload.partLength(part.PartNumber) {
+			break
+		}
+		complete = append(complete, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+	}
+	if len(complete) != upload.TotalParts {
+		return ErrUploadIncomplete
+	}
+
+	_, err = s.core().CompleteMultipartUpload(ctx, s.bucketTemp, upload.objectName, upload.storageID, complete, minio.PutObjectOptions{
+		ContentType: upload.MimeType,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to assemble upload: %w", err)
+	}
+	return nil
+}
+
+// listParts returns the parts stored for an upload, in order
+func (s *Service) listParts(ctx context.Context, upload *Upload) ([]minio.ObjectPart, error) {
+	parts := make([]minio.ObjectPart, 0, upload.TotalParts)
+	marker := 0
+	for {
+		result, err := s.core().ListObjectParts(ctx, s.bucketTemp, upload.objectName, upload.storageID, marker, 1000)
+		if minio.ToErrorResponse(err).Code == "NoSuchUpload" {
+			return nil, ErrUploadNotFound
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list parts: %w", err)
+		}
+
+		parts = append(parts, result.ObjectParts...)
+		if !result.IsTruncated {
+			break
+		}
+		marker = result.NextPartNumberMarker
+	}
+
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	return parts, nil
+}
+
+// checkStaged reads an upload's object in the temp bucket and returns its
+// hex SHA-256 if it has the size, format and hash declared for it, see
+// CheckContent
+func (s *Service) checkStaged(ctx context.Context, upload *Upload) (string, error) {
+	object, err := s.minioClient.GetObject(ctx, s.bucketTemp, upload.objectName, minio.GetObjectOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to read upload: %w", err)
+	}
+	defer object.Close()
+
+	info, err := object.Stat()
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return "", ErrUploadIncomplete
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read upload: %w", err)
+	}
+	if info.Size != upload.Size {
+		return "", ErrSizeMismatch
+	}
+
+	// Uploads made before formats were checked may have other MIME types
+	format := lookupFormat(upload.MimeType)
+	if format == nil || format.MediaType != upload.Type {
+		return "", ErrTypeMismatch
+	}
+
+	hash := sha256.New()
+	if err := CheckContent(format, io.TeeReader(object, hash)); err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(hash, object); err != nil {
+		return "", fmt.Errorf("failed to read upload: %w", err)
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if sum != upload.sha256 {
+		return "", ErrChecksumMismatch
+	}
+	return sum, nil
+}
+
+// dropUpload deletes an upload unless a request is completing it, then
+// aborts its multipart upload if it has one and removes anything it left in
+// the temp bucket. SweepTemp catches whatever the cleanup misses.
+func (s *Service) dropUpload(ctx context.Context, upload *Upload) error {
+	result, err := s.db.ExecContext(ctx,
+		"DELETE FROM media_uploads WHERE id = $1 AND completed_at IS NULL AND "+unclaimed,
+		upload.ID,
+	)
+	if err != nil {
+		return err
+	}
+	dropped, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if dropped == 0 {
+		return ErrUploadInProgress
+	}
+
+	if upload.storageID != "" {
+		err := s.core().AbortMultipartUpload(ctx, s.bucketTemp, upload.objectName, upload.storageID)
+		if err != nil && minio.ToErrorResponse(err).Code != "NoSuchUpload" {
+			log.Printf("[Media] Failed to abort upload %s: %v", upload.ID, err)
+		}
+	}
+	s.removeTemp(ctx, upload.objectName)
+	return nil
+}
+
+func (s *Service) removeTemp(ctx context.Context, objectName string) {
+	if err := s.minioClient.RemoveObject(ctx, s.bucketTemp, objectName, minio.RemoveObjectOptions{}); err != nil {
+		log.Printf("[Media] Failed to remove %s from the temp bucket: %v", objectName, err)
+	}
+}
+
+// mediaFile reads a gallery_media row uploaded by userID
+func (s *Service) mediaFile(ctx context.Context, userID, mediaID string) (*MediaFile, error) {
+	media := MediaFile{UserID: userID}
+	err := s.db.QueryRowContext(ctx,
+		`SELECT id, type, filename, original_filename, mime_type, size_bytes, url, hash, created_at
+		FROM gallery_media WHERE id = $1`,
+		mediaID,
+	).Scan(
+		&media.ID, &media.Type, &media.Filename, &media.OriginalFilename,
+		&media.MimeType, &media.Size, &media.URL, &media.Hash, &media.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrMediaNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &media, nil
+}
+
+// partCount is how many parts the upload is split into
+func (u *Upload) partCount() int {
+	return int((u.Size + u.PartSize - 1) / u.PartSize)
+}
+
+// partLength is the size a part must have
+func (u *Upload) partLength(part int) int64 {
+	if part == u.partCount() {
+		return u.Size - int64(part-1)*u.PartSize
+	}
+	return u.PartSize
+}
+
+// isInvalidID reports whether a query failed on an ID that is not a UUID
+func isInvalidID(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "22P02"
+}
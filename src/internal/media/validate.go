@@ -0,0 +1,447 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/webp"
+)
+
+// SniffLength is how many bytes SniffFormat needs to identify a file
+const SniffLength = 512
+
+// Images larger than this are refused before anything decodes them
+const (
+	MaxImageDimension = 12000
+	MaxImagePixels    = 50 * 1000 * 1000 // 50MP
+)
+
+// Format is a kind of file users may upload
+type Format struct {
+	MimeType  string
+	MediaType string // photo, video or audio, as in the media_type enum
+	MaxSize   int64
+
+	extensions []string
+	aliases    []string // Other Content-Types clients send for it
+}
+
+var (
+	formatJPEG = &Format{MimeType: "image/jpeg", MediaType: "photo", MaxSize: MaxImageSize,
+		extensions: []string{".jpg", ".jpeg"}, aliases: []string{"image/jpg", "image/pjpeg"}}
+	formatPNG = &Format{MimeType: "image/png", MediaType: "photo", MaxSize: MaxImageSize,
+		extensions: []string{".png"}}
+	formatGIF = &Format{MimeType: "image/gif", MediaType: "photo", MaxSize: MaxImageSize,
+		extensions: []string{".gif"}}
+	formatWebP = &Format{MimeType: "image/webp", MediaType: "photo", MaxSize: MaxImageSize,
+		extensions: []string{".webp"}}
+	formatMP4 = &Format{MimeType: "video/mp4", MediaType: "video", MaxSize: MaxVideoSize,
+		extensions: []string{".mp4"}}
+	formatWebM = &Format{MimeType: "video/webm", MediaType: "video", MaxSize: MaxVideoSize,
+		extensions: []string{".webm"}}
+	formatMOV = &Format{MimeType: "video/quicktime", MediaType: "video", MaxSize: MaxVideoSize,
+		extensions: []string{".mov"}}
+	formatMP3 = &Format{MimeType: "audio/mpeg", MediaType: "audio", MaxSize: MaxAudioSize,
+		extensions: []string{".mp3"}, aliases: []string{"audio/mp3"}}
+	formatWAV = &Format{MimeType: "audio/wav", MediaType: "audio", MaxSize: MaxAudioSize,
+		extensions: []string{".wav"}, aliases: []string{"audio/wave", "audio/x-wav", "audio/vnd.wave"}}
+	formatOgg = &Format{MimeType: "audio/ogg", MediaType: "audio", MaxSize: MaxAudioSize,
+		extensions: []string{".ogg"}, aliases: []string{"application/ogg", "audio/vorbis", "audio/opus"}}
+	formatM4A = &Format{MimeType: "audio/mp4", MediaType: "audio", MaxSize: MaxAudioSize,
+		extensions: []string{".m4a"}, aliases: []string{"audio/x-m4a", "audio/m4a"}}
+)
+
+var formats = []*Format{
+	formatJPEG, formatPNG, formatGIF, formatWebP,
+	formatMP4, formatWebM, formatMOV,
+	formatMP3, formatWAV, formatOgg, formatM4A,
+}
+
+// FileTooLargeError is returned for files over the size limit of their type
+type FileTooLargeError struct {
+	MaxSize int64
+}
+
+func (e *FileTooLargeError) Error() string {
+	return fmt.Sprintf("file too large, the limit is %d bytes", e.MaxSize)
+}
+
+func (e *FileTooLargeError) Unwrap() error {
+	return ErrFileTooLarge
+}
+
+// ValidateFileType returns the format a file's extension stands for. If the
+// client sent a specific Content-Type it must be that format's.
+func ValidateFileType(filename string, contentType string) (*Format, error) {
+	ext := strings.ToLower(filepath.Ext(filename))
+
+	var format *Format
+	for _, f := range formats {
+		for _, e := range f.extensions {
+			if e == ext {
+				format = f
+			}
+		}
+	}
+	if format == nil {
+		return nil, ErrInvalidFileType
+	}
+
+	// Generic types say nothing; the content is checked anyway
+	mimeType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mimeType == "application/octet-stream" {
+		return format, nil
+	}
+	if lookupFormat(mimeType) != format {
+		return nil, ErrInvalidFileType
+	}
+	return format, nil
+}
+
+// GetMediaType returns the media type of a MIME type we accept
+func GetMediaType(mimeType string) (string, error) {
+	format := lookupFormat(strings.ToLower(mimeType))
+	if format == nil {
+		return "", ErrInvalidFileType
+	}
+	return format.MediaType, nil
+}
+
+func lookupFormat(mimeType string) *Format {
+	for _, f := range formats {
+		if f.MimeType == mimeType {
+			return f
+		}
+		for _, alias := range f.aliases {
+			if alias == mimeType {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+// SniffFormat identifies a file by its magic bytes, or returns nil
+func SniffFormat(head []byte) *Format {
+	switch {
+	case bytes.HasPrefix(head, []byte("\xFF\xD8\xFF")):
+		return formatJPEG
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return formatPNG
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return formatGIF
+	case riff(head, "WEBP"):
+		return formatWebP
+	case riff(head, "WAVE"):
+		return formatWAV
+	case bytes.HasPrefix(head, []byte("\x1A\x45\xDF\xA3")):
+		// Matroska; only its WebM profile is accepted
+		if bytes.Contains(head, []byte("webm")) {
+			return formatWebM
+		}
+	case bytes.HasPrefix(head, []byte("OggS")):
+		// Ogg can hold video too; the first packet names the codec
+		for _, codec := range []string{"\x01vorbis", "OpusHead", "\x7FFLAC"} {
+			if bytes.Contains(head, []byte(codec)) {
+				return formatOgg
+			}
+		}
+	case bytes.HasPrefix(head, []byte("ID3")), mpegFrame(head):
+		return formatMP3
+	case len(head) >= 12:
+		return isoMedia(head)
+	}
+	return nil
+}
+
+func riff(head []byte, form string) bool {
+	return len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == form
+}
+
+// mpegFrame reports whether head starts with an MPEG audio frame header.
+// Layer 0 is AAC in ADTS, which is not accepted.
+func mpegFrame(head []byte) bool {
+	return len(head) >= 2 && head[0] == 0xFF && head[1]&0xE0 == 0xE0 &&
+		head[1]&0x18 != 0x08 && head[1]&0x06 != 0
+}
+
+// isoMedia tells MP4, M4A and QuickTime files apart by their brand
+func isoMedia(head []byte) *Format {
+	box := string(head[4:8])
+	if box != "ftyp" {
+		// Old QuickTime files start with other atoms
+		switch box {
+		case "moov", "mdat", "wide", "free", "skip", "pnot":
+			return formatMOV
+		}
+		return nil
+	}
+
+	brand := string(head[8:12])
+	switch {
+	case brand == "M4A " || brand == "M4B ":
+		return formatM4A
+	case brand == "qt  ":
+		return formatMOV
+	case strings.HasPrefix(brand, "iso"), strings.HasPrefix(brand, "mp4"), strings.HasPrefix(brand, "M4V"),
+		brand == "avc1", brand == "dash", brand == "mmp4", brand == "MSNV":
+		return formatMP4
+	}
+	return nil
+}
+
+// CheckContent reads a file from r and checks that it is what format says.
+// Images are read whole, to refuse polyglots and decompression bombs; for
+// other formats only the first SniffLength bytes are read.
+func CheckContent(format *Format, r io.Reader) error {
+	if format.MediaType != "photo" {
+		head := make([]byte, SniffLength)
+		n, err := io.ReadFull(r, head)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+		if SniffFormat(head[:n]) != format {
+			return ErrTypeMismatch
+		}
+		return nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, format.MaxSize+1))
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	if int64(len(data)) > format.MaxSize {
+		return &FileTooLargeError{MaxSize: format.MaxSize}
+	}
+	if SniffFormat(data[:min(len(data), SniffLength)]) != format {
+		return ErrTypeMismatch
+	}
+	return checkImage(format, data)
+}
+
+// checkImage refuses images too large to decode safely and images that are
+// also valid files of another format: anything after the end of the image,
+// markup in its metadata, or a PDF or ZIP hidden in it.
+func checkImage(format *Format, data []byte) error {
+	var config image.Config
+	var err error
+	switch format {
+	case formatJPEG:
+		config, err = jpeg.DecodeConfig(bytes.NewReader(data))
+	case formatPNG:
+		config, err = png.DecodeConfig(bytes.NewReader(data))
+	case formatGIF:
+		config, err = gif.DecodeConfig(bytes.NewReader(data))
+	case formatWebP:
+		config, err = webp.DecodeConfig(bytes.NewReader(data))
+	}
+	if err != nil {
+		return ErrTypeMismatch
+	}
+	if config.Width > MaxImageDimension || config.Height > MaxImageDimension ||
+		int64(config.Width)*int64(config.Height) > MaxImagePixels {
+		return ErrImageTooLarge
+	}
+
+	// PDF readers look for their header in the first KB, ZIP readers for
+	// their directory in the last 64KB
+	if bytes.Contains(data[:min(len(data), 1024)], []byte("%PDF-")) ||
+		bytes.Contains(data[max(0, len(data)-65557):], []byte("PK\x05\x06")) {
+		return ErrPolyglotFile
+	}
+
+	var metadata [][]byte
+	var end int
+	switch format {
+	case formatJPEG:
+		metadata, end, err = jpegSegments(data)
+	case formatPNG:
+		metadata, end, err = pngChunks(data)
+	case formatGIF:
+		metadata, end, err = gifBlocks(data)
+	case formatWebP:
+		end = 8 + int(binary.LittleEndian.Uint32(data[4:8]))
+	}
+	if err != nil {
+		return err
+	}
+	if end != len(data) {
+		return ErrPolyglotFile
+	}
+
+	for _, block := range metadata {
+		if hasMarkup(block) {
+			return ErrPolyglotFile
+		}
+	}
+	return nil
+}
+
+// Markup browsers would run if the file were served as a page
+var markupTokens = [][]byte{
+	[]byte("<script"), []byte("<html"), []byte("<body"), []byte("<iframe"),
+	[]byte("<svg"), []byte("<!doctype"), []byte("<?php"), []byte("javascript:"),
+}
+
+func hasMarkup(block []byte) bool {
+	lower := bytes.ToLower(block)
+	for _, token := range markupTokens {
+		if bytes.Contains(lower, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// jpegSegments walks a JPEG's markers and returns its comment and
+// application segments and where its EOI marker ends
+func jpegSegments(data []byte) ([][]byte, int, error) {
+	metadata := [][]byte{}
+	pos := 2
+	for pos < len(data) {
+		if data[pos] != 0xFF {
+			return nil, 0, ErrTypeMismatch
+		}
+		for pos < len(data) && data[pos] == 0xFF {
+			pos++
+		}
+		if pos >= len(data) {
+			break
+		}
+		marker := data[pos]
+		pos++
+
+		switch {
+		case marker == 0xD9:
+			return metadata, pos, nil
+		case marker >= 0xD0 && marker <= 0xD7, marker == 0x01:
+			continue
+		}
+
+		if pos+2 > len(data) {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos:]))
+		if length < 2 || pos+length > len(data) {
+			break
+		}
+		if marker == 0xFE || (marker >= 0xE0 && marker <= 0xEF) {
+			metadata = append(metadata, data[pos+2:pos+length])
+		}
+		pos += length
+
+		// Entropy-coded data follows a scan header, up to the next marker
+		// that isn't a stuffed byte or a restart
+		if marker == 0xDA {
+			for pos+1 < len(data) {
+				if data[pos] == 0xFF && data[pos+1] != 0x00 && (data[pos+1] < 0xD0 || data[pos+1] > 0xD7) {
+					break
+				}
+				pos++
+			}
+		}
+	}
+	return nil, 0, ErrTypeMismatch
+}
+
+// pngChunks walks a PNG's chunks and returns its uncompressed text chunks
+// and where its IEND chunk ends
+func pngChunks(data []byte) ([][]byte, int, error) {
+	metadata := [][]byte{}
+	pos := 8
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		kind := string(data[pos+4 : pos+8])
+		if length > len(data)-pos-12 {
+			break
+		}
+		if kind == "tEXt" || kind == "iTXt" {
+			metadata = append(metadata, data[pos+8:pos+8+length])
+		}
+		pos += 12 + length
+		if kind == "IEND" {
+			return metadata, pos, nil
+		}
+	}
+	return nil, 0, ErrTypeMismatch
+}
+
+// gifBlocks walks a GIF's blocks and returns its comment and application
+// extensions and where its trailer ends
+func gifBlocks(data []byte) ([][]byte, int, error) {
+	metadata := [][]byte{}
+	if len(data) < 13 {
+		return nil, 0, ErrTypeMismatch
+	}
+	pos := 13
+	if data[10]&0x80 != 0 {
+		pos += 3 << (data[10]&0x07 + 1)
+	}
+
+	// subBlocks skips a run of data sub-blocks, returning their contents
+	subBlocks := func() ([]byte, bool) {
+		var content []byte
+		for pos < len(data) {
+			size := int(data[pos])
+			pos++
+			if size == 0 {
+				return content, true
+			}
+			if pos+size > len(data) {
+				return nil, false
+			}
+			content = append(content, data[pos:pos+size]...)
+			pos += size
+		}
+		return nil, false
+	}
+
+	for pos < len(data) {
+		block := data[pos]
+		pos++
+
+		switch block {
+		case 0x3B:
+			return metadata, pos, nil
+		case 0x21:
+			if pos >= len(data) {
+				return nil, 0, ErrTypeMismatch
+			}
+			label := data[pos]
+			pos++
+			content, ok := subBlocks()
+			if !ok {
+				return nil, 0, ErrTypeMismatch
+			}
+			if label == 0xFE || label == 0xFF {
+				metadata = append(metadata, content)
+			}
+		case 0x2C:
+			if pos+9 > len(data) {
+				return nil, 0, ErrTypeMismatch
+			}
+			packed := data[pos+8]
+			pos += 9
+			if packed&0x80 != 0 {
+				pos += 3 << (packed&0x07 + 1)
+			}
+			// LZW minimum code size, then the image data
+			pos++
+			if _, ok := subBlocks(); !ok {
+				return nil, 0, ErrTypeMismatch
+			}
+		default:
+			return nil, 0, ErrTypeMismatch
+		}
+	}
+	return nil, 0, ErrTypeMismatch
+}
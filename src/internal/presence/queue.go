@@ -0,0 +1,138 @@
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrQueueFull is returned when a recipient already has the maximum number
+// of unacknowledged messages queued
+var ErrQueueFull = errors.New("pending message queue full")
+
+// PendingMessage is a queued message that has not been acknowledged yet
+type PendingMessage struct {
+	EntryID   string
+	MessageID string
+	Data      string
+}
+
+// enqueueScript appends one entry per recipient device atomically and links
+// each stream entry to the message metadata so acks can find it. Devices whose
+// queue is at the cap are skipped and get an empty entry ID.
+//
+// KEYS: message metadata, then one queue per device
+// ARGV: cap, message ID, TTL, then device ID and data for each queue
+var enqueueScript = redis.NewScript(`
+local ids = {}
+for i = 2, #KEYS do
+	local device = ARGV[2 + (i - 1) * 2]
+	local data = ARGV[3 + (i - 1) * 2]
+	if redis.call('XLEN', KEYS[i]) >= tonumber(ARGV[1]) then
+		ids[#ids + 1] = ''
+	else
+		local id = redis.call('XADD', KEYS[i], '*', 'message_id', ARGV[2], 'data', data)
+		redis.call('EXPIRE', KEYS[i], ARGV[3])
+		redis.call('HSET', KEYS[1], 'queue_entry:' .. device, id)
+		ids[#ids + 1] = id
+	end
+end
+return ids
+`)
+
+func pendingQueueKey(userID, deviceID string) string {
+	return fmt.Sprintf("queue:messages:%s:%s", userID, deviceID)
+}
+
+// StorePendingMessages appends a message to the durable queue of each
+// recipient device, keyed by device ID, and returns the stream entry ID per
+// device. Messages stay queued until the device acknowledges them.
+// Devices with a full queue are left out of the result; if every queue is
+// full ErrQueueFull is returned.
+func (t *Tracker) StorePendingMessages(ctx context.Context, userID, messageID string, messages map[string]interface{}) (map[string]string, error) {
+	devices := make([]string, 0, len(messages))
+	keys := []string{fmt.Sprintf("message:meta:%s", messageID)}
+	args := []interface{}{t.maxPending, messageID, int64(t.pendingTTL.Seconds())}
+
+	for deviceID, message := range messages {
+		data, err := json.Marshal(message)
+		if err != nil {
+			return nil, err
+		}
+
+		devices = append(devices, deviceID)
+		keys = append(keys, pendingQueueKey(userID, deviceID))
+		args = append(args, deviceID, data)
+	}
+
+	ids, err := enqueueScript.Run(ctx, t.redis, keys, args...).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]string, len(devices))
+	for i, entryID := range ids {
+		if entryID != "" {
+			entries[devices[i]] = entryID
+		}
+	}
+
+	if len(entries) == 0 && len(devices) > 0 {
+		return nil, ErrQueueFull
+	}
+	return entries, nil
+}
+
+// GetPendingMessages returns up to count unacknowledged messages queued for a
+// device after the given stream entry, oldest first. An empty after starts
+// from the oldest.
+func (t *Tracker) GetPendingMessages(ctx context.Context, userID, deviceID, after string, count int64) ([]PendingMessage, error) {
+	key := pendingQueueKey(userID, deviceID)
+
+	start := "-"
+	if after != "" {
+		// XRANGE is inclusive, so fetch one extra and skip the cursor itself
+		start = after
+		count++
+	}
+
+	entries, err := t.redis.XRangeN(ctx, key, start, "+", count).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]PendingMessage, 0, len(entries))
+	for _, entry := range entries {
+		if entry.ID == after {
+			continue
+		}
+
+		messageID, _ := entry.Values["message_id"].(string)
+		data, _ := entry.Values["data"].(string)
+		messages = append(messages, PendingMessage{
+			EntryID:   entry.ID,
+			MessageID: messageID,
+			Data:      data,
+		})
+	}
+
+	return messages, nil
+}
+
+// AckPendingMessage removes an acknowledged message from a device's queue.
+// Acking a message that is no longer queued is not an error.
+func (t *Tracker) AckPendingMessage(ctx context.Context, userID, deviceID, messageID string) error {
+	metaKey := fmt.Sprintf("message:meta:%s", messageID)
+	entryID, err := t.redis.HGet(ctx, metaKey, "queue_entry:"+deviceID).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return t.redis.XDel(ctx, pendingQueueKey(userID, deviceID), entryID).Err()
+}
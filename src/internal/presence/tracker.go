@@ -2,19 +2,28 @@ package presence
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// Tracker keeps presence, message metadata and the offline queues in Redis.
+// A user is online while any of their devices keeps sending heartbeats.
 type Tracker struct {
 	redis *redis.Client
+
+	// How long a device stays online after its last heartbeat
+	deviceTTL time.Duration
+
+	// Offline queue limits, see queue.go
+	maxPending int64
+	pendingTTL time.Duration
 }
 
-func NewTracker(redisClient *redis.Client) *Tracker {
+func NewTracker(redisClient *redis.Client, deviceTTL time.Duration, maxPending int, pendingTTL time.Duration) *Tracker {
 	// Verificar que Redis funciona al crear el tracker
 	ctx := context.Background()
 	if err := redisClient.Ping(ctx).Err(); err != nil {
@@ -22,127 +31,341 @@ func NewTracker(redisClient *redis.Client) *Tracker {
 	} else {
 		log.Printf("[DEBUG] Redis connection OK in presence tracker")
 	}
-	
+
 	return &Tracker{
-		redis: redisClient,
+		redis:      redisClient,
+		deviceTTL:  deviceTTL,
+		maxPending: int64(maxPending),
+		pendingTTL: pendingTTL,
 	}
 }
 
-func (t *Tracker) SetUserOnline(ctx context.Context, userID, deviceID string) error {
-	log.Printf("[DEBUG] SetUserOnline called for userID=%s, deviceID=%s", userID, deviceID)
-	
-	if t.redis == nil {
-		log.Printf("[ERROR] Redis client is nil!")
-		return fmt.Errorf("redis client is nil")
-	}
-	
-	pipe := t.redis.Pipeline()
+// Presence statuses. Clients pick online, away, dnd or invisible; users
+// without a live device are offline, and invisible users look offline to
+// everyone else.
+const (
+	StatusOnline    = "online"
+	StatusAway      = "away"
+	StatusDND       = "dnd"
+	StatusInvisible = "invisible"
+	StatusOffline   = "offline"
+)
+
+const (
+	// How long a user's chosen status is kept after their last heartbeat
+	statusTTL = 30 * 24 * time.Hour
 
-	userKey := fmt.Sprintf("presence:user:%s", userID)
-	pipe.HSet(ctx, userKey, map[string]interface{}{
-		"status":    "online",
-		"last_seen": time.Now().Unix(),
-	})
-	pipe.Expire(ctx, userKey, 24*time.Hour)
+	// Users with a live device, scored by their last heartbeat, so expired
+	// ones are found with a range query
+	onlineUsersKey = "presence:online"
 
-	deviceKey := fmt.Sprintf("presence:devices:%s", userID)
-	pipe.SAdd(ctx, deviceKey, deviceID)
-	pipe.Expire(ctx, deviceKey, 24*time.Hour)
+	// How many stale users CleanupInactive loads at a time
+	cleanupBatch = 500
+)
 
-	pipe.SAdd(ctx, "presence:online_users", userID)
+// WatchTTL is how long a presence subscription lasts unless renewed
+const WatchTTL = 24 * time.Hour
 
-	_, err := pipe.Exec(ctx)
-	if err != nil {
-		log.Printf("[ERROR] Failed to set user online: %v", err)
-		return err
+func userKey(userID string) string {
+	return fmt.Sprintf("presence:user:%s", userID)
+}
+
+// devicesKey holds a user's devices scored by when their heartbeat expires
+func devicesKey(userID string) string {
+	return fmt.Sprintf("presence:devices:%s", userID)
+}
+
+// watchersKey holds the users subscribed to a user's presence, scored by
+// when their subscription expires
+func watchersKey(userID string) string {
+	return fmt.Sprintf("presence:watchers:%s", userID)
+}
+
+// Visible is the status everyone else sees for a connected user who chose
+// status
+func Visible(status string) string {
+	switch status {
+	case "":
+		return StatusOnline
+	case StatusInvisible:
+		return StatusOffline
 	}
-	
-	log.Printf("[DEBUG] User %s set online successfully", userID)
-	return nil
+	return status
+}
+
+// Change is a user's presence as everyone else sees it, before and after a
+// heartbeat, disconnect or status update
+type Change struct {
+	UserID string
+	From   string
+	To     string
+	At     time.Time
 }
 
-func (t *Tracker) SetUserOffline(ctx context.Context, userID string) error {
-	log.Printf("[DEBUG] SetUserOffline called for userID=%s", userID)
-	
-	if t.redis == nil {
-		log.Printf("[ERROR] Redis client is nil!")
-		return fmt.Errorf("redis client is nil")
+func newChange(userID, from, to string, at time.Time) *Change {
+	if from == to {
+		return nil
 	}
-	
-	pipe := t.redis.Pipeline()
+	return &Change{UserID: userID, From: from, To: to, At: at}
+}
 
-	userKey := fmt.Sprintf("presence:user:%s", userID)
-	pipe.HSet(ctx, userKey, map[string]interface{}{
-		"status":    "offline",
-		"last_seen": time.Now().Unix(),
-	})
+// heartbeatScript extends a device's heartbeat and returns whether its user
+// just came online, with the status they chose
+//
+// KEYS: devices, user, online users
+// ARGV: device ID, now, device TTL, status TTL, user ID
+var heartbeatScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[2])
+redis.call('ZADD', KEYS[1], tonumber(ARGV[2]) + tonumber(ARGV[3]), ARGV[1])
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+redis.call('HSET', KEYS[2], 'last_seen', ARGV[2])
+redis.call('EXPIRE', KEYS[2], ARGV[4])
+local came = redis.call('ZADD', KEYS[3], ARGV[2], ARGV[5])
+return {came, redis.call('HGET', KEYS[2], 'status') or ''}
+`)
+
+// dropScript removes a device, or only the expired ones if the device ID is
+// empty, and returns whether its user went offline, with the status they
+// chose and when they were last seen. A disconnect counts as seen now, an
+// expired heartbeat as seen at the last one.
+//
+// KEYS: devices, user, online users
+// ARGV: device ID, now, user ID
+var dropScript = redis.NewScript(`
+if ARGV[1] ~= '' then
+	redis.call('ZREM', KEYS[1], ARGV[1])
+	redis.call('HSET', KEYS[2], 'last_seen', ARGV[2])
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[2])
+if redis.call('ZCARD', KEYS[1]) > 0 then
+	return {0, '', ''}
+end
+local gone = redis.call('ZREM', KEYS[3], ARGV[3])
+return {gone, redis.call('HGET', KEYS[2], 'status') or '', redis.call('HGET', KEYS[2], 'last_seen') or ''}
+`)
+
+// statusScript stores the status a user chose and returns the previous one,
+// and whether they have a live device
+//
+// KEYS: user, devices
+// ARGV: status, status TTL, now
+var statusScript = redis.NewScript(`
+local previous = redis.call('HGET', KEYS[1], 'status') or ''
+redis.call('HSET', KEYS[1], 'status', ARGV[1])
+redis.call('EXPIRE', KEYS[1], ARGV[2])
+return {previous, redis.call('ZCOUNT', KEYS[2], '(' .. ARGV[3], '+inf')}
+`)
+
+// Heartbeat records that a device is connected for another device TTL. It
+// returns the change if this brought its user online.
+func (t *Tracker) Heartbeat(ctx context.Context, userID, deviceID string) (*Change, error) {
+	now := time.Now()
+	result, err := heartbeatScript.Run(ctx, t.redis,
+		[]string{devicesKey(userID), userKey(userID), onlineUsersKey},
+		deviceID, now.Unix(), int64(t.deviceTTL.Seconds()), int64(statusTTL.Seconds()), userID,
+	).Slice()
+	if err != nil {
+		return nil, err
+	}
 
-	pipe.SRem(ctx, "presence:online_users", userID)
+	if came, _ := result[0].(int64); came == 0 {
+		return nil, nil
+	}
+	status, _ := result[1].(string)
+	return newChange(userID, StatusOffline, Visible(status), now), nil
+}
 
-	deviceKey := fmt.Sprintf("presence:devices:%s", userID)
-	pipe.Del(ctx, deviceKey)
+// DropDevice records that a device disconnected. It returns the change if
+// that was its user's last live device.
+func (t *Tracker) DropDevice(ctx context.Context, userID, deviceID string) (*Change, error) {
+	change, _, err := t.drop(ctx, userID, deviceID)
+	return change, err
+}
 
-	_, err := pipe.Exec(ctx)
+// drop also reports whether the user went offline, which invisible users
+// do without a change
+func (t *Tracker) drop(ctx context.Context, userID, deviceID string) (*Change, bool, error) {
+	result, err := dropScript.Run(ctx, t.redis,
+		[]string{devicesKey(userID), userKey(userID), onlineUsersKey},
+		deviceID, time.Now().Unix(), userID,
+	).Slice()
 	if err != nil {
-		log.Printf("[ERROR] Failed to set user offline: %v", err)
-		return err
+		return nil, false, err
 	}
-	
-	log.Printf("[DEBUG] User %s set offline successfully", userID)
-	return nil
+
+	if gone, _ := result[0].(int64); gone == 0 {
+		return nil, false, nil
+	}
+	status, _ := result[1].(string)
+	lastSeen, _ := result[2].(string)
+	return newChange(userID, Visible(status), StatusOffline, parseUnix(lastSeen)), true, nil
+}
+
+// SetStatus stores the status a user chose, which lasts across connections.
+// It returns the change if a connected user now looks different to others.
+func (t *Tracker) SetStatus(ctx context.Context, userID, status string) (*Change, error) {
+	now := time.Now()
+	result, err := statusScript.Run(ctx, t.redis,
+		[]string{userKey(userID), devicesKey(userID)},
+		status, int64(statusTTL.Seconds()), now.Unix(),
+	).Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	if live, _ := result[1].(int64); live == 0 {
+		return nil, nil
+	}
+	previous, _ := result[0].(string)
+	return newChange(userID, Visible(previous), Visible(status), now), nil
 }
+
+// Status returns the status a user chose, or offline if they have no live
+// device, and when they were last seen. The zero time means never.
+func (t *Tracker) Status(ctx context.Context, userID string) (string, time.Time, error) {
+	pipe := t.redis.Pipeline()
+	live := pipe.ZCount(ctx, devicesKey(userID), fmt.Sprintf("(%d", time.Now().Unix()), "+inf")
+	fields := pipe.HGetAll(ctx, userKey(userID))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", time.Time{}, err
+	}
+
+	status := fields.Val()["status"]
+	if status == "" {
+		status = StatusOnline
+	}
+	if live.Val() == 0 {
+		status = StatusOffline
+	}
+	return status, parseUnix(fields.Val()["last_seen"]), nil
+}
+
 func (t *Tracker) IsUserOnline(ctx context.Context, userID string) (bool, error) {
-	return t.redis.SIsMember(ctx, "presence:online_users", userID).Result()
+	live, err := t.redis.ZCount(ctx, devicesKey(userID), fmt.Sprintf("(%d", time.Now().Unix()), "+inf").Result()
+	return live > 0, err
 }
 
-func (t *Tracker) GetUserStatus(ctx context.Context, userID string) (map[string]string, error) {
-	userKey := fmt.Sprintf("presence:user:%s", userID)
-	return t.redis.HGetAll(ctx, userKey).Result()
+// OnlineUser is a user with a live device
+type OnlineUser struct {
+	UserID        string    `json:"user_id"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
 }
 
-func (t *Tracker) GetOnlineUsers(ctx context.Context) ([]string, error) {
-	return t.redis.SMembers(ctx, "presence:online_users").Result()
+// liveSince is the score range of users whose last heartbeat hasn't expired
+func (t *Tracker) liveSince() string {
+	return fmt.Sprintf("(%d", time.Now().Add(-t.deviceTTL).Unix())
 }
 
-func (t *Tracker) UpdatePresence(ctx context.Context, userID, status string) error {
-	userKey := fmt.Sprintf("presence:user:%s", userID)
-	return t.redis.HSet(ctx, userKey, "status", status).Err()
+// CountOnline returns how many users have a live device on any node,
+// invisible ones included
+func (t *Tracker) CountOnline(ctx context.Context) (int64, error) {
+	return t.redis.ZCount(ctx, onlineUsersKey, t.liveSince(), "+inf").Result()
 }
 
-func (t *Tracker) StorePendingMessage(ctx context.Context, userID string, message interface{}) error {
-	data, err := json.Marshal(message)
+// ListOnline returns a page of the users CountOnline counts, the most
+// recent heartbeat first
+func (t *Tracker) ListOnline(ctx context.Context, offset, limit int64) ([]OnlineUser, error) {
+	entries, err := t.redis.ZRevRangeByScoreWithScores(ctx, onlineUsersKey, &redis.ZRangeBy{
+		Min:    t.liveSince(),
+		Max:    "+inf",
+		Offset: offset,
+		Count:  limit,
+	}).Result()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	key := fmt.Sprintf("pending:messages:%s", userID)
-	pipe := t.redis.Pipeline()
-	
-	pipe.LPush(ctx, key, data)
-	pipe.LTrim(ctx, key, 0, 99)
-	pipe.Expire(ctx, key, 7*24*time.Hour)
+	users := make([]OnlineUser, 0, len(entries))
+	for _, entry := range entries {
+		userID, _ := entry.Member.(string)
+		users = append(users, OnlineUser{
+			UserID:        userID,
+			LastHeartbeat: time.Unix(int64(entry.Score), 0).UTC(),
+		})
+	}
+	return users, nil
+}
 
-	_, err = pipe.Exec(ctx)
+// GetActiveDevices returns the devices of a user with a live heartbeat
+func (t *Tracker) GetActiveDevices(ctx context.Context, userID string) ([]string, error) {
+	return t.redis.ZRangeByScore(ctx, devicesKey(userID), &redis.ZRangeBy{
+		Min: fmt.Sprintf("(%d", time.Now().Unix()),
+		Max: "+inf",
+	}).Result()
+}
+
+// Watch subscribes a user to the presence changes of others for WatchTTL
+func (t *Tracker) Watch(ctx context.Context, watcherID string, userIDs []string) error {
+	expires := float64(time.Now().Add(WatchTTL).Unix())
+
+	pipe := t.redis.Pipeline()
+	for _, userID := range userIDs {
+		pipe.ZAdd(ctx, watchersKey(userID), redis.Z{Score: expires, Member: watcherID})
+		pipe.Expire(ctx, watchersKey(userID), WatchTTL)
+	}
+	_, err := pipe.Exec(ctx)
 	return err
 }
 
-func (t *Tracker) GetPendingMessages(ctx context.Context, userID string) ([]string, error) {
-	key := fmt.Sprintf("pending:messages:%s", userID)
-	messages, err := t.redis.LRange(ctx, key, 0, -1).Result()
-	if err != nil {
+// Watchers returns the users subscribed to a user's presence
+func (t *Tracker) Watchers(ctx context.Context, userID string) ([]string, error) {
+	now := fmt.Sprintf("%d", time.Now().Unix())
+
+	pipe := t.redis.Pipeline()
+	pipe.ZRemRangeByScore(ctx, watchersKey(userID), "-inf", now)
+	watchers := pipe.ZRange(ctx, watchersKey(userID), 0, -1)
+	if _, err := pipe.Exec(ctx); err != nil {
 		return nil, err
 	}
-	
-	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
-		messages[i], messages[j] = messages[j], messages[i]
+	return watchers.Val(), nil
+}
+
+// CleanupInactive takes users whose last heartbeat expired offline, as of
+// that heartbeat, and returns the changes. Only the expired users are read.
+func (t *Tracker) CleanupInactive(ctx context.Context) ([]*Change, error) {
+	cutoff := fmt.Sprintf("%d", time.Now().Add(-t.deviceTTL).Unix())
+
+	changes := make([]*Change, 0)
+
+	// Users still online, e.g. with a heartbeat from a node whose clock is
+	// behind, stay in the range and are skipped
+	var skipped int64
+	for {
+		stale, err := t.redis.ZRangeByScore(ctx, onlineUsersKey, &redis.ZRangeBy{
+			Min:    "-inf",
+			Max:    cutoff,
+			Offset: skipped,
+			Count:  cleanupBatch,
+		}).Result()
+		if err != nil {
+			return changes, err
+		}
+
+		for _, userID := range stale {
+			change, gone, err := t.drop(ctx, userID, "")
+			if err != nil {
+				return changes, err
+			}
+			if !gone {
+				skipped++
+			}
+			if change != nil {
+				changes = append(changes, change)
+			}
+		}
+
+		if len(stale) < cleanupBatch {
+			return changes, nil
+		}
 	}
-	
-	return messages, nil
 }
 
-func (t *Tracker) ClearPendingMessages(ctx context.Context, userID string) error {
-	key := fmt.Sprintf("pending:messages:%s", userID)
-	return t.redis.Del(ctx, key).Err()
+func parseUnix(value string) time.Time {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0).UTC()
 }
 
 func (t *Tracker) StoreMessageMetadata(ctx context.Context, messageID, from, to string) error {
@@ -155,64 +378,66 @@ func (t *Tracker) StoreMessageMetadata(ctx context.Context, messageID, from, to
 		"read":      false,
 	}
 
+	// Metadata lives as long as the queued message so late acks still resolve
 	pipe := t.redis.Pipeline()
 	pipe.HSet(ctx, key, data)
-	pipe.Expire(ctx, key, 24*time.Hour)
+	pipe.Expire(ctx, key, t.pendingTTL)
 
 	_, err := pipe.Exec(ctx)
 	return err
 }
 
-func (t *Tracker) MarkMessageDelivered(ctx context.Context, messageID string) error {
+// StoreGroupMessageMetadata records a message fanned out to the members of
+// a group. Each recipient gets a recipient:<userID> field, so acks and read
+// receipts from any of them resolve.
+func (t *Tracker) StoreGroupMessageMetadata(ctx context.Context, messageID, from, groupID string, recipients []string) error {
 	key := fmt.Sprintf("message:meta:%s", messageID)
-	return t.redis.HSet(ctx, key, map[string]interface{}{
-		"delivered":    true,
-		"delivered_at": time.Now().Unix(),
-	}).Err()
-}
+	data := map[string]interface{}{
+		"from":      from,
+		"group":     groupID,
+		"timestamp": time.Now().Unix(),
+		"delivered": false,
+		"read":      false,
+	}
+	for _, userID := range recipients {
+		data["recipient:"+userID] = 1
+	}
 
-func (t *Tracker) MarkMessageRead(ctx context.Context, messageID string) error {
-	key := fmt.Sprintf("message:meta:%s", messageID)
-	return t.redis.HSet(ctx, key, map[string]interface{}{
-		"read":    true,
-		"read_at": time.Now().Unix(),
-	}).Err()
-}
+	pipe := t.redis.Pipeline()
+	pipe.HSet(ctx, key, data)
+	pipe.Expire(ctx, key, t.pendingTTL)
 
-func (t *Tracker) GetActiveDevices(ctx context.Context, userID string) ([]string, error) {
-	deviceKey := fmt.Sprintf("presence:devices:%s", userID)
-	return t.redis.SMembers(ctx, deviceKey).Result()
+	_, err := pipe.Exec(ctx)
+	return err
 }
 
-func (t *Tracker) Heartbeat(ctx context.Context, userID string) error {
-	userKey := fmt.Sprintf("presence:user:%s", userID)
-	return t.redis.HSet(ctx, userKey, "last_seen", time.Now().Unix()).Err()
+func (t *Tracker) GetMessageMetadata(ctx context.Context, messageID string) (map[string]string, error) {
+	key := fmt.Sprintf("message:meta:%s", messageID)
+	return t.redis.HGetAll(ctx, key).Result()
 }
 
-func (t *Tracker) CleanupInactive(ctx context.Context, inactiveThreshold time.Duration) error {
-	onlineUsers, err := t.GetOnlineUsers(ctx)
+// MarkMessageDelivered records the first delivery of a message. It reports
+// whether this call was the one that marked it.
+func (t *Tracker) MarkMessageDelivered(ctx context.Context, messageID string) (bool, error) {
+	key := fmt.Sprintf("message:meta:%s", messageID)
+
+	// delivered_at is only set once, so repeated acks are detected
+	first, err := t.redis.HSetNX(ctx, key, "delivered_at", time.Now().Unix()).Result()
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	now := time.Now().Unix()
-	threshold := now - int64(inactiveThreshold.Seconds())
-
-	for _, userID := range onlineUsers {
-		status, err := t.GetUserStatus(ctx, userID)
-		if err != nil {
-			continue
-		}
-
-		if lastSeenStr, ok := status["last_seen"]; ok {
-			var lastSeen int64
-			fmt.Sscanf(lastSeenStr, "%d", &lastSeen)
-			
-			if lastSeen < threshold {
-				t.SetUserOffline(ctx, userID)
-			}
-		}
+	if err := t.redis.HSet(ctx, key, "delivered", true).Err(); err != nil {
+		return false, err
 	}
 
-	return nil
+	return first, nil
+}
+
+func (t *Tracker) MarkMessageRead(ctx context.Context, messageID string) error {
+	key := fmt.Sprintf("message:meta:%s", messageID)
+	return t.redis.HSet(ctx, key, map[string]interface{}{
+		"read":    true,
+		"read_at": time.Now().Unix(),
+	}).Err()
 }
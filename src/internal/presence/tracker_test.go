@@ -0,0 +1,306 @@
+package presence
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+const testDeviceTTL = time.Minute
+
+func newTestTracker(t *testing.T) *Tracker {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	rc := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rc.Close() })
+
+	return NewTracker(rc, testDeviceTTL, 100, time.Hour)
+}
+
+// backdate moves a user's last heartbeat to at, with their devices expiring
+// one device TTL later, as if no heartbeat came since
+func backdate(t *testing.T, tr *Tracker, userID string, at time.Time) {
+	t.Helper()
+	ctx := context.Background()
+
+	devices, err := tr.redis.ZRange(ctx, devicesKey(userID), 0, -1).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pipe := tr.redis.Pipeline()
+	pipe.ZAdd(ctx, onlineUsersKey, redis.Z{Score: float64(at.Unix()), Member: userID})
+	pipe.HSet(ctx, userKey(userID), "last_seen", at.Unix())
+	for _, deviceID := range devices {
+		pipe.ZAdd(ctx, devicesKey(userID), redis.Z{Score: float64(at.Add(testDeviceTTL).Unix()), Member: deviceID})
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func heartbeat(t *testing.T, tr *Tracker, userID, deviceID string) *Change {
+	t.Helper()
+	change, err := tr.Heartbeat(context.Background(), userID, deviceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return change
+}
+
+func expectChange(t *testing.T, change *Change, from, to string) {
+	t.Helper()
+	if change == nil {
+		t.Fatalf("no change, want %s -> %s", from, to)
+	}
+	if change.From != from || change.To != to {
+		t.Fatalf("change %s -> %s, want %s -> %s", change.From, change.To, from, to)
+	}
+}
+
+func expectNoChange(t *testing.T, change *Change) {
+	t.Helper()
+	if change != nil {
+		t.Fatalf("unexpected change %s -> %s", change.From, change.To)
+	}
+}
+
+func TestHeartbeatScoresUsersByLastHeartbeat(t *testing.T) {
+	ctx := context.Background()
+	tr := newTestTracker(t)
+
+	before := time.Now().Unix()
+	expectChange(t, heartbeat(t, tr, "alice", "phone"), StatusOffline, StatusOnline)
+	expectNoChange(t, heartbeat(t, tr, "alice", "laptop"))
+
+	score, err := tr.redis.ZScore(ctx, onlineUsersKey, "alice").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(score) < before || int64(score) > time.Now().Unix() {
+		t.Fatalf("score %v is not the heartbeat time", score)
+	}
+
+	// A later heartbeat moves the score forward
+	backdate(t, tr, "alice", time.Now().Add(-30*time.Second))
+	expectNoChange(t, heartbeat(t, tr, "alice", "phone"))
+	score, err = tr.redis.ZScore(ctx, onlineUsersKey, "alice").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(score) < before {
+		t.Fatalf("score %v was not refreshed", score)
+	}
+
+	// Devices are scored by when they expire
+	expires, err := tr.redis.ZScore(ctx, devicesKey("alice"), "phone").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := float64(time.Now().Add(testDeviceTTL).Unix()); expires < want-1 || expires > want {
+		t.Fatalf("device expires at %v, want about %v", expires, want)
+	}
+}
+
+func TestDropDeviceResolvesStatusAcrossDevices(t *testing.T) {
+	ctx := context.Background()
+	tr := newTestTracker(t)
+
+	heartbeat(t, tr, "alice", "phone")
+	heartbeat(t, tr, "alice", "laptop")
+
+	change, err := tr.SetStatus(ctx, "alice", StatusAway)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, change, StatusOnline, StatusAway)
+
+	// The laptop keeps alice online, with the chosen status
+	change, err = tr.DropDevice(ctx, "alice", "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNoChange(t, change)
+
+	status, _, err := tr.Status(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != StatusAway {
+		t.Fatalf("status = %s, want %s", status, StatusAway)
+	}
+	devices, err := tr.GetActiveDevices(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0] != "laptop" {
+		t.Fatalf("active devices = %v, want [laptop]", devices)
+	}
+
+	// Dropping a device that already went away changes nothing
+	change, err = tr.DropDevice(ctx, "alice", "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNoChange(t, change)
+
+	change, err = tr.DropDevice(ctx, "alice", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, change, StatusAway, StatusOffline)
+
+	status, lastSeen, err := tr.Status(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != StatusOffline || lastSeen.IsZero() {
+		t.Fatalf("status = %s last seen %v, want offline with a last seen time", status, lastSeen)
+	}
+	if count, _ := tr.CountOnline(ctx); count != 0 {
+		t.Fatalf("%d users online, want 0", count)
+	}
+
+	// Coming back restores the chosen status
+	expectChange(t, heartbeat(t, tr, "alice", "phone"), StatusOffline, StatusAway)
+}
+
+func TestDropDeviceOfInvisibleUser(t *testing.T) {
+	ctx := context.Background()
+	tr := newTestTracker(t)
+
+	heartbeat(t, tr, "alice", "phone")
+	change, err := tr.SetStatus(ctx, "alice", StatusInvisible)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, change, StatusOnline, StatusOffline)
+
+	// Others saw alice offline all along, but the user still leaves the
+	// online set
+	change, err = tr.DropDevice(ctx, "alice", "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNoChange(t, change)
+	if count, _ := tr.CountOnline(ctx); count != 0 {
+		t.Fatalf("%d users online, want 0", count)
+	}
+}
+
+func TestCleanupInactiveDropsOnlyExpiredUsers(t *testing.T) {
+	ctx := context.Background()
+	tr := newTestTracker(t)
+
+	// More than a batch of expired users, so cleanup has to page
+	expired := 2*cleanupBatch + 17
+	past := time.Now().Add(-2 * testDeviceTTL)
+	for i := 0; i < expired; i++ {
+		userID := fmt.Sprintf("gone-%d", i)
+		heartbeat(t, tr, userID, "phone")
+		backdate(t, tr, userID, past)
+	}
+
+	live := []string{"alice", "bob"}
+	for _, userID := range live {
+		heartbeat(t, tr, userID, "phone")
+	}
+
+	// A heartbeat recorded by a node whose clock is behind: the user looks
+	// expired but still has a live device, so they are skipped
+	heartbeat(t, tr, "skewed", "phone")
+	if err := tr.redis.ZAdd(ctx, onlineUsersKey, redis.Z{Score: float64(past.Unix()), Member: "skewed"}).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := tr.CleanupInactive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != expired {
+		t.Fatalf("%d changes, want %d", len(changes), expired)
+	}
+	for _, change := range changes {
+		if change.To != StatusOffline {
+			t.Fatalf("%s went %s, want offline", change.UserID, change.To)
+		}
+		// Offline as of the last heartbeat, not the cleanup
+		if change.At.Unix() != past.Unix() {
+			t.Fatalf("%s went offline at %v, want %v", change.UserID, change.At, past)
+		}
+	}
+
+	members, err := tr.redis.ZRange(ctx, onlineUsersKey, 0, -1).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remaining := make(map[string]bool, len(members))
+	for _, userID := range members {
+		remaining[userID] = true
+	}
+	if len(remaining) != len(live)+1 || !remaining["alice"] || !remaining["bob"] || !remaining["skewed"] {
+		t.Fatalf("online set = %v, want alice, bob and skewed", members)
+	}
+
+	// Nothing left to clean up
+	changes, err = tr.CleanupInactive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Fatalf("%d changes on the second run, want 0", len(changes))
+	}
+}
+
+func TestListOnlinePagesByRecentHeartbeat(t *testing.T) {
+	ctx := context.Background()
+	tr := newTestTracker(t)
+
+	// user-0 has the oldest heartbeat, user-6 the newest
+	now := time.Now()
+	for i := 0; i < 7; i++ {
+		userID := fmt.Sprintf("user-%d", i)
+		heartbeat(t, tr, userID, "phone")
+		backdate(t, tr, userID, now.Add(time.Duration(i-7)*time.Second))
+	}
+	heartbeat(t, tr, "gone", "phone")
+	backdate(t, tr, "gone", now.Add(-2*testDeviceTTL))
+
+	count, err := tr.CountOnline(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 7 {
+		t.Fatalf("CountOnline = %d, want 7", count)
+	}
+
+	pages := [][]string{
+		{"user-6", "user-5", "user-4"},
+		{"user-3", "user-2", "user-1"},
+		{"user-0"},
+		{},
+	}
+	for page, want := range pages {
+		users, err := tr.ListOnline(ctx, int64(page*3), 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != len(want) {
+			t.Fatalf("page %d = %v, want %v", page, users, want)
+		}
+		for i, user := range users {
+			if user.UserID != want[i] {
+				t.Fatalf("page %d = %v, want %v", page, users, want)
+			}
+			score, _ := tr.redis.ZScore(ctx, onlineUsersKey, user.UserID).Result()
+			if user.LastHeartbeat.Unix() != int64(score) {
+				t.Fatalf("%s last heartbeat %v, want %v", user.UserID, user.LastHeartbeat, int64(score))
+			}
+		}
+	}
+}
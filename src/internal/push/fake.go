@@ -0,0 +1,303 @@
+package push
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// FakeNotification is a notification received by the fake gateway
+type FakeNotification struct {
+	ID          string            `json:"id"`
+	Provider    string            `json:"provider"`
+	Token       string            `json:"token"` // Device token, or the full Web Push endpoint
+	CollapseKey string            `json:"collapse_key,omitempty"`
+	Data        map[string]string `json:"data,omitempty"`
+	Payload     string            `json:"payload,omitempty"` // Raw body, empty for Web Push
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+// FakeGateway is an in-memory push service for local development and
+// integration tests. It speaks the FCM HTTP v1 API (with its OAuth token
+// endpoint), the APNs API and Web Push, and lets tests read back what was
+// sent to a token or make tokens stop working.
+type FakeGateway struct {
+	baseURL string // Public URL, to rebuild Web Push endpoints
+
+	mu            sync.Mutex
+	notifications []*FakeNotification
+	seq           int
+	unregistered  map[string]bool
+
+	// Failure injection: the next failCount sends answer failStatus
+	failCount  int
+	failStatus int
+}
+
+// NewFakeGateway creates a fake gateway reachable at baseURL, e.g.
+// http://push-gateway:4020
+func NewFakeGateway(baseURL string) *FakeGateway {
+	return &FakeGateway{
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+		unregistered: make(map[string]bool),
+	}
+}
+
+// App returns the gateway's HTTP API:
+//
+//	POST   /token                               FCM OAuth token exchange
+//	POST   /v1/projects/:project/messages:send  FCM send
+//	POST   /3/device/:token                     APNs send
+//	POST   /webpush/:id                         Web Push endpoint
+//	GET    /notifications?token=                Notifications, newest first
+//	DELETE /notifications                       Forget all notifications
+//	POST   /control/unregister                  {"token": "..."} stops working
+//	POST   /control/fail                        {"count": n, "status": 503}
+func (g *FakeGateway) App() *fiber.App {
+	app := fiber.New(fiber.Config{
+		AppName: "Fake Push Gateway",
+		// Messages outlive their request, so values must not alias its buffers
+		Immutable: true,
+	})
+
+	app.Post("/token", g.oauthToken)
+	app.Post("/v1/projects/:project/messages\\:send", g.fcmSend)
+	app.Post("/3/device/:token", g.apnsSend)
+	app.Post("/webpush/:id", g.webPushSend)
+	app.Get("/notifications", g.list)
+	app.Delete("/notifications", g.reset)
+	app.Post("/control/unregister", g.unregister)
+	app.Post("/control/fail", g.fail)
+
+	return app
+}
+
+func (g *FakeGateway) oauthToken(c *fiber.Ctx) error {
+	if c.FormValue("assertion") == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid_request",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"access_token": fmt.Sprintf("fake-access-token-%d", time.Now().UnixNano()),
+		"expires_in":   3600,
+		"token_type":   "Bearer",
+	})
+}
+
+func (g *FakeGateway) fcmSend(c *fiber.Ctx) error {
+	if !strings.HasPrefix(c.Get("Authorization"), "Bearer fake-access-token-") {
+		return fcmError(c, fiber.StatusUnauthorized, "UNAUTHENTICATED", "")
+	}
+	if status := g.injectedFailure(); status != 0 {
+		return fcmError(c, status, "UNAVAILABLE", "")
+	}
+
+	var req struct {
+		Message struct {
+			Token   string            `json:"token"`
+			Data    map[string]string `json:"data"`
+			Android struct {
+				CollapseKey string `json:"collapse_key"`
+			} `json:"android"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal(c.Body(), &req); err != nil || req.Message.Token == "" {
+		return fcmError(c, fiber.StatusBadRequest, "INVALID_ARGUMENT", "")
+	}
+	if g.isUnregistered(req.Message.Token) {
+		return fcmError(c, fiber.StatusNotFound, "NOT_FOUND", "UNREGISTERED")
+	}
+
+	n := g.store(ProviderFCM, req.Message.Token, req.Message.Android.CollapseKey, req.Message.Data, string(c.Body()))
+	return c.JSON(fiber.Map{
+		"name": fmt.Sprintf("projects/%s/messages/%s", c.Params("project"), n.ID),
+	})
+}
+
+func fcmError(c *fiber.Ctx, status int, code, errorCode string) error {
+	details := make([]fiber.Map, 0)
+	if errorCode != "" {
+		details = append(details, fiber.Map{
+			"@type":     "type.googleapis.com/google.firebase.fcm.v1.FcmError",
+			"errorCode": errorCode,
+		})
+	}
+	return c.Status(status).JSON(fiber.Map{
+		"error": fiber.Map{
+			"code":    status,
+			"message": "Injected or rejected by the fake gateway",
+			"status":  code,
+			"details": details,
+		},
+	})
+}
+
+func (g *FakeGateway) apnsSend(c *fiber.Ctx) error {
+	token := c.Params("token")
+
+	if !strings.HasPrefix(c.Get("Authorization"), "bearer ") {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"reason": "MissingProviderToken"})
+	}
+	if c.Get("apns-topic") == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"reason": "MissingTopic"})
+	}
+	if status := g.injectedFailure(); status != 0 {
+		return c.Status(status).JSON(fiber.Map{"reason": "ServiceUnavailable"})
+	}
+	if g.isUnregistered(token) {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"reason":    "Unregistered",
+			"timestamp": time.Now().UnixMilli(),
+		})
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(c.Body(), &payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"reason": "PayloadEmpty"})
+	}
+	data := make(map[string]string)
+	for key, value := range payload {
+		if s, ok := value.(string); ok {
+			data[key] = s
+		}
+	}
+
+	n := g.store(ProviderAPNs, token, c.Get("apns-collapse-id"), data, string(c.Body()))
+	c.Set("apns-id", n.ID)
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func (g *FakeGateway) webPushSend(c *fiber.Ctx) error {
+	endpoint := g.baseURL + "/webpush/" + c.Params("id")
+
+	if !strings.HasPrefix(c.Get("Authorization"), "vapid t=") {
+		return c.Status(fiber.StatusUnauthorized).SendString("Missing VAPID authorization")
+	}
+	if c.Get("TTL") == "" {
+		return c.Status(fiber.StatusBadRequest).SendString("Missing TTL header")
+	}
+	if status := g.injectedFailure(); status != 0 {
+		return c.Status(status).SendString("Injected failure")
+	}
+	if g.isUnregistered(endpoint) {
+		return c.Status(fiber.StatusGone).SendString("Subscription expired")
+	}
+
+	g.store(ProviderWebPush, endpoint, c.Get("Topic"), nil, string(c.Body()))
+	return c.SendStatus(fiber.StatusCreated)
+}
+
+func (g *FakeGateway) list(c *fiber.Ctx) error {
+	token := c.Query("token")
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	notifications := make([]*FakeNotification, 0)
+	for i := len(g.notifications) - 1; i >= 0; i-- {
+		if token == "" || g.notifications[i].Token == token {
+			notifications = append(notifications, g.notifications[i])
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"notifications": notifications,
+		"count":         len(notifications),
+	})
+}
+
+func (g *FakeGateway) reset(c *fiber.Ctx) error {
+	g.mu.Lock()
+	g.notifications = nil
+	g.unregistered = make(map[string]bool)
+	g.failCount = 0
+	g.mu.Unlock()
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (g *FakeGateway) unregister(c *fiber.Ctx) error {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := c.BodyParser(&req); err != nil || req.Token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "token required",
+		})
+	}
+
+	g.mu.Lock()
+	g.unregistered[req.Token] = true
+	g.mu.Unlock()
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (g *FakeGateway) fail(c *fiber.Ctx) error {
+	var req struct {
+		Count  int `json:"count"`
+		Status int `json:"status"`
+	}
+	if err := c.BodyParser(&req); err != nil || req.Count < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if req.Status < 400 || req.Status > 599 {
+		req.Status = fiber.StatusServiceUnavailable
+	}
+
+	g.mu.Lock()
+	g.failCount = req.Count
+	g.failStatus = req.Status
+	g.mu.Unlock()
+
+	return c.JSON(fiber.Map{
+		"count":  req.Count,
+		"status": req.Status,
+	})
+}
+
+// injectedFailure returns the status to fail a send with, or 0
+func (g *FakeGateway) injectedFailure() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.failCount == 0 {
+		return 0
+	}
+	g.failCount--
+	return g.failStatus
+}
+
+func (g *FakeGateway) isUnregistered(token string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.unregistered[token]
+}
+
+func (g *FakeGateway) store(provider, token, collapseKey string, data map[string]string, payload string) *FakeNotification {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.seq++
+	n := &FakeNotification{
+		ID:          fmt.Sprintf("push-%08d", g.seq),
+		Provider:    provider,
+		Token:       token,
+		CollapseKey: collapseKey,
+		Data:        data,
+		Payload:     payload,
+		CreatedAt:   time.Now(),
+	}
+	g.notifications = append(g.notifications, n)
+
+	log.Printf("[FAKE PUSH] %s notification %s to %s (collapse %q)", provider, n.ID, shortToken(token), collapseKey)
+	return n
+}
@@ -0,0 +1,227 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const fcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+// serviceAccount is the part of a Google service account key file FCM needs
+type serviceAccount struct {
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// FCM sends notifications through the Firebase Cloud Messaging HTTP v1 API,
+// authenticating with a service account
+type FCM struct {
+	account *serviceAccount
+	key     *rsa.PrivateKey
+	baseURL string
+	client  *http.Client
+
+	// OAuth access token, refreshed shortly before it expires
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+// NewFCM creates an FCM provider from a service account key file. projectID
+// overrides the project in the file if not empty.
+func NewFCM(credentialsFile, projectID, baseURL string) (*FCM, error) {
+	data, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read FCM credentials: %w", err)
+	}
+
+	var account serviceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("invalid FCM credentials: %w", err)
+	}
+	if projectID != "" {
+		account.ProjectID = projectID
+	}
+	if account.ProjectID == "" || account.ClientEmail == "" || account.TokenURI == "" {
+		return nil, fmt.Errorf("FCM credentials need project_id, client_email and token_uri")
+	}
+
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(account.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid FCM private key: %w", err)
+	}
+
+	return &FCM{
+		account: &account,
+		key:     key,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: providerTimeout},
+	}, nil
+}
+
+func (f *FCM) Name() string {
+	return ProviderFCM
+}
+
+func (f *FCM) Send(ctx context.Context, n *Notification) error {
+	token, err := f.token(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Data-only, so Android hands it to the app instead of showing it
+	message := map[string]interface{}{
+		"token": n.Token,
+		"data":  n.Data,
+		"android": map[string]interface{}{
+			"priority":     "HIGH",
+			"collapse_key": n.CollapseKey,
+			"ttl":          fmt.Sprintf("%ds", int(n.TTL.Seconds())),
+		},
+	}
+	// iOS devices with FCM tokens get a background push through APNs
+	message["apns"] = map[string]interface{}{
+		"headers": map[string]string{
+			"apns-collapse-id": n.CollapseKey,
+			"apns-priority":    "5",
+			"apns-push-type":   "background",
+		},
+		"payload": map[string]interface{}{
+			"aps": map[string]interface{}{"content-available": 1},
+		},
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"message": message})
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/projects/%s/messages:send", f.baseURL, url.PathEscape(f.account.ProjectID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return networkError(f.Name(), err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	var result struct {
+		Error struct {
+			Message string `json:"message"`
+			Status  string `json:"status"`
+			Details []struct {
+				ErrorCode string `json:"errorCode"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&result)
+
+	reason := result.Error.Status
+	for _, detail := range result.Error.Details {
+		if detail.ErrorCode != "" {
+			reason = detail.ErrorCode
+		}
+	}
+	if result.Error.Message != "" {
+		reason += " " + result.Error.Message
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		// Get a fresh access token next time
+		f.mu.Lock()
+		f.accessToken = ""
+		f.mu.Unlock()
+	}
+
+	unregistered := resp.StatusCode == http.StatusNotFound ||
+		strings.HasPrefix(reason, "UNREGISTERED") || strings.HasPrefix(reason, "SENDER_ID_MISMATCH")
+	return responseError(f.Name(), resp, strings.TrimSpace(reason), unregistered)
+}
+
+// token returns a valid OAuth access token, exchanging a signed assertion
+// for a new one when needed
+func (f *FCM) token(ctx context.Context) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.accessToken != "" && time.Now().Before(f.expiresAt) {
+		return f.accessToken, nil
+	}
+
+	now := time.Now()
+	assertion := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   f.account.ClientEmail,
+		"scope": fcmScope,
+		"aud":   f.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if f.account.PrivateKeyID != "" {
+		assertion.Header["kid"] = f.account.PrivateKeyID
+	}
+	signed, err := assertion.SignedString(f.key)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign FCM assertion: %w", err)
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {signed},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", networkError(f.Name(), err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		Error       string `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&result)
+
+	if resp.StatusCode/100 != 2 || result.AccessToken == "" {
+		return "", responseError(f.Name(), resp, "token exchange failed: "+result.Error, false)
+	}
+
+	lifetime := time.Duration(result.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = time.Hour
+	}
+	f.accessToken = result.AccessToken
+	f.expiresAt = now.Add(lifetime - time.Minute)
+
+	return f.accessToken, nil
+}
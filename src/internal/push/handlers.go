@@ -0,0 +1,242 @@
+package push
+
+import (
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// FCM registration tokens are opaque but URL-safe; APNs device tokens are hex
+var (
+	fcmTokenPattern  = regexp.MustCompile(`^[A-Za-z0-9_:\-]{20,}$`)
+	apnsTokenPattern = regexp.MustCompile(`^[0-9a-fA-F]{64,200}$`)
+)
+
+// Handler handles push token registration and notification settings
+type Handler struct {
+	store    *Store
+	notifier *Notifier
+}
+
+// NewHandler creates a new push handler
+func NewHandler(store *Store, notifier *Notifier) *Handler {
+	return &Handler{
+		store:    store,
+		notifier: notifier,
+	}
+}
+
+// RegisterToken sets the push token of the calling device
+func (h *Handler) RegisterToken(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	deviceID, _ := c.Locals("deviceID").(string)
+
+	var req struct {
+		Provider string `json:"provider"` // "fcm", "apns" or "webpush"
+		Token    string `json:"token"`
+		// A browser PushSubscription as JSON, instead of token for Web Push
+		Subscription *struct {
+			Endpoint string `json:"endpoint"`
+		} `json:"subscription"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if req.Subscription != nil && req.Token == "" {
+		req.Token = req.Subscription.Endpoint
+	}
+	req.Token = strings.TrimSpace(req.Token)
+
+	if deviceID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Token is not bound to a device",
+		})
+	}
+	if err := h.validToken(req.Provider, req.Token); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if err := h.store.SetToken(c.Context(), userID, deviceID, req.Provider, req.Token); err != nil {
+		if err == ErrDeviceNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Device not found",
+			})
+		}
+		log.Printf("Failed to register push token for device %s: %v", deviceID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to register push token",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":   "Push token registered",
+		"device_id": deviceID,
+		"provider":  req.Provider,
+	})
+}
+
+// RemoveToken stops push notifications to the calling device
+func (h *Handler) RemoveToken(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	deviceID, _ := c.Locals("deviceID").(string)
+
+	if err := h.store.ClearToken(c.Context(), userID, deviceID); err != nil {
+		log.Printf("Failed to remove push token for device %s: %v", deviceID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to remove push token",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// GetVAPIDKey returns the key browsers need to subscribe to Web Push
+func (h *Handler) GetVAPIDKey(c *fiber.Ctx) error {
+	key := h.notifier.VAPIDPublicKey()
+	if key == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Web Push is not configured",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"public_key": key,
+	})
+}
+
+// GetSettings returns the user's notification settings
+func (h *Handler) GetSettings(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	settings, err := h.store.Settings(c.Context(), userID)
+	if err != nil {
+		log.Printf("Failed to load push settings for %s: %v", userID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch notification settings",
+		})
+	}
+
+	return c.JSON(settings)
+}
+
+// UpdateSettings mutes or unmutes all of the user's notifications
+func (h *Handler) UpdateSettings(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var req struct {
+		Muted      bool       `json:"muted"`
+		MutedUntil *time.Time `json:"muted_until"` // Omit to mute until turned back on
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if req.MutedUntil != nil && !req.MutedUntil.After(time.Now()) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "muted_until must be in the future",
+		})
+	}
+
+	if err := h.store.SetMuted(c.Context(), userID, req.Muted, req.MutedUntil); err != nil {
+		log.Printf("Failed to update push settings for %s: %v", userID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update notification settings",
+		})
+	}
+
+	return h.GetSettings(c)
+}
+
+// MuteUser mutes notifications for messages from another user
+func (h *Handler) MuteUser(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	mutedUserID := c.Params("userId")
+
+	var req struct {
+		MutedUntil *time.Time `json:"muted_until"` // Omit to mute until unmuted
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+	}
+	if req.MutedUntil != nil && !req.MutedUntil.After(time.Now()) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "muted_until must be in the future",
+		})
+	}
+
+	err := h.store.Mute(c.Context(), userID, mutedUserID, req.MutedUntil)
+	switch err {
+	case nil:
+	case ErrSelfMute:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Cannot mute yourself",
+		})
+	case ErrUserNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	default:
+		log.Printf("Failed to mute %s for %s: %v", mutedUserID, userID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to mute user",
+		})
+	}
+
+	return c.JSON(&Mute{
+		UserID:     mutedUserID,
+		MutedUntil: req.MutedUntil,
+	})
+}
+
+// UnmuteUser lifts a mute set with MuteUser
+func (h *Handler) UnmuteUser(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	mutedUserID := c.Params("userId")
+
+	if err := h.store.Unmute(c.Context(), userID, mutedUserID); err != nil {
+		if err == ErrMuteNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "User is not muted",
+			})
+		}
+		log.Printf("Failed to unmute %s for %s: %v", mutedUserID, userID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to unmute user",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// validToken checks a token has the shape its provider uses
+func (h *Handler) validToken(provider, token string) error {
+	switch provider {
+	case ProviderFCM:
+		if len(token) <= 4096 && fcmTokenPattern.MatchString(token) {
+			return nil
+		}
+	case ProviderAPNs:
+		if apnsTokenPattern.MatchString(token) {
+			return nil
+		}
+	case ProviderWebPush:
+		if len(token) <= 2048 && ValidEndpoint(token, h.notifier.webPushHosts) {
+			return nil
+		}
+	default:
+		return ErrInvalidProvider
+	}
+	return ErrInvalidToken
+}
@@ -0,0 +1,277 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"chat-e2ee/internal/config"
+)
+
+// Wake-ups all share one collapse key, so a device that comes back online
+// finds a single notification however many messages arrived
+const collapseKey = "new-messages"
+
+// Longest wait between retries, whatever the backoff or Retry-After say
+const maxRetryDelay = 30 * time.Second
+
+// wakeup is one chat message queued for offline devices of a user
+type wakeup struct {
+	userID    string
+	from      string
+	deviceIDs []string
+}
+
+// batch collects the wake-ups for a user during the batch window
+type batch struct {
+	userID  string
+	devices map[string]bool
+	senders map[string]int // Messages per sender
+}
+
+// Notifier wakes up offline devices when chat messages are queued for
+// them. Messages arriving for a user within the batch window share one
+// notification per device, skipping senders the user muted. Notifications
+// carry no content or sender, only a hint to connect and fetch the queue.
+type Notifier struct {
+	store        *Store
+	providers    map[string]Provider
+	webPushHosts []string
+	vapidKey     string
+
+	window       time.Duration
+	ttl          time.Duration
+	maxAttempts  int
+	retryBackoff time.Duration
+
+	wakeups chan wakeup
+	flushes chan string
+}
+
+// New creates a notifier with the providers configured in cfg. Providers
+// without credentials are replaced by mocks that log wake-ups.
+func New(cfg config.PushConfig, store *Store) (*Notifier, error) {
+	n := &Notifier{
+		store:        store,
+		providers:    make(map[string]Provider),
+		webPushHosts: append(append([]string{}, DefaultWebPushHosts...), cfg.WebPushHosts...),
+		window:       cfg.BatchWindow,
+		ttl:          cfg.TTL,
+		maxAttempts:  cfg.MaxAttempts,
+		retryBackoff: cfg.RetryBackoff,
+		wakeups:      make(chan wakeup, 1024),
+		flushes:      make(chan string, 1024),
+	}
+	if n.maxAttempts < 1 {
+		n.maxAttempts = 1
+	}
+
+	n.providers[ProviderFCM] = NewMock(ProviderFCM)
+	if cfg.FCMCredentialsFile != "" {
+		fcm, err := NewFCM(cfg.FCMCredentialsFile, cfg.FCMProjectID, cfg.FCMURL)
+		if err != nil {
+			return nil, err
+		}
+		n.providers[ProviderFCM] = fcm
+	}
+
+	n.providers[ProviderAPNs] = NewMock(ProviderAPNs)
+	if cfg.APNsKeyFile != "" {
+		apns, err := NewAPNs(cfg.APNsKeyFile, cfg.APNsKeyID, cfg.APNsTeamID, cfg.APNsTopic, cfg.APNsURL)
+		if err != nil {
+			return nil, err
+		}
+		n.providers[ProviderAPNs] = apns
+	}
+
+	n.providers[ProviderWebPush] = NewMock(ProviderWebPush)
+	if cfg.VAPIDPrivateKey != "" {
+		webPush, err := NewWebPush(cfg.VAPIDPrivateKey, cfg.VAPIDSubject)
+		if err != nil {
+			return nil, err
+		}
+		n.providers[ProviderWebPush] = webPush
+		n.vapidKey = webPush.PublicKey()
+	}
+
+	return n, nil
+}
+
+// Describe lists the providers for the startup log
+func (n *Notifier) Describe() string {
+	names := make([]string, 0, len(n.providers))
+	for name, provider := range n.providers {
+		if _, mock := provider.(*Mock); mock {
+			name += " (mock)"
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// VAPIDPublicKey is the key browsers subscribe with, empty if Web Push
+// isn't configured
+func (n *Notifier) VAPIDPublicKey() string {
+	return n.vapidKey
+}
+
+// Notify queues a wake-up for the given devices of a user, who was sent a
+// message by from. It never blocks, so the relay can call it while holding
+// its locks; wake-ups are dropped if the queue is full.
+func (n *Notifier) Notify(userID, from string, deviceIDs []string) {
+	if len(deviceIDs) == 0 {
+		return
+	}
+
+	select {
+	case n.wakeups <- wakeup{userID: userID, from: from, deviceIDs: deviceIDs}:
+	default:
+		log.Printf("Push queue full, wake-up for %s dropped", userID)
+	}
+}
+
+// Run batches wake-ups and sends them when their window closes
+func (n *Notifier) Run() {
+	pending := make(map[string]*batch)
+
+	for {
+		select {
+		case w := <-n.wakeups:
+			b, exists := pending[w.userID]
+			if !exists {
+				b = &batch{
+					userID:  w.userID,
+					devices: make(map[string]bool),
+					senders: make(map[string]int),
+				}
+				pending[w.userID] = b
+
+				userID := w.userID
+				time.AfterFunc(n.window, func() { n.flushes <- userID })
+			}
+			for _, deviceID := range w.deviceIDs {
+				b.devices[deviceID] = true
+			}
+			b.senders[w.from]++
+
+		case userID := <-n.flushes:
+			if b, exists := pending[userID]; exists {
+				delete(pending, userID)
+				go n.send(b)
+			}
+		}
+	}
+}
+
+// send delivers one batch to every device of the user with a push token
+func (n *Notifier) send(b *batch) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	senders := make([]string, 0, len(b.senders))
+	for sender := range b.senders {
+		senders = append(senders, sender)
+	}
+
+	all, muted, err := n.store.Muted(ctx, b.userID, senders)
+	if err != nil {
+		log.Printf("Failed to load push mutes for %s: %v", b.userID, err)
+		return
+	}
+	if all {
+		return
+	}
+
+	count := 0
+	for sender, messages := range b.senders {
+		if !muted[sender] {
+			count += messages
+		}
+	}
+	if count == 0 {
+		return
+	}
+
+	deviceIDs := make([]string, 0, len(b.devices))
+	for deviceID := range b.devices {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+
+	targets, err := n.store.Targets(ctx, b.userID, deviceIDs)
+	if err != nil {
+		log.Printf("Failed to load push tokens for %s: %v", b.userID, err)
+		return
+	}
+
+	for _, target := range targets {
+		provider, exists := n.providers[target.Provider]
+		if !exists {
+			log.Printf("No push provider %q for device %s", target.Provider, target.DeviceID)
+			continue
+		}
+
+		notification := &Notification{
+			Token:       target.Token,
+			CollapseKey: collapseKey,
+			Data: map[string]string{
+				"type":  "messages",
+				"count": strconv.Itoa(count),
+			},
+			TTL: n.ttl,
+		}
+
+		err := n.deliver(ctx, provider, notification)
+		switch {
+		case err == nil:
+			log.Printf("Push wake-up sent: UserID=%s DeviceID=%s Provider=%s", b.userID, target.DeviceID, provider.Name())
+		case errors.Is(err, ErrUnregistered):
+			log.Printf("Push token of device %s no longer registered, forgetting it", target.DeviceID)
+			if err := n.store.ForgetToken(ctx, target.Provider, target.Token); err != nil {
+				log.Printf("Failed to forget push token of device %s: %v", target.DeviceID, err)
+			}
+		default:
+			log.Printf("Push wake-up to device %s failed: %v", target.DeviceID, err)
+		}
+	}
+}
+
+// deliver sends a notification, retrying temporary failures with
+// exponential backoff
+func (n *Notifier) deliver(ctx context.Context, provider Provider, notification *Notification) error {
+	delay := n.retryBackoff
+
+	var err error
+	for attempt := 1; attempt <= n.maxAttempts; attempt++ {
+		if err = provider.Send(ctx, notification); err == nil {
+			return nil
+		}
+
+		var providerErr *ProviderError
+		if !errors.As(err, &providerErr) || !providerErr.Temporary || attempt == n.maxAttempts {
+			return err
+		}
+
+		wait := delay
+		if providerErr.RetryAfter > wait {
+			wait = providerErr.RetryAfter
+		}
+		if wait > maxRetryDelay {
+			wait = maxRetryDelay
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return fmt.Errorf("%w (giving up: %v)", err, ctx.Err())
+		}
+		delay *= 2
+	}
+
+	return err
+}
@@ -0,0 +1,122 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Provider names, as stored in user_devices.push_provider
+const (
+	ProviderFCM     = "fcm"
+	ProviderAPNs    = "apns"
+	ProviderWebPush = "webpush"
+)
+
+const providerTimeout = 10 * time.Second
+
+// Notification is a wake-up for one device. It never carries message
+// content: the app connects and fetches its queued envelopes instead.
+type Notification struct {
+	Token       string            // Device token, or Web Push subscription endpoint
+	CollapseKey string            // Newer notifications with the same key replace older ones
+	Data        map[string]string // Small hints for the app, e.g. the notification kind
+	TTL         time.Duration     // How long the service keeps it for an unreachable device
+}
+
+// Provider delivers notifications through one push service
+type Provider interface {
+	// Name is the provider stored with device tokens
+	Name() string
+	Send(ctx context.Context, n *Notification) error
+}
+
+// ErrUnregistered means the token no longer reaches a device and should be
+// forgotten
+var ErrUnregistered = errors.New("push token no longer registered")
+
+// ProviderError is a notification the service rejected or that never reached
+// it. Temporary errors (network failures, 429 and 5xx) are worth retrying.
+type ProviderError struct {
+	Provider     string
+	Status       int    // HTTP status, 0 if there was no response
+	Reason       string // Service error reason, if any
+	Temporary    bool
+	Unregistered bool // The token is invalid or expired
+	RetryAfter   time.Duration
+}
+
+func (e *ProviderError) Error() string {
+	if e.Status == 0 {
+		return fmt.Sprintf("%s: %s", e.Provider, e.Reason)
+	}
+	if e.Reason != "" {
+		return fmt.Sprintf("%s: HTTP %d: %s", e.Provider, e.Status, e.Reason)
+	}
+	return fmt.Sprintf("%s: HTTP %d", e.Provider, e.Status)
+}
+
+// Is makes errors.Is(err, ErrUnregistered) true for dead tokens
+func (e *ProviderError) Is(target error) bool {
+	return target == ErrUnregistered && e.Unregistered
+}
+
+// networkError wraps a failed request, which is always worth retrying
+func networkError(provider string, err error) *ProviderError {
+	return &ProviderError{
+		Provider:  provider,
+		Reason:    err.Error(),
+		Temporary: true,
+	}
+}
+
+// responseError builds the error for a non-2xx response
+func responseError(provider string, resp *http.Response, reason string, unregistered bool) *ProviderError {
+	if reason == "" {
+		reason = http.StatusText(resp.StatusCode)
+	}
+
+	err := &ProviderError{
+		Provider:     provider,
+		Status:       resp.StatusCode,
+		Reason:       reason,
+		Temporary:    resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500,
+		Unregistered: unregistered,
+	}
+	if seconds, parseErr := strconv.Atoi(resp.Header.Get("Retry-After")); parseErr == nil {
+		err.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return err
+}
+
+// Mock logs notifications instead of sending them, for development and for
+// providers without credentials
+type Mock struct {
+	name string
+}
+
+// NewMock creates a mock standing in for the named provider
+func NewMock(name string) *Mock {
+	return &Mock{name: name}
+}
+
+func (m *Mock) Name() string {
+	return m.name
+}
+
+func (m *Mock) Send(ctx context.Context, n *Notification) error {
+	log.Printf("[MOCK PUSH] %s: token=%s collapse=%s data=%v", m.name, shortToken(n.Token), n.CollapseKey, n.Data)
+	return nil
+}
+
+// shortToken keeps tokens, which are credentials of sorts, out of logs
+func shortToken(token string) string {
+	if len(token) <= 12 {
+		return token
+	}
+	return token[:6] + "…" + token[len(token)-6:]
+}
@@ -0,0 +1,260 @@
+package push
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrDeviceNotFound  = errors.New("device not found")
+	ErrUserNotFound    = errors.New("user not found")
+	ErrInvalidToken    = errors.New("invalid push token")
+	ErrInvalidProvider = errors.New("provider must be fcm, apns or webpush")
+	ErrSelfMute        = errors.New("cannot mute yourself")
+	ErrMuteNotFound    = errors.New("mute not found")
+)
+
+// Target is a device wake-ups can be sent to
+type Target struct {
+	DeviceID string
+	Provider string
+	Token    string
+}
+
+// Settings are a user's notification preferences
+type Settings struct {
+	Muted      bool       `json:"muted"`
+	MutedUntil *time.Time `json:"muted_until"` // nil while muted: until turned back on
+	Mutes      []*Mute    `json:"mutes"`
+}
+
+// Mute silences wake-ups for messages from one sender
+type Mute struct {
+	UserID     string     `json:"user_id"`
+	MutedUntil *time.Time `json:"muted_until"` // nil: until unmuted
+}
+
+// Store keeps push tokens on user_devices and mute settings in PostgreSQL
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// SetToken registers the push token of one of the user's devices. A token
+// can only reach one device, so any other device holding it loses it.
+func (s *Store) SetToken(ctx context.Context, userID, deviceID, provider, token string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE user_devices SET push_token = NULL, push_provider = NULL WHERE push_token = $1 AND device_id <> $2",
+		token, deviceID,
+	)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx,
+		`UPDATE user_devices SET push_token = $3, push_provider = $4, push_token_updated_at = NOW()
+		WHERE device_id = $1 AND user_id = $2`,
+		deviceID, userID, token, provider,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrDeviceNotFound
+	}
+
+	return tx.Commit()
+}
+
+// ClearToken stops wake-ups to one of the user's devices
+func (s *Store) ClearToken(ctx context.Context, userID, deviceID string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE user_devices SET push_token = NULL, push_provider = NULL, push_token_updated_at = NOW()
+		WHERE device_id = $1 AND user_id = $2`,
+		deviceID, userID,
+	)
+	return err
+}
+
+// ForgetToken drops a token the push service no longer accepts
+func (s *Store) ForgetToken(ctx context.Context, provider, token string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE user_devices SET push_token = NULL, push_provider = NULL, push_token_updated_at = NOW()
+		WHERE push_provider = $1 AND push_token = $2`,
+		provider, token,
+	)
+	return err
+}
+
+// Targets returns the given devices of a user that have a push token
+func (s *Store) Targets(ctx context.Context, userID string, deviceIDs []string) ([]Target, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT device_id, push_provider, push_token FROM user_devices
+		WHERE user_id = $1 AND device_id = ANY($2) AND push_token IS NOT NULL AND push_provider IS NOT NULL`,
+		userID, pq.Array(deviceIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	targets := make([]Target, 0, len(deviceIDs))
+	for rows.Next() {
+		var t Target
+		if err := rows.Scan(&t.DeviceID, &t.Provider, &t.Token); err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+
+	return targets, rows.Err()
+}
+
+// Settings returns a user's notification preferences. Expired mutes are
+// left out.
+func (s *Store) Settings(ctx context.Context, userID string) (*Settings, error) {
+	settings := &Settings{Mutes: make([]*Mute, 0)}
+
+	var mutedUntil sql.NullTime
+	err := s.db.QueryRowContext(ctx,
+		"SELECT muted, muted_until FROM push_settings WHERE user_id = $1",
+		userID,
+	).Scan(&settings.Muted, &mutedUntil)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if settings.Muted && mutedUntil.Valid {
+		if mutedUntil.Time.After(time.Now()) {
+			settings.MutedUntil = &mutedUntil.Time
+		} else {
+			settings.Muted = false
+		}
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT muted_user_id, muted_until FROM push_mutes
+		WHERE user_id = $1 AND (muted_until IS NULL OR muted_until > NOW())
+		ORDER BY created_at`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var mute Mute
+		var until sql.NullTime
+		if err := rows.Scan(&mute.UserID, &until); err != nil {
+			return nil, err
+		}
+		if until.Valid {
+			mute.MutedUntil = &until.Time
+		}
+		settings.Mutes = append(settings.Mutes, &mute)
+	}
+
+	return settings, rows.Err()
+}
+
+// SetMuted mutes or unmutes all of a user's notifications. until is nil to
+// mute until turned back on.
+func (s *Store) SetMuted(ctx context.Context, userID string, muted bool, until *time.Time) error {
+	if !muted {
+		until = nil
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO push_settings (user_id, muted, muted_until, updated_at)
+		VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (user_id) DO UPDATE
+		SET muted = EXCLUDED.muted, muted_until = EXCLUDED.muted_until, updated_at = NOW()`,
+		userID, muted, until,
+	)
+	return err
+}
+
+// Mute silences notifications for messages from another user. until is nil
+// to mute until unmuted.
+func (s *Store) Mute(ctx context.Context, userID, mutedUserID string, until *time.Time) error {
+	if userID == mutedUserID {
+		return ErrSelfMute
+	}
+
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO push_mutes (user_id, muted_user_id, muted_until)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, muted_user_id) DO UPDATE SET muted_until = EXCLUDED.muted_until`,
+		userID, mutedUserID, until,
+	)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && (pqErr.Code == "23503" || pqErr.Code == "22P02") {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+// Unmute lifts a mute set with Mute
+func (s *Store) Unmute(ctx context.Context, userID, mutedUserID string) error {
+	result, err := s.db.ExecContext(ctx,
+		"DELETE FROM push_mutes WHERE user_id = $1 AND muted_user_id::text = $2",
+		userID, mutedUserID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrMuteNotFound
+	}
+	return nil
+}
+
+// Muted reports whether all of a user's notifications are muted, and
+// otherwise which of the given senders are
+func (s *Store) Muted(ctx context.Context, userID string, senders []string) (bool, map[string]bool, error) {
+	var all bool
+	err := s.db.QueryRowContext(ctx,
+		"SELECT muted AND (muted_until IS NULL OR muted_until > NOW()) FROM push_settings WHERE user_id = $1",
+		userID,
+	).Scan(&all)
+	if err != nil && err != sql.ErrNoRows {
+		return false, nil, err
+	}
+	if all {
+		return true, nil, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT muted_user_id FROM push_mutes
+		WHERE user_id = $1 AND muted_user_id::text = ANY($2)
+		AND (muted_until IS NULL OR muted_until > NOW())`,
+		userID, pq.Array(senders),
+	)
+	if err != nil {
+		return false, nil, err
+	}
+	defer rows.Close()
+
+	muted := make(map[string]bool)
+	for rows.Next() {
+		var sender string
+		if err := rows.Scan(&sender); err != nil {
+			return false, nil, err
+		}
+		muted[sender] = true
+	}
+
+	return false, muted, rows.Err()
+}
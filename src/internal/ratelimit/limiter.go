@@ -0,0 +1,159 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"chat-e2ee/internal/config"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// slidingWindowScript counts a request against every key in KEYS at once.
+// Each key is a sorted set of request timestamps in milliseconds. Entries
+// older than the window are trimmed first; if any key is already at the
+// limit nothing is recorded, so rejected requests don't extend a lockout.
+//
+// ARGV: window in ms, limit, unique member for this request
+// Returns {allowed, highest count, ms until that key frees a slot}
+var slidingWindowScript = redis.NewScript(`
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local member = ARGV[3]
+
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local highest = 0
+local reset = 0
+local allowed = 1
+
+for _, key in ipairs(KEYS) do
+	redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+	local count = redis.call('ZCARD', key)
+
+	local keyReset = 0
+	if count > 0 then
+		local index = math.max(count - limit, 0)
+		local entry = redis.call('ZRANGE', key, index, index, 'WITHSCORES')
+		keyReset = tonumber(entry[2]) + window - now
+	end
+
+	if count >= limit then
+		if allowed == 1 or keyReset > reset then
+			reset = keyReset
+		end
+		allowed = 0
+		highest = math.max(highest, count)
+	elseif allowed == 1 and count >= highest then
+		highest = count
+		reset = keyReset
+	end
+end
+
+if allowed == 0 then
+	return {0, highest, reset}
+end
+
+for _, key in ipairs(KEYS) do
+	redis.call('ZADD', key, now, member)
+	redis.call('PEXPIRE', key, window)
+end
+
+if highest == 0 then
+	reset = window
+end
+
+return {1, highest + 1, reset}
+`)
+
+// Policy limits how many requests an identifier may make per window
+type Policy struct {
+	Name     string
+	Requests int
+	Window   time.Duration
+}
+
+// Result is the outcome of a rate limit check
+type Result struct {
+	Allowed   bool
+	Policy    Policy
+	Remaining int
+	// ResetAfter is when the window frees a slot for the most limited
+	// identifier, or when a rejected request may be retried
+	ResetAfter time.Duration
+}
+
+// Limiter is a sliding window rate limiter shared by every instance through
+// Redis. Policies are looked up by route name in the rate limit config.
+type Limiter struct {
+	client *redis.Client
+	cfg    config.RateLimitConfig
+}
+
+// NewLimiter creates a rate limiter with the policies from cfg
+func NewLimiter(client *redis.Client, cfg config.RateLimitConfig) *Limiter {
+	return &Limiter{
+		client: client,
+		cfg:    cfg,
+	}
+}
+
+// Policy returns the policy for a route, falling back to the default one
+func (l *Limiter) Policy(route string) Policy {
+	policy := Policy{
+		Name:     route,
+		Requests: l.cfg.Requests,
+		Window:   l.cfg.Window,
+	}
+	if override, ok := l.cfg.Policies[route]; ok {
+		policy.Requests = override.Requests
+		policy.Window = override.Window
+	}
+	return policy
+}
+
+// Allow counts a request against each identifier under the route's policy.
+// The request is allowed only if every identifier is within the limit, and
+// is only counted if it is allowed. Empty identifiers are ignored.
+//
+// If rate limiting is disabled, or the route's policy has no limit, the
+// request is allowed and Policy.Requests is 0.
+func (l *Limiter) Allow(ctx context.Context, route string, identifiers ...string) (*Result, error) {
+	policy := l.Policy(route)
+	if !l.cfg.Enabled || policy.Requests <= 0 || policy.Window <= 0 {
+		return &Result{Allowed: true, Policy: Policy{Name: route}}, nil
+	}
+
+	keys := make([]string, 0, len(identifiers))
+	for _, id := range identifiers {
+		if id != "" {
+			keys = append(keys, fmt.Sprintf("ratelimit:%s:%s", route, id))
+		}
+	}
+	if len(keys) == 0 {
+		return &Result{Allowed: true, Policy: Policy{Name: route}}, nil
+	}
+
+	member := fmt.Sprintf("%d-%d", time.Now().UnixNano(), rand.Int63())
+	values, err := slidingWindowScript.Run(ctx, l.client, keys,
+		policy.Window.Milliseconds(), policy.Requests, member,
+	).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	remaining := policy.Requests - int(values[1])
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return &Result{
+		Allowed:    values[0] == 1,
+		Policy:     policy,
+		Remaining:  remaining,
+		ResetAfter: time.Duration(values[2]) * time.Millisecond,
+	}, nil
+}
@@ -0,0 +1,58 @@
+package relay
+
+import (
+	"context"
+	"log"
+)
+
+// How the relay answers a frame between users who blocked each other
+const (
+	// BlockPolicySilent drops the frame; chat messages still get a delivery
+	// frame, so the sender can't tell they were blocked
+	BlockPolicySilent = "silent"
+	// BlockPolicyError answers with a BLOCKED error
+	BlockPolicyError = "error"
+)
+
+// BlockChecker tells whether two users blocked each other, see users.Blocks
+type BlockChecker interface {
+	// Blocked reports whether either user blocked the other
+	Blocked(ctx context.Context, userID, otherID string) (bool, error)
+}
+
+// UseBlocks makes the hub drop messages, typing indicators and receipts
+// between users who blocked each other, answering the sender as policy says.
+// It must be called before clients connect.
+func (h *Hub) UseBlocks(checker BlockChecker, policy string) {
+	if policy != BlockPolicyError {
+		policy = BlockPolicySilent
+	}
+	h.blocks = checker
+	h.blockPolicy = policy
+}
+
+// dropBlocked reports whether a frame from this client to peer must be
+// dropped because one of them blocked the other. The client is told with a
+// BLOCKED error under the error policy; silent is true when it must not
+// notice anything.
+func (c *Client) dropBlocked(peer string) (drop, silent bool) {
+	if c.hub.blocks == nil {
+		return false, false
+	}
+
+	blocked, err := c.hub.blocks.Blocked(context.Background(), c.UserID, peer)
+	if err != nil {
+		log.Printf("[ERROR] Failed to check blocks between %s and %s: %v", c.UserID, peer, err)
+		c.sendError("BLOCK_LOOKUP_FAILED", "Failed to check the recipient")
+		return true, false
+	}
+	if !blocked {
+		return false, false
+	}
+
+	if c.hub.blockPolicy == BlockPolicyError {
+		c.sendError("BLOCKED", "You can't interact with this user")
+		return true, false
+	}
+	return true, true
+}
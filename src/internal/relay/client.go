@@ -5,8 +5,12 @@ import (
 	"encoding/json"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"chat-e2ee/internal/presence"
+	"chat-e2ee/internal/ratelimit"
+
 	"github.com/gofiber/websocket/v2"
 	"github.com/google/uuid"
 )
@@ -23,70 +27,89 @@ type Client struct {
 	ID       string
 	UserID   string
 	DeviceID string
+	// The login session of the token the connection was opened with
+	SessionID string
 
 	hub  *Hub
 	conn *websocket.Conn
 	send chan []byte
+	done chan struct{}
 
 	mu         sync.RWMutex
 	isClosing  bool
 	lastActive time.Time
+	// Sent in the close frame once queued frames are flushed
+	closeMessage []byte
+
+	// Frame throttling, only touched by the read pump
+	frames    *ratelimit.TokenBucket
+	throttled int
+
+	// Offline queue progress, only touched by the hub goroutine
+	pendingCursor string
+	backlog       atomic.Bool
+
+	// Users whose presence this connection subscribed to, and when the
+	// subscriptions were last renewed; guarded by mu
+	watching  map[string]bool
+	watchedAt time.Time
 }
 
-func NewClient(hub *Hub, conn *websocket.Conn, userID, deviceID string) *Client {
+func NewClient(hub *Hub, conn *websocket.Conn, userID, deviceID, sessionID string) *Client {
 	if conn == nil {
 		log.Printf("[ERROR] NewClient called with nil connection for UserID=%s", userID)
 		return nil
 	}
-	
+
 	return &Client{
 		ID:         uuid.New().String(),
 		UserID:     userID,
 		DeviceID:   deviceID,
+		SessionID:  sessionID,
 		hub:        hub,
 		conn:       conn,
 		send:       make(chan []byte, channelBufferSize),
+		done:       make(chan struct{}),
 		lastActive: time.Now(),
+		frames:     ratelimit.NewTokenBucket(hub.frameRate, hub.frameBurst),
 	}
 }
 
-func (c *Client) Start() {
+// Serve registers the client with the hub and pumps frames until the
+// connection is closed. It blocks, because the underlying connection is
+// released as soon as the websocket handler returns.
+func (c *Client) Serve() {
 	if c == nil || c.conn == nil {
-		log.Printf("[ERROR] Client.Start() called with nil client or connection")
+		log.Printf("[ERROR] Client.Serve() called with nil client or connection")
 		return
 	}
-	
-	log.Printf("[DEBUG] Client.Start() called for UserID=%s, DeviceID=%s, conn=%p", c.UserID, c.DeviceID, c.conn)
-	
+
+	c.sendWelcome()
 	c.hub.register <- c
-	log.Printf("[DEBUG] Client sent to hub.register channel")
-	
+
 	go c.writePump()
-	log.Printf("[DEBUG] writePump goroutine started")
-	
-	go c.readPump()
-	log.Printf("[DEBUG] readPump goroutine started")
+	c.readPump()
+
+	// Wait for the write pump to flush and exit before giving the connection back
+	<-c.done
 }
 
 func (c *Client) readPump() {
-	log.Printf("[DEBUG] readPump started for UserID=%s", c.UserID)
 	defer func() {
-		log.Printf("[DEBUG] readPump ending for UserID=%s", c.UserID)
 		c.hub.unregister <- c
 		c.conn.Close()
 	}()
 
-	// Configure WebSocket
 	c.conn.SetReadLimit(maxMessageSize)
 	if err := c.conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
 		log.Printf("[ERROR] Failed to set read deadline: %v", err)
 		return
 	}
-	
+
 	c.conn.SetPongHandler(func(string) error {
-		log.Printf("[DEBUG] Pong received from UserID=%s", c.UserID)
 		c.conn.SetReadDeadline(time.Now().Add(pongWait))
 		c.updateLastActive()
+		c.hub.heartbeat(c)
 		return nil
 	})
 
@@ -101,18 +124,26 @@ func (c *Client) readPump() {
 			break
 		}
 
-		log.Printf("[DEBUG] Message received from UserID=%s, type=%d, size=%d", c.UserID, messageType, len(message))
+		if !c.allowFrame() {
+			if c.throttled > c.hub.frameBurst {
+				log.Printf("[WebSocket] Closing connection for user %s: kept sending while rate limited", c.UserID)
+				c.setCloseMessage(websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded"))
+				break
+			}
+			continue
+		}
 
 		if messageType != websocket.TextMessage {
 			continue
 		}
 
 		c.updateLastActive()
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
 
 		clientMsg, err := ParseMessage(message)
 		if err != nil {
 			log.Printf("[ERROR] Failed to parse message from user %s: %v", c.UserID, err)
-			c.send <- NewErrorMessage("PARSE_ERROR", "Invalid message format")
+			c.sendError("PARSE_ERROR", "Invalid message format")
 			continue
 		}
 
@@ -120,13 +151,28 @@ func (c *Client) readPump() {
 	}
 }
 
+// allowFrame takes a token for an incoming frame. The first frame dropped
+// after an allowed one is answered with a RATE_LIMITED error, later ones are
+// dropped silently so the error itself can't flood the client.
+func (c *Client) allowFrame() bool {
+	if c.frames.Allow() {
+		c.throttled = 0
+		return true
+	}
+
+	if c.throttled == 0 {
+		c.sendError("RATE_LIMITED", "Too many frames, slow down")
+	}
+	c.throttled++
+	return false
+}
+
 func (c *Client) writePump() {
-	log.Printf("[DEBUG] writePump started for UserID=%s", c.UserID)
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
-		log.Printf("[DEBUG] writePump ending for UserID=%s", c.UserID)
 		ticker.Stop()
 		c.conn.Close()
+		close(c.done)
 	}()
 
 	for {
@@ -136,21 +182,18 @@ func (c *Client) writePump() {
 				log.Printf("[ERROR] Failed to set write deadline: %v", err)
 				return
 			}
-			
+
 			if !ok {
-				log.Printf("[DEBUG] Send channel closed for UserID=%s", c.UserID)
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.conn.WriteMessage(websocket.CloseMessage, c.getCloseMessage())
 				return
 			}
 
-			log.Printf("[DEBUG] Sending message to UserID=%s, size=%d", c.UserID, len(message))
 			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
 				log.Printf("[ERROR] Failed to write message: %v", err)
 				return
 			}
 
 		case <-ticker.C:
-			log.Printf("[DEBUG] Sending ping to UserID=%s", c.UserID)
 			if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
 				log.Printf("[ERROR] Failed to set write deadline for ping: %v", err)
 				return
@@ -164,54 +207,165 @@ func (c *Client) writePump() {
 }
 
 func (c *Client) processMessage(msg *ClientMessage) {
-	log.Printf("[DEBUG] Processing message type=%s from UserID=%s", msg.Type, c.UserID)
 	switch msg.Type {
 	case MessageTypeText:
 		c.handleTextMessage(msg)
+	case MessageTypeGroupMessage:
+		c.handleGroupMessage(msg)
 	case MessageTypeTyping:
 		c.handleTypingIndicator(msg)
 	case MessageTypeRead:
 		c.handleReadReceipt(msg)
+	case MessageTypeAck:
+		c.handleAck(msg)
 	case MessageTypePresence:
 		c.handlePresenceUpdate(msg)
+	case MessageTypePresenceSubscribe:
+		c.handlePresenceSubscribe(msg)
+	case MessageTypePresenceUnsubscribe:
+		c.handlePresenceUnsubscribe(msg)
 	case MessageTypePing:
 		c.handlePing()
+	case MessageTypeHeartbeat:
+		c.handleHeartbeat()
+	case MessageTypePong:
+		// Application-level pong, activity was already recorded
+	case MessageTypeDelivery, MessageTypeDelivered, MessageTypeError, MessageTypeStatus, MessageTypeConnected,
+		MessageTypePrekeysLow, MessageTypeKeyChanged, MessageTypeGroupEvent, MessageTypeRequestAccepted:
+		c.sendError("INVALID_TYPE", "Message type can only be sent by the server")
 	default:
-		c.send <- NewErrorMessage("UNKNOWN_TYPE", "Unknown message type")
+		c.sendError("UNKNOWN_TYPE", "Unknown message type")
 	}
 }
 
 func (c *Client) handleTextMessage(msg *ClientMessage) {
 	if msg.To == "" {
-		c.send <- NewErrorMessage("MISSING_RECIPIENT", "Recipient ID required")
+		c.sendError("MISSING_RECIPIENT", "Recipient ID required")
+		return
+	}
+	if len(msg.Envelopes) == 0 {
+		c.sendError("MISSING_ENVELOPES", "One encrypted envelope per recipient device required")
+		return
+	}
+
+	seen := make(map[string]bool, len(msg.Envelopes))
+	for _, envelope := range msg.Envelopes {
+		if envelope.DeviceID == "" || seen[envelope.DeviceID] {
+			c.sendError("INVALID_ENVELOPE", "Each envelope needs a distinct device_id")
+			return
+		}
+		if envelope.Payload == "" {
+			c.sendError("MISSING_PAYLOAD", "Encrypted payload required")
+			return
+		}
+		seen[envelope.DeviceID] = true
+	}
+
+	// Checked before the devices, so a mismatch can't give the block away
+	if drop, silent := c.dropBlocked(msg.To); drop {
+		if silent {
+			confirmAccepted(c, &RelayMessage{ID: generateMessageID()})
+		}
+		return
+	}
+
+	if c.hub.devices != nil {
+		mismatch, err := c.hub.devices.Verify(context.Background(), msg.To, msg.Envelopes)
+		if err != nil {
+			log.Printf("[ERROR] Failed to load devices for user %s: %v", msg.To, err)
+			c.sendError("DEVICE_LOOKUP_FAILED", "Failed to load recipient devices")
+			return
+		}
+		if mismatch != nil {
+			c.Send(mustMarshalError(ErrorMessage{
+				Code:    "DEVICE_MISMATCH",
+				Message: "Envelopes do not match the recipient's devices",
+				Devices: mismatch,
+			}, ""))
+			return
+		}
+	}
+
+	// Checked last, so only a message that can be delivered opens a request
+	requestID, ok := c.admit(msg.To)
+	if !ok {
 		return
 	}
 
 	relayMsg := &RelayMessage{
-		From:     c.UserID,
-		To:       msg.To,
-		DeviceID: c.DeviceID,
-		Type:     msg.Type,
-		Payload:  msg.Payload,
+		From:      c.UserID,
+		To:        msg.To,
+		DeviceID:  c.DeviceID,
+		Type:      msg.Type,
+		Envelopes: msg.Envelopes,
+		RequestID: requestID,
 	}
 
+	// The hub assigns the message ID and echoes it back as a delivery frame
 	c.hub.relay <- relayMsg
+}
 
-	ctx := context.Background()
-	messageID := generateMessageID()
-	
-	if c.hub.presence != nil {
-		c.hub.presence.StoreMessageMetadata(ctx, messageID, c.UserID, msg.To)
+// handleGroupMessage fans a sender-key message out to the devices of every
+// group member, including the sender's other devices
+func (c *Client) handleGroupMessage(msg *ClientMessage) {
+	if msg.GroupID == "" {
+		c.sendError("MISSING_GROUP", "Group ID required")
+		return
+	}
+	if msg.Payload == "" {
+		c.sendError("MISSING_PAYLOAD", "Encrypted payload required")
+		return
+	}
+	if c.hub.groups == nil {
+		c.sendError("GROUPS_UNAVAILABLE", "Group messages are not supported")
+		return
 	}
 
-	deliveryMsg := NewServerMessage(MessageTypeDelivery, "", messageID)
-	if data, err := json.Marshal(deliveryMsg); err == nil {
-		c.send <- data
+	// Membership is checked on every message, so removed members can't send
+	// and don't receive
+	recipients, member, err := c.hub.groups.Recipients(context.Background(), msg.GroupID, c.UserID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to load members of group %s: %v", msg.GroupID, err)
+		c.sendError("GROUP_LOOKUP_FAILED", "Failed to load group members")
+		return
+	}
+	if !member {
+		c.sendError("NOT_A_MEMBER", "You are not a member of this group")
+		return
+	}
+
+	// The sending device already has the message
+	own := make([]string, 0, len(recipients[c.UserID]))
+	for _, deviceID := range recipients[c.UserID] {
+		if deviceID != c.DeviceID {
+			own = append(own, deviceID)
+		}
+	}
+	if len(own) > 0 {
+		recipients[c.UserID] = own
+	} else {
+		delete(recipients, c.UserID)
+	}
+
+	c.hub.relay <- &RelayMessage{
+		From:       c.UserID,
+		DeviceID:   c.DeviceID,
+		Type:       MessageTypeGroupMessage,
+		Payload:    msg.Payload,
+		GroupID:    msg.GroupID,
+		Recipients: recipients,
 	}
 }
 
 func (c *Client) handleTypingIndicator(msg *ClientMessage) {
 	if msg.To == "" {
+		c.sendError("MISSING_RECIPIENT", "Recipient ID required")
+		return
+	}
+	if drop, _ := c.dropBlocked(msg.To); drop {
+		return
+	}
+	if !c.hub.approved(msg.To, c.UserID) {
 		return
 	}
 
@@ -223,16 +377,53 @@ func (c *Client) handleTypingIndicator(msg *ClientMessage) {
 	indicatorJSON, _ := json.Marshal(indicator)
 
 	relayMsg := &RelayMessage{
-		From:    c.UserID,
-		To:      msg.To,
-		Type:    MessageTypeTyping,
-		Payload: string(indicatorJSON),
+		From:     c.UserID,
+		To:       msg.To,
+		DeviceID: c.DeviceID,
+		Type:     MessageTypeTyping,
+		Payload:  string(indicatorJSON),
 	}
 
 	c.hub.relay <- relayMsg
 }
 
 func (c *Client) handleReadReceipt(msg *ClientMessage) {
+	if msg.Payload == "" {
+		c.sendError("MISSING_MESSAGE_ID", "Message ID required")
+		return
+	}
+
+	sender := msg.To
+	if c.hub.presence != nil {
+		ctx := context.Background()
+		from, ok := c.lookupReceivedMessage(ctx, msg.Payload)
+		if !ok {
+			return
+		}
+		sender = from
+
+		if err := c.hub.presence.MarkMessageRead(ctx, msg.Payload); err != nil {
+			log.Printf("[ERROR] Failed to mark message %s read: %v", msg.Payload, err)
+		}
+
+		// Reading implies receipt, so the message leaves the queue even without an ack
+		c.ackPending(ctx, msg.Payload)
+	}
+
+	if sender == "" {
+		c.sendError("MISSING_RECIPIENT", "Recipient ID required")
+		return
+	}
+	if drop, _ := c.dropBlocked(sender); drop {
+		return
+	}
+
+	// Read receipts would tell a sender whose request is pending that the
+	// recipient is around
+	if !c.hub.approved(c.UserID, sender) {
+		return
+	}
+
 	receipt := &ReadReceipt{
 		MessageID: msg.Payload,
 		ReadAt:    time.Now().UTC(),
@@ -241,180 +432,223 @@ func (c *Client) handleReadReceipt(msg *ClientMessage) {
 	receiptJSON, _ := json.Marshal(receipt)
 
 	relayMsg := &RelayMessage{
-		From:    c.UserID,
-		To:      msg.To,
-		Type:    MessageTypeRead,
-		Payload: string(receiptJSON),
+		ID:       msg.Payload,
+		From:     c.UserID,
+		To:       sender,
+		DeviceID: c.DeviceID,
+		Type:     MessageTypeRead,
+		Payload:  string(receiptJSON),
 	}
 
 	c.hub.relay <- relayMsg
 }
 
+// handleAck confirms that this device received a message and tells the
+// sender it was delivered
+func (c *Client) handleAck(msg *ClientMessage) {
+	if msg.Payload == "" {
+		c.sendError("MISSING_MESSAGE_ID", "Message ID required")
+		return
+	}
+
+	if c.hub.presence == nil {
+		return
+	}
+
+	ctx := context.Background()
+	sender, ok := c.lookupReceivedMessage(ctx, msg.Payload)
+	if !ok {
+		return
+	}
+
+	firstAck, err := c.hub.presence.MarkMessageDelivered(ctx, msg.Payload)
+	if err != nil {
+		log.Printf("[ERROR] Failed to mark message %s delivered: %v", msg.Payload, err)
+		c.sendError("ACK_FAILED", "Failed to acknowledge message")
+		return
+	}
+
+	c.ackPending(ctx, msg.Payload)
+
+	// Other devices of the recipient may ack the same message, and server
+	// events have no sender to tell
+	if !firstAck || sender == "" {
+		return
+	}
+
+	// The ack itself went through, so a block only costs the sender the
+	// receipt, whatever the policy
+	if c.hub.blocks != nil {
+		blocked, err := c.hub.blocks.Blocked(ctx, c.UserID, sender)
+		if err != nil {
+			log.Printf("[ERROR] Failed to check blocks between %s and %s: %v", c.UserID, sender, err)
+			return
+		}
+		if blocked {
+			return
+		}
+	}
+	if !c.hub.approved(c.UserID, sender) {
+		return
+	}
+
+	receipt := &DeliveryReceipt{
+		MessageID:   msg.Payload,
+		DeliveredAt: time.Now().UTC(),
+	}
+
+	relayMsg := &RelayMessage{
+		ID:       msg.Payload,
+		From:     c.UserID,
+		To:       sender,
+		DeviceID: c.DeviceID,
+		Type:     MessageTypeDelivered,
+		Payload:  mustMarshal(receipt),
+	}
+
+	c.hub.relay <- relayMsg
+}
+
+// ackPending removes a message from this device's offline queue and resumes
+// delivery if the queue had stalled on a full buffer
+func (c *Client) ackPending(ctx context.Context, messageID string) {
+	if err := c.hub.presence.AckPendingMessage(ctx, c.UserID, c.DeviceID, messageID); err != nil {
+		log.Printf("[ERROR] Failed to ack pending message %s: %v", messageID, err)
+	}
+
+	if c.hasBacklog() {
+		c.hub.RequestPendingDelivery(c)
+	}
+}
+
+// lookupReceivedMessage returns the sender of a message addressed to this
+// client's user, directly or through a group, reporting an error to the
+// client if there is none
+func (c *Client) lookupReceivedMessage(ctx context.Context, messageID string) (string, bool) {
+	meta, err := c.hub.presence.GetMessageMetadata(ctx, messageID)
+	if err != nil || len(meta) == 0 || (meta["to"] != c.UserID && meta["recipient:"+c.UserID] == "") {
+		c.sendError("UNKNOWN_MESSAGE", "Message not found")
+		return "", false
+	}
+	return meta["from"], true
+}
+
 func (c *Client) handlePresenceUpdate(msg *ClientMessage) {
+	status := msg.Payload
+	if status == presence.StatusOffline {
+		// Appearing offline is being invisible
+		status = presence.StatusInvisible
+	}
+	if !validPresenceStatuses[status] {
+		c.sendError("INVALID_STATUS", "Status must be one of: online, away, dnd, invisible")
+		return
+	}
+
 	ctx := context.Background()
 	if c.hub.presence != nil {
-		c.hub.presence.UpdatePresence(ctx, c.UserID, msg.Payload)
+		change, err := c.hub.presence.SetStatus(ctx, c.UserID, status)
+		if err != nil {
+			log.Printf("[ERROR] Failed to update presence for user %s: %v", c.UserID, err)
+			c.sendError("PRESENCE_FAILED", "Failed to update presence")
+			return
+		}
+		c.hub.queuePresence(change)
+	}
+
+	now := time.Now().UTC()
+	update := &PresenceUpdate{
+		UserID:   c.UserID,
+		Status:   status,
+		LastSeen: &now,
+	}
+
+	reply := NewServerMessage(MessageTypeStatus, "", mustMarshal(update))
+	if data, err := json.Marshal(reply); err == nil {
+		c.Send(data)
 	}
 }
 
 func (c *Client) handlePing() {
-	log.Printf("[DEBUG] Handling ping from UserID=%s", c.UserID)
 	pong := NewServerMessage(MessageTypePong, "", "")
 	if data, err := json.Marshal(pong); err == nil {
-		c.send <- data
+		c.Send(data)
 	}
 }
 
+func (c *Client) handleHeartbeat() {
+	c.hub.heartbeat(c)
+}
+
+func (c *Client) sendWelcome() {
+	welcome := map[string]interface{}{
+		"type":      MessageTypeConnected,
+		"message":   "Connected to Chat E2EE WebSocket",
+		"timestamp": time.Now().Unix(),
+		"user_id":   c.UserID,
+		"device_id": c.DeviceID,
+	}
+
+	if data, err := json.Marshal(welcome); err == nil {
+		c.Send(data)
+	}
+}
+
+func (c *Client) sendError(code, message string) {
+	c.Send(NewErrorMessage(code, message))
+}
+
 func (c *Client) updateLastActive() {
 	c.mu.Lock()
 	c.lastActive = time.Now()
 	c.mu.Unlock()
 }
 
+// Close stops the client's send channel. It is safe to call more than once.
 func (c *Client) Close() {
-	log.Printf("[DEBUG] Client.Close() called for UserID=%s", c.UserID)
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	
+
 	if c.isClosing {
-		log.Printf("[DEBUG] Client already closing for UserID=%s", c.UserID)
 		return
 	}
 	c.isClosing = true
-	
-	// Solo cerrar el canal si no es nil
-	if c.send != nil {
-		// Verificar si el canal ya está cerrado antes de cerrarlo
-		select {
-		case _, ok := <-c.send:
-			if !ok {
-				log.Printf("[DEBUG] Channel already closed for UserID=%s", c.UserID)
-				return
-			}
-		default:
-			close(c.send)
-			log.Printf("[DEBUG] Channel closed for UserID=%s", c.UserID)
-		}
-	}
+	close(c.send)
 }
 
-func (c *Client) GetLastActive() time.Time {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	return c.lastActive
+// Revoke closes the connection with a policy violation once queued frames
+// are flushed, e.g. because its session was revoked
+func (c *Client) Revoke(reason string) {
+	c.setCloseMessage(websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason))
+	c.Close()
 }
-// Agregar estos métodos alternativos a client.go
-
-func (c *Client) readPumpWithConn(conn *websocket.Conn) {
-	log.Printf("[DEBUG] readPumpWithConn started for UserID=%s, conn=%p", c.UserID, conn)
-	
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("[PANIC] readPumpWithConn panic for UserID=%s: %v", c.UserID, r)
-		}
-		log.Printf("[DEBUG] readPumpWithConn ending for UserID=%s", c.UserID)
-		conn.Close()
-	}()
-
-	// Configure WebSocket
-	conn.SetReadLimit(maxMessageSize)
-	if err := conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
-		log.Printf("[ERROR] Failed to set read deadline: %v (conn=%p)", err, conn)
-		return
-	}
-	
-	conn.SetPongHandler(func(string) error {
-		log.Printf("[DEBUG] Pong received from UserID=%s", c.UserID)
-		if err := conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
-			log.Printf("[ERROR] Failed to update read deadline: %v", err)
-			return err
-		}
-		c.updateLastActive()
-		return nil
-	})
-
-	log.Printf("[DEBUG] WebSocket configured, entering read loop for UserID=%s", c.UserID)
-
-	for {
-		messageType, message, err := conn.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("[ERROR] WebSocket error for user %s: %v", c.UserID, err)
-			} else {
-				log.Printf("[DEBUG] WebSocket closed for user %s: %v", c.UserID, err)
-			}
-			break
-		}
-
-		log.Printf("[DEBUG] Message received from UserID=%s, type=%d, size=%d", c.UserID, messageType, len(message))
-
-		if messageType != websocket.TextMessage {
-			log.Printf("[DEBUG] Ignoring non-text message type %d", messageType)
-			continue
-		}
-
-		c.updateLastActive()
 
-		clientMsg, err := ParseMessage(message)
-		if err != nil {
-			log.Printf("[ERROR] Failed to parse message from user %s: %v", c.UserID, err)
-			select {
-			case c.send <- NewErrorMessage("PARSE_ERROR", "Invalid message format"):
-			default:
-				log.Printf("[WARN] Send buffer full for user %s", c.UserID)
-			}
-			continue
-		}
+func (c *Client) setCloseMessage(message []byte) {
+	c.mu.Lock()
+	c.closeMessage = message
+	c.mu.Unlock()
+}
 
-		c.processMessage(clientMsg)
+func (c *Client) getCloseMessage() []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closeMessage == nil {
+		return []byte{}
 	}
+	return c.closeMessage
 }
 
-func (c *Client) writePumpWithConn(conn *websocket.Conn) {
-	log.Printf("[DEBUG] writePumpWithConn started for UserID=%s, conn=%p", c.UserID, conn)
-	ticker := time.NewTicker(pingPeriod)
-	
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("[PANIC] writePumpWithConn panic for UserID=%s: %v", c.UserID, r)
-		}
-		log.Printf("[DEBUG] writePumpWithConn ending for UserID=%s", c.UserID)
-		ticker.Stop()
-		conn.Close()
-	}()
-
-	for {
-		select {
-		case message, ok := <-c.send:
-			if err := conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
-				log.Printf("[ERROR] Failed to set write deadline: %v", err)
-				return
-			}
-			
-			if !ok {
-				log.Printf("[DEBUG] Send channel closed for UserID=%s", c.UserID)
-				conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
+func (c *Client) hasBacklog() bool {
+	return c.backlog.Load()
+}
 
-			log.Printf("[DEBUG] Sending message to UserID=%s, size=%d", c.UserID, len(message))
-			if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
-				log.Printf("[ERROR] Failed to write message: %v", err)
-				return
-			}
+func (c *Client) setBacklog(backlog bool) {
+	c.backlog.Store(backlog)
+}
 
-		case <-ticker.C:
-			log.Printf("[DEBUG] Sending ping to UserID=%s", c.UserID)
-			if err := conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
-				log.Printf("[ERROR] Failed to set write deadline for ping: %v", err)
-				return
-			}
-			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				log.Printf("[ERROR] Failed to send ping: %v", err)
-				return
-			}
-		}
-	}
+func (c *Client) GetLastActive() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastActive
 }
 
 // GetID returns the client ID
@@ -427,16 +661,26 @@ func (c *Client) GetUserID() string {
 	return c.UserID
 }
 
-// GetDeviceID returns the device ID  
+// GetDeviceID returns the device ID
 func (c *Client) GetDeviceID() string {
 	return c.DeviceID
 }
 
-// Send sends a message to the client
-func (c *Client) Send(message []byte) {
+// Send queues a message for the client without blocking. It returns false
+// if the client is closing or its buffer is full.
+func (c *Client) Send(message []byte) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.isClosing {
+		return false
+	}
+
 	select {
 	case c.send <- message:
+		return true
 	default:
 		log.Printf("[WebSocket] Send buffer full for user %s", c.UserID)
+		return false
 	}
 }
@@ -0,0 +1,270 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// How often a node refreshes its liveness and stats
+	clusterHeartbeat = 10 * time.Second
+	// A node that missed this long of heartbeats is considered gone
+	clusterNodeTTL = 3 * clusterHeartbeat
+
+	clusterNodesKey = "relay:nodes"
+)
+
+// Cluster event kinds exchanged between nodes
+const (
+	clusterEventRelay      = "relay"      // Deliver a frame to the node's local devices of a user
+	clusterEventPending    = "pending"    // A device has new messages in its offline queue
+	clusterEventTakeover   = "takeover"   // A device reconnected on another node
+	clusterEventDisconnect = "disconnect" // A session or device was revoked
+)
+
+// clusterEvent is published on a node's channel by the other nodes
+type clusterEvent struct {
+	Kind      string        `json:"kind"`
+	UserID    string        `json:"user_id,omitempty"`
+	DeviceID  string        `json:"device_id,omitempty"`
+	SessionID string        `json:"session_id,omitempty"`
+	Message   *RelayMessage `json:"message,omitempty"`
+}
+
+// Cluster lets several backend instances share one relay. Each node records
+// which devices it holds connections for in Redis, and nodes reach each
+// other's devices through pub/sub. Chat messages themselves travel through
+// the per-device offline queues, so a node only needs to be told to drain.
+type Cluster struct {
+	redis  *redis.Client
+	nodeID string
+}
+
+func NewCluster(redisClient *redis.Client, nodeID string) *Cluster {
+	return &Cluster{
+		redis:  redisClient,
+		nodeID: nodeID,
+	}
+}
+
+// NodeID returns the ID this node registers devices under
+func (c *Cluster) NodeID() string {
+	return c.nodeID
+}
+
+func ownersKey(userID string) string {
+	return fmt.Sprintf("relay:devices:%s", userID)
+}
+
+func nodeChannel(nodeID string) string {
+	return fmt.Sprintf("relay:node:%s", nodeID)
+}
+
+func nodeStatsKey(nodeID string) string {
+	return fmt.Sprintf("relay:stats:%s", nodeID)
+}
+
+// claimScript records this node as the owner of a device and returns the
+// previous owner, if any
+var claimScript = redis.NewScript(`
+local previous = redis.call('HGET', KEYS[1], ARGV[1])
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+return previous
+`)
+
+// releaseScript removes a device's owner only if it is still this node, so a
+// late disconnect does not drop a newer connection on another node
+var releaseScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) == ARGV[2] then
+	return redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// Register marks this node as holding the device's connection. If another
+// node held it before, that node is told to drop its stale connection.
+func (c *Cluster) Register(ctx context.Context, userID, deviceID string) error {
+	previous, err := claimScript.Run(ctx, c.redis, []string{ownersKey(userID)},
+		deviceID, c.nodeID, int64((24 * time.Hour).Seconds()),
+	).Text()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	if previous != "" && previous != c.nodeID {
+		return c.publish(ctx, previous, &clusterEvent{
+			Kind:     clusterEventTakeover,
+			UserID:   userID,
+			DeviceID: deviceID,
+		})
+	}
+	return nil
+}
+
+// Unregister releases the device if this node still owns it
+func (c *Cluster) Unregister(ctx context.Context, userID, deviceID string) error {
+	return releaseScript.Run(ctx, c.redis, []string{ownersKey(userID)}, deviceID, c.nodeID).Err()
+}
+
+// Owners returns the node holding each connected device of a user. Devices
+// whose node stopped sending heartbeats, e.g. because it crashed, are left
+// out: their entries outlive the node until the user's hash expires.
+func (c *Cluster) Owners(ctx context.Context, userID string) (map[string]string, error) {
+	pipe := c.redis.Pipeline()
+	ownersCmd := pipe.HGetAll(ctx, ownersKey(userID))
+	nodesCmd := pipe.ZRangeByScore(ctx, clusterNodesKey, liveNodesRange())
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	alive := make(map[string]bool)
+	for _, node := range nodesCmd.Val() {
+		alive[node] = true
+	}
+
+	owners := ownersCmd.Val()
+	for deviceID, node := range owners {
+		if !alive[node] {
+			delete(owners, deviceID)
+		}
+	}
+	return owners, nil
+}
+
+// NotifyPending tells a device's node that its offline queue has new messages
+func (c *Cluster) NotifyPending(ctx context.Context, nodeID, userID, deviceID string) error {
+	return c.publish(ctx, nodeID, &clusterEvent{
+		Kind:     clusterEventPending,
+		UserID:   userID,
+		DeviceID: deviceID,
+	})
+}
+
+// Forward hands a frame to another node for its local devices of msg.To
+func (c *Cluster) Forward(ctx context.Context, nodeID string, msg *RelayMessage) error {
+	return c.publish(ctx, nodeID, &clusterEvent{
+		Kind:    clusterEventRelay,
+		UserID:  msg.To,
+		Message: msg,
+	})
+}
+
+// Disconnect tells a node to close a user's revoked connections
+func (c *Cluster) Disconnect(ctx context.Context, nodeID, userID, deviceID, sessionID string) error {
+	return c.publish(ctx, nodeID, &clusterEvent{
+		Kind:      clusterEventDisconnect,
+		UserID:    userID,
+		DeviceID:  deviceID,
+		SessionID: sessionID,
+	})
+}
+
+func (c *Cluster) publish(ctx context.Context, nodeID string, event *clusterEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return c.redis.Publish(ctx, nodeChannel(nodeID), data).Err()
+}
+
+// Run subscribes to this node's channel and keeps its heartbeat and stats
+// up to date. Events are handed to the hub goroutine through events.
+func (c *Cluster) Run(hub *Hub, events chan<- *clusterEvent) {
+	ctx := context.Background()
+
+	sub := c.redis.Subscribe(ctx, nodeChannel(c.nodeID))
+	defer sub.Close()
+
+	c.heartbeat(ctx, hub.GetStats())
+
+	ticker := time.NewTicker(clusterHeartbeat)
+	defer ticker.Stop()
+
+	messages := sub.Channel()
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+
+			var event clusterEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				log.Printf("[Cluster] Invalid event on %s: %v", msg.Channel, err)
+				continue
+			}
+			events <- &event
+
+		case <-ticker.C:
+			c.heartbeat(ctx, hub.GetStats())
+		}
+	}
+}
+
+// heartbeat marks this node alive and publishes its local stats
+func (c *Cluster) heartbeat(ctx context.Context, stats HubStats) {
+	now := time.Now()
+
+	pipe := c.redis.Pipeline()
+	pipe.ZAdd(ctx, clusterNodesKey, redis.Z{Score: float64(now.Unix()), Member: c.nodeID})
+	pipe.ZRemRangeByScore(ctx, clusterNodesKey, "-inf", strconv.FormatInt(now.Add(-clusterNodeTTL).Unix(), 10))
+	pipe.HSet(ctx, nodeStatsKey(c.nodeID), map[string]interface{}{
+		"total_connections":  stats.TotalConnections,
+		"active_connections": stats.ActiveConnections,
+		"messages_relayed":   stats.MessagesRelayed,
+		"last_activity":      stats.LastActivity.Unix(),
+	})
+	pipe.Expire(ctx, nodeStatsKey(c.nodeID), clusterNodeTTL)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("[Cluster] Heartbeat failed for node %s: %v", c.nodeID, err)
+	}
+}
+
+func (c *Cluster) liveNodes(ctx context.Context) ([]string, error) {
+	return c.redis.ZRangeByScore(ctx, clusterNodesKey, liveNodesRange()).Result()
+}
+
+// liveNodesRange selects the nodes that sent a heartbeat within clusterNodeTTL
+func liveNodesRange() *redis.ZRangeBy {
+	min := strconv.FormatInt(time.Now().Add(-clusterNodeTTL).Unix(), 10)
+	return &redis.ZRangeBy{Min: min, Max: "+inf"}
+}
+
+// Stats adds up the stats last published by every live node
+func (c *Cluster) Stats(ctx context.Context) (HubStats, int, error) {
+	var total HubStats
+
+	nodes, err := c.liveNodes(ctx)
+	if err != nil {
+		return total, 0, err
+	}
+
+	for _, node := range nodes {
+		values, err := c.redis.HGetAll(ctx, nodeStatsKey(node)).Result()
+		if err != nil {
+			return total, 0, err
+		}
+
+		totalConnections, _ := strconv.ParseInt(values["total_connections"], 10, 64)
+		activeConnections, _ := strconv.Atoi(values["active_connections"])
+		messagesRelayed, _ := strconv.ParseInt(values["messages_relayed"], 10, 64)
+		lastActivity, _ := strconv.ParseInt(values["last_activity"], 10, 64)
+
+		total.TotalConnections += totalConnections
+		total.ActiveConnections += activeConnections
+		total.MessagesRelayed += messagesRelayed
+		if t := time.Unix(lastActivity, 0); lastActivity > 0 && t.After(total.LastActivity) {
+			total.LastActivity = t
+		}
+	}
+
+	return total, len(nodes), nil
+}
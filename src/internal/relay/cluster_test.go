@@ -0,0 +1,141 @@
+package relay
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedis(t *testing.T) *redis.Client {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	rc := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rc.Close() })
+	return rc
+}
+
+// beat records a node heartbeat at the given time
+func beat(t *testing.T, rc *redis.Client, nodeID string, at time.Time) {
+	t.Helper()
+	if err := rc.ZAdd(context.Background(), clusterNodesKey, redis.Z{Score: float64(at.Unix()), Member: nodeID}).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOwnersSkipsDeadNodes(t *testing.T) {
+	ctx := context.Background()
+	rc := newTestRedis(t)
+	live, dead := NewCluster(rc, "live"), NewCluster(rc, "dead")
+
+	beat(t, rc, "live", time.Now())
+	beat(t, rc, "dead", time.Now().Add(-2*clusterNodeTTL))
+	if err := live.Register(ctx, "alice", "phone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dead.Register(ctx, "alice", "laptop"); err != nil {
+		t.Fatal(err)
+	}
+
+	owners, err := live.Owners(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owners) != 1 || owners["phone"] != "live" {
+		t.Fatalf("owners = %v, want only phone on live", owners)
+	}
+
+	// The node comes back
+	beat(t, rc, "dead", time.Now())
+	owners, err = live.Owners(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owners) != 2 || owners["laptop"] != "dead" {
+		t.Fatalf("owners = %v, want phone and laptop", owners)
+	}
+}
+
+type pushCall struct {
+	userID, fromUserID string
+	deviceIDs          []string
+}
+
+// testPush records wake-ups; like push.Notifier it ignores empty ones
+type testPush chan pushCall
+
+func (p testPush) Notify(userID, fromUserID string, deviceIDs []string) {
+	if len(deviceIDs) > 0 {
+		p <- pushCall{userID, fromUserID, deviceIDs}
+	}
+}
+
+func TestPushReachesDevicesOfDeadNodes(t *testing.T) {
+	ctx := context.Background()
+	rc := newTestRedis(t)
+
+	push := make(testPush, 1)
+	hub := newTestHubWithRedis(rc)
+	hub.UsePushNotifier(push)
+	hub.JoinCluster(NewCluster(rc, "here"))
+	go hub.Run()
+
+	server := newTestServer(t, hub)
+	alice := server.dial(t, "alice", "a1")
+
+	// Bob's phone is connected to another node
+	beat(t, rc, "there", time.Now())
+	if err := NewCluster(rc, "there").Register(ctx, "bob", "b1"); err != nil {
+		t.Fatal(err)
+	}
+	sub := rc.Subscribe(ctx, nodeChannel("there"))
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func() {
+		alice.send(t, ClientMessage{
+			Type:      MessageTypeText,
+			To:        "bob",
+			Envelopes: []Envelope{{DeviceID: "b1", Payload: "ciphertext"}},
+		})
+		alice.expect(t, MessageTypeDelivery)
+	}
+
+	t.Run("live owner drains the queue", func(t *testing.T) {
+		send()
+		select {
+		case msg := <-sub.Channel():
+			if !strings.Contains(msg.Payload, `"kind":"pending"`) {
+				t.Fatalf("got %s, want a pending event", msg.Payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the owner node was not told to drain")
+		}
+		select {
+		case call := <-push:
+			t.Fatalf("pushed %v to a connected device", call)
+		default:
+		}
+	})
+
+	t.Run("dead owner falls back to push", func(t *testing.T) {
+		// The node stops sending heartbeats without releasing the device
+		beat(t, rc, "there", time.Now().Add(-2*clusterNodeTTL))
+
+		send()
+		select {
+		case call := <-push:
+			if call.userID != "bob" || call.fromUserID != "alice" || len(call.deviceIDs) != 1 || call.deviceIDs[0] != "b1" {
+				t.Fatalf("unexpected push %+v", call)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no push for a device whose node is gone")
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package relay
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+)
+
+// DeviceRegistry looks up the devices registered for a user, so envelopes
+// can be checked against the keys the sender should have encrypted for
+type DeviceRegistry struct {
+	db *sql.DB
+}
+
+// DeviceMismatch lists how a message's envelopes differ from the
+// recipient's registered devices
+type DeviceMismatch struct {
+	Missing []string `json:"missing,omitempty"` // Registered devices without an envelope
+	Extra   []string `json:"extra,omitempty"`   // Envelopes for unknown devices
+}
+
+func NewDeviceRegistry(db *sql.DB) *DeviceRegistry {
+	return &DeviceRegistry{db: db}
+}
+
+// GetDeviceIDs returns the device IDs registered for a user
+func (r *DeviceRegistry) GetDeviceIDs(ctx context.Context, userID string) ([]string, error) {
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT device_id FROM user_devices WHERE user_id = $1",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := make([]string, 0)
+	for rows.Next() {
+		var deviceID string
+		if err := rows.Scan(&deviceID); err != nil {
+			return nil, err
+		}
+		devices = append(devices, deviceID)
+	}
+
+	return devices, rows.Err()
+}
+
+// Verify compares a message's envelopes with the recipient's registered
+// devices. It returns nil when there is exactly one envelope per device.
+func (r *DeviceRegistry) Verify(ctx context.Context, userID string, envelopes []Envelope) (*DeviceMismatch, error) {
+	registered, err := r.GetDeviceIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return compareDevices(registered, envelopes), nil
+}
+
+func compareDevices(registered []string, envelopes []Envelope) *DeviceMismatch {
+	addressed := make(map[string]bool, len(envelopes))
+	for _, envelope := range envelopes {
+		addressed[envelope.DeviceID] = true
+	}
+
+	known := make(map[string]bool, len(registered))
+	mismatch := &DeviceMismatch{}
+	for _, deviceID := range registered {
+		known[deviceID] = true
+		if !addressed[deviceID] {
+			mismatch.Missing = append(mismatch.Missing, deviceID)
+		}
+	}
+
+	for deviceID := range addressed {
+		if !known[deviceID] {
+			mismatch.Extra = append(mismatch.Extra, deviceID)
+		}
+	}
+
+	if len(mismatch.Missing) == 0 && len(mismatch.Extra) == 0 {
+		return nil
+	}
+
+	sort.Strings(mismatch.Missing)
+	sort.Strings(mismatch.Extra)
+	return mismatch
+}
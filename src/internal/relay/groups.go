@@ -0,0 +1,136 @@
+package relay
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"chat-e2ee/internal/presence"
+)
+
+// GroupRegistry resolves who a group message goes to, see the groups package
+type GroupRegistry interface {
+	// Recipients returns the devices a message from senderID goes to, keyed
+	// by member, and whether the sender is a member of the group at all
+	Recipients(ctx context.Context, groupID, senderID string) (map[string][]string, bool, error)
+}
+
+// UseGroups makes the hub accept group messages, fanning them out to the
+// members registry returns. It must be called before Run.
+func (h *Hub) UseGroups(registry GroupRegistry) {
+	h.groups = registry
+}
+
+// NotifyGroup sends a server event about a group to every device of the
+// given users. Unlike NotifyUser it is queued for offline devices, so
+// membership changes reach everyone who has to rotate sender keys.
+func (h *Hub) NotifyGroup(groupID string, userIDs []string, event string, payload interface{}) {
+	h.queueEvent(groupID, userIDs, event, payload)
+}
+
+// queueEvent queues a server event for every device of the given users,
+// about a group if groupID is set
+func (h *Hub) queueEvent(groupID string, userIDs []string, event string, payload interface{}) {
+	if h.devices == nil {
+		return
+	}
+
+	ctx := context.Background()
+	recipients := make(map[string][]string, len(userIDs))
+	for _, userID := range userIDs {
+		if _, seen := recipients[userID]; seen {
+			continue
+		}
+
+		devices, err := h.devices.GetDeviceIDs(ctx, userID)
+		if err != nil {
+			log.Printf("Failed to load devices of %s for %s event: %v", userID, event, err)
+			continue
+		}
+		recipients[userID] = devices
+	}
+
+	h.relay <- &RelayMessage{
+		Type:       MessageType(event),
+		Payload:    mustMarshal(payload),
+		GroupID:    groupID,
+		Recipients: recipients,
+	}
+}
+
+// relayGroup queues a group message or a server event for every recipient
+// device and hands it to the ones that are online. Members whose queues are full miss
+// it; the rest still get it.
+func (h *Hub) relayGroup(msg *RelayMessage) {
+	msg.ID = generateMessageID()
+	ctx := context.Background()
+
+	if h.presence != nil {
+		users := make([]string, 0, len(msg.Recipients))
+		for userID := range msg.Recipients {
+			users = append(users, userID)
+		}
+		if err := h.presence.StoreGroupMessageMetadata(ctx, msg.ID, msg.From, msg.GroupID, users); err != nil {
+			log.Printf("Failed to store message metadata: %v", err)
+		}
+	}
+
+	delivered := false
+	for userID, deviceIDs := range msg.Recipients {
+		if len(deviceIDs) == 0 {
+			continue
+		}
+
+		copies := make(map[string]*RelayMessage, len(deviceIDs))
+		queue := make(map[string]interface{}, len(deviceIDs))
+		for _, deviceID := range deviceIDs {
+			copies[deviceID] = groupMessage(msg, userID, deviceID)
+			queue[deviceID] = copies[deviceID]
+		}
+
+		var entries map[string]string
+		if h.presence != nil {
+			var err error
+			entries, err = h.presence.StorePendingMessages(ctx, userID, msg.ID, queue)
+			switch {
+			case err == presence.ErrQueueFull:
+				log.Printf("Pending queue full, group message %s skipped for %s", msg.ID, userID)
+				continue
+			case err != nil:
+				// Still try live delivery, the message just won't survive a disconnect
+				log.Printf("Failed to queue message %s for %s: %v", msg.ID, userID, err)
+			}
+		}
+
+		sent, remote := h.deliverCopies(userID, copies, entries)
+		delivered = delivered || sent
+
+		// Membership events don't warrant waking anyone up
+		h.wakeDevices(userID, msg.From, remote, entries, msg.Type == MessageTypeGroupMessage)
+	}
+
+	if delivered {
+		h.updateStats(func(s *HubStats) {
+			s.MessagesRelayed++
+			s.LastActivity = time.Now()
+		})
+	}
+
+	if msg.From != "" {
+		confirmAccepted(h.localClient(msg.From, msg.DeviceID), msg)
+	}
+}
+
+// groupMessage is the copy of a group frame addressed to one device
+func groupMessage(msg *RelayMessage, userID, deviceID string) *RelayMessage {
+	return &RelayMessage{
+		ID:       msg.ID,
+		From:     msg.From,
+		To:       userID,
+		DeviceID: msg.DeviceID,
+		Type:     msg.Type,
+		Payload:  msg.Payload,
+		GroupID:  msg.GroupID,
+		ToDevice: deviceID,
+	}
+}
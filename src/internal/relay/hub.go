@@ -2,6 +2,7 @@ package relay
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"log"
 	"sync"
@@ -11,22 +12,67 @@ import (
 )
 
 type RelayMessage struct {
+	ID       string      `json:"id,omitempty"`
 	From     string      `json:"from"`
 	To       string      `json:"to"`
 	DeviceID string      `json:"device_id"`
 	Type     MessageType `json:"type"`
 	Payload  string      `json:"payload"`
+
+	// Chat messages carry one envelope per recipient device. Once split, each
+	// device's copy has its Payload and ToDevice set instead.
+	Envelopes []Envelope `json:"envelopes,omitempty"`
+	ToDevice  string     `json:"to_device,omitempty"`
+
+	// Group frames carry one payload for the devices of every recipient,
+	// keyed by user; each device's copy has To and ToDevice set instead
+	GroupID    string              `json:"group_id,omitempty"`
+	Recipients map[string][]string `json:"recipients,omitempty"`
+
+	// Set on the first message from a non-contact, which opened a message
+	// request the recipient has to accept
+	RequestID string `json:"request_id,omitempty"`
 }
 
+// pendingBatchSize is how many queued messages are read from Redis at a time
+const pendingBatchSize = 64
+
 type Hub struct {
-	clients    map[string]map[string]*Client
-	clientsMu  sync.RWMutex
+	// clientsMu guards the map only; it is never held across Redis calls
+	clients   map[string]map[string]*Client
+	clientsMu sync.RWMutex
 
 	relay      chan *RelayMessage
 	register   chan *Client
 	unregister chan *Client
+	pending    chan *Client
+	remote     chan *clusterEvent
 
 	presence *presence.Tracker
+	devices  *DeviceRegistry
+	cluster  *Cluster
+
+	// Per-connection frame throttling, see LimitFrames
+	frameRate  float64
+	frameBurst int
+
+	// Wakes up devices that are offline when a message is queued for them
+	push PushNotifier
+
+	// Resolves the members of a group, see UseGroups
+	groups GroupRegistry
+
+	// Drops frames between users who blocked each other, see UseBlocks
+	blocks      BlockChecker
+	blockPolicy string
+
+	// Holds messages from non-contacts, see UseMessageRequests
+	requests MessageRequests
+
+	// Presence changes waiting to be saved and published, see UsePresence
+	presenceChanges chan *presence.Change
+	presenceDB      *sql.DB
+	audience        PresenceAudience
 
 	stats   *HubStats
 	statsMu sync.RWMutex
@@ -39,21 +85,56 @@ type HubStats struct {
 	LastActivity      time.Time
 }
 
-func NewHub(presenceTracker *presence.Tracker) *Hub {
+func NewHub(presenceTracker *presence.Tracker, deviceRegistry *DeviceRegistry) *Hub {
 	return &Hub{
 		clients:    make(map[string]map[string]*Client),
 		relay:      make(chan *RelayMessage, 1000),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		pending:    make(chan *Client, channelBufferSize),
+		remote:     make(chan *clusterEvent, channelBufferSize),
 		presence:   presenceTracker,
+		devices:    deviceRegistry,
 		stats:      &HubStats{},
+
+		presenceChanges: make(chan *presence.Change, channelBufferSize),
 	}
 }
 
+// JoinCluster makes the hub share its devices with the other nodes of the
+// cluster. It must be called before Run.
+func (h *Hub) JoinCluster(cluster *Cluster) {
+	h.cluster = cluster
+	go cluster.Run(h, h.remote)
+}
+
+// LimitFrames throttles every connection to rate frames per second, with
+// bursts of up to burst frames. A rate of 0 disables throttling. It must be
+// called before clients connect.
+func (h *Hub) LimitFrames(rate float64, burst int) {
+	h.frameRate = rate
+	h.frameBurst = burst
+}
+
+// PushNotifier wakes up offline devices, see the push package. Notify is
+// called from the hub goroutine, so it must not block.
+type PushNotifier interface {
+	Notify(userID, fromUserID string, deviceIDs []string)
+}
+
+// UsePushNotifier makes the hub wake up recipient devices that are
+// connected nowhere when a chat message is queued for them. It must be
+// called before Run.
+func (h *Hub) UsePushNotifier(notifier PushNotifier) {
+	h.push = notifier
+}
+
 func (h *Hub) Run() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
+	go h.runPresence()
+
 	for {
 		select {
 		case client := <-h.register:
@@ -65,6 +146,12 @@ func (h *Hub) Run() {
 		case message := <-h.relay:
 			h.relayMessage(message)
 
+		case client := <-h.pending:
+			h.resumePendingDelivery(client)
+
+		case event := <-h.remote:
+			h.handleClusterEvent(event)
+
 		case <-ticker.C:
 			h.cleanup()
 		}
@@ -73,12 +160,15 @@ func (h *Hub) Run() {
 
 func (h *Hub) registerClient(client *Client) {
 	h.clientsMu.Lock()
-	defer h.clientsMu.Unlock()
-
 	if _, exists := h.clients[client.UserID]; !exists {
 		h.clients[client.UserID] = make(map[string]*Client)
 	}
 
+	// A reconnecting device replaces its previous connection
+	if previous, exists := h.clients[client.UserID][client.DeviceID]; exists && previous != client {
+		previous.Close()
+	}
+
 	h.clients[client.UserID][client.DeviceID] = client
 
 	h.updateStats(func(s *HubStats) {
@@ -86,10 +176,15 @@ func (h *Hub) registerClient(client *Client) {
 		s.ActiveConnections = h.countActiveConnections()
 		s.LastActivity = time.Now()
 	})
+	h.clientsMu.Unlock()
 
-	if h.presence != nil {
-		ctx := context.Background()
-		h.presence.SetUserOnline(ctx, client.UserID, client.DeviceID)
+	h.heartbeat(client)
+
+	ctx := context.Background()
+	if h.cluster != nil {
+		if err := h.cluster.Register(ctx, client.UserID, client.DeviceID); err != nil {
+			log.Printf("Failed to register device in cluster: UserID=%s DeviceID=%s: %v", client.UserID, client.DeviceID, err)
+		}
 	}
 
 	log.Printf("Client registered: UserID=%s, DeviceID=%s", client.UserID, client.DeviceID)
@@ -98,13 +193,15 @@ func (h *Hub) registerClient(client *Client) {
 }
 
 func (h *Hub) unregisterClient(client *Client) {
-	h.clientsMu.Lock()
-	defer h.clientsMu.Unlock()
+	// Always release the client's send channel, even if it was already
+	// replaced or swept by cleanup
+	defer client.Close()
 
+	h.clientsMu.Lock()
+	removed := false
 	if devices, exists := h.clients[client.UserID]; exists {
-		if _, exists := devices[client.DeviceID]; exists {
+		if current, exists := devices[client.DeviceID]; exists && current == client {
 			delete(devices, client.DeviceID)
-			client.Close()
 
 			if len(devices) == 0 {
 				delete(h.clients, client.UserID)
@@ -113,101 +210,572 @@ func (h *Hub) unregisterClient(client *Client) {
 			h.updateStats(func(s *HubStats) {
 				s.ActiveConnections = h.countActiveConnections()
 			})
+			removed = true
+		}
+	}
+	h.clientsMu.Unlock()
 
-			if h.presence != nil {
-				ctx := context.Background()
-				if len(devices) == 0 {
-					h.presence.SetUserOffline(ctx, client.UserID)
-				}
-			}
+	if !removed {
+		return
+	}
+
+	h.releaseDevice(client)
+	log.Printf("Client unregistered: UserID=%s, DeviceID=%s", client.UserID, client.DeviceID)
+}
 
-			log.Printf("Client unregistered: UserID=%s, DeviceID=%s", client.UserID, client.DeviceID)
+// releaseDevice removes a device that left this node from the cluster and
+// from presence. It must be called without clientsMu held.
+func (h *Hub) releaseDevice(client *Client) {
+	ctx := context.Background()
+	if h.cluster != nil {
+		if err := h.cluster.Unregister(ctx, client.UserID, client.DeviceID); err != nil {
+			log.Printf("Failed to unregister device from cluster: UserID=%s DeviceID=%s: %v", client.UserID, client.DeviceID, err)
 		}
 	}
+
+	// The user goes offline with their last device on any node
+	if h.presence != nil {
+		change, err := h.presence.DropDevice(ctx, client.UserID, client.DeviceID)
+		if err != nil {
+			log.Printf("Failed to drop device presence: UserID=%s DeviceID=%s: %v", client.UserID, client.DeviceID, err)
+		}
+		h.queuePresence(change)
+	}
 }
 
+// relayMessage routes a frame from a client, another node or the server.
+// It reads the local clients through snapshots, so clientsMu is not held
+// while it talks to Redis.
 func (h *Hub) relayMessage(msg *RelayMessage) {
+	if msg.Type == MessageTypeText {
+		h.relayEnvelopes(msg)
+		return
+	}
+	// Group messages and queued events name every recipient device
+	if msg.Recipients != nil {
+		h.relayGroup(msg)
+		return
+	}
+
+	if h.sendToLocalDevices(msg) {
+		h.updateStats(func(s *HubStats) {
+			s.MessagesRelayed++
+			s.LastActivity = time.Now()
+		})
+	}
+
+	if h.cluster != nil {
+		h.forwardToNodes(msg)
+	}
+}
+
+// localDevices returns a snapshot of the devices of a user connected to
+// this node, keyed by device ID
+func (h *Hub) localDevices(userID string) map[string]*Client {
+	h.clientsMu.RLock()
+	defer h.clientsMu.RUnlock()
+
+	devices := make(map[string]*Client, len(h.clients[userID]))
+	for deviceID, client := range h.clients[userID] {
+		devices[deviceID] = client
+	}
+	return devices
+}
+
+// localClient returns the connection of a device on this node, or nil
+func (h *Hub) localClient(userID, deviceID string) *Client {
 	h.clientsMu.RLock()
 	defer h.clientsMu.RUnlock()
+	return h.clients[userID][deviceID]
+}
+
+// sendToLocalDevices sends a frame to every device of msg.To connected to
+// this node, or only to msg.ToDevice if set
+func (h *Hub) sendToLocalDevices(msg *RelayMessage) bool {
+	devices := h.localDevices(msg.To)
+	if len(devices) == 0 {
+		return false
+	}
+
+	serverMsg := NewRelayedMessage(msg)
+	data, err := json.Marshal(serverMsg)
+	if err != nil {
+		log.Printf("Failed to marshal message: %v", err)
+		return false
+	}
+
+	// Other users' presence only goes to the connections that subscribed
+	watched := msg.Type == MessageTypeStatus && msg.From != "" && msg.From != msg.To
+
+	delivered := false
+	for deviceID, client := range devices {
+		if msg.ToDevice != "" && deviceID != msg.ToDevice {
+			continue
+		}
+		if watched && !client.watches(msg.From) {
+			continue
+		}
+		if client.Send(data) {
+			delivered = true
+		} else {
+			log.Printf("Client buffer full: UserID=%s DeviceID=%s", msg.To, deviceID)
+		}
+	}
+	return delivered
+}
+
+// forwardToNodes hands a frame to the other nodes holding devices of msg.To,
+// once per node
+func (h *Hub) forwardToNodes(msg *RelayMessage) {
+	local := h.localDevices(msg.To)
+
+	ctx := context.Background()
+	owners, err := h.cluster.Owners(ctx, msg.To)
+	if err != nil {
+		log.Printf("Failed to load device owners for %s: %v", msg.To, err)
+		return
+	}
+
+	forwarded := make(map[string]bool)
+	for deviceID, node := range owners {
+		if node == h.cluster.NodeID() || forwarded[node] {
+			continue
+		}
+		if msg.ToDevice != "" && deviceID != msg.ToDevice {
+			continue
+		}
+		if _, ok := local[deviceID]; ok {
+			continue
+		}
+
+		forwarded[node] = true
+		if err := h.cluster.Forward(ctx, node, msg); err != nil {
+			log.Printf("Failed to forward message to node %s: %v", node, err)
+		}
+	}
+}
+
+// relayEnvelopes queues a chat message and hands each online recipient
+// device its own envelope
+func (h *Hub) relayEnvelopes(msg *RelayMessage) {
+	entries, ok := h.acceptMessage(msg)
+	if !ok {
+		return
+	}
 
-	if devices, exists := h.clients[msg.To]; exists {
-		serverMsg := NewServerMessage(msg.Type, msg.From, msg.Payload)
-		data, err := json.Marshal(serverMsg)
+	copies := make(map[string]*RelayMessage, len(msg.Envelopes))
+	for _, envelope := range msg.Envelopes {
+		copies[envelope.DeviceID] = envelopeMessage(msg, envelope)
+	}
+
+	delivered, remote := h.deliverCopies(msg.To, copies, entries)
+	if delivered {
+		h.updateStats(func(s *HubStats) {
+			s.MessagesRelayed++
+			s.LastActivity = time.Now()
+		})
+	}
+
+	h.wakeDevices(msg.To, msg.From, remote, entries, true)
+}
+
+// deliverCopies hands each device of a user that is connected to this node
+// its copy of a message, and returns whether any got it and which devices
+// are not connected here. entries are the queue entries of the copies.
+func (h *Hub) deliverCopies(userID string, copies map[string]*RelayMessage, entries map[string]string) (bool, []string) {
+	devices := h.localDevices(userID)
+	delivered := false
+	remote := make([]string, 0)
+	for deviceID, deviceMsg := range copies {
+		client, online := devices[deviceID]
+		if !online {
+			remote = append(remote, deviceID)
+			continue
+		}
+
+		// Keep queue order: a device with a backlog gets this message when it drains
+		entryID, queued := entries[deviceID]
+		if queued && client.hasBacklog() {
+			continue
+		}
+
+		data, err := json.Marshal(NewRelayedMessage(deviceMsg))
 		if err != nil {
 			log.Printf("Failed to marshal message: %v", err)
-			return
+			continue
 		}
 
-		delivered := false
-		for deviceID, client := range devices {
-			select {
-			case client.send <- data:
-				delivered = true
-				log.Printf("Message relayed: From=%s To=%s Device=%s", msg.From, msg.To, deviceID)
-			default:
-				log.Printf("Client buffer full: UserID=%s DeviceID=%s", msg.To, deviceID)
+		if client.Send(data) {
+			delivered = true
+			if queued {
+				client.pendingCursor = entryID
+			}
+			log.Printf("Message relayed: From=%s To=%s Device=%s", deviceMsg.From, userID, deviceID)
+		} else {
+			if queued {
+				client.setBacklog(true)
+			}
+			log.Printf("Client buffer full: UserID=%s DeviceID=%s", userID, deviceID)
+		}
+	}
+	return delivered, remote
+}
+
+// wakeDevices gets a queued message to the devices of a user that are not
+// connected to this node: devices on other nodes pick it up from their
+// queue, and with push set the ones connected nowhere get a push
+// notification to come fetch it.
+func (h *Hub) wakeDevices(userID, fromUserID string, remote []string, entries map[string]string, push bool) {
+	if len(remote) == 0 || len(entries) == 0 {
+		return
+	}
+
+	offline := remote
+	if h.cluster != nil {
+		offline = h.notifyRemoteDevices(userID, remote)
+	}
+	if h.push != nil && push {
+		queued := make([]string, 0, len(offline))
+		for _, deviceID := range offline {
+			if _, ok := entries[deviceID]; ok {
+				queued = append(queued, deviceID)
 			}
 		}
+		h.push.Notify(userID, fromUserID, queued)
+	}
+}
 
-		if delivered {
+// notifyRemoteDevices tells the nodes holding the given devices to drain
+// their offline queues, and returns the devices not connected to any live
+// node. Devices left behind by a crashed node count as offline, so they
+// still get a push.
+func (h *Hub) notifyRemoteDevices(userID string, deviceIDs []string) []string {
+	ctx := context.Background()
+	owners, err := h.cluster.Owners(ctx, userID)
+	if err != nil {
+		// Better a needless wake-up than a missed one
+		log.Printf("Failed to load device owners for %s: %v", userID, err)
+		return deviceIDs
+	}
+
+	offline := make([]string, 0)
+	for _, deviceID := range deviceIDs {
+		node, connected := owners[deviceID]
+		if !connected {
+			offline = append(offline, deviceID)
+			continue
+		}
+		if node == h.cluster.NodeID() {
+			continue
+		}
+
+		if err := h.cluster.NotifyPending(ctx, node, userID, deviceID); err != nil {
+			log.Printf("Failed to notify node %s: %v", node, err)
+		}
+	}
+	return offline
+}
+
+// handleClusterEvent applies an event published by another node
+func (h *Hub) handleClusterEvent(event *clusterEvent) {
+	switch event.Kind {
+	case clusterEventRelay:
+		if event.Message == nil {
+			return
+		}
+
+		if h.sendToLocalDevices(event.Message) {
 			h.updateStats(func(s *HubStats) {
 				s.MessagesRelayed++
 				s.LastActivity = time.Now()
 			})
 		}
-	} else {
-		if msg.Type == MessageTypeText && h.presence != nil {
-			ctx := context.Background()
-			h.presence.StorePendingMessage(ctx, msg.To, msg)
+
+	case clusterEventPending:
+		if client := h.localClient(event.UserID, event.DeviceID); client != nil {
+			h.deliverPendingMessages(client)
+		}
+
+	case clusterEventTakeover:
+		// The device reconnected on another node; the new owner is already
+		// recorded, so only the local connection goes away
+		h.clientsMu.Lock()
+		client, exists := h.clients[event.UserID][event.DeviceID]
+		if exists {
+			delete(h.clients[event.UserID], event.DeviceID)
+			if len(h.clients[event.UserID]) == 0 {
+				delete(h.clients, event.UserID)
+			}
+
+			h.updateStats(func(s *HubStats) {
+				s.ActiveConnections = h.countActiveConnections()
+			})
+		}
+		h.clientsMu.Unlock()
+
+		if exists {
+			log.Printf("Device moved to another node: UserID=%s DeviceID=%s", event.UserID, event.DeviceID)
+			client.Close()
 		}
-		log.Printf("User offline, message stored: To=%s", msg.To)
+
+	case clusterEventDisconnect:
+		h.disconnectLocal(event.UserID, event.DeviceID, event.SessionID)
+
+	default:
+		log.Printf("Unknown cluster event: %s", event.Kind)
 	}
 }
 
+// acceptMessage assigns the message its stable ID, records its metadata,
+// queues each envelope for its device and tells the sending device which ID
+// it got. It returns the queue entry per device, and false if the message
+// was rejected.
+func (h *Hub) acceptMessage(msg *RelayMessage) (map[string]string, bool) {
+	msg.ID = generateMessageID()
+	sender := h.localClient(msg.From, msg.DeviceID)
+
+	var entries map[string]string
+	if h.presence != nil {
+		ctx := context.Background()
+		if err := h.presence.StoreMessageMetadata(ctx, msg.ID, msg.From, msg.To); err != nil {
+			log.Printf("Failed to store message metadata: %v", err)
+		}
+
+		copies := make(map[string]interface{}, len(msg.Envelopes))
+		for _, envelope := range msg.Envelopes {
+			copies[envelope.DeviceID] = envelopeMessage(msg, envelope)
+		}
+
+		var err error
+		entries, err = h.presence.StorePendingMessages(ctx, msg.To, msg.ID, copies)
+		switch {
+		case err == presence.ErrQueueFull:
+			log.Printf("Pending queue full, message rejected: From=%s To=%s", msg.From, msg.To)
+			if sender != nil {
+				sender.Send(mustMarshalError(ErrorMessage{
+					Code:    "RECIPIENT_QUEUE_FULL",
+					Message: "Recipient has too many undelivered messages",
+				}, msg.ID))
+			}
+			return nil, false
+		case err != nil:
+			// Still try live delivery, the message just won't survive a disconnect
+			log.Printf("Failed to queue message %s: %v", msg.ID, err)
+		case len(entries) < len(msg.Envelopes):
+			log.Printf("Pending queue full for some devices of %s, message %s skipped there", msg.To, msg.ID)
+		}
+	}
+
+	confirmAccepted(sender, msg)
+	return entries, true
+}
+
+// confirmAccepted tells the sending device, if connected here, which ID
+// its message got
+func confirmAccepted(sender *Client, msg *RelayMessage) {
+	if sender == nil {
+		return
+	}
+
+	delivery := NewServerMessage(MessageTypeDelivery, "", msg.ID)
+	delivery.MessageID = msg.ID
+	delivery.GroupID = msg.GroupID
+	delivery.RequestID = msg.RequestID
+	if data, err := json.Marshal(delivery); err == nil {
+		sender.Send(data)
+	}
+}
+
+// envelopeMessage is the copy of a chat message addressed to one device
+func envelopeMessage(msg *RelayMessage, envelope Envelope) *RelayMessage {
+	return &RelayMessage{
+		ID:       msg.ID,
+		From:     msg.From,
+		To:       msg.To,
+		DeviceID: msg.DeviceID,
+		Type:     msg.Type,
+		Payload:  envelope.Payload,
+		ToDevice: envelope.DeviceID,
+
+		RequestID: msg.RequestID,
+	}
+}
+
+// deliverPendingMessages sends the client every queued message after its
+// cursor, in order, until the queue is exhausted or its buffer fills up.
+// Messages stay queued until acked, so a fresh connection (empty cursor)
+// gets everything that was never acknowledged.
 func (h *Hub) deliverPendingMessages(client *Client) {
 	if h.presence == nil {
 		return
 	}
 
 	ctx := context.Background()
-	messages, _ := h.presence.GetPendingMessages(ctx, client.UserID)
+	client.setBacklog(false)
 
-	for _, msgData := range messages {
-		var msg RelayMessage
-		if err := json.Unmarshal([]byte(msgData), &msg); err != nil {
-			continue
+	for {
+		messages, err := h.presence.GetPendingMessages(ctx, client.UserID, client.DeviceID, client.pendingCursor, pendingBatchSize)
+		if err != nil {
+			log.Printf("Failed to load pending messages for %s: %v", client.UserID, err)
+			return
 		}
 
-		serverMsg := NewServerMessage(msg.Type, msg.From, msg.Payload)
-		if data, err := json.Marshal(serverMsg); err == nil {
-			select {
-			case client.send <- data:
-				log.Printf("Delivered pending message to %s", client.UserID)
-			default:
+		for _, pending := range messages {
+			var msg RelayMessage
+			if err := json.Unmarshal([]byte(pending.Data), &msg); err != nil {
+				client.pendingCursor = pending.EntryID
+				continue
+			}
+
+			data, err := json.Marshal(NewRelayedMessage(&msg))
+			if err != nil {
+				client.pendingCursor = pending.EntryID
+				continue
 			}
+
+			if !client.Send(data) {
+				client.setBacklog(true)
+				return
+			}
+			client.pendingCursor = pending.EntryID
+		}
+
+		if len(messages) < pendingBatchSize {
+			return
 		}
 	}
+}
 
-	h.presence.ClearPendingMessages(ctx, client.UserID)
+// RequestPendingDelivery asks the hub to resume draining a client's queue,
+// for example after it acked messages and freed up its buffer
+func (h *Hub) RequestPendingDelivery(client *Client) {
+	select {
+	case h.pending <- client:
+	default:
+	}
 }
 
+func (h *Hub) resumePendingDelivery(client *Client) {
+	// The client may have disconnected since the request was queued
+	if h.localClient(client.UserID, client.DeviceID) != client {
+		return
+	}
+
+	h.deliverPendingMessages(client)
+}
+
+// cleanup drops inactive clients and retries queues that stalled on a full
+// buffer. Only the map changes under clientsMu; the Redis work runs on what
+// was collected.
 func (h *Hub) cleanup() {
-	h.clientsMu.Lock()
-	defer h.clientsMu.Unlock()
+	var inactive, backlogged []*Client
 
+	h.clientsMu.Lock()
 	now := time.Now()
 	for userID, devices := range h.clients {
 		for deviceID, client := range devices {
 			if now.Sub(client.GetLastActive()) > 5*time.Minute {
-				log.Printf("Removing inactive client: UserID=%s DeviceID=%s", userID, deviceID)
 				delete(devices, deviceID)
-				client.Close()
+				inactive = append(inactive, client)
+				continue
+			}
+			if client.hasBacklog() {
+				backlogged = append(backlogged, client)
 			}
 		}
 		if len(devices) == 0 {
 			delete(h.clients, userID)
 		}
 	}
+	if len(inactive) > 0 {
+		h.updateStats(func(s *HubStats) {
+			s.ActiveConnections = h.countActiveConnections()
+		})
+	}
+	h.clientsMu.Unlock()
+
+	// Their readPumps find them already removed when they exit, so they
+	// are released here
+	for _, client := range inactive {
+		log.Printf("Removing inactive client: UserID=%s DeviceID=%s", client.UserID, client.DeviceID)
+		client.Close()
+		h.releaseDevice(client)
+	}
+
+	for _, client := range backlogged {
+		h.deliverPendingMessages(client)
+	}
+}
+
+// NotifyUser sends a server event to every connected device of a user
+func (h *Hub) NotifyUser(userID, event string, payload interface{}) {
+	h.NotifyDevice(userID, "", event, payload)
+}
+
+// NotifyUsers sends a server event to every device of the given users. Unlike
+// NotifyUser it is queued, so offline devices get it when they reconnect.
+func (h *Hub) NotifyUsers(userIDs []string, event string, payload interface{}) {
+	h.queueEvent("", userIDs, event, payload)
+}
+
+// NotifyDevice sends a server event to one device of a user, wherever in the
+// cluster it is connected. Offline devices do not get it.
+func (h *Hub) NotifyDevice(userID, deviceID, event string, payload interface{}) {
+	h.relay <- &RelayMessage{
+		To:       userID,
+		ToDevice: deviceID,
+		Type:     MessageType(event),
+		Payload:  mustMarshal(payload),
+	}
+}
+
+// Disconnect closes the live connections of a revoked session on every node.
+// An empty deviceID matches all of the user's devices and an empty sessionID
+// all sessions of the matched devices. The connections unregister as usual
+// once their close frame is sent.
+func (h *Hub) Disconnect(userID, deviceID, sessionID string) {
+	h.disconnectLocal(userID, deviceID, sessionID)
+
+	if h.cluster == nil {
+		return
+	}
+
+	ctx := context.Background()
+	owners, err := h.cluster.Owners(ctx, userID)
+	if err != nil {
+		log.Printf("Failed to look up device owners for %s: %v", userID, err)
+		return
+	}
+
+	notified := make(map[string]bool)
+	for device, node := range owners {
+		if node == h.cluster.NodeID() || notified[node] {
+			continue
+		}
+		if deviceID != "" && device != deviceID {
+			continue
+		}
+		notified[node] = true
+		if err := h.cluster.Disconnect(ctx, node, userID, deviceID, sessionID); err != nil {
+			log.Printf("Failed to notify node %s: %v", node, err)
+		}
+	}
+}
+
+func (h *Hub) disconnectLocal(userID, deviceID, sessionID string) {
+	h.clientsMu.RLock()
+	defer h.clientsMu.RUnlock()
+
+	for device, client := range h.clients[userID] {
+		if deviceID != "" && device != deviceID {
+			continue
+		}
+		if sessionID != "" && client.SessionID != sessionID {
+			continue
+		}
+		log.Printf("Disconnecting revoked client: UserID=%s DeviceID=%s", userID, device)
+		client.Revoke("session revoked")
+	}
 }
 
 func (h *Hub) GetStats() HubStats {
@@ -235,10 +803,7 @@ func (h *Hub) BroadcastToUser(userID string, message []byte) {
 
 	if devices, exists := h.clients[userID]; exists {
 		for _, client := range devices {
-			select {
-			case client.send <- message:
-			default:
-			}
+			client.Send(message)
 		}
 	}
 }
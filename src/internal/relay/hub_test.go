@@ -0,0 +1,50 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"chat-e2ee/internal/presence"
+)
+
+func TestCleanupDropsPresenceOfInactiveDevices(t *testing.T) {
+	hub := newTestHub(t)
+	hub.UsePresence(nil, testAudience{"alice", "bob"})
+	go hub.Run()
+
+	server := newTestServer(t, hub)
+	server.dial(t, "alice", "a1")
+	bob := server.dial(t, "bob", "b1")
+
+	bob.send(t, ClientMessage{Type: MessageTypePresenceSubscribe, Users: []string{"alice"}})
+	bob.expect(t, MessageTypeStatus)
+
+	// Alice's connection went silent without closing
+	clients := hub.GetUserClients("alice")
+	if len(clients) != 1 {
+		t.Fatalf("alice has %d clients, want 1", len(clients))
+	}
+	clients[0].mu.Lock()
+	clients[0].lastActive = time.Now().Add(-10 * time.Minute)
+	clients[0].mu.Unlock()
+
+	hub.cleanup()
+
+	var update PresenceUpdate
+	if err := json.Unmarshal([]byte(bob.expect(t, MessageTypeStatus).Payload), &update); err != nil {
+		t.Fatal(err)
+	}
+	if update.UserID != "alice" || update.Status != presence.StatusOffline {
+		t.Fatalf("unexpected presence update: %+v", update)
+	}
+
+	status, _, err := hub.presence.Status(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != presence.StatusOffline {
+		t.Fatalf("alice is %s, want offline", status)
+	}
+}
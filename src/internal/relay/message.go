@@ -3,7 +3,8 @@ package relay
 import (
 	"encoding/json"
 	"time"
-	"math/rand"
+
+	"github.com/google/uuid"
 )
 
 // MessageType defines the type of WebSocket message
@@ -15,11 +16,27 @@ const (
 	MessageTypeTyping   MessageType = "typing"
 	MessageTypeRead     MessageType = "read"
 	MessageTypePresence MessageType = "presence"
+	MessageTypeAck      MessageType = "ack"
+
+	// Follow or stop following the presence of contacts
+	MessageTypePresenceSubscribe   MessageType = "presence_subscribe"
+	MessageTypePresenceUnsubscribe MessageType = "presence_unsubscribe"
+
+	// Both ways: a sender-key message for every member of a group
+	MessageTypeGroupMessage MessageType = "group_message"
 
 	// Server to Client
-	MessageTypeDelivery MessageType = "delivery"
-	MessageTypeError    MessageType = "error"
-	MessageTypeStatus   MessageType = "status"
+	MessageTypeDelivery   MessageType = "delivery"
+	MessageTypeDelivered  MessageType = "delivered"
+	MessageTypeError      MessageType = "error"
+	MessageTypeStatus     MessageType = "status"
+	MessageTypeConnected  MessageType = "connected"
+	MessageTypePrekeysLow MessageType = "prekeys_low"
+	MessageTypeKeyChanged MessageType = "key_changed"
+	MessageTypeGroupEvent MessageType = "group_event"
+
+	// The sender's message request was accepted
+	MessageTypeRequestAccepted MessageType = "request_accepted"
 
 	// System
 	MessageTypeHeartbeat MessageType = "heartbeat"
@@ -35,8 +52,8 @@ type Message struct {
 	Timestamp time.Time   `json:"timestamp"`
 
 	// Routing information
-	From     string `json:"from,omitempty"`     // UserID of sender
-	To       string `json:"to,omitempty"`       // UserID of recipient
+	From     string `json:"from,omitempty"`      // UserID of sender
+	To       string `json:"to,omitempty"`        // UserID of recipient
 	DeviceID string `json:"device_id,omitempty"` // Device that sent the message
 
 	// E2EE payload - server never decrypts this
@@ -51,6 +68,22 @@ type ClientMessage struct {
 	Type    MessageType `json:"type"`
 	To      string      `json:"to"`      // Target user ID
 	Payload string      `json:"payload"` // Encrypted content
+
+	// Target group for group messages, whose payload is encrypted once with
+	// the sender key instead of per device
+	GroupID string `json:"group_id,omitempty"`
+
+	// One ciphertext per recipient device, required for chat messages
+	Envelopes []Envelope `json:"envelopes,omitempty"`
+
+	// Users for presence subscriptions; none means every contact
+	Users []string `json:"users,omitempty"`
+}
+
+// Envelope carries a message encrypted for a single recipient device
+type Envelope struct {
+	DeviceID string `json:"device_id"`
+	Payload  string `json:"payload"`
 }
 
 // ServerMessage is what server sends to clients
@@ -60,6 +93,9 @@ type ServerMessage struct {
 	Payload   string      `json:"payload,omitempty"`
 	Timestamp time.Time   `json:"timestamp"`
 	MessageID string      `json:"message_id,omitempty"`
+	DeviceID  string      `json:"device_id,omitempty"` // Sending device, to pick the E2EE session
+	GroupID   string      `json:"group_id,omitempty"`
+	RequestID string      `json:"request_id,omitempty"` // Message that opened a message request
 }
 
 // TypingIndicator for typing status
@@ -68,23 +104,33 @@ type TypingIndicator struct {
 	IsTyping bool   `json:"is_typing"`
 }
 
+// DeliveryReceipt confirms that a recipient device received a message
+type DeliveryReceipt struct {
+	MessageID   string    `json:"message_id"`
+	DeliveredAt time.Time `json:"delivered_at"`
+}
+
 // ReadReceipt for read confirmations
 type ReadReceipt struct {
 	MessageID string    `json:"message_id"`
 	ReadAt    time.Time `json:"read_at"`
 }
 
-// PresenceUpdate for online/offline status
+// PresenceUpdate for online/offline status. LastSeen is left out for
+// users who hide it.
 type PresenceUpdate struct {
-	UserID   string    `json:"user_id"`
-	Status   string    `json:"status"` // "online", "offline", "away"
-	LastSeen time.Time `json:"last_seen"`
+	UserID   string     `json:"user_id"`
+	Status   string     `json:"status"` // "online", "away", "dnd", "offline"
+	LastSeen *time.Time `json:"last_seen,omitempty"`
 }
 
 // ErrorMessage for error responses
 type ErrorMessage struct {
 	Code    string `json:"code"`
 	Message string `json:"message"`
+
+	// Set for DEVICE_MISMATCH errors
+	Devices *DeviceMismatch `json:"devices,omitempty"`
 }
 
 // ParseMessage parses raw WebSocket message
@@ -96,49 +142,62 @@ func ParseMessage(data []byte) (*ClientMessage, error) {
 	return &msg, nil
 }
 
-// NewServerMessage creates a server message
+// NewServerMessage creates a server message. Frames that refer to a chat
+// message carry the ID assigned by the hub, see NewRelayedMessage.
 func NewServerMessage(msgType MessageType, from string, payload string) *ServerMessage {
 	return &ServerMessage{
 		Type:      msgType,
 		From:      from,
 		Payload:   payload,
 		Timestamp: time.Now().UTC(),
-		MessageID: generateMessageID(),
 	}
 }
 
+// NewRelayedMessage creates the server message delivered for a relayed frame,
+// keeping the message ID it was assigned when first accepted
+func NewRelayedMessage(msg *RelayMessage) *ServerMessage {
+	serverMsg := NewServerMessage(msg.Type, msg.From, msg.Payload)
+	serverMsg.MessageID = msg.ID
+	serverMsg.DeviceID = msg.DeviceID
+	serverMsg.GroupID = msg.GroupID
+	serverMsg.RequestID = msg.RequestID
+	return serverMsg
+}
+
 // NewErrorMessage creates an error message
 func NewErrorMessage(code, message string) []byte {
 	errMsg := ErrorMessage{Code: code, Message: message}
 	payload, _ := json.Marshal(errMsg)
-	
+
 	msg := ServerMessage{
 		Type:      MessageTypeError,
 		Timestamp: time.Now().UTC(),
 		Payload:   string(payload),
 	}
-	
+
+	data, _ := json.Marshal(msg)
+	return data
+}
+
+// mustMarshalError builds an error frame with extra details, optionally
+// tied to a message ID
+func mustMarshalError(errMsg ErrorMessage, messageID string) []byte {
+	msg := NewServerMessage(MessageTypeError, "", mustMarshal(errMsg))
+	msg.MessageID = messageID
+
 	data, _ := json.Marshal(msg)
 	return data
 }
 
 // Helper functions
 
+// generateMessageID returns the ID a message keeps on every node of the
+// cluster, for its metadata and receipts
 func generateMessageID() string {
-	// Simple ID generation - could be replaced with UUID
-	return time.Now().Format("20060102150405") + "-" + randomString(8)
+	return uuid.New().String()
 }
 
 func mustMarshal(v interface{}) string {
 	data, _ := json.Marshal(v)
 	return string(data)
 }
-
-func randomString(n int) string {
-	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
-	}
-	return string(b)
-}
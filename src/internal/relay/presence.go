@@ -0,0 +1,266 @@
+package relay
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"chat-e2ee/internal/presence"
+)
+
+// Statuses a client may pick with a presence frame
+var validPresenceStatuses = map[string]bool{
+	presence.StatusOnline:    true,
+	presence.StatusAway:      true,
+	presence.StatusDND:       true,
+	presence.StatusInvisible: true,
+}
+
+// PresenceAudience decides whose presence a user may follow, see
+// users.Service
+type PresenceAudience interface {
+	// ContactIDs returns the contacts a user may subscribe to
+	ContactIDs(ctx context.Context, userID string) ([]string, error)
+
+	// PresenceVisible reports what viewerID may see of userID's presence
+	PresenceVisible(ctx context.Context, viewerID, userID string) (online, lastSeen bool, err error)
+}
+
+// UsePresence makes the hub keep users.is_online and last_seen in db in
+// step with the devices' heartbeats, and lets clients subscribe to the
+// presence of the contacts audience allows. Either may be nil. It must be
+// called before Run.
+func (h *Hub) UsePresence(db *sql.DB, audience PresenceAudience) {
+	h.presenceDB = db
+	h.audience = audience
+}
+
+// heartbeat keeps a client's device online for another device TTL, and
+// renews its presence subscriptions before they expire
+func (h *Hub) heartbeat(client *Client) {
+	if h.presence == nil {
+		return
+	}
+
+	ctx := context.Background()
+	change, err := h.presence.Heartbeat(ctx, client.UserID, client.DeviceID)
+	if err != nil {
+		log.Printf("[ERROR] Heartbeat failed for user %s: %v", client.UserID, err)
+		return
+	}
+	h.queuePresence(change)
+
+	if userIDs := client.staleWatches(time.Now()); len(userIDs) > 0 {
+		if err := h.presence.Watch(ctx, client.UserID, userIDs); err != nil {
+			log.Printf("[ERROR] Failed to renew presence subscriptions of %s: %v", client.UserID, err)
+		}
+	}
+}
+
+// queuePresence hands a presence change to runPresence. It never blocks,
+// since it is called from the hub goroutine.
+func (h *Hub) queuePresence(change *presence.Change) {
+	if change == nil {
+		return
+	}
+
+	select {
+	case h.presenceChanges <- change:
+	default:
+		log.Printf("Presence queue full, change dropped: UserID=%s %s -> %s", change.UserID, change.From, change.To)
+	}
+}
+
+// runPresence saves and publishes presence changes in order, away from the
+// hub goroutine
+func (h *Hub) runPresence() {
+	for change := range h.presenceChanges {
+		h.publishPresence(change)
+	}
+}
+
+func (h *Hub) publishPresence(change *presence.Change) {
+	ctx := context.Background()
+	online := change.To != presence.StatusOffline
+
+	// Away and dnd users are still online; invisible ones are offline to all
+	if h.presenceDB != nil && online != (change.From != presence.StatusOffline) {
+		_, err := h.presenceDB.ExecContext(ctx,
+			"UPDATE users SET is_online = $2, last_seen = $3 WHERE id = $1",
+			change.UserID, online, change.At,
+		)
+		if err != nil {
+			log.Printf("Failed to save presence of %s: %v", change.UserID, err)
+		}
+	}
+
+	if h.audience == nil {
+		return
+	}
+
+	watchers, err := h.presence.Watchers(ctx, change.UserID)
+	if err != nil {
+		log.Printf("Failed to load presence watchers of %s: %v", change.UserID, err)
+		return
+	}
+
+	for _, watcherID := range watchers {
+		update, ok := h.presenceFor(ctx, watcherID, change.UserID, change.To, change.At)
+		// Users hiding their online status look offline all along, so only
+		// going offline, with its last seen time, is news
+		if !ok || update.Status != change.To {
+			continue
+		}
+
+		h.relay <- &RelayMessage{
+			From:    change.UserID,
+			To:      watcherID,
+			Type:    MessageTypeStatus,
+			Payload: mustMarshal(update),
+		}
+	}
+}
+
+// presenceFor is what viewerID may see of a user whose status is status and
+// who was last seen at lastSeen, or false if they may see nothing at all
+func (h *Hub) presenceFor(ctx context.Context, viewerID, userID, status string, lastSeen time.Time) (*PresenceUpdate, bool) {
+	if h.blocks != nil {
+		blocked, err := h.blocks.Blocked(ctx, userID, viewerID)
+		if err != nil || blocked {
+			return nil, false
+		}
+	}
+
+	showOnline, showLastSeen, err := h.audience.PresenceVisible(ctx, viewerID, userID)
+	if err != nil {
+		log.Printf("Failed to check presence of %s for %s: %v", userID, viewerID, err)
+		return nil, false
+	}
+	if !showOnline && !showLastSeen {
+		return nil, false
+	}
+
+	update := &PresenceUpdate{UserID: userID, Status: status}
+	if !showOnline {
+		update.Status = presence.StatusOffline
+	}
+	if showLastSeen && !lastSeen.IsZero() {
+		update.LastSeen = &lastSeen
+	}
+	return update, true
+}
+
+// handlePresenceSubscribe subscribes the connection to the presence of the
+// listed contacts, or all of them, and sends each one's current status
+func (c *Client) handlePresenceSubscribe(msg *ClientMessage) {
+	if c.hub.audience == nil || c.hub.presence == nil {
+		c.sendError("PRESENCE_UNAVAILABLE", "Presence subscriptions are not supported")
+		return
+	}
+
+	ctx := context.Background()
+	contacts, err := c.hub.audience.ContactIDs(ctx, c.UserID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to load contacts of %s: %v", c.UserID, err)
+		c.sendError("PRESENCE_FAILED", "Failed to load contacts")
+		return
+	}
+
+	// Users who aren't contacts are left out
+	userIDs := contacts
+	if len(msg.Users) > 0 {
+		isContact := make(map[string]bool, len(contacts))
+		for _, contactID := range contacts {
+			isContact[contactID] = true
+		}
+		userIDs = make([]string, 0, len(msg.Users))
+		for _, userID := range msg.Users {
+			if isContact[userID] {
+				userIDs = append(userIDs, userID)
+			}
+		}
+	}
+	if len(userIDs) == 0 {
+		return
+	}
+
+	if err := c.hub.presence.Watch(ctx, c.UserID, userIDs); err != nil {
+		log.Printf("[ERROR] Failed to subscribe %s to presence: %v", c.UserID, err)
+		c.sendError("PRESENCE_FAILED", "Failed to subscribe")
+		return
+	}
+	c.watch(userIDs, time.Now())
+
+	for _, userID := range userIDs {
+		status, lastSeen, err := c.hub.presence.Status(ctx, userID)
+		if err != nil {
+			log.Printf("[ERROR] Failed to load presence of %s: %v", userID, err)
+			continue
+		}
+
+		update, ok := c.hub.presenceFor(ctx, c.UserID, userID, presence.Visible(status), lastSeen)
+		if !ok {
+			continue
+		}
+		c.Send([]byte(mustMarshal(NewServerMessage(MessageTypeStatus, userID, mustMarshal(update)))))
+	}
+}
+
+// handlePresenceUnsubscribe stops presence updates on this connection for
+// the listed users, or everyone
+func (c *Client) handlePresenceUnsubscribe(msg *ClientMessage) {
+	c.unwatch(msg.Users)
+}
+
+func (c *Client) watch(userIDs []string, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.watching == nil {
+		c.watching = make(map[string]bool, len(userIDs))
+	}
+	for _, userID := range userIDs {
+		c.watching[userID] = true
+	}
+	c.watchedAt = at
+}
+
+// staleWatches returns the users the connection watches if its
+// subscriptions are halfway to expiring, marking them renewed
+func (c *Client) staleWatches(now time.Time) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.watching) == 0 || now.Sub(c.watchedAt) < presence.WatchTTL/2 {
+		return nil
+	}
+	c.watchedAt = now
+
+	userIDs := make([]string, 0, len(c.watching))
+	for userID := range c.watching {
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs
+}
+
+// unwatch drops the listed users, or all of them if none are listed
+func (c *Client) unwatch(userIDs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(userIDs) == 0 {
+		c.watching = nil
+		return
+	}
+	for _, userID := range userIDs {
+		delete(c.watching, userID)
+	}
+}
+
+// watches reports whether the connection subscribed to a user's presence
+func (c *Client) watches(userID string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.watching[userID]
+}
@@ -0,0 +1,59 @@
+package relay
+
+import (
+	"context"
+	"log"
+)
+
+// MessageRequests holds messages from strangers to users who require
+// approval, see users.Requests
+type MessageRequests interface {
+	// Admit decides whether a message from senderID may go to recipientID,
+	// returning the ID of the request it opens if it is the first one
+	Admit(ctx context.Context, senderID, recipientID string) (requestID string, admitted bool, err error)
+
+	// Approved reports whether otherID may reach userID: see them typing,
+	// get their receipts
+	Approved(ctx context.Context, userID, otherID string) (bool, error)
+}
+
+// UseMessageRequests makes the hub hold messages from non-contacts to users
+// who require approval. It must be called before clients connect.
+func (h *Hub) UseMessageRequests(requests MessageRequests) {
+	h.requests = requests
+}
+
+// admit checks a message from this client to recipientID against the
+// recipient's message requests, telling the client when it can't be sent
+func (c *Client) admit(recipientID string) (requestID string, ok bool) {
+	if c.hub.requests == nil {
+		return "", true
+	}
+
+	requestID, admitted, err := c.hub.requests.Admit(context.Background(), c.UserID, recipientID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to check message requests from %s to %s: %v", c.UserID, recipientID, err)
+		c.sendError("REQUEST_LOOKUP_FAILED", "Failed to check the recipient")
+		return "", false
+	}
+	if !admitted {
+		c.sendError("MESSAGE_REQUEST_PENDING", "The recipient has not accepted your message request yet")
+		return "", false
+	}
+	return requestID, true
+}
+
+// approved reports whether userID lets otherID see typing indicators and
+// receipts from them; lookup failures count as not approved
+func (h *Hub) approved(userID, otherID string) bool {
+	if h.requests == nil {
+		return true
+	}
+
+	ok, err := h.requests.Approved(context.Background(), userID, otherID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to check whether %s approved %s: %v", userID, otherID, err)
+		return false
+	}
+	return ok
+}
@@ -2,13 +2,14 @@ package relay
 
 import (
 	"context"
-	"encoding/json"
+	"database/sql"
+	"errors"
 	"log"
 	"strings"
-	"sync"
 	"time"
 
 	"chat-e2ee/internal/auth"
+	"chat-e2ee/internal/config"
 	"chat-e2ee/internal/presence"
 
 	"github.com/gofiber/fiber/v2"
@@ -20,16 +21,12 @@ import (
 type Handler struct {
 	hub        *Hub
 	jwtService *auth.JWTService
-	
-	connMu sync.RWMutex
-	conns  map[string]*websocket.Conn
 }
 
 func NewHandler(hub *Hub, jwtService *auth.JWTService) *Handler {
 	return &Handler{
 		hub:        hub,
 		jwtService: jwtService,
-		conns:      make(map[string]*websocket.Conn),
 	}
 }
 
@@ -53,23 +50,34 @@ func (h *Handler) UpgradeHandler() fiber.Handler {
 				})
 			}
 
-			claims, err := h.jwtService.ValidateToken(token)
-			if err != nil {
+			claims, err := h.jwtService.ValidateAccessToken(c.Context(), token)
+			switch {
+			case err == nil:
+			case err == auth.ErrWrongTokenType:
 				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-					"error": "Invalid token",
+					"error": "Invalid token type",
 				})
-			}
-
-			if claims.Type != "access" {
+			case err == auth.ErrTokenRevoked:
 				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-					"error": "Invalid token type",
+					"error": "Session revoked",
+					"code":  "TOKEN_REVOKED",
+				})
+			case errors.Is(err, auth.ErrRevocationDown):
+				log.Printf("[WebSocket] %v", err)
+				return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+					"error": "Failed to validate token",
+				})
+			default:
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+					"error": "Invalid token",
 				})
 			}
 
 			c.Locals("userID", claims.UserID)
 			c.Locals("deviceID", claims.DeviceID)
+			c.Locals("sessionID", claims.SessionID)
 
-			log.Printf("[WebSocket] Upgrade request authenticated - UserID: %s, DeviceID: %s", 
+			log.Printf("[WebSocket] Upgrade request authenticated - UserID: %s, DeviceID: %s",
 				claims.UserID, claims.DeviceID)
 
 			return c.Next()
@@ -81,219 +89,174 @@ func (h *Handler) UpgradeHandler() fiber.Handler {
 
 func (h *Handler) WebSocketHandler() fiber.Handler {
 	return websocket.New(func(ws *websocket.Conn) {
-		userID := ws.Locals("userID").(string)
-		deviceID := ws.Locals("deviceID").(string)
-		connID := uuid.New().String()
-		
-		log.Printf("[WebSocket] New connection: UserID=%s, DeviceID=%s, ConnID=%s", userID, deviceID, connID)
-		
-		// Store connection
-		h.connMu.Lock()
-		h.conns[connID] = ws
-		h.connMu.Unlock()
-		
-		// Create send channel
-		send := make(chan []byte, 256)
-		
-		// Register with hub
-		if h.hub != nil {
-			client := &Client{
-				ID:         connID,
-				UserID:     userID,
-				DeviceID:   deviceID,
-				hub:        h.hub,
-				send:       send,
-				lastActive: time.Now(),
-			}
-			h.hub.register <- client
-		}
-		
-		// Send welcome message
-		welcome := map[string]interface{}{
-			"type": "connected",
-			"message": "Connected to Chat E2EE WebSocket",
-			"timestamp": time.Now().Unix(),
-			"user_id": userID,
-			"device_id": deviceID,
-		}
-		
-		if data, err := json.Marshal(welcome); err == nil {
-			ws.WriteMessage(websocket.TextMessage, data)
-		}
-		
-		// Start write pump
-		stopWrite := make(chan bool)
-		go h.writePump(ws, send, stopWrite)
-		
-		// Read pump (blocking)
-		h.readPump(ws, userID, deviceID, send)
-		
-		// Cleanup
-		close(stopWrite)
-		close(send)
-		
-		h.connMu.Lock()
-		delete(h.conns, connID)
-		h.connMu.Unlock()
-		
-		// Unregister from hub
-		if h.hub != nil {
-			client := &Client{
-				ID:       connID,
-				UserID:   userID,
-				DeviceID: deviceID,
-				hub:      h.hub,
-			}
-			h.hub.unregister <- client
-		}
-		
-		log.Printf("[WebSocket] Connection closed: UserID=%s, ConnID=%s", userID, connID)
-	})
-}
-
-func (h *Handler) readPump(ws *websocket.Conn, userID, deviceID string, send chan []byte) {
-	defer ws.Close()
-	
-	ws.SetReadLimit(512 * 1024)
-	ws.SetReadDeadline(time.Now().Add(60 * time.Second))
-	ws.SetPongHandler(func(string) error {
-		ws.SetReadDeadline(time.Now().Add(60 * time.Second))
-		return nil
-	})
-	
-	for {
-		messageType, message, err := ws.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("[WebSocket] Error: %v", err)
-			}
-			break
-		}
-		
-		if messageType == websocket.TextMessage {
-			log.Printf("[WebSocket] Received from %s: %s", userID, string(message))
-			
-			var msg ClientMessage
-			if err := json.Unmarshal(message, &msg); err != nil {
-				log.Printf("[WebSocket] Parse error: %v", err)
-				continue
-			}
-			
-			switch msg.Type {
-			case "ping":
-				pong := map[string]interface{}{
-					"type": "pong",
-					"timestamp": time.Now().Unix(),
-				}
-				if data, err := json.Marshal(pong); err == nil {
-					select {
-					case send <- data:
-						log.Printf("[WebSocket] Pong queued")
-					default:
-						log.Printf("[WebSocket] Send buffer full")
-					}
-				}
-				
-			case "message":
-				if msg.To != "" && h.hub != nil {
-					relayMsg := &RelayMessage{
-						From:     userID,
-						To:       msg.To,
-						DeviceID: deviceID,
-						Type:     MessageTypeText,
-						Payload:  msg.Payload,
-					}
-					h.hub.relay <- relayMsg
-				}
-				
-			default:
-				log.Printf("[WebSocket] Unknown message type: %s", msg.Type)
-			}
-		}
-	}
-}
+		userID, _ := ws.Locals("userID").(string)
+		deviceID, _ := ws.Locals("deviceID").(string)
+		sessionID, _ := ws.Locals("sessionID").(string)
 
-func (h *Handler) writePump(ws *websocket.Conn, send chan []byte, stop chan bool) {
-	ticker := time.NewTicker(54 * time.Second)
-	defer ticker.Stop()
-	
-	for {
-		select {
-		case message, ok := <-send:
-			ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			
-			if !ok {
-				ws.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-			
-			if err := ws.WriteMessage(websocket.TextMessage, message); err != nil {
-				return
-			}
-			
-		case <-ticker.C:
-			ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := ws.WriteMessage(websocket.PingMessage, nil); err != nil {
-				return
-			}
-			
-		case <-stop:
+		client := NewClient(h.hub, ws, userID, deviceID, sessionID)
+		if client == nil {
 			return
 		}
-	}
+
+		log.Printf("[WebSocket] New connection: UserID=%s, DeviceID=%s, ConnID=%s", userID, deviceID, client.ID)
+
+		// Blocks until the connection is closed
+		client.Serve()
+
+		log.Printf("[WebSocket] Connection closed: UserID=%s, ConnID=%s", userID, client.ID)
+	})
 }
 
 func (h *Handler) GetStats() fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		h.connMu.RLock()
-		activeConns := len(h.conns)
-		h.connMu.RUnlock()
-		
 		stats := h.hub.GetStats()
-		
-		var onlineUsers []string
+		ctx := c.Context()
+
+		// In cluster mode the totals cover every live node
+		nodes := 1
+		if h.hub.cluster != nil {
+			clusterStats, count, err := h.hub.cluster.Stats(ctx)
+			if err != nil {
+				log.Printf("[WebSocket] Failed to load cluster stats: %v", err)
+			} else if count > 0 {
+				stats, nodes = clusterStats, count
+			}
+		}
+
+		// Only the count; admins page through the users with ListOnlineUsers
+		var onlineCount int64
 		if h.hub.presence != nil {
-			ctx := c.Context()
-			onlineUsers, _ = h.hub.presence.GetOnlineUsers(ctx)
+			count, err := h.hub.presence.CountOnline(ctx)
+			if err != nil {
+				log.Printf("[WebSocket] Failed to count online users: %v", err)
+			}
+			onlineCount = count
 		}
 
 		return c.JSON(fiber.Map{
 			"websocket": fiber.Map{
 				"total_connections":  stats.TotalConnections,
-				"active_connections": activeConns,
+				"active_connections": stats.ActiveConnections,
 				"messages_relayed":   stats.MessagesRelayed,
 				"last_activity":      stats.LastActivity,
+				"nodes":              nodes,
 			},
 			"users": fiber.Map{
-				"online_count": len(onlineUsers),
-				"online_users": onlineUsers,
+				"online_count": onlineCount,
 			},
 		})
 	}
 }
 
-func CreateRelayService(redisClient *redis.Client, jwtService *auth.JWTService) (*Handler, *Hub) {
+// ListOnlineUsers returns a page of the users online on any node, the most
+// recently active first
+func (h *Handler) ListOnlineUsers() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if h.hub.presence == nil {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+				"error": "Presence is not available",
+			})
+		}
+
+		page := c.QueryInt("page", 1)
+		if page < 1 {
+			page = 1
+		}
+		pageSize := c.QueryInt("page_size", 50)
+		if pageSize < 1 || pageSize > 200 {
+			pageSize = 50
+		}
+
+		ctx := c.Context()
+		total, err := h.hub.presence.CountOnline(ctx)
+		if err != nil {
+			log.Printf("[WebSocket] Failed to count online users: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to list online users",
+			})
+		}
+
+		users, err := h.hub.presence.ListOnline(ctx, int64((page-1)*pageSize), int64(pageSize))
+		if err != nil {
+			log.Printf("[WebSocket] Failed to list online users: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to list online users",
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"users":       users,
+			"total_count": total,
+			"page":        page,
+			"page_size":   pageSize,
+			"has_more":    total > int64(page*pageSize),
+		})
+	}
+}
+
+// CreateRelayService starts the hub. Offline recipients are woken up
+// through pushNotifier, group messages are fanned out to the members groups
+// returns, frames between users who blocked each other are dropped
+// according to blocks, messages from non-contacts go through requests, and
+// users follow the presence of the contacts audience allows; any of them
+// may be nil.
+func CreateRelayService(db *sql.DB, redisClient *redis.Client, jwtService *auth.JWTService, cfg config.RelayConfig, pushNotifier PushNotifier, groups GroupRegistry, blocks BlockChecker, requests MessageRequests, audience PresenceAudience) (*Handler, *Hub) {
 	log.Printf("[WebSocket] Creating relay service...")
-	
-	presenceTracker := presence.NewTracker(redisClient)
-	hub := NewHub(presenceTracker)
-	
+
+	// Devices must outlive the time between two pongs
+	presenceTTL := cfg.PresenceTTL
+	if presenceTTL < pongWait+writeWait {
+		log.Printf("[WebSocket] RELAY_PRESENCE_TTL %s is too short, using %s", presenceTTL, pongWait+writeWait)
+		presenceTTL = pongWait + writeWait
+	}
+
+	presenceTracker := presence.NewTracker(redisClient, presenceTTL, cfg.MaxPendingMessages, cfg.PendingMessageTTL)
+	hub := NewHub(presenceTracker, NewDeviceRegistry(db))
+	hub.LimitFrames(cfg.FrameRate, cfg.FrameBurst)
+	if pushNotifier != nil {
+		hub.UsePushNotifier(pushNotifier)
+	}
+	if groups != nil {
+		hub.UseGroups(groups)
+	}
+	if blocks != nil {
+		hub.UseBlocks(blocks, cfg.BlockPolicy)
+	}
+	if requests != nil {
+		hub.UseMessageRequests(requests)
+	}
+	hub.UsePresence(db, audience)
+
+	if cfg.ClusterMode {
+		nodeID := cfg.NodeID
+		if nodeID == "" {
+			nodeID = uuid.New().String()
+		}
+		hub.JoinCluster(NewCluster(redisClient, nodeID))
+		log.Printf("[WebSocket] Cluster mode enabled, node ID: %s", nodeID)
+	}
+
 	go hub.Run()
-	
+
 	handler := NewHandler(hub, jwtService)
-	
+
+	// Devices that stopped sending heartbeats without disconnecting, e.g.
+	// on a node that crashed, go offline here
 	go func() {
-		ticker := time.NewTicker(5 * time.Minute)
+		ticker := time.NewTicker(presenceTTL)
 		defer ticker.Stop()
-		
+
 		for range ticker.C {
-			ctx := context.Background()
-			if err := presenceTracker.CleanupInactive(ctx, 10*time.Minute); err != nil {
+			changes, err := presenceTracker.CleanupInactive(context.Background())
+			if err != nil {
 				log.Printf("Presence cleanup error: %v", err)
 			}
+			for _, change := range changes {
+				hub.queuePresence(change)
+			}
 		}
 	}()
-	
+
 	log.Printf("[WebSocket] Relay service created successfully")
 	return handler, hub
 }
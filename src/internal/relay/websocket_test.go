@@ -0,0 +1,370 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"chat-e2ee/internal/auth"
+	"chat-e2ee/internal/presence"
+
+	fws "github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// testGroups puts every test user in one group
+type testGroups map[string][]string
+
+func (g testGroups) Recipients(ctx context.Context, groupID, senderID string) (map[string][]string, bool, error) {
+	if _, member := g[senderID]; !member {
+		return nil, false, nil
+	}
+	recipients := make(map[string][]string, len(g))
+	for userID, devices := range g {
+		recipients[userID] = append([]string(nil), devices...)
+	}
+	return recipients, true, nil
+}
+
+// testAudience makes everyone a contact who shows everything
+type testAudience []string
+
+func (a testAudience) ContactIDs(ctx context.Context, userID string) ([]string, error) {
+	contacts := make([]string, 0, len(a))
+	for _, contactID := range a {
+		if contactID != userID {
+			contacts = append(contacts, contactID)
+		}
+	}
+	return contacts, nil
+}
+
+func (a testAudience) PresenceVisible(ctx context.Context, viewerID, userID string) (bool, bool, error) {
+	return true, true, nil
+}
+
+type testServer struct {
+	addr     string
+	jwt      *auth.JWTService
+	sessions *auth.SessionStore
+	hub      *Hub
+}
+
+// newTestServer serves /ws like cmd/server does, on an ephemeral port, with
+// the session denylist in an in-memory Redis
+func newTestServer(t *testing.T, hub *Hub) *testServer {
+	t.Helper()
+
+	jwtService := auth.NewJWTService("test-secret", time.Hour, time.Hour)
+	sessions := auth.NewSessionStore(nil, newTestRedis(t), time.Hour)
+	jwtService.CheckRevocations(sessions)
+	handler := NewHandler(hub, jwtService)
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Use("/ws", handler.UpgradeHandler())
+	app.Get("/ws", handler.WebSocketHandler())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	// Closing the listener stops the server; app.Shutdown races with the
+	// request contexts handed to Redis, inside fasthttp
+	t.Cleanup(func() { ln.Close() })
+
+	return &testServer{addr: ln.Addr().String(), jwt: jwtService, sessions: sessions, hub: hub}
+}
+
+func newTestHub(t *testing.T) *Hub {
+	t.Helper()
+	return newTestHubWithRedis(newTestRedis(t))
+}
+
+func newTestHubWithRedis(rc *redis.Client) *Hub {
+	return NewHub(presence.NewTracker(rc, time.Minute, 100, time.Hour), nil)
+}
+
+type testConn struct {
+	conn *fws.Conn
+}
+
+// login mints an access token for a new session of the device. Sessions
+// live in Postgres, which the tests don't have, but only the Redis denylist
+// is checked on upgrade.
+func (s *testServer) login(t *testing.T, userID, deviceID string) string {
+	t.Helper()
+
+	token, _, err := s.jwt.GenerateTokenPair(userID, deviceID, uuid.New().String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// dial connects a device and waits for its connected frame, sent once the
+// hub registered it
+func (s *testServer) dial(t *testing.T, userID, deviceID string) *testConn {
+	t.Helper()
+
+	token := s.login(t, userID, deviceID)
+	conn, _, err := fws.DefaultDialer.Dial("ws://"+s.addr+"/ws?token="+token, nil)
+	if err != nil {
+		t.Fatalf("dial as %s/%s: %v", userID, deviceID, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &testConn{conn: conn}
+	c.expect(t, MessageTypeConnected)
+	return c
+}
+
+func (c *testConn) send(t *testing.T, msg ClientMessage) {
+	t.Helper()
+	if err := c.conn.WriteJSON(msg); err != nil {
+		t.Fatalf("send %s: %v", msg.Type, err)
+	}
+}
+
+// expect reads the next frame and fails unless it has the given type
+func (c *testConn) expect(t *testing.T, msgType MessageType) *ServerMessage {
+	t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("waiting for %s: %v", msgType, err)
+	}
+
+	// The connected frame has a Unix timestamp
+	var frame struct {
+		ServerMessage
+		Timestamp json.RawMessage `json:"timestamp"`
+	}
+	if err := json.Unmarshal(data, &frame); err != nil {
+		t.Fatalf("waiting for %s: %v", msgType, err)
+	}
+	if frame.Type != msgType {
+		t.Fatalf("got %s frame, want %s: %s", frame.Type, msgType, data)
+	}
+	return &frame.ServerMessage
+}
+
+// expectError reads the next frame and fails unless it is an error with
+// the given code
+func (c *testConn) expectError(t *testing.T, code string) {
+	t.Helper()
+
+	msg := c.expect(t, MessageTypeError)
+	var errMsg ErrorMessage
+	if err := json.Unmarshal([]byte(msg.Payload), &errMsg); err != nil {
+		t.Fatal(err)
+	}
+	if errMsg.Code != code {
+		t.Fatalf("got %s error, want %s", errMsg.Code, code)
+	}
+}
+
+// expectQuiet checks that the frames sent so far got no reply, by pinging
+// and expecting the pong next
+func (c *testConn) expectQuiet(t *testing.T) {
+	t.Helper()
+	c.send(t, ClientMessage{Type: MessageTypePing})
+	c.expect(t, MessageTypePong)
+}
+
+// messageTypes returns every MessageType constant declared in message.go
+func messageTypes(t *testing.T) map[MessageType]string {
+	t.Helper()
+
+	file, err := parser.ParseFile(token.NewFileSet(), "message.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := make(map[MessageType]string)
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			value := spec.(*ast.ValueSpec)
+			if ident, ok := value.Type.(*ast.Ident); !ok || ident.Name != "MessageType" {
+				continue
+			}
+			for i, name := range value.Names {
+				literal, err := strconv.Unquote(value.Values[i].(*ast.BasicLit).Value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				types[MessageType(literal)] = name.Name
+			}
+		}
+	}
+	return types
+}
+
+func TestWebSocketDispatchesEveryMessageType(t *testing.T) {
+	hub := newTestHub(t)
+	hub.UseGroups(testGroups{"alice": {"a1"}, "bob": {"b1"}})
+	hub.UsePresence(nil, testAudience{"alice", "bob"})
+	go hub.Run()
+
+	server := newTestServer(t, hub)
+	alice := server.dial(t, "alice", "a1")
+	bob := server.dial(t, "bob", "b1")
+
+	checked := make(map[MessageType]bool)
+	check := func(msgType MessageType, run func(t *testing.T)) {
+		checked[msgType] = true
+		t.Run(string(msgType), run)
+	}
+
+	var messageID string
+	check(MessageTypeText, func(t *testing.T) {
+		alice.send(t, ClientMessage{
+			Type:      MessageTypeText,
+			To:        "bob",
+			Envelopes: []Envelope{{DeviceID: "b1", Payload: "ciphertext"}},
+		})
+		accepted := alice.expect(t, MessageTypeDelivery)
+		received := bob.expect(t, MessageTypeText)
+		if received.MessageID == "" || received.MessageID != accepted.MessageID {
+			t.Fatalf("bob got message %q, alice was told %q", received.MessageID, accepted.MessageID)
+		}
+		if received.From != "alice" || received.DeviceID != "a1" || received.Payload != "ciphertext" {
+			t.Fatalf("unexpected message: %+v", received)
+		}
+		messageID = received.MessageID
+	})
+
+	check(MessageTypeAck, func(t *testing.T) {
+		bob.send(t, ClientMessage{Type: MessageTypeAck, Payload: messageID})
+		receipt := alice.expect(t, MessageTypeDelivered)
+		if receipt.MessageID != messageID || receipt.From != "bob" {
+			t.Fatalf("unexpected delivery receipt: %+v", receipt)
+		}
+	})
+
+	check(MessageTypeRead, func(t *testing.T) {
+		bob.send(t, ClientMessage{Type: MessageTypeRead, Payload: messageID})
+		receipt := alice.expect(t, MessageTypeRead)
+		if receipt.MessageID != messageID || receipt.From != "bob" {
+			t.Fatalf("unexpected read receipt: %+v", receipt)
+		}
+	})
+
+	check(MessageTypeTyping, func(t *testing.T) {
+		alice.send(t, ClientMessage{Type: MessageTypeTyping, To: "bob", Payload: "true"})
+		var indicator TypingIndicator
+		if err := json.Unmarshal([]byte(bob.expect(t, MessageTypeTyping).Payload), &indicator); err != nil {
+			t.Fatal(err)
+		}
+		if indicator.UserID != "alice" || !indicator.IsTyping {
+			t.Fatalf("unexpected typing indicator: %+v", indicator)
+		}
+	})
+
+	check(MessageTypeGroupMessage, func(t *testing.T) {
+		alice.send(t, ClientMessage{Type: MessageTypeGroupMessage, GroupID: "g1", Payload: "sender-key"})
+		alice.expect(t, MessageTypeDelivery)
+		received := bob.expect(t, MessageTypeGroupMessage)
+		if received.GroupID != "g1" || received.From != "alice" || received.Payload != "sender-key" {
+			t.Fatalf("unexpected group message: %+v", received)
+		}
+	})
+
+	check(MessageTypePresence, func(t *testing.T) {
+		alice.send(t, ClientMessage{Type: MessageTypePresence, Payload: presence.StatusAway})
+		var update PresenceUpdate
+		if err := json.Unmarshal([]byte(alice.expect(t, MessageTypeStatus).Payload), &update); err != nil {
+			t.Fatal(err)
+		}
+		if update.UserID != "alice" || update.Status != presence.StatusAway {
+			t.Fatalf("unexpected presence update: %+v", update)
+		}
+	})
+
+	check(MessageTypePresenceSubscribe, func(t *testing.T) {
+		alice.send(t, ClientMessage{Type: MessageTypePresenceSubscribe, Users: []string{"bob"}})
+		status := alice.expect(t, MessageTypeStatus)
+		if status.From != "bob" {
+			t.Fatalf("got presence of %q, want bob", status.From)
+		}
+	})
+
+	check(MessageTypePresenceUnsubscribe, func(t *testing.T) {
+		alice.send(t, ClientMessage{Type: MessageTypePresenceUnsubscribe})
+		alice.expectQuiet(t)
+	})
+
+	check(MessageTypePing, func(t *testing.T) {
+		alice.send(t, ClientMessage{Type: MessageTypePing})
+		alice.expect(t, MessageTypePong)
+	})
+
+	check(MessageTypeHeartbeat, func(t *testing.T) {
+		alice.send(t, ClientMessage{Type: MessageTypeHeartbeat})
+		alice.expectQuiet(t)
+	})
+
+	check(MessageTypePong, func(t *testing.T) {
+		alice.send(t, ClientMessage{Type: MessageTypePong})
+		alice.expectQuiet(t)
+	})
+
+	serverOnly := []MessageType{
+		MessageTypeDelivery, MessageTypeDelivered, MessageTypeError, MessageTypeStatus, MessageTypeConnected,
+		MessageTypePrekeysLow, MessageTypeKeyChanged, MessageTypeGroupEvent, MessageTypeRequestAccepted,
+	}
+	for _, msgType := range serverOnly {
+		check(msgType, func(t *testing.T) {
+			alice.send(t, ClientMessage{Type: msgType, To: "bob", Payload: "forged"})
+			alice.expectError(t, "INVALID_TYPE")
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		alice.send(t, ClientMessage{Type: "bogus"})
+		alice.expectError(t, "UNKNOWN_TYPE")
+	})
+
+	// Nothing leaked to bob along the way
+	bob.expectQuiet(t)
+
+	for msgType, name := range messageTypes(t) {
+		if !checked[msgType] {
+			t.Errorf("%s (%q) is not covered", name, msgType)
+		}
+	}
+}
+
+func TestWebSocketRejectsTokensWithoutSession(t *testing.T) {
+	hub := newTestHub(t)
+	go hub.Run()
+	server := newTestServer(t, hub)
+
+	token, _, err := server.jwt.GenerateTokenPair("alice", "a1", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, resp, err := fws.DefaultDialer.Dial("ws://"+server.addr+"/ws?token="+token, nil)
+	if err == nil {
+		t.Fatal("upgraded with a token that has no session")
+	}
+	if resp == nil || resp.StatusCode != fiber.StatusUnauthorized {
+		t.Fatalf("got %v, want 401", resp)
+	}
+
+	// A token of a session is accepted
+	server.dial(t, "alice", "a1")
+}
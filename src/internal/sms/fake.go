@@ -0,0 +1,321 @@
+package sms
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Verification codes in message bodies
+var codePattern = regexp.MustCompile(`\b\d{4,8}\b`)
+
+// FakeMessage is a message received by the fake gateway
+type FakeMessage struct {
+	ID        string    `json:"id"`
+	Provider  string    `json:"provider"` // "twilio" or "http", by the API used
+	To        string    `json:"to"`
+	From      string    `json:"from,omitempty"`
+	Body      string    `json:"body"`
+	Code      string    `json:"code,omitempty"` // First 4-8 digit number in Body
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// FakeGateway is an in-memory SMS gateway for local development and
+// integration tests. It speaks both the Twilio Messages API and the HTTP
+// provider format, posts signed delivery callbacks, and lets tests read
+// back what was sent to a number.
+type FakeGateway struct {
+	twilioToken string
+	httpToken   string
+	client      *http.Client
+
+	mu       sync.Mutex
+	messages []*FakeMessage
+	seq      int
+
+	// Failure injection: the next failCount sends answer failStatus
+	failCount  int
+	failStatus int
+}
+
+// NewFakeGateway creates a fake gateway that signs Twilio callbacks with
+// twilioToken and HTTP provider callbacks with httpToken
+func NewFakeGateway(twilioToken, httpToken string) *FakeGateway {
+	return &FakeGateway{
+		twilioToken: twilioToken,
+		httpToken:   httpToken,
+		client:      &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// App returns the gateway's HTTP API:
+//
+//	POST   /2010-04-01/Accounts/:sid/Messages.json  Twilio-compatible send
+//	POST   /messages                                HTTP provider send
+//	GET    /messages?to=                            Messages, newest first
+//	GET    /messages/last?to=                       Last message and its code
+//	DELETE /messages                                Forget all messages
+//	POST   /control/fail                            {"count": n, "status": 503}
+func (g *FakeGateway) App() *fiber.App {
+	app := fiber.New(fiber.Config{
+		AppName: "Fake SMS Gateway",
+		// Messages outlive their request, so values must not alias its buffers
+		Immutable: true,
+	})
+
+	app.Post("/2010-04-01/Accounts/:sid/Messages.json", g.twilioSend)
+	app.Post("/messages", g.httpSend)
+	app.Get("/messages", g.list)
+	app.Get("/messages/last", g.last)
+	app.Delete("/messages", g.reset)
+	app.Post("/control/fail", g.fail)
+
+	return app
+}
+
+func (g *FakeGateway) twilioSend(c *fiber.Ctx) error {
+	if status := g.injectedFailure(); status != 0 {
+		return c.Status(status).JSON(fiber.Map{
+			"code":    status * 100,
+			"message": "Injected failure",
+			"status":  status,
+		})
+	}
+
+	to := c.FormValue("To")
+	body := c.FormValue("Body")
+	if to == "" || body == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"code":    21604,
+			"message": "A 'To' phone number and a 'Body' are required.",
+			"status":  fiber.StatusBadRequest,
+		})
+	}
+
+	from := c.FormValue("From")
+	if from == "" {
+		from = c.FormValue("MessagingServiceSid")
+	}
+
+	msg := g.store("twilio", "SM", to, from, body)
+
+	if callback := c.FormValue("StatusCallback"); callback != "" {
+		go g.twilioCallbacks(callback, c.Params("sid"), msg)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"sid":    msg.ID,
+		"to":     msg.To,
+		"from":   msg.From,
+		"body":   msg.Body,
+		"status": msg.Status,
+	})
+}
+
+func (g *FakeGateway) httpSend(c *fiber.Ctx) error {
+	if status := g.injectedFailure(); status != 0 {
+		return c.Status(status).JSON(fiber.Map{
+			"code":    "INJECTED_FAILURE",
+			"message": "Injected failure",
+		})
+	}
+
+	var req HTTPMessage
+	if err := c.BodyParser(&req); err != nil || req.To == "" || req.Body == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"code":    "INVALID_MESSAGE",
+			"message": "to and body are required",
+		})
+	}
+
+	msg := g.store("http", "msg-", req.To, req.From, req.Body)
+
+	if req.CallbackURL != "" {
+		go g.httpCallbacks(req.CallbackURL, msg)
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"id":     msg.ID,
+		"status": msg.Status,
+	})
+}
+
+func (g *FakeGateway) list(c *fiber.Ctx) error {
+	to := c.Query("to")
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	messages := make([]*FakeMessage, 0)
+	for i := len(g.messages) - 1; i >= 0; i-- {
+		if to == "" || g.messages[i].To == normalizeNumber(to) {
+			messages = append(messages, g.messages[i])
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"messages": messages,
+		"count":    len(messages),
+	})
+}
+
+func (g *FakeGateway) last(c *fiber.Ctx) error {
+	to := c.Query("to")
+	if to == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "to required",
+		})
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for i := len(g.messages) - 1; i >= 0; i-- {
+		if g.messages[i].To == normalizeNumber(to) {
+			return c.JSON(g.messages[i])
+		}
+	}
+
+	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+		"error": "No messages for this number",
+	})
+}
+
+func (g *FakeGateway) reset(c *fiber.Ctx) error {
+	g.mu.Lock()
+	g.messages = nil
+	g.failCount = 0
+	g.mu.Unlock()
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (g *FakeGateway) fail(c *fiber.Ctx) error {
+	var req struct {
+		Count  int `json:"count"`
+		Status int `json:"status"`
+	}
+	if err := c.BodyParser(&req); err != nil || req.Count < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if req.Status < 400 || req.Status > 599 {
+		req.Status = fiber.StatusServiceUnavailable
+	}
+
+	g.mu.Lock()
+	g.failCount = req.Count
+	g.failStatus = req.Status
+	g.mu.Unlock()
+
+	return c.JSON(fiber.Map{
+		"count":  req.Count,
+		"status": req.Status,
+	})
+}
+
+// injectedFailure returns the status to fail a send with, or 0
+func (g *FakeGateway) injectedFailure() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.failCount == 0 {
+		return 0
+	}
+	g.failCount--
+	return g.failStatus
+}
+
+func (g *FakeGateway) store(provider, idPrefix, to, from, body string) *FakeMessage {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.seq++
+	msg := &FakeMessage{
+		ID:        fmt.Sprintf("%s%08d", idPrefix, g.seq),
+		Provider:  provider,
+		To:        normalizeNumber(to),
+		From:      from,
+		Body:      body,
+		Code:      codePattern.FindString(body),
+		Status:    StatusQueued,
+		CreatedAt: time.Now(),
+	}
+	g.messages = append(g.messages, msg)
+
+	log.Printf("[FAKE SMS] %s message %s to %s: %s", provider, msg.ID, msg.To, body)
+	return msg
+}
+
+func (g *FakeGateway) setStatus(msg *FakeMessage, status string) {
+	g.mu.Lock()
+	msg.Status = status
+	g.mu.Unlock()
+}
+
+// twilioCallbacks reports the message as sent and then delivered, the way
+// Twilio does
+func (g *FakeGateway) twilioCallbacks(callbackURL, accountSID string, msg *FakeMessage) {
+	for _, status := range []string{StatusSent, StatusDelivered} {
+		time.Sleep(100 * time.Millisecond)
+		g.setStatus(msg, status)
+
+		params := url.Values{
+			"AccountSid":    {accountSID},
+			"MessageSid":    {msg.ID},
+			"MessageStatus": {status},
+			"To":            {msg.To},
+		}
+		req, err := http.NewRequest(http.MethodPost, callbackURL, strings.NewReader(params.Encode()))
+		if err != nil {
+			log.Printf("[FAKE SMS] Invalid callback URL %s: %v", callbackURL, err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Twilio-Signature", TwilioSignature(g.twilioToken, callbackURL, params))
+		g.deliver(req, msg.ID, status)
+	}
+}
+
+// httpCallbacks reports the message as sent and then delivered, in the
+// HTTP provider format
+func (g *FakeGateway) httpCallbacks(callbackURL string, msg *FakeMessage) {
+	for _, status := range []string{StatusSent, StatusDelivered} {
+		time.Sleep(100 * time.Millisecond)
+		g.setStatus(msg, status)
+
+		body, _ := json.Marshal(HTTPStatus{ID: msg.ID, Status: status})
+		req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("[FAKE SMS] Invalid callback URL %s: %v", callbackURL, err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(SignatureHeader, HTTPSignature(g.httpToken, body))
+		g.deliver(req, msg.ID, status)
+	}
+}
+
+func (g *FakeGateway) deliver(req *http.Request, id, status string) {
+	resp, err := g.client.Do(req)
+	if err != nil {
+		log.Printf("[FAKE SMS] Callback %s for %s failed: %v", status, id, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		log.Printf("[FAKE SMS] Callback %s for %s got HTTP %d", status, id, resp.StatusCode)
+	}
+}
@@ -0,0 +1,99 @@
+package sms
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Handler receives delivery-status callbacks from the providers
+type Handler struct {
+	statuses    *StatusStore
+	twilioToken string
+	httpToken   string
+	callbackURL string
+}
+
+// NewHandler creates the callback handler. Callbacks are verified with
+// each provider's token, and Twilio signatures against the public
+// callback URL the provider was given.
+func NewHandler(statuses *StatusStore, twilioToken, httpToken, callbackURL string) *Handler {
+	return &Handler{
+		statuses:    statuses,
+		twilioToken: twilioToken,
+		httpToken:   httpToken,
+		callbackURL: strings.TrimSuffix(callbackURL, "/"),
+	}
+}
+
+// TwilioStatus handles Twilio status callbacks (form posts signed with
+// X-Twilio-Signature)
+func (h *Handler) TwilioStatus(c *fiber.Ctx) error {
+	params, err := url.ParseQuery(string(c.Body()))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	expected := TwilioSignature(h.twilioToken, h.callbackURL+"/twilio", params)
+	if h.twilioToken == "" || !hmac.Equal([]byte(c.Get("X-Twilio-Signature")), []byte(expected)) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Invalid signature",
+		})
+	}
+
+	return h.update(c, "twilio", params.Get("MessageSid"), params.Get("MessageStatus"),
+		params.Get("ErrorCode"), params.Get("ErrorMessage"))
+}
+
+// HTTPStatus handles status callbacks from the HTTP provider's gateway
+// (JSON bodies signed with X-SMS-Signature)
+func (h *Handler) HTTPStatus(c *fiber.Ctx) error {
+	expected := HTTPSignature(h.httpToken, c.Body())
+	if h.httpToken == "" || !hmac.Equal([]byte(c.Get(SignatureHeader)), []byte(expected)) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Invalid signature",
+		})
+	}
+
+	var status HTTPStatus
+	if err := json.Unmarshal(c.Body(), &status); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	return h.update(c, "http", status.ID, status.Status, status.ErrorCode, status.ErrorMessage)
+}
+
+func (h *Handler) update(c *fiber.Ctx, provider, id, status, errorCode, errorMessage string) error {
+	if id == "" || status == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Message ID and status required",
+		})
+	}
+
+	err := h.statuses.Update(c.Context(), provider, id, status, errorCode, errorMessage)
+	if errors.Is(err, ErrMessageNotFound) {
+		// Unknown or expired: acknowledge so the provider doesn't retry
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+	if err != nil {
+		log.Printf("[SMS] Failed to record status of %s message %s: %v", provider, id, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to record status",
+		})
+	}
+
+	if status == StatusFailed || status == StatusUndelivered {
+		log.Printf("[SMS] %s message %s %s: %s %s", provider, id, status, errorCode, errorMessage)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
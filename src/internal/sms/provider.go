@@ -0,0 +1,80 @@
+package sms
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Provider sends text messages through one SMS service
+type Provider interface {
+	// Name identifies the provider in routes, logs and status callbacks
+	Name() string
+	// Send delivers body to a number in E.164 format and returns the
+	// provider's message ID
+	Send(ctx context.Context, to, body string) (string, error)
+}
+
+// ProviderError is a send the provider rejected or that never reached it.
+// Temporary errors (network failures, 429 and 5xx) are worth retrying.
+type ProviderError struct {
+	Provider   string
+	Status     int    // HTTP status, 0 if there was no response
+	Code       string // Provider error code, if any
+	Message    string
+	Temporary  bool
+	RetryAfter time.Duration // From a Retry-After header
+}
+
+func (e *ProviderError) Error() string {
+	if e.Status == 0 {
+		return fmt.Sprintf("%s: %s", e.Provider, e.Message)
+	}
+	if e.Code != "" {
+		return fmt.Sprintf("%s: HTTP %d, code %s: %s", e.Provider, e.Status, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s: HTTP %d: %s", e.Provider, e.Status, e.Message)
+}
+
+// networkError wraps a failed request, which is always worth retrying
+func networkError(provider string, err error) *ProviderError {
+	return &ProviderError{
+		Provider:  provider,
+		Message:   err.Error(),
+		Temporary: true,
+	}
+}
+
+// responseError builds the error for a non-2xx response
+func responseError(provider string, resp *http.Response, code, message string) *ProviderError {
+	if message == "" {
+		message = http.StatusText(resp.StatusCode)
+	}
+
+	err := &ProviderError{
+		Provider:  provider,
+		Status:    resp.StatusCode,
+		Code:      code,
+		Message:   message,
+		Temporary: resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500,
+	}
+	if seconds, parseErr := strconv.Atoi(resp.Header.Get("Retry-After")); parseErr == nil {
+		err.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return err
+}
+
+// Mock logs messages instead of sending them, for development
+type Mock struct{}
+
+func (m *Mock) Name() string {
+	return "mock"
+}
+
+func (m *Mock) Send(ctx context.Context, to, body string) (string, error) {
+	log.Printf("[MOCK SMS] To: %s, Message: %s", to, body)
+	return fmt.Sprintf("mock-%d", time.Now().UnixNano()), nil
+}
@@ -0,0 +1,77 @@
+package sms
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// Longest wait between two attempts, unless the provider asks for more
+const maxBackoff = 10 * time.Second
+
+// Retrying retries a provider's temporary failures with exponential backoff
+type Retrying struct {
+	provider Provider
+	attempts int
+	backoff  time.Duration
+}
+
+// WithRetries makes up to attempts sends, waiting backoff before the first
+// retry and doubling it for each one after, with jitter
+func WithRetries(provider Provider, attempts int, backoff time.Duration) *Retrying {
+	if attempts < 1 {
+		attempts = 1
+	}
+	return &Retrying{
+		provider: provider,
+		attempts: attempts,
+		backoff:  backoff,
+	}
+}
+
+func (r *Retrying) Name() string {
+	return r.provider.Name()
+}
+
+func (r *Retrying) Send(ctx context.Context, to, body string) (string, error) {
+	delay := r.backoff
+	for attempt := 1; ; attempt++ {
+		id, err := r.provider.Send(ctx, to, body)
+		if err == nil {
+			return id, nil
+		}
+
+		var providerErr *ProviderError
+		if !errors.As(err, &providerErr) || !providerErr.Temporary || attempt >= r.attempts {
+			return "", err
+		}
+
+		// Full delay plus up to 50% jitter, so retries from many requests
+		// don't hit the provider in lockstep
+		wait := delay
+		if wait > 0 {
+			wait += time.Duration(rand.Int63n(int64(wait)/2 + 1))
+		}
+		if providerErr.RetryAfter > wait {
+			wait = providerErr.RetryAfter
+		}
+
+		log.Printf("[SMS] Send via %s to %s failed (attempt %d/%d), retrying in %s: %v",
+			r.Name(), to, attempt, r.attempts, wait.Round(time.Millisecond), err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return "", err
+		case <-timer.C:
+		}
+
+		delay *= 2
+		if delay > maxBackoff {
+			delay = maxBackoff
+		}
+	}
+}
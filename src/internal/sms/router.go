@@ -0,0 +1,128 @@
+package sms
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"chat-e2ee/internal/config"
+)
+
+// Router sends each message through the provider routed for the number's
+// prefix, falling back to a default provider. It implements
+// auth.SMSProvider.
+type Router struct {
+	providers map[string]Provider
+	routes    []route // Longest prefix first
+	fallback  Provider
+	statuses  *StatusStore
+}
+
+type route struct {
+	prefix   string
+	provider Provider
+}
+
+// New builds the providers configured in cfg and routes between them.
+// Providers other than the mock retry temporary failures. Delivery statuses
+// are recorded in statuses, which may be nil.
+func New(cfg config.SMSConfig, statuses *StatusStore) (*Router, error) {
+	callback := func(provider string) string {
+		if cfg.StatusCallbackURL == "" {
+			return ""
+		}
+		return strings.TrimSuffix(cfg.StatusCallbackURL, "/") + "/" + provider
+	}
+
+	providers := map[string]Provider{
+		"mock": &Mock{},
+	}
+	if cfg.AccountSID != "" {
+		providers["twilio"] = WithRetries(
+			NewTwilio(cfg.AccountSID, cfg.AuthToken, cfg.FromNumber, cfg.TwilioURL, callback("twilio")),
+			cfg.MaxAttempts, cfg.RetryBackoff,
+		)
+	}
+	if cfg.HTTPURL != "" {
+		providers["http"] = WithRetries(
+			NewHTTPProvider(cfg.HTTPURL, cfg.HTTPToken, cfg.HTTPFrom, callback("http")),
+			cfg.MaxAttempts, cfg.RetryBackoff,
+		)
+	}
+
+	fallback, ok := providers[cfg.Provider]
+	if !ok {
+		return nil, fmt.Errorf("SMS provider %q is unknown or not configured", cfg.Provider)
+	}
+
+	router := &Router{
+		providers: providers,
+		fallback:  fallback,
+		statuses:  statuses,
+	}
+	for prefix, name := range cfg.Routes {
+		provider, ok := providers[name]
+		if !ok {
+			return nil, fmt.Errorf("SMS route %s: provider %q is unknown or not configured", prefix, name)
+		}
+		router.routes = append(router.routes, route{
+			prefix:   normalizeNumber(prefix),
+			provider: provider,
+		})
+	}
+	sort.Slice(router.routes, func(i, j int) bool {
+		return len(router.routes[i].prefix) > len(router.routes[j].prefix)
+	})
+
+	return router, nil
+}
+
+// Describe lists the fallback provider and the routes, for startup logs
+func (r *Router) Describe() string {
+	parts := []string{"default=" + r.fallback.Name()}
+	for _, route := range r.routes {
+		parts = append(parts, route.prefix+"="+route.provider.Name())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ProviderFor returns the provider a number is routed to
+func (r *Router) ProviderFor(to string) Provider {
+	to = normalizeNumber(to)
+	for _, route := range r.routes {
+		if strings.HasPrefix(to, route.prefix) {
+			return route.provider
+		}
+	}
+	return r.fallback
+}
+
+// SendSMS sends a message through the routed provider. The number is sent
+// and recorded in E.164 form, with its leading +.
+func (r *Router) SendSMS(ctx context.Context, to, message string) error {
+	to = normalizeNumber(to)
+	provider := r.ProviderFor(to)
+
+	id, err := provider.Send(ctx, to, message)
+	if err != nil {
+		return err
+	}
+
+	if r.statuses != nil && id != "" {
+		if err := r.statuses.Sent(ctx, provider.Name(), id, to); err != nil {
+			log.Printf("[SMS] Failed to record message %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// normalizeNumber adds the leading + to numbers and prefixes missing one
+func normalizeNumber(number string) string {
+	number = strings.TrimSpace(number)
+	if !strings.HasPrefix(number, "+") {
+		number = "+" + number
+	}
+	return number
+}
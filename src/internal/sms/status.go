@@ -0,0 +1,104 @@
+package sms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Delivery statuses, as reported by Twilio and normalised for other providers
+const (
+	StatusQueued      = "queued"
+	StatusSent        = "sent"
+	StatusDelivered   = "delivered"
+	StatusUndelivered = "undelivered"
+	StatusFailed      = "failed"
+)
+
+// How long message statuses are kept
+const statusTTL = 7 * 24 * time.Hour
+
+var ErrMessageNotFound = errors.New("message not found")
+
+// MessageStatus is the latest known delivery status of a sent message
+type MessageStatus struct {
+	Provider     string
+	ID           string
+	To           string
+	Status       string
+	ErrorCode    string
+	ErrorMessage string
+	UpdatedAt    time.Time
+}
+
+// StatusStore keeps message delivery statuses in Redis
+type StatusStore struct {
+	redis *redis.Client
+}
+
+func NewStatusStore(redisClient *redis.Client) *StatusStore {
+	return &StatusStore{redis: redisClient}
+}
+
+func statusKey(provider, id string) string {
+	return fmt.Sprintf("sms:message:%s:%s", provider, id)
+}
+
+// Sent records a message accepted by a provider
+func (s *StatusStore) Sent(ctx context.Context, provider, id, to string) error {
+	pipe := s.redis.TxPipeline()
+	pipe.HSet(ctx, statusKey(provider, id),
+		"to", to,
+		"status", StatusQueued,
+		"updated_at", time.Now().Unix(),
+	)
+	pipe.Expire(ctx, statusKey(provider, id), statusTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Update records a status reported by a provider callback. Statuses for
+// messages this server didn't send are ignored with ErrMessageNotFound.
+func (s *StatusStore) Update(ctx context.Context, provider, id, status, errorCode, errorMessage string) error {
+	exists, err := s.redis.Exists(ctx, statusKey(provider, id)).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return ErrMessageNotFound
+	}
+
+	return s.redis.HSet(ctx, statusKey(provider, id),
+		"status", status,
+		"error_code", errorCode,
+		"error_message", errorMessage,
+		"updated_at", time.Now().Unix(),
+	).Err()
+}
+
+// Get returns the latest status of a message
+func (s *StatusStore) Get(ctx context.Context, provider, id string) (*MessageStatus, error) {
+	fields, err := s.redis.HGetAll(ctx, statusKey(provider, id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, ErrMessageNotFound
+	}
+
+	var updatedAt int64
+	fmt.Sscan(fields["updated_at"], &updatedAt)
+
+	return &MessageStatus{
+		Provider:     provider,
+		ID:           id,
+		To:           fields["to"],
+		Status:       fields["status"],
+		ErrorCode:    fields["error_code"],
+		ErrorMessage: fields["error_message"],
+		UpdatedAt:    time.Unix(updatedAt, 0),
+	}, nil
+}
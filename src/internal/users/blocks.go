@@ -0,0 +1,119 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// How long a user's block set stays cached. Blocks changed through the
+// service apply at once; direct database edits within this time.
+const blocksCacheTTL = 10 * time.Minute
+
+// blocksPlaceholder keeps a cached set from being empty, so users without
+// blocks are cache hits too
+const blocksPlaceholder = "-"
+
+// Blocks answers whether two users blocked each other. Blocking works both
+// ways: neither side can message or find the other. Each user's set of
+// blocked and blocking users is cached in Redis.
+type Blocks struct {
+	db    *sql.DB
+	redis *redis.Client
+}
+
+func NewBlocks(db *sql.DB, redisClient *redis.Client) *Blocks {
+	return &Blocks{
+		db:    db,
+		redis: redisClient,
+	}
+}
+
+func blocksKey(userID string) string {
+	return fmt.Sprintf("blocks:%s", userID)
+}
+
+// Blocked reports whether either user blocked the other. userID must be a
+// valid user ID, otherID may be anything.
+func (b *Blocks) Blocked(ctx context.Context, userID, otherID string) (bool, error) {
+	if userID == otherID {
+		return false, nil
+	}
+
+	pipe := b.redis.Pipeline()
+	exists := pipe.Exists(ctx, blocksKey(userID))
+	member := pipe.SIsMember(ctx, blocksKey(userID), otherID)
+	if _, err := pipe.Exec(ctx); err == nil && exists.Val() == 1 {
+		return member.Val(), nil
+	}
+
+	ids, err := b.load(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range ids {
+		if id == otherID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Hidden returns everyone userID blocked or was blocked by
+func (b *Blocks) Hidden(ctx context.Context, userID string) ([]string, error) {
+	cached, err := b.redis.SMembers(ctx, blocksKey(userID)).Result()
+	if err == nil && len(cached) > 0 {
+		ids := make([]string, 0, len(cached)-1)
+		for _, id := range cached {
+			if id != blocksPlaceholder {
+				ids = append(ids, id)
+			}
+		}
+		return ids, nil
+	}
+
+	return b.load(ctx, userID)
+}
+
+// Invalidate drops the cached sets of both sides of a block
+func (b *Blocks) Invalidate(ctx context.Context, userID, otherID string) error {
+	return b.redis.Del(ctx, blocksKey(userID), blocksKey(otherID)).Err()
+}
+
+func (b *Blocks) load(ctx context.Context, userID string) ([]string, error) {
+	rows, err := b.db.QueryContext(ctx,
+		`SELECT contact_id FROM user_contacts WHERE user_id = $1 AND blocked
+		UNION
+		SELECT user_id FROM user_contacts WHERE contact_id = $1 AND blocked`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0)
+	members := []interface{}{blocksPlaceholder}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+		members = append(members, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	pipe := b.redis.TxPipeline()
+	pipe.Del(ctx, blocksKey(userID))
+	pipe.SAdd(ctx, blocksKey(userID), members...)
+	pipe.Expire(ctx, blocksKey(userID), blocksCacheTTL)
+	pipe.Exec(ctx)
+
+	return ids, nil
+}
@@ -5,24 +5,43 @@ import (
 	"database/sql"
 	"log"
 	"strings"
+	"time"
 
 	"chat-e2ee/internal/media"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
 	"github.com/minio/minio-go/v7"
 )
 
+// Notifier sends a server event to a user's connected devices
+type Notifier interface {
+	NotifyUser(userID, event string, payload interface{})
+}
+
 // Handler handles user-related HTTP requests
 type Handler struct {
 	service      *Service
 	mediaService *media.Service
+	requests     *Requests
+	settings     *Settings
+	notifier     Notifier
 }
 
-// NewHandler creates a new user handler
-func NewHandler(db *sql.DB, minioClient *minio.Client, bucketMedia string) *Handler {
+// NewHandler creates a new user handler. Blocks made through it apply to
+// the relay and discovery through blocks; senders hear about accepted
+// message requests through notifier.
+func NewHandler(db *sql.DB, minioClient *minio.Client, bucketMedia string, blocks *Blocks, requests *Requests, settings *Settings, notifier Notifier) *Handler {
+	service := NewService(db)
+	service.UseBlocks(blocks)
+	service.UseRequests(requests)
+
 	return &Handler{
-		service:      NewService(db),
+		service:      service,
 		mediaService: media.NewService(db, minioClient, bucketMedia, "", ""),
+		requests:     requests,
+		settings:     settings,
+		notifier:     notifier,
 	}
 }
 
@@ -64,24 +83,19 @@ func (h *Handler) GetMe(c *fiber.Ctx) error {
 		devices = []*Device{}
 	}
 
-	// TODO: Get user settings from a settings table or user metadata
-	settings := UserSettings{
-		NotificationsEnabled: true,
-		Language:             "en",
-		Theme:                "light",
-		Privacy: PrivacySettings{
-			ShowOnline:      true,
-			ShowLastSeen:    true,
-			AllowDiscovery:  true,
-			RequireApproval: false,
-		},
+	settings, err := h.settings.Get(c.Context(), userID)
+	if err != nil {
+		log.Printf("[GetMe] Error fetching settings: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch settings",
+		})
 	}
 
 	log.Printf("[GetMe] Returning profile for user: %s", userID)
 	return c.JSON(UserProfileResponse{
 		User:     user,
 		Devices:  devices,
-		Settings: settings,
+		Settings: *settings,
 	})
 }
 
@@ -149,7 +163,8 @@ func (h *Handler) UpdateAvatar(c *fiber.Ctx) error {
 	}
 
 	// Validate file type
-	if err := media.ValidateFileType(file.Filename, file.Header.Get("Content-Type")); err != nil {
+	format, err := media.ValidateFileType(file.Filename, file.Header.Get("Content-Type"))
+	if err != nil || format.MediaType != "photo" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Invalid file type. Only images are allowed",
 		})
@@ -166,7 +181,13 @@ func (h *Handler) UpdateAvatar(c *fiber.Ctx) error {
 
 	// Upload file
 	mediaFile, err := h.mediaService.UploadFile(c.Context(), src, file, userID, "photo")
-	if err != nil {
+	switch err {
+	case nil:
+	case media.ErrTypeMismatch, media.ErrImageTooLarge, media.ErrPolyglotFile:
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Invalid image",
+		})
+	default:
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to upload avatar",
 		})
@@ -186,9 +207,24 @@ func (h *Handler) UpdateAvatar(c *fiber.Ctx) error {
 	})
 }
 
-// GetUser returns a public user profile
+// GetUser returns a public user profile. Users on either side of a block
+// with the viewer don't exist for them.
 func (h *Handler) GetUser(c *fiber.Ctx) error {
 	targetUserID := c.Params("id")
+	viewerID, _ := c.Locals("userID").(string)
+
+	blocked, err := h.service.Blocked(c.Context(), viewerID, targetUserID)
+	if err != nil {
+		log.Printf("[GetUser] Failed to check blocks of %s: %v", viewerID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch user",
+		})
+	}
+	if blocked {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
 
 	// Get user info
 	user, err := h.service.GetUser(c.Context(), targetUserID)
@@ -210,13 +246,48 @@ func (h *Handler) GetUser(c *fiber.Ctx) error {
 		DisplayName: user.DisplayName,
 		AvatarURL:   user.AvatarURL,
 		Role:        user.Role,
-		IsOnline:    user.IsOnline,
-		LastSeen:    user.LastSeen,
+	}
+
+	showOnline, showLastSeen, err := h.service.PresenceVisible(c.Context(), viewerID, targetUserID)
+	if err != nil {
+		log.Printf("[GetUser] Failed to check presence of %s for %s: %v", targetUserID, viewerID, err)
+	}
+	if showOnline {
+		publicUser.IsOnline = user.IsOnline
+	}
+	if showLastSeen {
+		publicUser.LastSeen = &user.LastSeen
 	}
 
 	return c.JSON(publicUser)
 }
 
+// GetUserDevices returns the device keys of a user, so senders can encrypt
+// a message envelope for each of their devices
+func (h *Handler) GetUserDevices(c *fiber.Ctx) error {
+	targetUserID := c.Params("id")
+
+	devices, err := h.getUserDevices(c.Context(), targetUserID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch devices",
+		})
+	}
+
+	keys := make([]DeviceKey, 0, len(devices))
+	for _, d := range devices {
+		keys = append(keys, DeviceKey{
+			DeviceID:  d.DeviceID,
+			PublicKey: d.PublicKey,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"user_id": targetUserID,
+		"devices": keys,
+	})
+}
+
 // GetContacts returns the user's contact list
 func (h *Handler) GetContacts(c *fiber.Ctx) error {
 	userID := c.Locals("userID").(string)
@@ -373,6 +444,178 @@ func (h *Handler) UnblockContact(c *fiber.Ctx) error {
 	})
 }
 
+// GetSettings returns the user's settings
+func (h *Handler) GetSettings(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	settings, err := h.settings.Get(c.Context(), userID)
+	if err != nil {
+		return h.settingsError(c, err, "Failed to fetch settings")
+	}
+
+	return c.JSON(settings)
+}
+
+// UpdateSettings changes the settings present in the body
+func (h *Handler) UpdateSettings(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var req UpdateSettingsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	settings, err := h.settings.Update(c.Context(), userID, &req)
+	if err != nil {
+		return h.settingsError(c, err, "Failed to update settings")
+	}
+
+	return c.JSON(settings)
+}
+
+func (h *Handler) settingsError(c *fiber.Ctx, err error, message string) error {
+	switch err {
+	case ErrInvalidLanguage:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid language. Use a language tag such as en, es or pt-BR",
+		})
+	case ErrInvalidTheme:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid theme. Use light, dark or system",
+		})
+	case ErrNoSettings:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "No settings to update",
+		})
+	default:
+		log.Printf("[Users] %s: %v", message, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": message,
+		})
+	}
+}
+
+// ListRequests returns the message requests waiting for the user's answer
+func (h *Handler) ListRequests(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	requests, err := h.requests.Incoming(c.Context(), userID)
+	if err != nil {
+		return h.requestError(c, err, "Failed to fetch message requests")
+	}
+
+	return c.JSON(fiber.Map{
+		"requests": requests,
+		"count":    len(requests),
+	})
+}
+
+// ListSentRequests returns the message requests the user opened
+func (h *Handler) ListSentRequests(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	requests, err := h.requests.Sent(c.Context(), userID)
+	if err != nil {
+		return h.requestError(c, err, "Failed to fetch message requests")
+	}
+
+	return c.JSON(fiber.Map{
+		"requests": requests,
+		"count":    len(requests),
+	})
+}
+
+// AcceptRequest accepts a message request, making sender and recipient
+// contacts of each other
+func (h *Handler) AcceptRequest(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	requestID := c.Params("id")
+
+	senderID, err := h.requests.Accept(c.Context(), userID, requestID)
+	if err != nil {
+		return h.requestError(c, err, "Failed to accept message request")
+	}
+
+	if h.notifier != nil {
+		// Delivered after the request returns, and route params alias its buffers
+		h.notifier.NotifyUser(senderID, EventRequestAccepted, fiber.Map{
+			"request_id":  utils.CopyString(requestID),
+			"user_id":     userID,
+			"accepted_at": time.Now().UTC(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":    "Message request accepted",
+		"request_id": requestID,
+		"contact_id": senderID,
+	})
+}
+
+// DeclineRequest turns down a message request without telling the sender
+func (h *Handler) DeclineRequest(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	if err := h.requests.Decline(c.Context(), userID, c.Params("id")); err != nil {
+		return h.requestError(c, err, "Failed to decline message request")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Message request declined",
+	})
+}
+
+// BlockRequest turns down a message request and blocks its sender
+func (h *Handler) BlockRequest(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	if err := h.requests.Block(c.Context(), userID, c.Params("id")); err != nil {
+		return h.requestError(c, err, "Failed to block sender")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Message request declined and sender blocked",
+	})
+}
+
+// UpdateRequestSettings turns message requests on or off for the user
+func (h *Handler) UpdateRequestSettings(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var req struct {
+		RequireApproval *bool `json:"require_approval"`
+	}
+	if err := c.BodyParser(&req); err != nil || req.RequireApproval == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "require_approval is required",
+		})
+	}
+
+	if err := h.requests.SetRequireApproval(c.Context(), userID, *req.RequireApproval); err != nil {
+		return h.requestError(c, err, "Failed to update settings")
+	}
+
+	return c.JSON(fiber.Map{
+		"require_approval": *req.RequireApproval,
+	})
+}
+
+func (h *Handler) requestError(c *fiber.Ctx, err error, message string) error {
+	switch err {
+	case ErrRequestNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Message request not found",
+		})
+	default:
+		log.Printf("[Users] %s: %v", message, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": message,
+		})
+	}
+}
+
 // Helper function to get user devices
 func (h *Handler) getUserDevices(ctx context.Context, userID string) ([]*Device, error) {
 	query := `
@@ -22,13 +22,13 @@ type User struct {
 
 // PublicUser represents public user information
 type PublicUser struct {
-	ID          string    `json:"id"`
-	Username    *string   `json:"username,omitempty"`
-	DisplayName *string   `json:"display_name,omitempty"`
-	AvatarURL   *string   `json:"avatar_url,omitempty"`
-	Role        string    `json:"role"`
-	IsOnline    bool      `json:"is_online"`
-	LastSeen    time.Time `json:"last_seen"`
+	ID          string     `json:"id"`
+	Username    *string    `json:"username,omitempty"`
+	DisplayName *string    `json:"display_name,omitempty"`
+	AvatarURL   *string    `json:"avatar_url,omitempty"`
+	Role        string     `json:"role"`
+	IsOnline    bool       `json:"is_online"`
+	LastSeen    *time.Time `json:"last_seen,omitempty"` // Hidden from viewers not allowed to see it
 }
 
 // Contact represents a user's contact
@@ -40,30 +40,46 @@ type Contact struct {
 	CreatedAt time.Time `json:"created_at"`
 
 	// User info
-	Username    *string   `json:"username,omitempty"`
-	DisplayName *string   `json:"display_name,omitempty"`
-	AvatarURL   *string   `json:"avatar_url,omitempty"`
-	Status      string    `json:"status"`
-	IsOnline    bool      `json:"is_online"`
-	LastSeen    time.Time `json:"last_seen"`
+	Username    *string    `json:"username,omitempty"`
+	DisplayName *string    `json:"display_name,omitempty"`
+	AvatarURL   *string    `json:"avatar_url,omitempty"`
+	Status      string     `json:"status"`
+	IsOnline    bool       `json:"is_online"`
+	LastSeen    *time.Time `json:"last_seen,omitempty"` // Hidden from viewers not allowed to see it
 }
 
 // ModelProfile represents a model's public profile
 type ModelProfile struct {
-	ID          string    `json:"id"`
-	Username    *string   `json:"username,omitempty"`
-	DisplayName *string   `json:"display_name,omitempty"`
-	AvatarURL   *string   `json:"avatar_url,omitempty"`
-	Status      string    `json:"status"`
-	IsOnline    bool      `json:"is_online"`
-	LastSeen    time.Time `json:"last_seen"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID          string     `json:"id"`
+	Username    *string    `json:"username,omitempty"`
+	DisplayName *string    `json:"display_name,omitempty"`
+	AvatarURL   *string    `json:"avatar_url,omitempty"`
+	Status      string     `json:"status"`
+	IsOnline    bool       `json:"is_online"`
+	LastSeen    *time.Time `json:"last_seen,omitempty"` // Hidden from viewers not allowed to see it
+	CreatedAt   time.Time  `json:"created_at"`
 
 	// Gallery info
 	GalleryID  *string `json:"gallery_id,omitempty"`
 	MediaCount *int    `json:"media_count,omitempty"`
 }
 
+// MessageRequest is a request from a non-contact to message a user who
+// requires approval
+type MessageRequest struct {
+	ID          string     `json:"id"`
+	SenderID    string     `json:"sender_id"`
+	RecipientID string     `json:"recipient_id"`
+	Status      string     `json:"status"` // pending, accepted, declined
+	CreatedAt   time.Time  `json:"created_at"`
+	RespondedAt *time.Time `json:"responded_at,omitempty"`
+
+	// The other user: the sender for incoming requests, the recipient for sent ones
+	Username    *string `json:"username,omitempty"`
+	DisplayName *string `json:"display_name,omitempty"`
+	AvatarURL   *string `json:"avatar_url,omitempty"`
+}
+
 // UpdateProfileRequest represents a profile update request
 type UpdateProfileRequest struct {
 	Username    *string                `json:"username,omitempty" validate:"omitempty,min=3,max=30,alphanum"`
@@ -78,6 +94,23 @@ type AddContactRequest struct {
 	Nickname  *string `json:"nickname,omitempty" validate:"omitempty,max=100"`
 }
 
+// UpdateSettingsRequest changes some of a user's settings; omitted fields
+// are left as they are
+type UpdateSettingsRequest struct {
+	NotificationsEnabled *bool                 `json:"notifications_enabled,omitempty"`
+	Language             *string               `json:"language,omitempty" validate:"omitempty,max=16"`
+	Theme                *string               `json:"theme,omitempty" validate:"omitempty,oneof=light dark system"`
+	Privacy              *UpdatePrivacyRequest `json:"privacy,omitempty"`
+}
+
+// UpdatePrivacyRequest changes some of a user's privacy settings
+type UpdatePrivacyRequest struct {
+	ShowOnline      *bool `json:"show_online,omitempty"`
+	ShowLastSeen    *bool `json:"show_last_seen,omitempty"`
+	AllowDiscovery  *bool `json:"allow_discovery,omitempty"`
+	RequireApproval *bool `json:"require_approval,omitempty"`
+}
+
 // UpdateContactRequest represents a contact update request
 type UpdateContactRequest struct {
 	Nickname *string `json:"nickname,omitempty" validate:"omitempty,max=100"`
@@ -97,6 +130,9 @@ type ModelFilters struct {
 	SortBy     string `query:"sort_by"` // newest, active, popular
 	Page       int    `query:"page"`
 	PageSize   int    `query:"page_size"`
+
+	// The signed-in user browsing, whose blocks are left out
+	ViewerID string `query:"-"`
 }
 
 // ModelsResponse represents a paginated list of models
@@ -119,6 +155,13 @@ type Device struct {
 	CreatedAt  time.Time `json:"created_at"`
 }
 
+// DeviceKey is the public part of another user's device, used to encrypt
+// one message envelope per device
+type DeviceKey struct {
+	DeviceID  string `json:"device_id"`
+	PublicKey string `json:"public_key"`
+}
+
 // UserProfileResponse represents the complete user profile
 type UserProfileResponse struct {
 	User     *User        `json:"user"`
@@ -143,6 +186,13 @@ type PrivacySettings struct {
 	RequireApproval bool `json:"require_approval"`
 }
 
+// Themes a user can pick
+const (
+	ThemeLight  = "light"
+	ThemeDark   = "dark"
+	ThemeSystem = "system"
+)
+
 // Constants for user roles and status
 const (
 	RoleUser  = "user"
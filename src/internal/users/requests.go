@@ -0,0 +1,330 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// How long a user's require_approval setting stays cached
+const approvalCacheTTL = 10 * time.Minute
+
+// Message request statuses, as in the message_request_status enum
+const (
+	RequestPending  = "pending"
+	RequestAccepted = "accepted"
+	RequestDeclined = "declined"
+)
+
+// EventRequestAccepted is the frame the sender's devices get when their
+// request is accepted
+const EventRequestAccepted = "request_accepted"
+
+var ErrRequestNotFound = errors.New("message request not found")
+
+// Requests holds messages from non-contacts to users who require approval.
+// The first one opens a message request; until the recipient accepts it the
+// sender can't send more, see them typing, get receipts or see their
+// presence.
+type Requests struct {
+	db     *sql.DB
+	redis  *redis.Client
+	blocks *Blocks
+}
+
+func NewRequests(db *sql.DB, redisClient *redis.Client, blocks *Blocks) *Requests {
+	return &Requests{
+		db:     db,
+		redis:  redisClient,
+		blocks: blocks,
+	}
+}
+
+func approvalKey(userID string) string {
+	return fmt.Sprintf("approval:%s", userID)
+}
+
+// RequiresApproval reports whether a user holds messages from non-contacts
+func (r *Requests) RequiresApproval(ctx context.Context, userID string) (bool, error) {
+	if cached, err := r.redis.Get(ctx, approvalKey(userID)).Result(); err == nil {
+		return cached == "1", nil
+	}
+
+	var required bool
+	err := r.db.QueryRowContext(ctx,
+		"SELECT COALESCE((SELECT require_approval FROM user_settings WHERE user_id = $1), false)",
+		userID,
+	).Scan(&required)
+	if isInvalidID(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	value := "0"
+	if required {
+		value = "1"
+	}
+	r.redis.Set(ctx, approvalKey(userID), value, approvalCacheTTL)
+
+	return required, nil
+}
+
+// SetRequireApproval turns message requests on or off for a user. Turning
+// them off doesn't accept pending requests, it only lets new senders through.
+func (r *Requests) SetRequireApproval(ctx context.Context, userID string, required bool) error {
+	_, err := r.db.ExecContext(ctx,
+		`INSERT INTO user_settings (user_id, require_approval) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET require_approval = EXCLUDED.require_approval`,
+		userID, required,
+	)
+	if err != nil {
+		return err
+	}
+
+	return r.redis.Del(ctx, approvalKey(userID)).Err()
+}
+
+// Approved reports whether otherID may reach userID: message them, see them
+// typing, get their receipts and see their presence. That is always the case
+// unless userID requires approval and hasn't got otherID as a contact.
+// otherID may be empty for anonymous viewers.
+func (r *Requests) Approved(ctx context.Context, userID, otherID string) (bool, error) {
+	if userID == otherID {
+		return true, nil
+	}
+
+	required, err := r.RequiresApproval(ctx, userID)
+	if err != nil || !required || otherID == "" {
+		return !required, err
+	}
+
+	var contact bool
+	err = r.db.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM user_contacts WHERE user_id = $1 AND contact_id = $2 AND NOT blocked)",
+		userID, otherID,
+	).Scan(&contact)
+	if isInvalidID(err) {
+		return false, nil
+	}
+	return contact, err
+}
+
+// Admit decides whether a message from senderID may go to recipientID. If
+// the recipient requires approval and the sender is not a contact, the
+// first message opens a request and is let through with its ID; later ones
+// are refused until the request is accepted.
+func (r *Requests) Admit(ctx context.Context, senderID, recipientID string) (requestID string, admitted bool, err error) {
+	approved, err := r.Approved(ctx, recipientID, senderID)
+	if err != nil || approved {
+		return "", approved, err
+	}
+
+	// A request accepted earlier whose contact was since removed starts over
+	err = r.db.QueryRowContext(ctx,
+		`INSERT INTO message_requests (sender_id, recipient_id) VALUES ($1, $2)
+		ON CONFLICT (sender_id, recipient_id) DO UPDATE
+		SET status = 'pending', created_at = NOW(), responded_at = NULL
+		WHERE message_requests.status = 'accepted'
+		RETURNING id`,
+		senderID, recipientID,
+	).Scan(&requestID)
+	switch {
+	case err == sql.ErrNoRows:
+		return "", false, nil
+	case isInvalidID(err):
+		// No such recipient; the message goes nowhere anyway
+		return "", true, nil
+	case err != nil:
+		return "", false, err
+	}
+
+	return requestID, true, nil
+}
+
+// Incoming returns the requests waiting for a user's answer
+func (r *Requests) Incoming(ctx context.Context, userID string) ([]*MessageRequest, error) {
+	return r.list(ctx,
+		`SELECT m.id, m.sender_id, m.recipient_id, m.status, m.created_at, m.responded_at,
+		       u.username, u.display_name, u.avatar_url
+		FROM message_requests m
+		JOIN users u ON u.id = m.sender_id
+		WHERE m.recipient_id = $1 AND m.status = 'pending' AND u.deleted_at IS NULL
+		ORDER BY m.created_at DESC`,
+		userID,
+	)
+}
+
+// Sent returns the requests a user opened. Declined ones are shown as
+// pending, so senders can't tell.
+func (r *Requests) Sent(ctx context.Context, userID string) ([]*MessageRequest, error) {
+	requests, err := r.list(ctx,
+		`SELECT m.id, m.sender_id, m.recipient_id, m.status, m.created_at, NULL,
+		       u.username, u.display_name, u.avatar_url
+		FROM message_requests m
+		JOIN users u ON u.id = m.recipient_id
+		WHERE m.sender_id = $1 AND u.deleted_at IS NULL
+		ORDER BY m.created_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, request := range requests {
+		if request.Status == RequestDeclined {
+			request.Status = RequestPending
+		} else {
+			request.RespondedAt = nil
+		}
+	}
+	return requests, nil
+}
+
+func (r *Requests) list(ctx context.Context, query, userID string) ([]*MessageRequest, error) {
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := make([]*MessageRequest, 0)
+	for rows.Next() {
+		var m MessageRequest
+		var respondedAt pq.NullTime
+		err := rows.Scan(
+			&m.ID, &m.SenderID, &m.RecipientID, &m.Status, &m.CreatedAt, &respondedAt,
+			&m.Username, &m.DisplayName, &m.AvatarURL,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if respondedAt.Valid {
+			m.RespondedAt = &respondedAt.Time
+		}
+		requests = append(requests, &m)
+	}
+
+	return requests, rows.Err()
+}
+
+// Accept accepts a request addressed to recipientID, adding each user to
+// the other's contacts. It returns the sender.
+func (r *Requests) Accept(ctx context.Context, recipientID, requestID string) (string, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	senderID, err := r.respond(ctx, tx, recipientID, requestID, RequestAccepted)
+	if err != nil {
+		return "", err
+	}
+
+	// Accepting lifts a block the recipient had put on the sender, but not
+	// one the sender had put on them
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO user_contacts (user_id, contact_id) VALUES ($1, $2)
+		ON CONFLICT (user_id, contact_id) DO UPDATE SET blocked = false`,
+		recipientID, senderID,
+	)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO user_contacts (user_id, contact_id) VALUES ($1, $2)
+		ON CONFLICT (user_id, contact_id) DO NOTHING`,
+		senderID, recipientID,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	r.invalidateBlocks(ctx, recipientID, senderID)
+	return senderID, nil
+}
+
+// Decline turns down a request. The sender isn't told and still can't
+// send any more messages.
+func (r *Requests) Decline(ctx context.Context, recipientID, requestID string) error {
+	_, err := r.respond(ctx, r.db, recipientID, requestID, RequestDeclined)
+	return err
+}
+
+// Block declines a request and blocks its sender
+func (r *Requests) Block(ctx context.Context, recipientID, requestID string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	senderID, err := r.respond(ctx, tx, recipientID, requestID, RequestDeclined)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO user_contacts (user_id, contact_id, blocked) VALUES ($1, $2, true)
+		ON CONFLICT (user_id, contact_id) DO UPDATE SET blocked = true`,
+		recipientID, senderID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	r.invalidateBlocks(ctx, recipientID, senderID)
+	return nil
+}
+
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// respond answers a request that hasn't been accepted yet and returns its
+// sender. A declined request can still be accepted or blocked later.
+func (r *Requests) respond(ctx context.Context, q queryer, recipientID, requestID, status string) (string, error) {
+	var senderID string
+	err := q.QueryRowContext(ctx,
+		`UPDATE message_requests SET status = $3, responded_at = NOW()
+		WHERE id = $1 AND recipient_id = $2 AND status <> 'accepted'
+		RETURNING sender_id`,
+		requestID, recipientID, status,
+	).Scan(&senderID)
+	if err == sql.ErrNoRows || isInvalidID(err) {
+		return "", ErrRequestNotFound
+	}
+	return senderID, err
+}
+
+func (r *Requests) invalidateBlocks(ctx context.Context, userID, otherID string) {
+	if r.blocks == nil {
+		return
+	}
+	if err := r.blocks.Invalidate(ctx, userID, otherID); err != nil {
+		log.Printf("[Users] Failed to invalidate blocks of %s and %s: %v", userID, otherID, err)
+	}
+}
+
+// isInvalidID reports whether a query failed on an ID that is not a UUID
+// or does not reference an existing row
+func isInvalidID(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && (pqErr.Code == "22P02" || pqErr.Code == "23503")
+}
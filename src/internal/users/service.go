@@ -27,6 +27,12 @@ var (
 // Service handles user-related operations
 type Service struct {
 	db *sql.DB
+
+	// Block checks and cache invalidation, see UseBlocks
+	blocks *Blocks
+
+	// Approval of non-contacts, see UseRequests
+	requests *Requests
 }
 
 // NewService creates a new user service
@@ -34,6 +40,55 @@ func NewService(db *sql.DB) *Service {
 	return &Service{db: db}
 }
 
+// UseBlocks makes the service hide users from the people they blocked or
+// were blocked by, and keep the block cache current when contacts change
+func (s *Service) UseBlocks(blocks *Blocks) {
+	s.blocks = blocks
+}
+
+// UseRequests makes the service hide the presence of users who require
+// approval from everyone they haven't approved
+func (s *Service) UseRequests(requests *Requests) {
+	s.requests = requests
+}
+
+// PresenceVisible reports what viewerID may see of userID's presence:
+// whether they are online and when they were last seen. Users can hide
+// either from everyone, and users who require approval hide both from
+// everyone they haven't approved. viewerID is empty for anonymous viewers.
+func (s *Service) PresenceVisible(ctx context.Context, viewerID, userID string) (online, lastSeen bool, err error) {
+	if viewerID == userID {
+		return true, true, nil
+	}
+
+	err = s.db.QueryRowContext(ctx,
+		`SELECT COALESCE((SELECT show_online FROM user_settings WHERE user_id = $1), true),
+		        COALESCE((SELECT show_last_seen FROM user_settings WHERE user_id = $1), true)`,
+		userID,
+	).Scan(&online, &lastSeen)
+	if err != nil {
+		return false, false, err
+	}
+	if (!online && !lastSeen) || s.requests == nil {
+		return online, lastSeen, nil
+	}
+
+	approved, err := s.requests.Approved(ctx, userID, viewerID)
+	if err != nil || !approved {
+		return false, false, err
+	}
+	return online, lastSeen, nil
+}
+
+// Blocked reports whether either user blocked the other. It is always false
+// for anonymous viewers and without UseBlocks.
+func (s *Service) Blocked(ctx context.Context, viewerID, userID string) (bool, error) {
+	if s.blocks == nil || viewerID == "" {
+		return false, nil
+	}
+	return s.blocks.Blocked(ctx, viewerID, userID)
+}
+
 // GetUser retrieves a user by ID
 func (s *Service) GetUser(ctx context.Context, userID string) (*User, error) {
 	log.Printf("[GetUser] Starting - Looking for user ID: %s", userID)
@@ -213,13 +268,34 @@ func (s *Service) UpdateAvatar(ctx context.Context, userID, avatarURL string) er
 	return err
 }
 
-// GetContacts retrieves user's contacts
+// contactPresenceVisible is the condition under which a contact's presence
+// shows in the contact list of c.user_id: neither side blocked the other,
+// and the contact either has them as a contact too (r) or doesn't require
+// approval (st). The contact's show_online and show_last_seen apply on top.
+const contactPresenceVisible = `(NOT c.blocked AND NOT COALESCE(r.blocked, false)
+		  AND (r.id IS NOT NULL OR NOT COALESCE(st.require_approval, false)))`
+
+// presenceVisibleTo is the condition under which the viewer bound to the
+// given placeholder sees the presence of the user aliased u, whose settings
+// are aliased st. Anonymous viewers are bound as NULL.
+func presenceVisibleTo(viewerArg int) string {
+	return fmt.Sprintf(`(NOT COALESCE(st.require_approval, false)
+		  OR EXISTS (SELECT 1 FROM user_contacts a WHERE a.user_id = u.id AND a.contact_id = $%d::uuid AND NOT a.blocked))`, viewerArg)
+}
+
+// GetContacts retrieves user's contacts. The presence of contacts on either
+// side of a block, or who haven't approved the user, is hidden, and so is
+// whatever contacts chose not to show.
 func (s *Service) GetContacts(ctx context.Context, userID string, includeBlocked bool) ([]*Contact, error) {
 	query := `
 		SELECT c.id, c.contact_id, c.nickname, c.blocked, c.created_at,
-		       u.username, u.display_name, u.avatar_url, u.status, u.is_online, u.last_seen
+		       u.username, u.display_name, u.avatar_url, u.status,
+		       u.is_online AND COALESCE(st.show_online, true) AND ` + contactPresenceVisible + `,
+		       CASE WHEN COALESCE(st.show_last_seen, true) AND ` + contactPresenceVisible + ` THEN u.last_seen END
 		FROM user_contacts c
 		JOIN users u ON u.id = c.contact_id
+		LEFT JOIN user_contacts r ON r.user_id = c.contact_id AND r.contact_id = c.user_id
+		LEFT JOIN user_settings st ON st.user_id = c.contact_id
 		WHERE c.user_id = $1
 		  AND u.deleted_at IS NULL`
 
@@ -238,20 +314,50 @@ func (s *Service) GetContacts(ctx context.Context, userID string, includeBlocked
 	contacts := make([]*Contact, 0)
 	for rows.Next() {
 		var c Contact
+		var lastSeen pq.NullTime
 		err := rows.Scan(
 			&c.ID, &c.ContactID, &c.Nickname, &c.Blocked, &c.CreatedAt,
 			&c.Username, &c.DisplayName, &c.AvatarURL, &c.Status,
-			&c.IsOnline, &c.LastSeen,
+			&c.IsOnline, &lastSeen,
 		)
 		if err != nil {
 			continue
 		}
+		if lastSeen.Valid {
+			c.LastSeen = &lastSeen.Time
+		}
 		contacts = append(contacts, &c)
 	}
 
 	return contacts, nil
 }
 
+// ContactIDs returns the IDs of a user's contacts they haven't blocked,
+// whose presence they may follow through the relay
+func (s *Service) ContactIDs(ctx context.Context, userID string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT c.contact_id FROM user_contacts c
+		JOIN users u ON u.id = c.contact_id
+		WHERE c.user_id = $1 AND NOT c.blocked AND u.deleted_at IS NULL`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contactIDs := make([]string, 0)
+	for rows.Next() {
+		var contactID string
+		if err := rows.Scan(&contactID); err != nil {
+			return nil, err
+		}
+		contactIDs = append(contactIDs, contactID)
+	}
+
+	return contactIDs, rows.Err()
+}
+
 // AddContact adds a new contact
 func (s *Service) AddContact(ctx context.Context, userID string, req *AddContactRequest) (*Contact, error) {
 	// Validate not adding self
@@ -302,19 +408,24 @@ func (s *Service) AddContact(ctx context.Context, userID string, req *AddContact
 // GetContact retrieves a specific contact
 func (s *Service) GetContact(ctx context.Context, userID, contactID string) (*Contact, error) {
 	var c Contact
+	var lastSeen pq.NullTime
 
 	query := `
 		SELECT c.id, c.contact_id, c.nickname, c.blocked, c.created_at,
-		       u.username, u.display_name, u.avatar_url, u.status, u.is_online, u.last_seen
+		       u.username, u.display_name, u.avatar_url, u.status,
+		       u.is_online AND COALESCE(st.show_online, true) AND ` + contactPresenceVisible + `,
+		       CASE WHEN COALESCE(st.show_last_seen, true) AND ` + contactPresenceVisible + ` THEN u.last_seen END
 		FROM user_contacts c
 		JOIN users u ON u.id = c.contact_id
+		LEFT JOIN user_contacts r ON r.user_id = c.contact_id AND r.contact_id = c.user_id
+		LEFT JOIN user_settings st ON st.user_id = c.contact_id
 		WHERE c.user_id = $1 AND c.contact_id = $2
 		  AND u.deleted_at IS NULL`
 
 	err := s.db.QueryRowContext(ctx, query, userID, contactID).Scan(
 		&c.ID, &c.ContactID, &c.Nickname, &c.Blocked, &c.CreatedAt,
 		&c.Username, &c.DisplayName, &c.AvatarURL, &c.Status,
-		&c.IsOnline, &c.LastSeen,
+		&c.IsOnline, &lastSeen,
 	)
 
 	if err != nil {
@@ -323,6 +434,9 @@ func (s *Service) GetContact(ctx context.Context, userID, contactID string) (*Co
 		}
 		return nil, err
 	}
+	if lastSeen.Valid {
+		c.LastSeen = &lastSeen.Time
+	}
 
 	return &c, nil
 }
@@ -364,6 +478,10 @@ func (s *Service) UpdateContact(ctx context.Context, userID, contactID string, u
 		return ErrContactNotFound
 	}
 
+	if update.Blocked != nil {
+		s.invalidateBlocks(ctx, userID, contactID)
+	}
+
 	return nil
 }
 
@@ -382,6 +500,9 @@ func (s *Service) RemoveContact(ctx context.Context, userID, contactID string) e
 		return ErrContactNotFound
 	}
 
+	// Removing a blocked contact lifts the block
+	s.invalidateBlocks(ctx, userID, contactID)
+
 	return nil
 }
 
@@ -400,28 +521,46 @@ func (s *Service) BlockContact(ctx context.Context, userID, contactID string, bl
 		return ErrContactNotFound
 	}
 
+	s.invalidateBlocks(ctx, userID, contactID)
+
 	return nil
 }
 
-// GetModels retrieves models for discovery
+// invalidateBlocks drops the cached blocks of both users, so a block or
+// unblock applies to their next message
+func (s *Service) invalidateBlocks(ctx context.Context, userID, contactID string) {
+	if s.blocks == nil {
+		return
+	}
+	if err := s.blocks.Invalidate(ctx, userID, contactID); err != nil {
+		log.Printf("[Users] Failed to invalidate blocks of %s and %s: %v", userID, contactID, err)
+	}
+}
+
+// GetModels retrieves models for discovery. Models who turned off
+// allow_discovery are left out.
 func (s *Service) GetModels(ctx context.Context, filters *ModelFilters) ([]*ModelProfile, int, error) {
 	// Build query
 	query := `
 		SELECT u.id, u.username, u.display_name, u.avatar_url, u.status, 
-		       u.is_online, u.last_seen, u.created_at,
+		       u.is_online AND %[1]s, CASE WHEN %[2]s THEN u.last_seen END, u.created_at,
 		       g.id as gallery_id, g.media_count, g.updated_at as gallery_updated
 		FROM users u
 		LEFT JOIN model_galleries g ON g.model_id = u.id
+		LEFT JOIN user_settings st ON st.user_id = u.id
 		WHERE u.role = 'model' 
 		  AND u.status = 'active' 
-		  AND u.deleted_at IS NULL`
+		  AND u.deleted_at IS NULL
+		  AND COALESCE(st.allow_discovery, true)`
 
 	countQuery := `
 		SELECT COUNT(DISTINCT u.id) 
 		FROM users u
+		LEFT JOIN user_settings st ON st.user_id = u.id
 		WHERE u.role = 'model' 
 		  AND u.status = 'active' 
-		  AND u.deleted_at IS NULL`
+		  AND u.deleted_at IS NULL
+		  AND COALESCE(st.allow_discovery, true)`
 
 	args := []interface{}{}
 	argCount := 1
@@ -436,14 +575,40 @@ func (s *Service) GetModels(ctx context.Context, filters *ModelFilters) ([]*Mode
 		argCount++
 	}
 
+	// Models who blocked the viewer, or were blocked by them, don't show up
+	if filters.ViewerID != "" && s.blocks != nil {
+		hidden, err := s.blocks.Hidden(ctx, filters.ViewerID)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(hidden) > 0 {
+			blockCondition := fmt.Sprintf(" AND u.id <> ALL($%d::uuid[])", argCount)
+			query += blockCondition
+			countQuery += blockCondition
+			args = append(args, pq.Array(hidden))
+			argCount++
+		}
+	}
+
+	// Models who require approval only show their presence to their contacts,
+	// and only what they chose to show
+	visible := presenceVisibleTo(argCount)
+	onlineVisible := "COALESCE(st.show_online, true) AND " + visible
+	lastSeenVisible := "COALESCE(st.show_last_seen, true) AND " + visible
+	args = append(args, sql.NullString{String: filters.ViewerID, Valid: filters.ViewerID != ""})
+	argCount++
+	countArgs := args[:len(args)-1]
+
 	if filters.OnlineOnly {
-		query += " AND u.is_online = true"
-		countQuery += " AND u.is_online = true"
+		query += " AND u.is_online = true AND " + onlineVisible
+		countQuery += " AND u.is_online = true AND " + onlineVisible
+		countArgs = args
 	}
+	query = fmt.Sprintf(query, onlineVisible, lastSeenVisible)
 
 	// Get total count
 	var totalCount int
-	err := s.db.QueryRowContext(ctx, countQuery, args...).Scan(&totalCount)
+	err := s.db.QueryRowContext(ctx, countQuery, countArgs...).Scan(&totalCount)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -453,7 +618,8 @@ func (s *Service) GetModels(ctx context.Context, filters *ModelFilters) ([]*Mode
 	case "newest":
 		query += " ORDER BY u.created_at DESC"
 	case "active":
-		query += " ORDER BY u.last_seen DESC"
+		// Hidden last seen times sort last, so the order doesn't give them away
+		query += " ORDER BY CASE WHEN " + lastSeenVisible + " THEN u.last_seen END DESC NULLS LAST"
 	case "popular":
 		query += " ORDER BY g.media_count DESC NULLS LAST"
 	default:
@@ -478,15 +644,19 @@ func (s *Service) GetModels(ctx context.Context, filters *ModelFilters) ([]*Mode
 		var galleryID sql.NullString
 		var mediaCount sql.NullInt64
 		var galleryUpdated pq.NullTime
+		var lastSeen pq.NullTime
 
 		err := rows.Scan(
 			&m.ID, &m.Username, &m.DisplayName, &m.AvatarURL,
-			&m.Status, &m.IsOnline, &m.LastSeen, &m.CreatedAt,
+			&m.Status, &m.IsOnline, &lastSeen, &m.CreatedAt,
 			&galleryID, &mediaCount, &galleryUpdated,
 		)
 		if err != nil {
 			continue
 		}
+		if lastSeen.Valid {
+			m.LastSeen = &lastSeen.Time
+		}
 
 		// Set gallery info if exists
 		if galleryID.Valid {
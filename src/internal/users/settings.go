@@ -0,0 +1,171 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrInvalidLanguage = errors.New("invalid language")
+	ErrInvalidTheme    = errors.New("invalid theme")
+	ErrNoSettings      = errors.New("no settings to update")
+)
+
+// languagePattern accepts BCP 47 tags made of a language, an optional
+// script and an optional region: en, es-419, zh-Hant-TW
+var languagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z][a-z]{3})?(-([A-Z]{2}|[0-9]{3}))?$`)
+
+// DefaultSettings are the settings of users who never changed them
+func DefaultSettings() *UserSettings {
+	return &UserSettings{
+		NotificationsEnabled: true,
+		Language:             "en",
+		Theme:                ThemeLight,
+		Privacy: PrivacySettings{
+			ShowOnline:      true,
+			ShowLastSeen:    true,
+			AllowDiscovery:  true,
+			RequireApproval: false,
+		},
+	}
+}
+
+// Settings stores user preferences in user_settings. notifications_enabled
+// is the account-wide mute of push_settings, so both APIs see the same value.
+type Settings struct {
+	db    *sql.DB
+	redis *redis.Client
+}
+
+func NewSettings(db *sql.DB, redisClient *redis.Client) *Settings {
+	return &Settings{
+		db:    db,
+		redis: redisClient,
+	}
+}
+
+// Get returns a user's settings, or the defaults if they never changed them
+func (s *Settings) Get(ctx context.Context, userID string) (*UserSettings, error) {
+	settings := DefaultSettings()
+
+	err := s.db.QueryRowContext(ctx,
+		`SELECT NOT EXISTS(SELECT 1 FROM push_settings p WHERE p.user_id = $1
+		                   AND p.muted AND (p.muted_until IS NULL OR p.muted_until > NOW())),
+		        COALESCE(st.language, 'en'), COALESCE(st.theme, 'light'),
+		        COALESCE(st.show_online, true), COALESCE(st.show_last_seen, true),
+		        COALESCE(st.allow_discovery, true), COALESCE(st.require_approval, false)
+		FROM (SELECT $1::uuid AS user_id) v
+		LEFT JOIN user_settings st ON st.user_id = v.user_id`,
+		userID,
+	).Scan(
+		&settings.NotificationsEnabled, &settings.Language, &settings.Theme,
+		&settings.Privacy.ShowOnline, &settings.Privacy.ShowLastSeen,
+		&settings.Privacy.AllowDiscovery, &settings.Privacy.RequireApproval,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+// Update validates and saves the fields set in update, leaving the rest
+// as they are, and returns the resulting settings
+func (s *Settings) Update(ctx context.Context, userID string, update *UpdateSettingsRequest) (*UserSettings, error) {
+	columns := []string{}
+	args := []interface{}{userID}
+
+	set := func(column string, value interface{}) {
+		args = append(args, value)
+		columns = append(columns, column)
+	}
+
+	if update.Language != nil {
+		if !languagePattern.MatchString(*update.Language) {
+			return nil, ErrInvalidLanguage
+		}
+		set("language", *update.Language)
+	}
+	if update.Theme != nil {
+		switch *update.Theme {
+		case ThemeLight, ThemeDark, ThemeSystem:
+		default:
+			return nil, ErrInvalidTheme
+		}
+		set("theme", *update.Theme)
+	}
+	if p := update.Privacy; p != nil {
+		if p.ShowOnline != nil {
+			set("show_online", *p.ShowOnline)
+		}
+		if p.ShowLastSeen != nil {
+			set("show_last_seen", *p.ShowLastSeen)
+		}
+		if p.AllowDiscovery != nil {
+			set("allow_discovery", *p.AllowDiscovery)
+		}
+		if p.RequireApproval != nil {
+			set("require_approval", *p.RequireApproval)
+		}
+	}
+
+	if len(columns) == 0 && update.NotificationsEnabled == nil {
+		return nil, ErrNoSettings
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if len(columns) > 0 {
+		placeholders := make([]string, len(columns))
+		updates := make([]string, len(columns))
+		for i, column := range columns {
+			placeholders[i] = fmt.Sprintf("$%d", i+2)
+			updates[i] = fmt.Sprintf("%s = EXCLUDED.%s", column, column)
+		}
+
+		query := fmt.Sprintf(
+			`INSERT INTO user_settings (user_id, %s) VALUES ($1, %s)
+			ON CONFLICT (user_id) DO UPDATE SET %s`,
+			strings.Join(columns, ", "), strings.Join(placeholders, ", "), strings.Join(updates, ", "),
+		)
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return nil, err
+		}
+	}
+
+	if update.NotificationsEnabled != nil {
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO push_settings (user_id, muted, muted_until, updated_at)
+			VALUES ($1, $2, NULL, NOW())
+			ON CONFLICT (user_id) DO UPDATE
+			SET muted = EXCLUDED.muted, muted_until = NULL, updated_at = NOW()`,
+			userID, !*update.NotificationsEnabled,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// The relay reads require_approval from its cache
+	if update.Privacy != nil && update.Privacy.RequireApproval != nil {
+		if err := s.redis.Del(ctx, approvalKey(userID)).Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.Get(ctx, userID)
+}